@@ -0,0 +1,516 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/javgh/sia-nbdserver/nbd"
+	"github.com/javgh/sia-nbdserver/sia"
+)
+
+type (
+	// flushResponse lists the pages that are going to be uploaded.
+	// Their data from before RequestedAt is on Sia once they are no
+	// longer dirty or have become dirty again afterwards.
+	flushResponse struct {
+		RequestedAt time.Time `json:"requested_at"`
+		Pages       []int     `json:"pages"`
+	}
+
+	// stateDumpResponse tells where the server has written a state dump.
+	stateDumpResponse struct {
+		Path string `json:"path"`
+	}
+
+	// adminEndpoint is where the admin API of the running server is
+	// found and the file with the token it requires, if any.
+	adminEndpoint struct {
+		address   string
+		tokenFile string
+	}
+)
+
+const (
+	flushPollInterval = 5 * time.Second
+	defaultWorstPages = 10
+)
+
+// newAdminAPI returns the endpoints for inspecting and controlling the
+// running server. They are served apart from the metrics, as they are not
+// meant for monitoring.
+func newAdminAPI(siaBackend *sia.Backend, connections *nbd.Connections) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pages", func(w http.ResponseWriter, r *http.Request) {
+		pages, err := siaBackend.Pages(r.URL.Query().Get("state"), r.URL.Query().Get("checksums") != "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pages)
+	})
+
+	mux.HandleFunc("/flush-page", adminPost(func(r *http.Request) (interface{}, error) {
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid page: %s", err)
+		}
+
+		response := flushResponse{RequestedAt: time.Now(), Pages: []int{}}
+		dirty, err := siaBackend.FlushPage(page)
+		if dirty {
+			response.Pages = append(response.Pages, page)
+		}
+		return response, err
+	}))
+
+	mux.HandleFunc("/flush-all", adminPost(func(r *http.Request) (interface{}, error) {
+		response := flushResponse{RequestedAt: time.Now()}
+		var err error
+		response.Pages, err = siaBackend.FlushAll()
+		return response, err
+	}))
+
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(connections.List())
+	})
+
+	mux.HandleFunc("/trash", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(siaBackend.Trash())
+	})
+
+	mux.HandleFunc("/undelete", adminPost(func(r *http.Request) (interface{}, error) {
+		return struct{}{}, siaBackend.Undelete(r.URL.Query().Get("path"))
+	}))
+
+	mux.HandleFunc("/purge", adminPost(func(r *http.Request) (interface{}, error) {
+		return siaBackend.PurgeTrash()
+	}))
+
+	mux.HandleFunc("/evict-page", adminPost(func(r *http.Request) (interface{}, error) {
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid page: %s", err)
+		}
+		return struct{}{}, siaBackend.EvictPage(page)
+	}))
+
+	// /changes lists the change markers or, given a marker, the ranges
+	// written to since then.
+	mux.HandleFunc("/changes", func(w http.ResponseWriter, r *http.Request) {
+		marker := r.URL.Query().Get("marker")
+		if marker == "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(siaBackend.ChangeMarkers())
+			return
+		}
+
+		report, err := siaBackend.Changes(marker)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+
+	mux.HandleFunc("/mark-changes", adminPost(func(r *http.Request) (interface{}, error) {
+		return siaBackend.MarkChanges(r.URL.Query().Get("marker"))
+	}))
+
+	mux.HandleFunc("/forget-changes", adminPost(func(r *http.Request) (interface{}, error) {
+		return struct{}{}, siaBackend.ForgetChanges(r.URL.Query().Get("marker"))
+	}))
+
+	mux.HandleFunc("/checkpoints", func(w http.ResponseWriter, r *http.Request) {
+		checkpoints, err := siaBackend.Checkpoints()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(checkpoints)
+	})
+
+	mux.HandleFunc("/checkpoint", adminPost(func(r *http.Request) (interface{}, error) {
+		return siaBackend.Checkpoint(r.URL.Query().Get("name"))
+	}))
+
+	mux.HandleFunc("/delete-checkpoint", adminPost(func(r *http.Request) (interface{}, error) {
+		return struct{}{}, siaBackend.DeleteCheckpoint(r.URL.Query().Get("name"))
+	}))
+
+	// /epoch-recorded is where the server that writes to a followed
+	// device announces new epoch markers (see --publish-epochs). It
+	// needs no token, as it merely makes the follower look for one.
+	mux.HandleFunc("/epoch-recorded", adminPost(func(r *http.Request) (interface{}, error) {
+		return struct{}{}, siaBackend.EpochPublished()
+	}))
+
+	// /dump-state does the same as SIGQUIT and tells where the dump is.
+	mux.HandleFunc("/dump-state", adminPost(func(r *http.Request) (interface{}, error) {
+		path, err := writeStateDump(siaBackend, connections)
+		return stateDumpResponse{Path: path}, err
+	}))
+	return mux
+}
+
+// writeStateDump writes the internal state of the server, including its
+// connections, to a file in the data directory for debugging hangs.
+func writeStateDump(siaBackend *sia.Backend, connections *nbd.Connections) (string, error) {
+	return siaBackend.WriteStateDump(func(w io.Writer) {
+		fmt.Fprintf(w, "connections:\n")
+		for _, c := range connections.List() {
+			disconnected := "-"
+			if !c.DisconnectedAt.IsZero() {
+				disconnected = c.DisconnectedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "  %d: client %q, identity %q, connected %s, disconnected %s, "+
+				"%d reads, %d writes, %d flushes, %d errors, throttled %s\n", c.ID, c.RemoteAddr,
+				c.Identity, c.ConnectedAt.Format(time.RFC3339), disconnected, c.Reads, c.Writes,
+				c.Flushes, c.Errors, c.Throttled)
+		}
+	})
+}
+
+// requireAdminToken lets only requests through that carry the token as a
+// bearer token, except for announcements of epoch markers. An empty token
+// lets every request through.
+func requireAdminToken(token string, handler http.Handler) http.Handler {
+	if token == "" {
+		return handler
+	}
+
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(r.Header.Get("Authorization"))
+		if r.URL.Path != "/epoch-recorded" && subtle.ConstantTimeCompare(given, expected) != 1 {
+			http.Error(w, "missing or wrong admin token", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// adminPost wraps an operation that changes the state of the server, so
+// that it can only be triggered by a POST request. The request needs to be
+// JSON and must not come from a page of another site, which browsers could
+// otherwise be made to send with a plain form.
+func adminPost(operation func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			http.Error(w, "only application/json is supported", http.StatusUnsupportedMediaType)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+			return
+		}
+
+		response, err := operation(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// sameOrigin reports whether a request was sent by a page of the admin API
+// itself or by something other than a browser, which sends no Origin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// readAdminToken reads the token that requests to the admin API need to
+// carry. Without a file, no token is required.
+func readAdminToken(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(encoded))
+	if token == "" {
+		return "", fmt.Errorf("%s does not contain a token", path)
+	}
+	return token, nil
+}
+
+func adminGet(endpoint adminEndpoint, path string, query url.Values, v interface{}) error {
+	return adminRequest(http.MethodGet, endpoint, path, query, v)
+}
+
+func adminRequest(method string, endpoint adminEndpoint, path string, query url.Values,
+	v interface{}) error {
+	if endpoint.address == "" {
+		return errors.New("this talks to the running server; please specify its --admin-address")
+	}
+	token, err := readAdminToken(endpoint.tokenFile)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method,
+		fmt.Sprintf("http://%s%s?%s", endpoint.address, path, query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var message [512]byte
+		n, _ := resp.Body.Read(message[:])
+		return fmt.Errorf("server replied with %s: %s", resp.Status, message[:n])
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func printPages(endpoint adminEndpoint, state string, checksums bool) error {
+	query := url.Values{}
+	if state != "" {
+		query.Set("state", state)
+	}
+	if checksums {
+		query.Set("checksums", "1")
+	}
+
+	var pages []sia.PageInfo
+	err := adminGet(endpoint, "/pages", query, &pages)
+	if err != nil {
+		return err
+	}
+
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Local().Format("2006-01-02 15:04:05")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PAGE\tSTATE\tGENERATION\tLAST ACCESS\tLAST WRITE\tDIRTY SINCE\tFAILURES\tVERIFIED\tCHECKSUM")
+	for _, page := range pages {
+		generation := "-"
+		if page.OnSia {
+			generation = fmt.Sprintf("%d", page.Generation)
+		}
+		checksum := page.Checksum
+		if checksum == "" {
+			checksum = "-"
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", page.Page, page.State, generation,
+			formatTime(page.LastAccess), formatTime(page.LastWrite), formatTime(page.DirtySince),
+			page.UploadFailures, formatTime(page.VerifiedAt), checksum)
+	}
+	return w.Flush()
+}
+
+func flushPages(endpoint adminEndpoint, path string, query url.Values, wait bool) error {
+	var response flushResponse
+	err := adminRequest(http.MethodPost, endpoint, path, query, &response)
+	if err != nil {
+		return err
+	}
+
+	if len(response.Pages) == 0 {
+		fmt.Println("Nothing to upload")
+		return nil
+	}
+	if !wait {
+		fmt.Printf("Requested upload of %d page(s)\n", len(response.Pages))
+		return nil
+	}
+
+	requested := make(map[int]bool)
+	for _, page := range response.Pages {
+		requested[page] = true
+	}
+
+	lastRemaining := -1
+	for {
+		var dirtyPages []sia.PageInfo
+		err := adminGet(endpoint, "/pages", url.Values{"state": {"dirty"}}, &dirtyPages)
+		if err != nil {
+			return err
+		}
+
+		remaining := 0
+		failures := 0
+		for _, page := range dirtyPages {
+			if requested[page.Page] && !page.DirtySince.After(response.RequestedAt) {
+				remaining += 1
+				failures += page.UploadFailures
+			}
+		}
+
+		if remaining == 0 {
+			fmt.Printf("Uploaded %d page(s)\n", len(response.Pages))
+			return nil
+		}
+		if remaining != lastRemaining {
+			log.Printf("Waiting for %d of %d page(s) to be uploaded (%d failed attempts so far)\n",
+				remaining, len(response.Pages), failures)
+			lastRemaining = remaining
+		}
+		time.Sleep(flushPollInterval)
+	}
+}
+
+func evictPage(endpoint adminEndpoint, page int) error {
+	var response struct{}
+	return adminRequest(http.MethodPost, endpoint, "/evict-page",
+		url.Values{"page": {strconv.Itoa(page)}}, &response)
+}
+
+func printTrash(endpoint adminEndpoint) error {
+	var entries []sia.TrashEntry
+	err := adminGet(endpoint, "/trash", nil, &entries)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SIAPATH\tPAGE\tGENERATION\tDELETED\tREASON")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", entry.SiaPath, entry.Page, entry.Generation,
+			entry.DeletedAt.Local().Format("2006-01-02 15:04:05"), entry.Reason)
+	}
+	return w.Flush()
+}
+
+func printChanges(endpoint adminEndpoint, marker string) error {
+	if marker == "" {
+		var markers []sia.ChangeMarker
+		err := adminGet(endpoint, "/changes", nil, &markers)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "MARKER\tSINCE\tCHANGED\tRESET")
+		for _, marker := range markers {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\n", marker.Name, marker.Since.Local().Format("2006-01-02 15:04:05"),
+				formatBytes(uint64(marker.ChangedBlocks)*marker.BlockSize), marker.Reset)
+		}
+		return w.Flush()
+	}
+
+	var report sia.ChangeReport
+	err := adminGet(endpoint, "/changes", url.Values{"marker": {marker}}, &report)
+	if err != nil {
+		return err
+	}
+	if report.Reset {
+		fmt.Fprintf(os.Stderr, "Marker %s was reset by a crash; everything counts as changed\n", marker)
+	}
+	for _, extent := range report.Extents {
+		if extent.Zero {
+			fmt.Printf("%d %d zero\n", extent.Offset, extent.Length)
+			continue
+		}
+		fmt.Printf("%d %d\n", extent.Offset, extent.Length)
+	}
+	return nil
+}
+
+func printCheckpoints(endpoint adminEndpoint) error {
+	var checkpoints []sia.Checkpoint
+	err := adminGet(endpoint, "/checkpoints", nil, &checkpoints)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECKPOINT	CREATED	CACHED	ON SIA")
+	for _, checkpoint := range checkpoints {
+		fmt.Fprintf(w, "%s	%s	%d	%d\n", checkpoint.Name,
+			checkpoint.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+			len(checkpoint.Cached), len(checkpoint.Generations))
+	}
+	return w.Flush()
+}
+
+func printConnections(endpoint adminEndpoint) error {
+	var connections []nbd.ConnectionStats
+	err := adminGet(endpoint, "/connections", nil, &connections)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCLIENT\tIDENTITY\tCONNECTED\tDISCONNECTED\tREADS\tREAD\tWRITES\tWRITTEN\tFLUSHES\tERRORS")
+	for _, c := range connections {
+		disconnected := "-"
+		if !c.DisconnectedAt.IsZero() {
+			disconnected = c.DisconnectedAt.Local().Format("2006-01-02 15:04:05")
+		}
+		client, identity := c.RemoteAddr, c.Identity
+		if client == "" {
+			client = "unix socket"
+		}
+		if identity == "" {
+			identity = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%d\t%s\t%d\t%d\n", c.ID, client, identity,
+			c.ConnectedAt.Local().Format("2006-01-02 15:04:05"), disconnected, c.Reads,
+			formatBytes(c.BytesRead), c.Writes, formatBytes(c.BytesWritten), c.Flushes, c.Errors)
+	}
+	return w.Flush()
+}
+
+func dumpState(endpoint adminEndpoint) error {
+	var response stateDumpResponse
+	err := adminRequest(http.MethodPost, endpoint, "/dump-state", nil, &response)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Dumped state to %s\n", response.Path)
+	return nil
+}
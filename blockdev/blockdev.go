@@ -0,0 +1,53 @@
+// Package blockdev defines the block device that frontends such as the NBD
+// server serve, so that each frontend is written once for every backend.
+package blockdev
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+)
+
+type (
+	// Device is a block device of a fixed size. Errors may wrap a
+	// syscall.Errno (e.g. ENOSPC or ESHUTDOWN) to tell frontends how to
+	// report them to clients; other errors count as EIO.
+	Device interface {
+		// ReadAt and WriteAt work like io.ReaderAt and io.WriterAt.
+		ReadAt(ctx context.Context, buf []byte, offset int64) (int, error)
+		WriteAt(ctx context.Context, buf []byte, offset int64) (int, error)
+
+		// Flush makes sure that all writes so far survive a crash.
+		Flush(ctx context.Context) error
+
+		// Trim hints that a range is no longer needed. It may read as
+		// anything afterwards, but typically reads as zeroes.
+		Trim(ctx context.Context, offset int64, length int64) error
+
+		// WriteZeroes makes a range read as zeroes. mayDiscard is unset
+		// if the range is to stay allocated.
+		WriteZeroes(ctx context.Context, offset int64, length int64, mayDiscard bool) error
+
+		// Size is the size of the device in bytes.
+		Size() int64
+
+		// Close flushes the device and releases it.
+		Close() error
+	}
+)
+
+var (
+	// ErrBeyondEnd is returned for writes, trims and zero writes that
+	// reach past the end of a device.
+	ErrBeyondEnd = fmt.Errorf("write beyond the end of the device: %w", syscall.ENOSPC)
+
+	// ErrReadBeyondEnd is returned for reads that reach past the end of
+	// a device.
+	ErrReadBeyondEnd = fmt.Errorf("read beyond the end of the device: %w", syscall.EINVAL)
+)
+
+// InRange reports whether length bytes at offset lie within a device of the
+// given size, guarding against negative values and overflow.
+func InRange(size int64, offset int64, length int64) bool {
+	return offset >= 0 && length >= 0 && offset <= size && length <= size-offset
+}
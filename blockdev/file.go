@@ -0,0 +1,155 @@
+package blockdev
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+type (
+	// File is a device backed by a local file, e.g. for trying out a
+	// frontend without Sia, or for tests. Trimmed ranges are punched out
+	// of the file, so that they take up no space.
+	File struct {
+		file *os.File
+		size int64
+
+		mutex  sync.Mutex
+		closed bool
+	}
+)
+
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+var errClosed = fmt.Errorf("device is closed: %w", syscall.ESHUTDOWN)
+
+// OpenFile opens the file at path as a device of the given size, creating
+// the file if necessary.
+func OpenFile(path string, size int64) (*File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = file.Truncate(size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &File{file: file, size: size}, nil
+}
+
+// check returns an error if the device is closed or the range does not lie
+// within it, which is rangeErr then.
+func (f *File) check(offset int64, length int64, rangeErr error) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return errClosed
+	}
+	if !InRange(f.size, offset, length) {
+		return rangeErr
+	}
+	return nil
+}
+
+func (f *File) ReadAt(ctx context.Context, buf []byte, offset int64) (int, error) {
+	err := f.check(offset, int64(len(buf)), ErrReadBeyondEnd)
+	if err != nil {
+		return 0, err
+	}
+	return f.file.ReadAt(buf, offset)
+}
+
+func (f *File) WriteAt(ctx context.Context, buf []byte, offset int64) (int, error) {
+	err := f.check(offset, int64(len(buf)), ErrBeyondEnd)
+	if err != nil {
+		return 0, err
+	}
+	return f.file.WriteAt(buf, offset)
+}
+
+func (f *File) Flush(ctx context.Context) error {
+	err := f.check(0, 0, nil)
+	if err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// Trim punches the range out of the file. Filesystems that cannot do so
+// leave it alone, as trimming is merely a hint.
+func (f *File) Trim(ctx context.Context, offset int64, length int64) error {
+	err := f.check(offset, length, ErrBeyondEnd)
+	if err != nil {
+		return err
+	}
+	err = syscall.Fallocate(int(f.file.Fd()), fallocPunchHole|fallocKeepSize, offset, length)
+	if err == syscall.EOPNOTSUPP {
+		return nil
+	}
+	return err
+}
+
+// WriteZeroes punches the range out of the file if mayDiscard is set and
+// the filesystem can do so, and writes zeroes otherwise.
+func (f *File) WriteZeroes(ctx context.Context, offset int64, length int64, mayDiscard bool) error {
+	err := f.check(offset, length, ErrBeyondEnd)
+	if err != nil {
+		return err
+	}
+	if mayDiscard {
+		err = syscall.Fallocate(int(f.file.Fd()), fallocPunchHole|fallocKeepSize, offset, length)
+		if err != syscall.EOPNOTSUPP {
+			return err
+		}
+	}
+
+	zeroes := make([]byte, 1024*1024)
+	for length > 0 {
+		chunk := int64(len(zeroes))
+		if chunk > length {
+			chunk = length
+		}
+		_, err = f.file.WriteAt(zeroes[:chunk], offset)
+		if err != nil {
+			return err
+		}
+		offset += chunk
+		length -= chunk
+	}
+	return nil
+}
+
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// Available reports whether the device has not been closed yet.
+func (f *File) Available() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return !f.closed
+}
+
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return errClosed
+	}
+	f.closed = true
+	err := f.file.Sync()
+	closeErr := f.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
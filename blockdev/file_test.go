@@ -0,0 +1,70 @@
+package blockdev
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInRange(t *testing.T) {
+	assert.True(t, InRange(100, 0, 100))
+	assert.True(t, InRange(100, 100, 0))
+	assert.False(t, InRange(100, 1, 100))
+	assert.False(t, InRange(100, -1, 1))
+	assert.False(t, InRange(100, 0, -1))
+	assert.False(t, InRange(100, 1<<62, 1<<62), "expected overflow to be caught")
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var device Device
+	file, err := OpenFile(filepath.Join(dir, "device"), 3*4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device = file
+	ctx := context.Background()
+	assert.Equal(t, int64(3*4096), device.Size())
+
+	ones := bytes.Repeat([]byte{1}, 3*4096)
+	n, err := device.WriteAt(ctx, ones, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(ones), n)
+
+	_, err = device.WriteAt(ctx, []byte{1}, 3*4096)
+	assert.True(t, errors.Is(err, syscall.ENOSPC))
+	_, err = device.ReadAt(ctx, make([]byte, 2), 3*4096-1)
+	assert.True(t, errors.Is(err, syscall.EINVAL))
+	assert.True(t, errors.Is(device.Trim(ctx, 4096, 3*4096), syscall.ENOSPC))
+
+	// a trimmed range reads as zeroes on filesystems that punch holes and
+	// is left alone elsewhere
+	assert.Nil(t, device.Trim(ctx, 0, 4096))
+	assert.Nil(t, device.WriteZeroes(ctx, 4096, 4096, true))
+	assert.Nil(t, device.WriteZeroes(ctx, 2*4096, 100, false))
+	assert.Nil(t, device.Flush(ctx))
+
+	buf := make([]byte, 3*4096)
+	_, err = device.ReadAt(ctx, buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 4096+100), buf[4096:2*4096+100])
+	assert.Equal(t, ones[:4096-100], buf[2*4096+100:])
+
+	assert.True(t, file.Available())
+	assert.Nil(t, device.Close())
+	assert.False(t, file.Available())
+	_, err = device.ReadAt(ctx, buf, 0)
+	assert.True(t, errors.Is(err, syscall.ESHUTDOWN))
+}
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -49,3 +53,97 @@ func ReadPasswordFile(path string) (string, error) {
 
 	return strings.TrimSpace(string(passwordBytes)), nil
 }
+
+// ReadKeyFile reads a 256-bit key stored as 64 hex digits, as generated by
+// `openssl rand -hex 32`.
+func ReadKeyFile(path string) ([]byte, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s needs to contain 64 hex digits", path)
+	}
+	return key, nil
+}
+
+type (
+	// Export configures an export in the "exports" section of the config
+	// file, which maps export names to their configuration.
+	Export struct {
+		// Clients lists who may use the export. The first entry that
+		// matches a client applies. If missing, every client may use
+		// the export.
+		Clients []ExportClient `json:"clients"`
+
+		// Frontends lists the frontends that serve the export, e.g.
+		// "nbd-unix" and "nbd-tcp". If empty, the export is served on
+		// the unix socket, or via TCP with --listen.
+		Frontends []string `json:"frontends"`
+	}
+
+	// ExportClient grants access to the clients in Network (an address
+	// or CIDR block) that authenticated with a TLS client certificate
+	// for Identity (its common name). At least one of the two needs to be
+	// given. Access is "rw" (the default) or "ro".
+	ExportClient struct {
+		Network  string `json:"network"`
+		Identity string `json:"identity"`
+		Access   string `json:"access"`
+	}
+)
+
+const exportsKey = "exports"
+
+// ReadConfigFile reads a JSON object that maps flag names (without leading
+// dashes) to values, e.g. {"soft": 64, "idle": 60}. The values are returned
+// in their textual form, ready to be passed to the flag parser. The
+// "exports" section is read by ReadExports instead.
+func ReadConfigFile(path string) (map[string]string, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var raw map[string]interface{}
+	err = decoder.Decode(&raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	values := make(map[string]string)
+	for name, value := range raw {
+		if name == exportsKey {
+			continue
+		}
+
+		switch value.(type) {
+		case string, bool, json.Number:
+			values[name] = fmt.Sprint(value)
+		default:
+			return nil, fmt.Errorf("%s: %s needs to be a string, number or boolean", path, name)
+		}
+	}
+	return values, nil
+}
+
+// ReadExports reads the "exports" section of a config file.
+func ReadExports(path string) (map[string]Export, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configFile struct {
+		Exports map[string]Export `json:"exports"`
+	}
+	err = json.Unmarshal(encoded, &configFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return configFile.Exports, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"github.com/javgh/sia-nbdserver/config"
+	"github.com/javgh/sia-nbdserver/nbd"
+	"github.com/javgh/sia-nbdserver/sia"
+)
+
+type (
+	// configFile sets the flags that were not given on the command line
+	// from a config file, once on startup and again on every reload.
+	configFile struct {
+		path     string
+		cmd      *cobra.Command
+		fromFile map[string]bool
+	}
+)
+
+// reloadableFlags are the flags that take effect when the config file is
+// reloaded; see sia.Backend.Reconfigure.
+var reloadableFlags = map[string]bool{
+	"hard":                  true,
+	"soft":                  true,
+	"write-reserve":         true,
+	"read-overflow":         true,
+	"idle":                  true,
+	"min-idle":              true,
+	"max-idle":              true,
+	"ordered-uploads":       true,
+	"max-dirty-age":         true,
+	"max-dirty-bytes":       true,
+	"min-redundancy":        true,
+	"warn-redundancy":       true,
+	"budget":                true,
+	"upload-failure-notify": true,
+	"pause-writes-after":    true,
+	"upload-stall-timeout":  true,
+	"growth-warning":        true,
+	"scrub-interval":        true,
+	"contract-warning":      true,
+	"write-combine":         true,
+	"ghost-cache":           true,
+	"max-uploads":           true,
+	"parallel-downloads":    true,
+	"watchdog":              true,
+	"watchdog-expand":       true,
+}
+
+func newConfigFile(path string, cmd *cobra.Command) *configFile {
+	return &configFile{
+		path:     path,
+		cmd:      cmd,
+		fromFile: make(map[string]bool),
+	}
+}
+
+// apply sets the flags from the config file and returns the names of those
+// whose value changed. Flags given on the command line take precedence.
+func (c *configFile) apply() ([]string, error) {
+	values, err := config.ReadConfigFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	changed := []string{}
+	for _, name := range names {
+		flag := c.cmd.Flags().Lookup(name)
+		if flag == nil {
+			return nil, fmt.Errorf("%s: unknown setting %s", c.path, name)
+		}
+		if c.cmd.Flags().Changed(name) && !c.fromFile[name] {
+			continue
+		}
+
+		previous := flag.Value.String()
+		err := c.cmd.Flags().Set(name, values[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", c.path, err)
+		}
+		c.fromFile[name] = true
+
+		if flag.Value.String() != previous {
+			changed = append(changed, name)
+		}
+	}
+	return changed, nil
+}
+
+// accessRules reads the clients that may use each export. Exports without
+// a list of clients are left out, so that every client may use them.
+func (c *configFile) accessRules() (map[string][]nbd.AccessRule, error) {
+	exports, err := config.ReadExports(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	access := make(map[string][]nbd.AccessRule)
+	for name, export := range exports {
+		if export.Clients == nil {
+			continue
+		}
+		rules := []nbd.AccessRule{}
+		for _, client := range export.Clients {
+			if client.Network == "" && client.Identity == "" {
+				return nil, fmt.Errorf("%s: export %s: client needs a network or an identity", c.path, name)
+			}
+
+			rule := nbd.AccessRule{Identity: client.Identity}
+			if client.Network != "" {
+				rule.Network, err = parseNetwork(client.Network)
+				if err != nil {
+					return nil, fmt.Errorf("%s: export %s: %s", c.path, name, err)
+				}
+			}
+			switch client.Access {
+			case "", "rw":
+			case "ro":
+				rule.ReadOnly = true
+			default:
+				return nil, fmt.Errorf("%s: export %s: access needs to be rw or ro", c.path, name)
+			}
+			rules = append(rules, rule)
+		}
+		access[name] = rules
+	}
+	return access, nil
+}
+
+// exportFrontends reads the frontends that each export is to be served with,
+// leaving out exports that do not list any.
+func (c *configFile) exportFrontends() (map[string][]string, error) {
+	exports, err := config.ReadExports(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	frontends := make(map[string][]string)
+	for name, export := range exports {
+		if len(export.Frontends) > 0 {
+			frontends[name] = export.Frontends
+		}
+	}
+	return frontends, nil
+}
+
+// parseNetwork accepts CIDR blocks as well as single addresses.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// reload re-reads the config file and applies the settings that can change
+// at runtime to the backend, without interrupting the NBD connection.
+func (c *configFile) reload(siaBackend *sia.Backend, backendSettings func() sia.BackendSettings) {
+	changed, err := c.apply()
+	if err != nil {
+		log.Printf("Unable to reload config file: %s\n", err)
+		return
+	}
+
+	for _, name := range changed {
+		if reloadableFlags[name] {
+			log.Printf("Reloaded setting %s\n", name)
+		} else {
+			log.Printf("Setting %s only takes effect after a restart\n", name)
+		}
+	}
+
+	err = siaBackend.Reconfigure(backendSettings())
+	if err != nil {
+		log.Printf("Unable to apply reloaded config file: %s\n", err)
+	}
+}
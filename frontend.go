@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/javgh/sia-nbdserver/httpexport"
+	"github.com/javgh/sia-nbdserver/nbd"
+)
+
+type (
+	// frontendSettings are the settings of the NBD server, which the
+	// other frontends share where they apply, plus their own.
+	frontendSettings struct {
+		nbd.ServerSettings
+
+		// httpListenAddress is where the http frontend listens.
+		httpListenAddress string
+	}
+
+	// frontend serves the device to clients until the backend becomes
+	// unavailable. It calls settings.Listening once it is ready to accept
+	// clients.
+	frontend func(settings frontendSettings, backend nbd.Backend) error
+)
+
+// frontends holds the frontends by name. Frontends register themselves
+// with registerFrontend and are enabled per export in the config file.
+var frontends = map[string]frontend{}
+
+func registerFrontend(name string, f frontend) {
+	if _, ok := frontends[name]; ok {
+		panic("frontend registered twice: " + name)
+	}
+	frontends[name] = f
+}
+
+func init() {
+	registerFrontend("nbd-unix", func(settings frontendSettings, backend nbd.Backend) error {
+		if settings.SocketPath == "" {
+			return fmt.Errorf("frontend nbd-unix needs a socket path (--unix)")
+		}
+		settings.ListenAddress = ""
+		return nbd.Serve(settings.ServerSettings, backend)
+	})
+	registerFrontend("nbd-tcp", func(settings frontendSettings, backend nbd.Backend) error {
+		if settings.ListenAddress == "" {
+			return fmt.Errorf("frontend nbd-tcp needs an address to listen at (--listen)")
+		}
+		return nbd.Serve(settings.ServerSettings, backend)
+	})
+	registerFrontend("http", func(settings frontendSettings, backend nbd.Backend) error {
+		if settings.httpListenAddress == "" {
+			return fmt.Errorf("frontend http needs an address to listen at (--http-listen)")
+		}
+		return httpexport.Serve(httpexport.Settings{
+			ListenAddress: settings.httpListenAddress,
+			Name:          nbd.ExportName,
+			TLSConfig:     settings.TLSConfig,
+			MayRead: func(addr net.Addr, identity string) bool {
+				return settings.MayRead(addr, identity, nbd.ExportName)
+			},
+			Listening: settings.Listening,
+		}, backend)
+	})
+}
+
+func frontendNames() []string {
+	names := []string{}
+	for name := range frontends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectFrontends returns the frontends to serve the export with: those
+// given in the config file or, by default, NBD via TCP with --listen and
+// on the unix socket otherwise, plus HTTP with --http-listen.
+func selectFrontends(configured []string, listenAddress string, httpListenAddress string) ([]string, error) {
+	if len(configured) == 0 {
+		selected := []string{"nbd-unix"}
+		if listenAddress != "" {
+			selected = []string{"nbd-tcp"}
+		}
+		if httpListenAddress != "" {
+			selected = append(selected, "http")
+		}
+		return selected, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range configured {
+		if _, ok := frontends[name]; !ok {
+			return nil, fmt.Errorf("unknown frontend %q (valid: %s)", name,
+				strings.Join(frontendNames(), ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("frontend %s is given twice", name)
+		}
+		seen[name] = true
+	}
+	return configured, nil
+}
+
+// serveFrontends serves the backend with the named frontends until it
+// becomes unavailable, returning the first error of any of them. As
+// privileges may be dropped in settings.Listening, it is only called once,
+// after all frontends are listening.
+func serveFrontends(names []string, settings frontendSettings, backend nbd.Backend) error {
+	listening := settings.Listening
+	var ready sync.WaitGroup
+	var once sync.Once
+	var listeningErr error
+	ready.Add(len(names))
+	settings.Listening = func() error {
+		ready.Done()
+		ready.Wait()
+		once.Do(func() {
+			if listening != nil {
+				listeningErr = listening()
+			}
+		})
+		return listeningErr
+	}
+
+	errs := make(chan error, len(names))
+	for _, name := range names {
+		go func(f frontend) {
+			errs <- f(settings, backend)
+		}(frontends[name])
+	}
+	for range names {
+		err := <-errs
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// Package httpexport serves a block device read-only over HTTP as a single
+// file that supports range requests, so that clients without NBD (such as
+// the curl driver of qemu or forensic tools) can read it.
+package httpexport
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/javgh/sia-nbdserver/blockdev"
+)
+
+type (
+	// Backend is the device to serve. Only reads are used.
+	Backend interface {
+		blockdev.Device
+		Available() bool
+	}
+
+	// Settings configure the server.
+	Settings struct {
+		ListenAddress string
+
+		// Name is the file name the device is served under, at /Name
+		// as well as at /.
+		Name string
+
+		// TLSConfig makes the server use HTTPS; may be nil. With client
+		// certificates, their common name is the client's identity.
+		TLSConfig *tls.Config
+
+		// MayRead decides whether the client at addr, authenticated as
+		// identity (empty if not authenticated), may read the device;
+		// nil lets every client read it.
+		MayRead func(addr net.Addr, identity string) bool
+
+		// Listening is called once the server is listening, before any
+		// client is accepted; may be nil. An error stops the server.
+		Listening func() error
+	}
+
+	// deviceReader reads the device on behalf of a request, so that reads
+	// are canceled when the client goes away.
+	deviceReader struct {
+		ctx     context.Context
+		backend Backend
+	}
+)
+
+// interruptInterval is how often the server checks whether the backend is
+// still available.
+const interruptInterval = 5 * time.Second
+
+func (d deviceReader) ReadAt(buf []byte, offset int64) (int, error) {
+	return d.backend.ReadAt(d.ctx, buf, offset)
+}
+
+// Handler serves the device for GET and HEAD requests, including range
+// requests.
+func Handler(settings Settings, backend Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/"+settings.Name {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "the device is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		if settings.MayRead != nil && !settings.MayRead(remoteAddr(r), peerIdentity(r)) {
+			log.Printf("Refusing HTTP client %s\n", r.RemoteAddr)
+			http.Error(w, "access denied", http.StatusForbidden)
+			return
+		}
+		if !backend.Available() {
+			http.Error(w, "the device is no longer available", http.StatusServiceUnavailable)
+			return
+		}
+
+		// the contents of a block device are not worth sniffing
+		w.Header().Set("Content-Type", "application/octet-stream")
+		device := io.NewSectionReader(deviceReader{ctx: r.Context(), backend: backend}, 0, backend.Size())
+		http.ServeContent(w, r, settings.Name, time.Time{}, device)
+	})
+}
+
+// remoteAddr returns the address of the client of a request.
+func remoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// peerIdentity returns the common name of the verified client certificate
+// of a request, if any.
+func peerIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// Serve serves the device until the backend becomes unavailable.
+func Serve(settings Settings, backend Backend) error {
+	ln, err := net.Listen("tcp", settings.ListenAddress)
+	if err != nil {
+		return err
+	}
+	if settings.TLSConfig != nil {
+		ln = tls.NewListener(ln, settings.TLSConfig)
+	}
+	if settings.Listening != nil {
+		err = settings.Listening()
+		if err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	scheme := "http"
+	if settings.TLSConfig != nil {
+		scheme = "https"
+	}
+	log.Printf("Serving the device read-only at %s://%s/%s\n", scheme, ln.Addr(), settings.Name)
+
+	server := &http.Server{Handler: Handler(settings, backend)}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(interruptInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !backend.Available() {
+					server.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	err = server.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package httpexport
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/javgh/sia-nbdserver/blockdev"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpexport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	device, err := blockdev.OpenFile(filepath.Join(dir, "device"), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	_, err = device.WriteAt(context.Background(), []byte("hello world"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := true
+	settings := Settings{
+		Name: "sia",
+		MayRead: func(addr net.Addr, identity string) bool {
+			return allowed
+		},
+	}
+	server := httptest.NewServer(Handler(settings, device))
+	defer server.Close()
+
+	get := func(path string, header string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set("Range", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	resp, body := get("/sia", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 4096, len(body))
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+
+	resp, body = get("/", "bytes=1000-1004")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, "bytes 1000-1004/4096", resp.Header.Get("Content-Range"))
+
+	resp, _ = get("/sia", "bytes=5000-")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+	resp, _ = get("/other", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+"/sia", "application/octet-stream", strings.NewReader("x"))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	allowed = false
+	resp, _ = get("/sia", "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
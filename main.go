@@ -1,63 +1,428 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/javgh/sia-nbdserver/config"
 	"github.com/javgh/sia-nbdserver/nbd"
+	"github.com/javgh/sia-nbdserver/notify"
 	"github.com/javgh/sia-nbdserver/sia"
+	"github.com/javgh/sia-nbdserver/tracing"
 )
 
 const (
-	defaultSize                  = 1099511627776
-	defaultHardMaxCached         = 128
-	defaultSoftMaxCached         = 96
-	defaultIdleIntervalSeconds   = 120
-	defaultSiaDaemonAddress      = "localhost:9980"
-	defaultSiaPasswordFileSuffix = ".sia/apipassword"
+	defaultSize                       = 1099511627776
+	defaultHardMaxCached              = 128
+	defaultSoftMaxCached              = 96
+	defaultReadOverflow               = 2
+	defaultIdleIntervalSeconds        = 120
+	defaultSiaDaemonAddress           = "localhost:9980"
+	defaultSiaPasswordFileSuffix      = ".sia/apipassword"
+	defaultSiaPathPrefix              = "nbd"
+	defaultUploadFailureNotify        = 3
+	defaultMinRedundancy              = 2.5
+	defaultWarnRedundancy             = 1.5
+	defaultTrashRetentionSeconds      = 24 * 60 * 60
+	defaultMaintenanceIntervalSeconds = 5
+	defaultBreakerThreshold           = 5
+	defaultBreakerProbeSeconds        = 30
+	defaultWatchdogSeconds            = 600
+	defaultFollowIntervalSeconds      = 60
+	defaultUploadStallSeconds         = 6 * 60 * 60
+	defaultGrowthWarningSeconds       = 60 * 60
+	defaultContractWarningSeconds     = 7 * 24 * 60 * 60
+	defaultParallelDownloads          = 4
+	defaultMaxUploads                 = 8
+	defaultEvacuateParallel           = 16
 )
 
-func installSignalHandlers(siaBackend *sia.Backend) {
+func installSignalHandlers(siaBackend *sia.Backend, connections *nbd.Connections,
+	exitLevel sia.ShutdownLevel, reload func(*sia.Backend)) {
 	c := make(chan os.Signal, 3)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGHUP, syscall.SIGQUIT)
 
+	shutdown := func(level sia.ShutdownLevel) {
+		err := siaBackend.Shutdown(level)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Shutdowns run in the background, so that another signal can
+	// interrupt one that is waiting for uploads.
+	shuttingDown := false
 	for {
 		sig := <-c
+		if sig == syscall.SIGHUP {
+			if reload == nil {
+				log.Printf("Ignoring SIGHUP, as no config file was given\n")
+			} else {
+				log.Printf("Reloading config file\n")
+				reload(siaBackend)
+			}
+			continue
+		}
+		if sig == syscall.SIGQUIT {
+			// in the background, as the server may be hanging
+			go func() {
+				path, err := writeStateDump(siaBackend, connections)
+				if err != nil {
+					log.Printf("Unable to dump state: %s\n", err)
+					return
+				}
+				log.Printf("Dumped state to %s\n", path)
+			}()
+			continue
+		}
+
+		if shuttingDown {
+			log.Printf("Interrupting shutdown; remaining data stays in the cache\n")
+			siaBackend.InterruptShutdown()
+			continue
+		}
+
 		switch sig {
 		case syscall.SIGINT, syscall.SIGTERM:
-			log.Printf("Performing fast shutdown\n")
-			err := siaBackend.Shutdown(false)
-			if err != nil {
-				log.Fatal(err)
-			}
+			log.Printf("Shutting down with --flush-on-exit=%s\n", exitLevel)
+			go shutdown(exitLevel)
 		case syscall.SIGUSR1:
-			log.Printf("Performing thorough shutdown\n")
-			err := siaBackend.Shutdown(true)
-			if err != nil {
-				log.Fatal(err)
+			if siaBackend.Following() {
+				log.Printf("Ignoring SIGUSR1, as a follower has nothing to upload\n")
+				continue
 			}
+			log.Printf("Performing thorough shutdown\n")
+			go shutdown(sia.ShutdownRemote)
 		default:
 			panic("unexpected signal")
 		}
+		shuttingDown = true
+	}
+}
+
+// publishMetrics returns the read-only endpoints for monitoring the running
+// server.
+func publishMetrics(siaBackend *sia.Backend, connections *nbd.Connections) *http.ServeMux {
+	expvar.Publish("dirty", expvar.Func(func() interface{} {
+		dirtyData := siaBackend.DirtyData()
+		oldestWriteAge := 0.0
+		if !dirtyData.OldestWrite.IsZero() {
+			oldestWriteAge = time.Since(dirtyData.OldestWrite).Seconds()
+		}
+
+		return map[string]interface{}{
+			"pages":                    dirtyData.Pages,
+			"bytes":                    dirtyData.Bytes,
+			"oldest_write_age_seconds": oldestWriteAge,
+		}
+	}))
+	expvar.Publish("maintenance", expvar.Func(func() interface{} {
+		stats := siaBackend.MaintenanceStats()
+		return map[string]interface{}{
+			"runs":                   stats.Runs,
+			"skipped":                stats.Skipped,
+			"failures":               stats.Failures,
+			"last_duration_seconds":  stats.LastDuration.Seconds(),
+			"last_lock_wait_seconds": stats.LastLockWait.Seconds(),
+			"max_duration_seconds":   stats.MaxDuration.Seconds(),
+		}
+	}))
+	expvar.Publish("uploads", expvar.Func(func() interface{} {
+		stalls := siaBackend.UploadStalls()
+		return map[string]interface{}{
+			"uploading": stalls.Uploading,
+			"stalled":   stalls.Stalled,
+		}
+	}))
+	expvar.Publish("concurrency", expvar.Func(func() interface{} {
+		concurrency := siaBackend.Concurrency()
+		return map[string]interface{}{
+			"uploads":                   concurrency.Uploads,
+			"max_uploads":               concurrency.MaxUploads,
+			"upload_baseline_seconds":   concurrency.UploadBaseline.Seconds(),
+			"downloads":                 concurrency.Downloads,
+			"max_downloads":             concurrency.MaxDownloads,
+			"download_baseline_seconds": concurrency.DownloadBaseline.Seconds(),
+		}
+	}))
+	expvar.Publish("cache_growth", expvar.Func(func() interface{} {
+		growth := siaBackend.CacheGrowth()
+		return map[string]interface{}{
+			"dirty_pages":      growth.DirtyPages,
+			"limit":            growth.Limit,
+			"pages_per_hour":   growth.PagesPerHour,
+			"limit_in_seconds": growth.LimitIn.Seconds(),
+			"warning":          growth.Warning,
+		}
+	}))
+	expvar.Publish("scrub", expvar.Func(func() interface{} {
+		scrub := siaBackend.ScrubStatus()
+		return map[string]interface{}{
+			"interval_seconds": scrub.Interval.Seconds(),
+			"pages":            scrub.Pages,
+			"verified":         scrub.Verified,
+			"failed":           len(scrub.Failed),
+		}
+	}))
+	expvar.Publish("contracts", expvar.Func(func() interface{} {
+		expiry := siaBackend.ContractExpiry()
+		expiring := []map[string]interface{}{}
+		for _, contract := range expiry.Expiring {
+			expiring = append(expiring, map[string]interface{}{
+				"host":            contract.Host,
+				"window_start":    contract.WindowStart,
+				"ends_in_seconds": contract.EndsIn.Seconds(),
+			})
+		}
+		return map[string]interface{}{
+			"warning_seconds": expiry.Warning.Seconds(),
+			"block_height":    expiry.BlockHeight,
+			"contracts":       expiry.Contracts,
+			"expiring":        expiring,
+			"pages_at_risk":   expiry.PagesAtRisk,
+		}
+	}))
+	expvar.Publish("health", expvar.Func(func() interface{} {
+		return siaBackend.Health()
+	}))
+	expvar.Publish("sia_daemons", expvar.Func(func() interface{} {
+		daemons := []map[string]interface{}{}
+		for _, daemon := range siaBackend.SiaDaemons() {
+			daemons = append(daemons, map[string]interface{}{
+				"address":         daemon.Address,
+				"active":          daemon.Active,
+				"downloads":       daemon.Downloads,
+				"failures":        daemon.Failures,
+				"latency_seconds": daemon.Latency.Seconds(),
+			})
+		}
+		return daemons
+	}))
+	expvar.Publish("connections", expvar.Func(func() interface{} {
+		return connections.List()
+	}))
+	expvar.Publish("device", expvar.Func(func() interface{} {
+		return siaBackend.Device()
+	}))
+	expvar.Publish("build", expvar.Func(func() interface{} {
+		return currentBuild()
+	}))
+	expvar.Publish("usage", expvar.Func(func() interface{} {
+		return siaBackend.Usage()
+	}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(siaBackend.Usage())
+	})
+
+	// /health answers 503 while unhealthy, so that it can be polled by
+	// monitoring without parsing the response. It also tells which binary
+	// serves which device.
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		health := siaBackend.Health()
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(struct {
+			sia.Health
+			Build    buildInfo      `json:"build"`
+			Device   sia.DeviceInfo `json:"device"`
+			PageSize uint64         `json:"page_size"`
+		}{health, currentBuild(), siaBackend.Device(), sia.PageSize})
+	})
+
+	// /page-health lists the pages with the lowest redundancy on Sia.
+	mux.HandleFunc("/page-health", func(w http.ResponseWriter, r *http.Request) {
+		count := defaultWorstPages
+		if r.URL.Query().Get("count") != "" {
+			var err error
+			count, err = strconv.Atoi(r.URL.Query().Get("count"))
+			if err != nil || count < 0 {
+				http.Error(w, "invalid count", http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(siaBackend.WorstPages(count))
+	})
+	return mux
+}
+
+func printStats(metricsAddress string) error {
+	if metricsAddress == "" {
+		return errors.New("this talks to the running server; please specify its --metrics-address")
+	}
+
+	var usage sia.Usage
+	err := adminGet(adminEndpoint{address: metricsAddress}, "/stats", nil, &usage)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Pages:           %d\n", usage.Pages)
+	fmt.Printf("  zero:          %d\n", usage.ZeroPages)
+	fmt.Printf("  on Sia:        %d\n", usage.RemotePages)
+	fmt.Printf("  cached:        %d\n", usage.CachedPages)
+	fmt.Printf("  dirty:         %d\n", usage.DirtyPages)
+	fmt.Printf("Storage on Sia:  %s (including redundancy)\n", formatBytes(usage.RemoteBytes))
+	fmt.Printf("Cache on disk:   %s\n", formatBytes(usage.CacheBytes))
+	if usage.GhostBytes > 0 {
+		fmt.Printf("Ghost copies:    %s\n", formatBytes(usage.GhostBytes))
+	}
+
+	lifetime := usage.Lifetime
+	fmt.Printf("Since %s (%d starts):\n", lifetime.Since.Local().Format("2006-01-02 15:04:05"), lifetime.Starts)
+	fmt.Printf("  uploaded:      %s (%d pages, %d failures)\n", formatBytes(lifetime.BytesUploaded),
+		lifetime.Uploads, lifetime.UploadFailures)
+	fmt.Printf("  downloaded:    %s (%d pages)\n", formatBytes(lifetime.BytesDownloaded), lifetime.Downloads)
+	fmt.Printf("  flushes:       %d\n", lifetime.Flushes)
+	fmt.Printf("  repairs:       %d\n", lifetime.Repairs)
+	return nil
+}
+
+func printEpochMarker(backendSettings sia.BackendSettings) error {
+	marker, err := sia.ReadEpochMarker(backendSettings)
+	if err != nil {
+		return err
+	}
+
+	if marker == nil {
+		fmt.Println("No epoch marker has been recorded yet")
+		return nil
+	}
+
+	fmt.Printf("Flush:        %d\n", marker.Flush)
+	if marker.FlushedAt.IsZero() {
+		fmt.Printf("Flushed at:   unknown (flush implied by restart)\n")
+	} else {
+		fmt.Printf("Flushed at:   %s\n", marker.FlushedAt.Format(time.RFC3339))
+	}
+	fmt.Printf("Recorded at:  %s\n", marker.RecordedAt.Format(time.RFC3339))
+	fmt.Printf("Ordered:      %t\n", marker.Ordered)
+	fmt.Printf("Pages on Sia: %d\n", len(marker.Generations))
+	return nil
+}
+
+func printDevices(backendSettings sia.BackendSettings) error {
+	devices, err := sia.ListDevices(backendSettings)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PREFIX\tUUID\tLABEL\tSIZE\tFLUSH\tFLUSHED\tPAGES")
+	for _, device := range devices {
+		uuid, size := "-", "-"
+		if device.Info.UUID != "" {
+			uuid = device.Info.UUID
+			size = formatBytes(device.Info.Size)
+		}
+		flush, flushed, pages := "-", "-", "-"
+		if device.Epoch != nil {
+			flush = strconv.FormatUint(device.Epoch.Flush, 10)
+			if !device.Epoch.FlushedAt.IsZero() {
+				flushed = device.Epoch.FlushedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			pages = strconv.Itoa(len(device.Epoch.Generations))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", device.SiaPathPrefix, uuid,
+			device.Info.Label, size, flush, flushed, pages)
+	}
+	return w.Flush()
+}
+
+// dataDirectory returns where the cache of the device under siaPathPrefix is
+// kept. Devices other than the default one get a directory of their own, so
+// that servers for several devices can run side by side.
+func dataDirectory(siaPathPrefix string) string {
+	if siaPathPrefix == defaultSiaPathPrefix {
+		return config.PrependDataDirectory("")
+	}
+	return config.PrependDataDirectory(filepath.Join("devices", url.PathEscape(siaPathPrefix)))
+}
+
+func formatBytes(bytes uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit += 1
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// serveHTTP binds right away, so that this happens before privileges are
+// dropped, and serves handler in the background.
+func serveHTTP(what string, address string, handler http.Handler) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Printf("Unable to serve %s: %s\n", what, err)
+		return
 	}
+
+	go func() {
+		err := http.Serve(ln, handler)
+		if err != nil {
+			log.Printf("Unable to serve %s: %s\n", what, err)
+		}
+	}()
 }
 
-func serve(socketPath string, exportSize uint64, backendSettings sia.BackendSettings) {
+func serve(serverSettings nbd.ServerSettings, httpListenAddress string, enabledFrontends []string,
+	backendSettings sia.BackendSettings, metricsAddress string, adminAddress string, adminToken string,
+	exitLevel sia.ShutdownLevel, reload func(*sia.Backend)) {
 	siaBackend, err := sia.NewBackend(backendSettings)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	go installSignalHandlers(siaBackend)
+	serverSettings.ExportDescription = exportDescription(siaBackend.Device())
+	log.Printf("Serving %s (sia-nbdserver %s)\n", serverSettings.ExportDescription,
+		currentBuild().Version)
+
+	serverSettings.Connections = nbd.NewConnections()
+	if metricsAddress != "" {
+		log.Printf("Serving metrics at http://%s/ (/debug/vars, /stats, /health, /page-health)\n",
+			metricsAddress)
+		serveHTTP("metrics", metricsAddress, publishMetrics(siaBackend, serverSettings.Connections))
+	}
+	if adminAddress != "" {
+		if adminToken == "" {
+			log.Printf("The admin API at %s has no --admin-token-file; anyone who can reach it can control the server\n",
+				adminAddress)
+		}
+		log.Printf("Serving admin API at http://%s/\n", adminAddress)
+		serveHTTP("admin API", adminAddress,
+			requireAdminToken(adminToken, newAdminAPI(siaBackend, serverSettings.Connections)))
+	}
+
+	go installSignalHandlers(siaBackend, serverSettings.Connections, exitLevel, reload)
 
-	err = nbd.Serve(socketPath, exportSize, siaBackend)
+	err = serveFrontends(enabledFrontends, frontendSettings{
+		ServerSettings:    serverSettings,
+		httpListenAddress: httpListenAddress,
+	}, siaBackend)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -70,48 +435,947 @@ func main() {
 	size := uint64(defaultSize)
 	hardMaxCached := defaultHardMaxCached
 	softMaxCached := defaultSoftMaxCached
+	writeReserve := 0
+	readOverflow := defaultReadOverflow
 	idleIntervalSeconds := defaultIdleIntervalSeconds
+	minIdleIntervalSeconds := 0
+	maxIdleIntervalSeconds := 0
+	orderedUploads := false
 	siaDaemonAddress := defaultSiaDaemonAddress
+	fallbackSiaDaemons := []string{}
+	balanceReads := false
+	parallelDownloads := defaultParallelDownloads
+	maxUploads := defaultMaxUploads
+	label := ""
+	layoutName := sia.LayoutFlat.String()
+	cacheModeName := sia.CacheWriteback.String()
+	discardName := "ignore"
+	detectZeroesName := sia.DetectZeroesOff.String()
+	var cacheMode sia.CacheMode
+	var detectZeroes sia.DetectZeroes
+	layout := sia.LayoutFlat
+	resize := false
+	truncate := false
 	siaPasswordFile := config.PrependHomeDirectory(defaultSiaPasswordFileSuffix)
+	otlpEndpoint := ""
+	webhookURL := ""
+	eventScript := ""
+	uploadFailureNotify := defaultUploadFailureNotify
+	pauseWritesAfter := 0
+	uploadStallSeconds := defaultUploadStallSeconds
+	growthWarningSeconds := defaultGrowthWarningSeconds
+	startupWaitSeconds := 0
+	scrubIntervalSeconds := 0
+	staleReads := false
+	minShards := 0
+	totalShards := 0
+	extraUploadParameters := uploadParameters{}
+	contractWarningSeconds := defaultContractWarningSeconds
+	maxDirtySeconds := 0
+	trashRetentionSeconds := defaultTrashRetentionSeconds
+	maintenanceIntervalSeconds := defaultMaintenanceIntervalSeconds
+	maintenanceJitterSeconds := 0
+	breakerThreshold := defaultBreakerThreshold
+	breakerProbeSeconds := defaultBreakerProbeSeconds
+	watchdogSeconds := defaultWatchdogSeconds
+	watchdogExpand := false
+	paranoid := false
+	follower := false
+	followIntervalSeconds := defaultFollowIntervalSeconds
+	publishEpochs := []string{}
+	maxDirtyBytes := uint64(0)
+	metricsAddress := ""
+	admin := adminEndpoint{}
+	siaPathPrefix := defaultSiaPathPrefix
+	minRedundancy := defaultMinRedundancy
+	warnRedundancy := defaultWarnRedundancy
+	budget := uint64(0)
+	writeCombineBytes := 0
+	ghostCacheBytes := uint64(0)
+	cacheKeyFile := ""
+	previousCacheKeyFile := ""
+	cacheFileMode := fileMode(sia.DefaultCacheFileMode)
+	cacheGroup := groupID(0)
+	integrityKeyFile := ""
+	maxRequestSize := uint32(0)
+	clientRateLimit := uint64(0)
+	flushOnExit := sia.ShutdownCache.String()
+	configPath := ""
+	runAsUser := ""
+	listenAddress := ""
+	httpListenAddress := ""
+	runAsGroup := ""
+	tlsCert := ""
+	tlsKey := ""
+	tlsClientCA := ""
+	var loadedConfig *configFile
+
+	backendSettings := func() sia.BackendSettings {
+		return sia.BackendSettings{
+			Size:             size,
+			HardMaxCached:    hardMaxCached,
+			SoftMaxCached:    softMaxCached,
+			IdleInterval:     time.Duration(idleIntervalSeconds) * time.Second,
+			SiaDaemonAddress: siaDaemonAddress,
+			SiaPasswordFile:  siaPasswordFile,
+			SiaPathPrefix:    siaPathPrefix,
+			DataDirectory:    dataDirectory(siaPathPrefix),
+			Label:            label,
+			Layout:           layout,
+			Resize:           resize,
+			Truncate:         truncate,
+
+			WriteReservePages: writeReserve,
+			ReadOverflowPages: readOverflow,
+
+			FallbackSiaDaemonAddresses: fallbackSiaDaemons,
+			BalanceReads:               balanceReads,
+			ParallelDownloads:          parallelDownloads,
+			MaxUploads:                 maxUploads,
+
+			MinIdleInterval: time.Duration(minIdleIntervalSeconds) * time.Second,
+			MaxIdleInterval: time.Duration(maxIdleIntervalSeconds) * time.Second,
+			OrderedUploads:  orderedUploads,
+
+			Notifier:               notify.New(webhookURL, eventScript),
+			UploadFailureThreshold: uploadFailureNotify,
+			PauseWritesAfter:       pauseWritesAfter,
+			UploadStallTimeout:     time.Duration(uploadStallSeconds) * time.Second,
+			GrowthWarning:          time.Duration(growthWarningSeconds) * time.Second,
+			StartupWait:            time.Duration(startupWaitSeconds) * time.Second,
+			ScrubInterval:          time.Duration(scrubIntervalSeconds) * time.Second,
+			StaleReads:             staleReads,
+			ContractWarning:        time.Duration(contractWarningSeconds) * time.Second,
+
+			MaxDirtyAge:   time.Duration(maxDirtySeconds) * time.Second,
+			MaxDirtyBytes: maxDirtyBytes,
+
+			UploadParameters: sia.UploadParameters{
+				MinShards:   minShards,
+				TotalShards: totalShards,
+				Extra:       url.Values(extraUploadParameters),
+			},
+
+			MinimumRedundancy: minRedundancy,
+			WarningRedundancy: warnRedundancy,
+
+			StorageBudget:     budget,
+			WriteCombineBytes: writeCombineBytes,
+			GhostCacheBytes:   ghostCacheBytes,
+			CacheKeyFile:      cacheKeyFile,
+			CacheFileMode:     os.FileMode(cacheFileMode),
+			CacheMode:         cacheMode,
+			Discard:           discardName == "unmap",
+			DetectZeroes:      detectZeroes,
+			CacheGID:          int(cacheGroup),
+
+			PreviousCacheKeyFile: previousCacheKeyFile,
+			IntegrityKeyFile:     integrityKeyFile,
+			TrashRetention:       time.Duration(trashRetentionSeconds) * time.Second,
+
+			MaintenanceInterval: time.Duration(maintenanceIntervalSeconds) * time.Second,
+			MaintenanceJitter:   time.Duration(maintenanceJitterSeconds) * time.Second,
+
+			BreakerThreshold:     breakerThreshold,
+			BreakerProbeInterval: time.Duration(breakerProbeSeconds) * time.Second,
+
+			WatchdogTimeout: time.Duration(watchdogSeconds) * time.Second,
+			WatchdogExpand:  watchdogExpand,
+
+			Paranoid: paranoid,
+
+			Follower:       follower,
+			FollowInterval: time.Duration(followIntervalSeconds) * time.Second,
+			EpochPublisher: notify.NewWebhooks(publishEpochs),
+		}
+	}
 
 	rootDesc := "NBD server backed by Sia storage + local cache"
 	rootCmd := &cobra.Command{
 		Use:   "sia-nbdserver",
 		Short: rootDesc,
 		Long:  fmt.Sprintf("%s.", rootDesc),
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if configPath != "" {
+				loadedConfig = newConfigFile(configPath, cmd)
+				_, err := loadedConfig.apply()
+				if err != nil {
+					return err
+				}
+			}
+
+			err := sia.ValidateSiaPathPrefix(siaPathPrefix)
+			if err != nil {
+				return err
+			}
+			layout, err = sia.ParseLayout(layoutName)
+			if err != nil {
+				return err
+			}
+			cacheMode, err = sia.ParseCacheMode(cacheModeName)
+			if err != nil {
+				return err
+			}
+			if discardName != "ignore" && discardName != "unmap" {
+				return fmt.Errorf("unknown discard mode %q (valid: ignore, unmap)", discardName)
+			}
+			detectZeroes, err = sia.ParseDetectZeroes(detectZeroesName)
+			return err
+		},
 		Run: func(cmd *cobra.Command, args []string) {
-			if socketPath == "" {
+			if socketPath != "" && !cmd.Flags().Changed("unix") && siaPathPrefix != defaultSiaPathPrefix {
+				socketPath += "-" + url.PathEscape(siaPathPrefix)
+			}
+			if socketPath == "" && listenAddress == "" {
 				fmt.Println("Default socket path is $XDG_RUNTIME_DIR/sia-nbdserver," +
 					" but $XDG_RUNTIME_DIR is not set. Please specify a socket path via -u flag.")
 				os.Exit(1)
 			}
 
-			backendSettings := sia.BackendSettings{
-				Size:             size,
-				HardMaxCached:    hardMaxCached,
-				SoftMaxCached:    softMaxCached,
-				IdleInterval:     time.Duration(idleIntervalSeconds * int(time.Second)),
-				SiaDaemonAddress: siaDaemonAddress,
-				SiaPasswordFile:  siaPasswordFile,
+			if otlpEndpoint != "" {
+				err := tracing.Init(otlpEndpoint, "sia-nbdserver")
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer tracing.Shutdown()
+			}
+
+			settings := backendSettings()
+			serverSettings := nbd.ServerSettings{
+				SocketPath:      socketPath,
+				ExportSize:      size,
+				ListenAddress:   listenAddress,
+				MaxRequestSize:  maxRequestSize,
+				Notifier:        settings.Notifier,
+				ClientRateLimit: clientRateLimit,
+				ReadOnly:        follower,
+			}
+			configuredFrontends := []string{}
+			if loadedConfig != nil {
+				access, err := loadedConfig.accessRules()
+				if err != nil {
+					log.Fatal(err)
+				}
+				serverSettings.Access = access
+
+				exportFrontends, err := loadedConfig.exportFrontends()
+				if err != nil {
+					log.Fatal(err)
+				}
+				for name := range exportFrontends {
+					if name != nbd.ExportName {
+						log.Fatalf("unknown export %s (the only export is %s)", name, nbd.ExportName)
+					}
+				}
+				configuredFrontends = exportFrontends[nbd.ExportName]
+			}
+			enabledFrontends, err := selectFrontends(configuredFrontends, listenAddress, httpListenAddress)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if tlsCert != "" || tlsKey != "" {
+				tlsConfig, err := nbd.LoadTLSConfig(tlsCert, tlsKey, tlsClientCA)
+				if err != nil {
+					log.Fatal(err)
+				}
+				serverSettings.TLSConfig = tlsConfig
+			} else if tlsClientCA != "" {
+				log.Fatal("--tls-client-ca requires --tls-cert and --tls-key")
+			}
+
+			if runAsUser != "" {
+				serverSettings.Listening = func() error {
+					return dropPrivileges(runAsUser, runAsGroup, settings.DataDirectory)
+				}
+			} else if runAsGroup != "" {
+				log.Fatal("--group requires --user")
+			}
+			if runAsUser != "" && cacheGroup != 0 {
+				log.Fatal("--cache-group cannot be combined with --user; use --group instead")
+			}
+
+			exitLevel, err := sia.ParseShutdownLevel(flushOnExit)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if follower && exitLevel == sia.ShutdownRemote {
+				log.Fatal("--flush-on-exit=remote cannot be combined with --follower")
+			}
+
+			var reload func(*sia.Backend)
+			if loadedConfig != nil {
+				reload = func(siaBackend *sia.Backend) {
+					loadedConfig.reload(siaBackend, backendSettings)
+				}
+			}
+
+			adminToken, err := readAdminToken(admin.tokenFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			serve(serverSettings, httpListenAddress, enabledFrontends, settings, metricsAddress,
+				admin.address, adminToken, exitLevel, reload)
+		},
+	}
+
+	selfTestCmd := &cobra.Command{
+		Use:   "selftest",
+		Short: "Write, upload, download and verify random data under a scratch SiaPath",
+		Long: "Write random data to a tiny temporary device under a scratch SiaPath, force it\n" +
+			"to be uploaded, read it back from Sia and verify it. All scratch data is\n" +
+			"removed afterwards. Use this to confirm that the renter is correctly funded\n" +
+			"and configured before trusting it with real data.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := sia.SelfTest(backendSettings())
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(selfTestCmd)
+
+	rekeyCmd := &cobra.Command{
+		Use:   "rekey",
+		Short: "Re-encrypt the cache files with a new key",
+		Long: "Re-encrypt the cache files that are encrypted with --previous-cache-key-file\n" +
+			"(or not encrypted at all) with --cache-key-file. The server must not be\n" +
+			"running. An interrupted run can simply be repeated.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := sia.Rekey(backendSettings())
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(rekeyCmd)
+
+	rollbackCacheFormatCmd := &cobra.Command{
+		Use:   "rollback-cache-format",
+		Short: "Return the cache to the format of versions without cache file headers",
+		Long: "Remove the headers of the cache files, which the server adds on startup,\n" +
+			"so that the cache can be used by a version from before headers were\n" +
+			"introduced. The cache files themselves are left alone. The server must not\n" +
+			"be running. Starting this version again migrates the cache once more.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			removed, err := sia.RollbackCacheFormat(backendSettings())
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Removed %d cache file header(s)\n", removed)
+		},
+	}
+	rootCmd.AddCommand(rollbackCacheFormatCmd)
+
+	statsCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show page, Sia storage and cache disk usage of the running server",
+		Long: "Query the running server (which needs to have been started with\n" +
+			"--metrics-address) for how many pages are zero, on Sia, cached and dirty,\n" +
+			"how much storage they take up on Sia and how much disk space the cache uses,\n" +
+			"along with how much was uploaded and downloaded since the cache was created.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := printStats(metricsAddress)
+			if err != nil {
+				log.Fatal(err)
 			}
-			serve(socketPath, size, backendSettings)
 		},
 	}
+	rootCmd.AddCommand(statsCmd)
+
+	epochCmd := &cobra.Command{
+		Use:   "epoch",
+		Short: "Show which flush the pages on Sia correspond to",
+		Long: "Show the latest epoch marker stored on Sia, which records the most recent\n" +
+			"flush for which all previously written pages have been uploaded. This tells\n" +
+			"which point in time the pages on Sia correspond to if the cache is lost.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := printEpochMarker(backendSettings())
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(epochCmd)
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the devices stored under the Sia daemon",
+		Long: "Find the devices stored under the Sia daemon by their metadata and show\n" +
+			"their SiaPath prefix, UUID, label, size and latest epoch marker. Devices\n" +
+			"that have never been started by this version and have not recorded an\n" +
+			"epoch marker yet are not found.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := printDevices(backendSettings())
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(listCmd)
+
+	preallocate := false
+	pagesPerObject := 1
+	createCmd := &cobra.Command{
+		Use:   "create",
+		Short: "Create a new device with the given --size and --label on Sia",
+		Long: "Set up a new device under the Sia daemon with the size given by --size\n" +
+			"and the label given by --label, without serving it. Serving the device\n" +
+			"afterwards with a different --size fails unless --resize is given, which\n" +
+			"catches mistyped sizes. Pages start out as zeroes without being stored on\n" +
+			"Sia, unless --preallocate is given, which uploads every page as zeroes\n" +
+			"right away, so that storage for the whole device is paid for up front.\n" +
+			"With --pages-per-object, several consecutive pages are stored together\n" +
+			"in one object, which suits small devices. An existing device is left\n" +
+			"alone.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			info, err := sia.CreateDevice(backendSettings(), preallocate, pagesPerObject)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Created device %s with a size of %d bytes (%s)\n",
+				info.UUID, info.Size, formatBytes(info.Size))
+		},
+	}
+	createCmd.Flags().BoolVar(&preallocate, "preallocate", preallocate,
+		"upload every page as zeroes when creating the device")
+	createCmd.Flags().IntVar(&pagesPerObject, "pages-per-object", pagesPerObject,
+		"number of consecutive pages stored together in one object on Sia (at most 16)")
+	rootCmd.AddCommand(createCmd)
+
+	migrateLayoutCmd := &cobra.Command{
+		Use:   "migrate-layout",
+		Short: "Move the pages of the device on Sia to the layout given by --layout",
+		Long: "Move every page of the device on Sia that is not stored in the layout\n" +
+			"given by --layout yet, including generations in the trash. Each page is\n" +
+			"downloaded and uploaded again, so this takes a while for large devices.\n" +
+			"The server must not be running in the meantime. An interrupted migration\n" +
+			"can be resumed by running this again.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			moved, err := sia.MigrateLayout(backendSettings(), layout)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Moved %d object(s) to the %s layout\n", moved, layout)
+		},
+	}
+	rootCmd.AddCommand(migrateLayoutCmd)
+
+	evacuateTo := ""
+	evacuateParallel := defaultEvacuateParallel
+	evacuateCmd := &cobra.Command{
+		Use:   "evacuate --to DIR",
+		Short: "Copy every recoverable page of the device into an image file in DIR",
+		Long: "Copy the device into a sparse image file named after its UUID in DIR, for\n" +
+			"when the data needs to leave Sia in a hurry, e.g. because contracts are\n" +
+			"about to expire or the allowance has run out. Pages in the cache, including\n" +
+			"data that is not on Sia yet, are copied first. The other pages are then\n" +
+			"downloaded --parallel at a time and verified if --integrity-key-file is\n" +
+			"given. A page whose newest generation is unreadable is taken from an older\n" +
+			"generation in the trash. Pages that cannot be recovered at all are listed\n" +
+			"and read as zeroes in the image. The server must not be running.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if evacuateTo == "" {
+				log.Fatal("evacuate needs --to")
+			}
+			report, err := sia.Evacuate(backendSettings(), evacuateTo, evacuateParallel)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Evacuated to %s: %d page(s) from the cache, %d from Sia, %d from stale generations, %d zero\n",
+				report.Image, report.Cached, report.Downloaded, report.Stale, report.Zero)
+			if len(report.Failed) > 0 {
+				log.Fatalf("Unable to recover %d page(s): %v\n", len(report.Failed), report.Failed)
+			}
+		},
+	}
+	evacuateCmd.Flags().StringVar(&evacuateTo, "to", evacuateTo,
+		"directory to write the image file to")
+	evacuateCmd.Flags().IntVar(&evacuateParallel, "parallel", evacuateParallel,
+		"number of pages to download at once")
+	rootCmd.AddCommand(evacuateCmd)
+
+	pagesState := ""
+	pagesChecksums := false
+	pagesCmd := &cobra.Command{
+		Use:   "pages",
+		Short: "Show state and history of the pages of the running server",
+		Long: "Query the running server (which needs to have been started with\n" +
+			"--admin-address) for every page that has been accessed or is on Sia and\n" +
+			"show its state, generation on Sia, last access, last write, since when it\n" +
+			"holds un-uploaded data and how often its upload failed in a row.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := printPages(admin, pagesState, pagesChecksums)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	pagesCmd.Flags().StringVar(&pagesState, "state", pagesState,
+		"only show pages in this state (remote, cached, clean, dirty, uploading)")
+	pagesCmd.Flags().BoolVar(&pagesChecksums, "checksum", pagesChecksums,
+		"show the SHA-256 of cached pages (reads them from disk)")
+	rootCmd.AddCommand(pagesCmd)
+
+	flushWait := true
+	flushPageCmd := &cobra.Command{
+		Use:   "flush-page N",
+		Short: "Upload a page of the running server now",
+		Long: "Make the running server (which needs to have been started with\n" +
+			"--admin-address) upload page N within the next few seconds instead of\n" +
+			"waiting for it to become idle, and wait until its data is on Sia.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			page, err := strconv.Atoi(args[0])
+			if err != nil {
+				log.Fatalf("Invalid page: %s", err)
+			}
+
+			err = flushPages(admin, "/flush-page",
+				url.Values{"page": {strconv.Itoa(page)}}, flushWait)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	flushPageCmd.Flags().BoolVar(&flushWait, "wait", flushWait,
+		"wait until the upload is complete")
+	rootCmd.AddCommand(flushPageCmd)
+
+	flushAllCmd := &cobra.Command{
+		Use:   "flush-all",
+		Short: "Upload all pages of the running server with data not on Sia yet",
+		Long: "Make the running server (which needs to have been started with\n" +
+			"--admin-address) upload every page with data not on Sia yet instead of\n" +
+			"waiting for them to become idle, and wait until that data is on Sia. Use\n" +
+			"this to get everything onto Sia before a maintenance window.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := flushPages(admin, "/flush-all", nil, flushWait)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	flushAllCmd.Flags().BoolVar(&flushWait, "wait", flushWait,
+		"wait until all uploads are complete")
+	rootCmd.AddCommand(flushAllCmd)
+
+	evictPageCmd := &cobra.Command{
+		Use:   "evict-page N",
+		Short: "Remove a page from the cache of the running server",
+		Long: "Make the running server (which needs to have been started with\n" +
+			"--admin-address) remove page N from its cache to free up space. Pages\n" +
+			"with data that is not on Sia yet need to be flushed first.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			page, err := strconv.Atoi(args[0])
+			if err != nil {
+				log.Fatalf("Invalid page: %s", err)
+			}
+
+			err = evictPage(admin, page)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(evictPageCmd)
+
+	trashCmd := &cobra.Command{
+		Use:   "trash",
+		Short: "List the deleted objects of the running server that are kept for now",
+		Long: "Query the running server (which needs to have been started with\n" +
+			"--admin-address) for the objects on Sia that have been deleted, but are\n" +
+			"kept until --trash-retention has passed.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := printTrash(admin)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(trashCmd)
+
+	connectionsCmd := &cobra.Command{
+		Use:   "connections",
+		Short: "List the clients of the running server and their requests",
+		Long: "Query the running server (which needs to have been started with\n" +
+			"--admin-address) for the connected NBD clients and the most recently\n" +
+			"disconnected ones, along with how many requests and bytes each of them\n" +
+			"read and wrote.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := printConnections(admin)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(connectionsCmd)
+
+	dumpStateCmd := &cobra.Command{
+		Use:   "dump-state",
+		Short: "Make the running server dump its internal state to a file",
+		Long: "Make the running server (which needs to have been started with\n" +
+			"--admin-address) write the state of every page, the upload queue, the\n" +
+			"operations in flight and the stacks of all goroutines to a file in its data\n" +
+			"directory, for debugging hangs. Sending it SIGQUIT does the same.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := dumpState(admin)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(dumpStateCmd)
+
+	undeleteCmd := &cobra.Command{
+		Use:   "undelete SIAPATH",
+		Short: "Take an object out of the trash of the running server",
+		Long: "Make the running server (which needs to have been started with\n" +
+			"--admin-address) keep an object that is in the trash. A superseded\n" +
+			"generation of a page is then merely kept, while a generation that is newer\n" +
+			"than the current one takes its place after the next restart.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var response struct{}
+			err := adminRequest(http.MethodPost, admin, "/undelete",
+				url.Values{"path": {args[0]}}, &response)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(undeleteCmd)
+
+	purgeCmd := &cobra.Command{
+		Use:   "purge",
+		Short: "Remove all objects in the trash of the running server for good",
+		Long: "Make the running server (which needs to have been started with\n" +
+			"--admin-address) remove the objects in its trash from Sia right away,\n" +
+			"e.g. to free up storage.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var purged int
+			err := adminRequest(http.MethodPost, admin, "/purge", nil, &purged)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Purged %d object(s)\n", purged)
+		},
+	}
+	rootCmd.AddCommand(purgeCmd)
+
+	changesCmd := &cobra.Command{
+		Use:   "changes [MARKER]",
+		Short: "List the ranges of the running server written to since a marker",
+		Long: "Query the running server (which needs to have been started with\n" +
+			"--admin-address) for the ranges of the device written to since MARKER\n" +
+			"was set with mark-changes, one \"OFFSET LENGTH\" line in bytes per range,\n" +
+			"so that a backup only needs to copy those. Without MARKER, list the markers.",
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			marker := ""
+			if len(args) > 0 {
+				marker = args[0]
+			}
+			err := printChanges(admin, marker)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(changesCmd)
+
+	markChangesCmd := &cobra.Command{
+		Use:   "mark-changes MARKER",
+		Short: "Start tracking the writes to the running server under a marker",
+		Long: "Make the running server (which needs to have been started with\n" +
+			"--admin-address) track the ranges written to from now on under MARKER,\n" +
+			"e.g. right before a backup, replacing an earlier marker of that name.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var marker sia.ChangeMarker
+			err := adminRequest(http.MethodPost, admin, "/mark-changes",
+				url.Values{"marker": {args[0]}}, &marker)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Tracking changes since %s as %s\n",
+				marker.Since.Local().Format("2006-01-02 15:04:05"), marker.Name)
+		},
+	}
+	rootCmd.AddCommand(markChangesCmd)
+
+	forgetChangesCmd := &cobra.Command{
+		Use:   "forget-changes MARKER",
+		Short: "Stop tracking the writes to the running server under a marker",
+		Long: "Make the running server (which needs to have been started with\n" +
+			"--admin-address) stop tracking the ranges written to since MARKER.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var response struct{}
+			err := adminRequest(http.MethodPost, admin, "/forget-changes",
+				url.Values{"marker": {args[0]}}, &response)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(forgetChangesCmd)
+
+	checkpointCmd := &cobra.Command{
+		Use:   "checkpoint NAME",
+		Short: "Take a local checkpoint of the running server",
+		Long: "Make the running server (which needs to have been started with\n" +
+			"--admin-address) take a local restore point under NAME, replacing an\n" +
+			"earlier checkpoint of that name. The pages that are not on Sia yet are\n" +
+			"reflinked into the checkpoint, which requires the cache directory to be on\n" +
+			"a filesystem with reflinks, such as btrfs or XFS. Restore it with\n" +
+			"restore-checkpoint.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var checkpoint sia.Checkpoint
+			err := adminRequest(http.MethodPost, admin, "/checkpoint",
+				url.Values{"name": {args[0]}}, &checkpoint)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Took checkpoint %s with %d cached page(s)\n", checkpoint.Name, len(checkpoint.Cached))
+		},
+	}
+	rootCmd.AddCommand(checkpointCmd)
+
+	checkpointsCmd := &cobra.Command{
+		Use:   "checkpoints",
+		Short: "List the local checkpoints of the running server",
+		Long: "Query the running server (which needs to have been started with\n" +
+			"--admin-address) for its checkpoints, along with how many pages each\n" +
+			"keeps in the cache directory and how many it refers to on Sia.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := printCheckpoints(admin)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(checkpointsCmd)
+
+	deleteCheckpointCmd := &cobra.Command{
+		Use:   "delete-checkpoint NAME",
+		Short: "Delete a local checkpoint of the running server",
+		Long: "Make the running server (which needs to have been started with\n" +
+			"--admin-address) delete the checkpoint NAME.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var response struct{}
+			err := adminRequest(http.MethodPost, admin, "/delete-checkpoint",
+				url.Values{"name": {args[0]}}, &response)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(deleteCheckpointCmd)
+
+	restoreCheckpointCmd := &cobra.Command{
+		Use:   "restore-checkpoint NAME",
+		Short: "Turn the device back into the state of a local checkpoint",
+		Long: "Replace the cache with the pages kept by the checkpoint NAME and roll back\n" +
+			"the pages uploaded to Sia since, by moving their newer generations to the\n" +
+			"trash. Pages can only be rolled back while the generation of the checkpoint\n" +
+			"is still on Sia, so keep --trash-retention longer than checkpoints are\n" +
+			"kept. Nothing is changed unless every page can be restored. Writes since\n" +
+			"the checkpoint are lost. The server must not be running in the meantime.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			checkpoint, err := sia.RestoreCheckpoint(backendSettings(), args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Restored checkpoint %s taken at %s\n", checkpoint.Name,
+				checkpoint.CreatedAt.Local().Format("2006-01-02 15:04:05"))
+		},
+	}
+	rootCmd.AddCommand(restoreCheckpointCmd)
+
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version of this binary",
+		Long: "Print the version of this binary and what it was built with. The running\n" +
+			"server reports the same under \"build\" at /health.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			printVersion()
+		},
+	}
+	rootCmd.AddCommand(versionCmd)
 
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", configPath,
+		"JSON file with settings keyed by flag name; flags given on the command line take precedence")
 	rootCmd.PersistentFlags().StringVarP(&socketPath, "unix", "u", socketPath,
 		"unix domain socket")
-	rootCmd.PersistentFlags().Uint64VarP(&size, "size", "s", size,
-		"size of block device; should ideally be a multiple of 67108864 (2 ^ 26)")
+	rootCmd.PersistentFlags().VarP((*byteSize)(&size), "size", "s",
+		"size of block device in bytes or with a unit like 250GiB or 1.5TiB; a multiple of 512 and ideally of 64MiB")
 	rootCmd.PersistentFlags().IntVarP(&hardMaxCached, "hard", "H", hardMaxCached,
 		"hard limit for number of 64 MiB pages in the cache")
 	rootCmd.PersistentFlags().IntVarP(&softMaxCached, "soft", "S", softMaxCached,
 		"soft limit for number of 64 MiB pages in the cache")
+	rootCmd.PersistentFlags().IntVar(&writeReserve, "write-reserve", writeReserve,
+		"number of pages below the hard limit that only writes may fill; at most --hard minus --soft")
+	rootCmd.PersistentFlags().IntVar(&readOverflow, "read-overflow", readOverflow,
+		"number of pages by which reads may exceed the hard limit while all cached pages are dirty")
 	rootCmd.PersistentFlags().IntVarP(&idleIntervalSeconds, "idle", "i", idleIntervalSeconds,
 		"seconds to wait before a cache page is marked idle and upload begins")
+	rootCmd.PersistentFlags().IntVar(&minIdleIntervalSeconds, "min-idle", minIdleIntervalSeconds,
+		"lower bound in seconds for adapting the idle interval of a page (0 = same as --idle)")
+	rootCmd.PersistentFlags().IntVar(&maxIdleIntervalSeconds, "max-idle", maxIdleIntervalSeconds,
+		"upper bound in seconds for adapting the idle interval of a page (0 = same as --idle)")
+	rootCmd.PersistentFlags().BoolVar(&orderedUploads, "ordered-uploads", orderedUploads,
+		"upload pages written to before a flush before any pages written to after it")
 	rootCmd.PersistentFlags().StringVar(&siaPasswordFile, "sia-password-file", siaPasswordFile,
 		"path to Sia API password file")
 	rootCmd.PersistentFlags().StringVar(&siaDaemonAddress, "sia-daemon", siaDaemonAddress,
 		"host and port of Sia daemon")
+	rootCmd.PersistentFlags().StringSliceVar(&fallbackSiaDaemons, "fallback-sia-daemon", fallbackSiaDaemons,
+		"host and port of further renterd nodes sharing the bus of --sia-daemon, used while it is failing")
+	rootCmd.PersistentFlags().StringVar(&otlpEndpoint, "otlp-endpoint", otlpEndpoint,
+		"export traces to this OTLP/HTTP collector (e.g. http://localhost:4318)")
+	rootCmd.PersistentFlags().StringVar(&webhookURL, "webhook", webhookURL,
+		"URL to POST JSON event notifications to")
+	rootCmd.PersistentFlags().StringVar(&eventScript, "event-script", eventScript,
+		"script to run for every event notification")
+	rootCmd.PersistentFlags().IntVar(&uploadFailureNotify, "upload-failure-notify", uploadFailureNotify,
+		"number of consecutive failed uploads of a page before a notification is sent")
+	rootCmd.PersistentFlags().IntVar(&pauseWritesAfter, "pause-writes-after", pauseWritesAfter,
+		"pause writes after this many consecutive failed uploads of a page or maintenance cycles, until uploads succeed again (0 = never)")
+	rootCmd.PersistentFlags().IntVar(&uploadStallSeconds, "upload-stall-timeout", uploadStallSeconds,
+		"seconds after which an upload that Sia has accepted but not completed is started over (0 = never)")
+	rootCmd.PersistentFlags().IntVar(&scrubIntervalSeconds, "scrub-interval", scrubIntervalSeconds,
+		"seconds within which every page on Sia is downloaded and verified once while the device is idle, e.g. 604800 for weekly (0 = never)")
+	rootCmd.PersistentFlags().IntVar(&startupWaitSeconds, "startup-wait", startupWaitSeconds,
+		"seconds to keep trying to reach the Sia daemon at startup, e.g. while it is still starting at boot (0 = fail right away)")
+	rootCmd.PersistentFlags().IntVar(&growthWarningSeconds, "growth-warning", growthWarningSeconds,
+		"warn when the pages not yet on Sia keep growing and are predicted to reach the cache limit within this many seconds (0 = never)")
+	rootCmd.PersistentFlags().IntVar(&contractWarningSeconds, "contract-warning", contractWarningSeconds,
+		"warn when contracts with hosts end within this many seconds without having been renewed (0 = never)")
+	rootCmd.PersistentFlags().IntVar(&trashRetentionSeconds, "trash-retention", trashRetentionSeconds,
+		"seconds to keep deleted objects on Sia before removing them for good (0 = remove right away)")
+	rootCmd.PersistentFlags().BoolVar(&staleReads, "stale-reads", staleReads,
+		"serve a page whose newest generation on Sia is unreadable from an older generation in the trash")
+	rootCmd.PersistentFlags().IntVar(&breakerThreshold, "breaker-threshold", breakerThreshold,
+		"consecutive failed requests to the Sia daemon after which it is only probed until it recovers (0 = never stop)")
+	rootCmd.PersistentFlags().IntVar(&breakerProbeSeconds, "breaker-probe-interval", breakerProbeSeconds,
+		"seconds between probes of a failing Sia daemon")
+	rootCmd.PersistentFlags().IntVar(&watchdogSeconds, "watchdog", watchdogSeconds,
+		"seconds a request may wait for space in the cache before it is reported (0 = never)")
+	rootCmd.PersistentFlags().BoolVar(&watchdogExpand, "watchdog-expand", watchdogExpand,
+		"let requests reported by the watchdog exceed the hard limit of the cache")
+	rootCmd.PersistentFlags().BoolVar(&paranoid, "paranoid", paranoid,
+		"verify the invariants of the cache after every operation and crash with a state dump if one is violated")
+	rootCmd.PersistentFlags().BoolVar(&follower, "follower", follower,
+		"serve the device of another server read-only, as of its last flush whose writes are all on Sia")
+	rootCmd.PersistentFlags().IntVar(&followIntervalSeconds, "follow-interval", followIntervalSeconds,
+		"seconds between looks for a newer flush of the device when following it")
+	rootCmd.PersistentFlags().StringSliceVar(&publishEpochs, "publish-epochs", publishEpochs,
+		"URL to POST an event to whenever an epoch marker has been recorded, e.g. the /epoch-recorded endpoint of a follower")
+	rootCmd.PersistentFlags().IntVar(&maintenanceIntervalSeconds, "maintenance-interval", maintenanceIntervalSeconds,
+		"seconds between maintenance cycles, which start and check on uploads and evict pages")
+	rootCmd.PersistentFlags().IntVar(&maintenanceJitterSeconds, "maintenance-jitter", maintenanceJitterSeconds,
+		"up to this many seconds are added at random to each maintenance interval")
+	rootCmd.PersistentFlags().IntVar(&maxDirtySeconds, "max-dirty-age", maxDirtySeconds,
+		"seconds a write may stay un-uploaded before uploads are forced and writes throttled (0 = unlimited)")
+	rootCmd.PersistentFlags().Uint64Var(&maxDirtyBytes, "max-dirty-bytes", maxDirtyBytes,
+		"bytes of un-uploaded data before uploads are forced and writes throttled (0 = unlimited)")
+	rootCmd.PersistentFlags().IntVar(&minShards, "min-shards", minShards,
+		"shards needed to restore a slab of a page uploaded from now on (0 = 2)")
+	rootCmd.PersistentFlags().IntVar(&totalShards, "total-shards", totalShards,
+		"shards a slab of a page uploaded from now on is split into; the redundancy is total/min shards (0 = 5)")
+	rootCmd.PersistentFlags().Var(&extraUploadParameters, "upload-parameter",
+		"further query parameter of page uploads that the Sia worker accepts, e.g. contractset=nbd; may be repeated")
+	rootCmd.PersistentFlags().Float64Var(&minRedundancy, "min-redundancy", minRedundancy,
+		"redundancy a page needs to reach before its upload is considered complete")
+	rootCmd.PersistentFlags().Float64Var(&warnRedundancy, "warn-redundancy", warnRedundancy,
+		"warn when downloading a page stored with less redundancy than this")
+	rootCmd.PersistentFlags().BoolVar(&balanceReads, "balance-reads", balanceReads,
+		"download pages from whichever of --sia-daemon and --fallback-sia-daemon has been fastest")
+	rootCmd.PersistentFlags().IntVar(&parallelDownloads, "parallel-downloads", parallelDownloads,
+		"number of pages only on Sia that a read spanning several of them downloads at once, each held in memory; lowered while the Sia daemon is slow or failing")
+	rootCmd.PersistentFlags().IntVar(&maxUploads, "max-uploads", maxUploads,
+		"number of pages that may be uploading at once; lowered while the Sia daemon is slow or failing (0 = unlimited)")
+	rootCmd.PersistentFlags().Uint64Var(&budget, "budget", budget,
+		"bytes that may be stored on Sia, including redundancy (0 = unlimited)")
+	rootCmd.PersistentFlags().IntVar(&writeCombineBytes, "write-combine", writeCombineBytes,
+		"bytes per page for merging adjacent small writes before they hit the cache (0 = off)")
+	rootCmd.PersistentFlags().StringVar(&flushOnExit, "flush-on-exit", flushOnExit,
+		"on SIGINT/SIGTERM, exit right away (none), after syncing the cache to disk (cache) or after uploading everything (remote)")
+	rootCmd.PersistentFlags().StringVar(&label, "label", label,
+		"label to store along with the UUID of the device on Sia (default: keep the stored one)")
+	rootCmd.PersistentFlags().BoolVar(&resize, "resize", resize,
+		"allow --size to differ from the size the device was created with")
+	rootCmd.PersistentFlags().BoolVar(&truncate, "truncate", truncate,
+		"delete the pages on Sia that lie beyond the end of the device at --size")
+	rootCmd.PersistentFlags().StringVar(&siaPathPrefix, "prefix", siaPathPrefix,
+		"SiaPath prefix of the device; every device needs its own")
+	rootCmd.PersistentFlags().StringVar(&layoutName, "layout", layoutName,
+		"store the pages of a new device directly below its SiaPath prefix (flat) or in directories of 1024 pages (sharded)")
+	rootCmd.PersistentFlags().StringVar(&cacheModeName, "cache", cacheModeName,
+		"when writes are synced to disk, as with qemu-nbd: on flush (writeback, none), with every write (writethrough, directsync) or never (unsafe)")
+	rootCmd.PersistentFlags().StringVar(&discardName, "discard", discardName,
+		"whether trims and zero writes drop whole pages from the cache and Sia (unmap) or are ignored and written (ignore)")
+	rootCmd.PersistentFlags().StringVar(&detectZeroesName, "detect-zeroes", detectZeroesName,
+		"keep pages written with nothing but zeroes unallocated (on), also dropping whole pages with --discard unmap (unmap), or not (off)")
+	rootCmd.PersistentFlags().StringVar(&listenAddress, "listen", listenAddress,
+		"host and port to accept NBD clients at via TCP instead of the unix socket (e.g. 0.0.0.0:10809)")
+	rootCmd.PersistentFlags().StringVar(&httpListenAddress, "http-listen", httpListenAddress,
+		"host and port to additionally serve the device read-only at via HTTP with range requests (e.g. 0.0.0.0:8080)")
+	rootCmd.PersistentFlags().StringVar(&tlsCert, "tls-cert", tlsCert,
+		"PEM certificate to offer NBD clients TLS with; TCP clients are then required to use it")
+	rootCmd.PersistentFlags().StringVar(&tlsKey, "tls-key", tlsKey,
+		"PEM private key belonging to --tls-cert")
+	rootCmd.PersistentFlags().StringVar(&tlsClientCA, "tls-client-ca", tlsClientCA,
+		"PEM CA certificates that client certificates need to be signed by; their common name is the client's identity")
+	rootCmd.PersistentFlags().StringVar(&runAsUser, "user", runAsUser,
+		"user to switch to once the socket is listening")
+	rootCmd.PersistentFlags().StringVar(&runAsGroup, "group", runAsGroup,
+		"group to switch to along with --user (default: the user's primary group)")
+	rootCmd.PersistentFlags().Var(&cacheFileMode, "cache-mode",
+		"permissions of the cache files in octal; the data directory gets the same plus search permission where reading is allowed")
+	rootCmd.PersistentFlags().Var(&cacheGroup, "cache-group",
+		"group to own the data directory and cache files, e.g. to let backup agents read them with --cache-mode 0640")
+	rootCmd.PersistentFlags().StringVar(&cacheKeyFile, "cache-key-file", cacheKeyFile,
+		"file with a 256-bit key as 64 hex digits to encrypt the cache files with")
+	rootCmd.PersistentFlags().StringVar(&previousCacheKeyFile, "previous-cache-key-file", previousCacheKeyFile,
+		"key that --cache-key-file replaces; cache files encrypted with it are re-encrypted when opened")
+	rootCmd.PersistentFlags().StringVar(&integrityKeyFile, "integrity-key-file", integrityKeyFile,
+		"file with a 256-bit key as 64 hex digits to authenticate the pages on Sia with")
+	rootCmd.PersistentFlags().Uint64Var(&ghostCacheBytes, "ghost-cache", ghostCacheBytes,
+		"bytes of compressed copies of evicted pages to keep, so re-reads avoid a download (0 = off)")
+	rootCmd.PersistentFlags().Uint32Var(&maxRequestSize, "max-request-size", maxRequestSize,
+		"largest NBD request in bytes to accept and advertise to clients (0 = 256 MiB)")
+	rootCmd.PersistentFlags().Uint64Var(&clientRateLimit, "client-rate-limit", clientRateLimit,
+		"bytes per second each NBD client may read and write (0 = unlimited)")
+	rootCmd.PersistentFlags().StringVar(&metricsAddress, "metrics-address", metricsAddress,
+		"host and port to serve metrics at /debug/vars, /stats, /health and /page-health (e.g. localhost:9981)")
+	rootCmd.PersistentFlags().StringVar(&admin.address, "admin-address", admin.address,
+		"host and port to serve the admin API at, which the admin subcommands talk to (e.g. localhost:9982)")
+	rootCmd.PersistentFlags().StringVar(&admin.tokenFile, "admin-token-file", admin.tokenFile,
+		"file with a token that every request to the admin API needs to carry as a bearer token")
 
 	err := rootCmd.Execute()
 	if err != nil {
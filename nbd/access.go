@@ -0,0 +1,101 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+type (
+	// AccessRule grants clients from Network that authenticated as
+	// Identity access to an export. A nil Network matches clients from
+	// anywhere and an empty Identity matches any client.
+	AccessRule struct {
+		Network  *net.IPNet
+		Identity string
+		ReadOnly bool
+	}
+)
+
+// clientIP returns the IP address of a client, or nil for clients that
+// connected via the unix socket.
+func clientIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
+
+func (rule AccessRule) matchesNetwork(ip net.IP) bool {
+	return rule.Network == nil || rule.Network.Contains(ip)
+}
+
+// exportAccess determines whether the client at addr, authenticated as
+// identity (empty if not authenticated), may use the named export and
+// whether only for reading. The first matching rule of the export applies.
+// Without any rules, and for clients on the unix socket, which is protected
+// by file permissions, all access is granted, read-only if the server is.
+func (settings ServerSettings) exportAccess(addr net.Addr, identity string,
+	name string) (allowed bool, readOnly bool) {
+	ip := clientIP(addr)
+	if len(settings.Access) == 0 || ip == nil {
+		return true, settings.ReadOnly
+	}
+
+	for _, rule := range settings.Access[name] {
+		if rule.matchesNetwork(ip) && (rule.Identity == "" || rule.Identity == identity) {
+			return true, settings.ReadOnly || rule.ReadOnly
+		}
+	}
+	return false, false
+}
+
+// MayRead reports whether the client at addr, authenticated as identity
+// (empty if not authenticated), may read the named export. It applies the
+// access rules to frontends other than NBD.
+func (settings ServerSettings) MayRead(addr net.Addr, identity string, name string) bool {
+	allowed, _ := settings.exportAccess(addr, identity, name)
+	return allowed
+}
+
+// mayConnect reports whether the client at addr may possibly use any export,
+// before it has had the chance to authenticate.
+func (settings ServerSettings) mayConnect(addr net.Addr) bool {
+	ip := clientIP(addr)
+	if len(settings.Access) == 0 || ip == nil {
+		return true
+	}
+
+	for _, rules := range settings.Access {
+		for _, rule := range rules {
+			if rule.matchesNetwork(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requiresTLS reports whether the client at addr needs to use TLS before
+// it may do anything else. TLS is optional on the unix socket.
+func (settings ServerSettings) requiresTLS(addr net.Addr) bool {
+	return settings.TLSConfig != nil && clientIP(addr) != nil
+}
+
+// requestedExport returns the export name of the data of an NBD_OPT_GO
+// option, with the empty name standing for the default export. It returns
+// false if the data is malformed.
+func requestedExport(optionData []byte) (string, bool) {
+	if len(optionData) < 4 {
+		return "", false
+	}
+	// compared as uint32, as the length turns negative as an int on
+	// 32-bit architectures
+	nameLength := binary.BigEndian.Uint32(optionData[0:4])
+	if nameLength > uint32(len(optionData)-4) {
+		return "", false
+	}
+	if nameLength == 0 {
+		return ExportName, true
+	}
+	return string(optionData[4 : 4+nameLength]), true
+}
@@ -0,0 +1,219 @@
+package nbd
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// ConnectionStats counts the requests of a client connection.
+	ConnectionStats struct {
+		ID             uint64    `json:"id"`
+		RemoteAddr     string    `json:"remoteAddr"`
+		Identity       string    `json:"identity"`
+		ReadOnly       bool      `json:"readOnly"`
+		ConnectedAt    time.Time `json:"connectedAt"`
+		DisconnectedAt time.Time `json:"disconnectedAt"`
+
+		Reads        uint64 `json:"reads"`
+		Writes       uint64 `json:"writes"`
+		Flushes      uint64 `json:"flushes"`
+		Errors       uint64 `json:"errors"`
+		BytesRead    uint64 `json:"bytesRead"`
+		BytesWritten uint64 `json:"bytesWritten"`
+
+		// Throttled is how long requests were held back by the rate
+		// limit of the connection.
+		Throttled time.Duration `json:"throttled"`
+	}
+
+	// Connections keeps track of the connected clients and the most
+	// recently disconnected ones. It is safe for concurrent use. A nil
+	// *Connections is valid and keeps nothing.
+	Connections struct {
+		mutex  sync.Mutex
+		nextID uint64
+		active map[uint64]*ConnectionStats
+		closed []ConnectionStats
+	}
+
+	// connection is what the request loop of a client updates.
+	connection struct {
+		connections *Connections
+		stats       *ConnectionStats
+		limiter     *rateLimiter
+	}
+
+	requestKind int
+
+	// rateLimiter is a token bucket that holds up to a second's worth of
+	// bytes.
+	rateLimiter struct {
+		rate      float64
+		available float64
+		last      time.Time
+	}
+)
+
+// closedConnections is how many disconnected clients are still listed.
+const closedConnections = 16
+
+var errReadOnly = errors.New("write to a read-only export")
+
+const (
+	readRequestKind requestKind = iota
+	writeRequestKind
+	flushRequestKind
+)
+
+func NewConnections() *Connections {
+	return &Connections{active: make(map[uint64]*ConnectionStats)}
+}
+
+// open starts tracking a client that has entered the transmission phase.
+// rateLimit is in bytes per second (0 = unlimited).
+func (c *Connections) open(remoteAddr string, identity string, readOnly bool,
+	rateLimit uint64) *connection {
+	conn := &connection{
+		connections: c,
+		stats: &ConnectionStats{
+			RemoteAddr:  remoteAddr,
+			Identity:    identity,
+			ReadOnly:    readOnly,
+			ConnectedAt: time.Now(),
+		},
+	}
+	if rateLimit > 0 {
+		conn.limiter = newRateLimiter(rateLimit, time.Now())
+	}
+	if c == nil {
+		return conn
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.nextID += 1
+	conn.stats.ID = c.nextID
+	c.active[conn.stats.ID] = conn.stats
+	return conn
+}
+
+// close moves the connection to the disconnected clients.
+func (conn *connection) close() {
+	c := conn.connections
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	conn.stats.DisconnectedAt = time.Now()
+	delete(c.active, conn.stats.ID)
+	c.closed = append(c.closed, *conn.stats)
+	if len(c.closed) > closedConnections {
+		c.closed = c.closed[len(c.closed)-closedConnections:]
+	}
+}
+
+// throttle waits until the rate limit of the connection allows transferring
+// length bytes.
+func (conn *connection) throttle(length uint32) {
+	if conn.limiter == nil {
+		return
+	}
+
+	wait := conn.limiter.reserve(float64(length), time.Now())
+	if wait <= 0 {
+		return
+	}
+	time.Sleep(wait)
+	conn.update(func(stats *ConnectionStats) {
+		stats.Throttled += wait
+	})
+}
+
+// record counts a request of the given kind that transferred length bytes.
+func (conn *connection) record(kind requestKind, length uint32, err error) {
+	conn.update(func(stats *ConnectionStats) {
+		switch kind {
+		case readRequestKind:
+			stats.Reads += 1
+			if err == nil {
+				stats.BytesRead += uint64(length)
+			}
+		case writeRequestKind:
+			stats.Writes += 1
+			if err == nil {
+				stats.BytesWritten += uint64(length)
+			}
+		case flushRequestKind:
+			stats.Flushes += 1
+		}
+		if err != nil {
+			stats.Errors += 1
+		}
+	})
+}
+
+func (conn *connection) update(f func(stats *ConnectionStats)) {
+	if conn.connections == nil {
+		f(conn.stats)
+		return
+	}
+
+	conn.connections.mutex.Lock()
+	defer conn.connections.mutex.Unlock()
+	f(conn.stats)
+}
+
+// List returns the connected clients, oldest first, followed by the most
+// recently disconnected ones.
+func (c *Connections) List() []ConnectionStats {
+	if c == nil {
+		return []ConnectionStats{}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	list := []ConnectionStats{}
+	for _, stats := range c.active {
+		list = append(list, *stats)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return append(list, c.closed...)
+}
+
+func newRateLimiter(rate uint64, now time.Time) *rateLimiter {
+	return &rateLimiter{
+		rate:      float64(rate),
+		available: float64(rate),
+		last:      now,
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait until
+// they are covered. Requests larger than the bucket are let through once
+// it is full, as they could never be covered otherwise.
+func (rl *rateLimiter) reserve(n float64, now time.Time) time.Duration {
+	rl.available += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.available > rl.rate {
+		rl.available = rl.rate
+	}
+	rl.last = now
+
+	if n > rl.rate {
+		n = rl.rate
+	}
+	rl.available -= n
+	if rl.available >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.available / rl.rate * float64(time.Second))
+}
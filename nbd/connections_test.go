@@ -0,0 +1,70 @@
+package nbd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnections(t *testing.T) {
+	connections := NewConnections()
+	first := connections.open("10.0.0.1:5000", "", false, 0)
+	second := connections.open("10.0.0.2:5000", "backup", true, 0)
+
+	first.record(readRequestKind, 4096, nil)
+	first.record(readRequestKind, 4096, errors.New("download failed"))
+	first.record(writeRequestKind, 512, nil)
+	first.record(flushRequestKind, 0, nil)
+	second.record(writeRequestKind, 512, errReadOnly)
+
+	list := connections.List()
+	assert.Equal(t, 2, len(list))
+	assert.Equal(t, uint64(1), list[0].ID)
+	assert.Equal(t, uint64(2), list[0].Reads)
+	assert.Equal(t, uint64(4096), list[0].BytesRead, "expected failed reads to transfer nothing")
+	assert.Equal(t, uint64(1), list[0].Writes)
+	assert.Equal(t, uint64(512), list[0].BytesWritten)
+	assert.Equal(t, uint64(1), list[0].Flushes)
+	assert.Equal(t, uint64(1), list[0].Errors)
+	assert.Equal(t, "backup", list[1].Identity)
+	assert.Equal(t, uint64(0), list[1].BytesWritten)
+
+	first.close()
+	third := connections.open("10.0.0.3:5000", "", false, 0)
+	list = connections.List()
+	assert.Equal(t, 3, len(list))
+	assert.Equal(t, uint64(2), list[0].ID, "expected connected clients first")
+	assert.Equal(t, uint64(3), list[1].ID)
+	assert.Equal(t, uint64(1), list[2].ID)
+	assert.False(t, list[2].DisconnectedAt.IsZero())
+	third.close()
+	second.close()
+
+	for i := 0; i < 2*closedConnections; i++ {
+		connections.open("10.0.0.4:5000", "", false, 0).close()
+	}
+	assert.Equal(t, closedConnections, len(connections.List()))
+}
+
+func TestNilConnections(t *testing.T) {
+	var connections *Connections
+	client := connections.open("10.0.0.1:5000", "", false, 0)
+	client.record(readRequestKind, 4096, nil)
+	client.close()
+	assert.Equal(t, uint64(4096), client.stats.BytesRead)
+	assert.Empty(t, connections.List())
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(1000, now)
+	assert.Equal(t, time.Duration(0), limiter.reserve(600, now))
+	assert.Equal(t, 200*time.Millisecond, limiter.reserve(600, now), "expected to wait for the missing bytes")
+
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), limiter.reserve(800, now))
+	assert.Equal(t, time.Second, limiter.reserve(5000, now),
+		"expected large requests to wait for a full bucket only")
+}
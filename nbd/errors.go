@@ -0,0 +1,39 @@
+package nbd
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errnoMapping maps the errnos a backend may wrap into its errors to the
+// error values of the NBD protocol. NBD has no EROFS; writes to a read-only
+// device are to be answered with EPERM.
+var errnoMapping = []struct {
+	errno    syscall.Errno
+	nbdError uint32
+}{
+	{syscall.ENOSPC, nbdENOSPC},
+	{syscall.EROFS, nbdEPERM},
+	{syscall.EPERM, nbdEPERM},
+	{syscall.EACCES, nbdEPERM},
+	{syscall.EINVAL, nbdEINVAL},
+	{syscall.ENOMEM, nbdENOMEM},
+	{syscall.ESHUTDOWN, nbdESHUTDOWN},
+	{syscall.EIO, nbdEIO},
+}
+
+// nbdErrorCode returns the NBD error value to reply with for an error of
+// the backend. Errors that do not wrap any known errno are assumed to be
+// failures to get at the data, which the client sees as EIO.
+func nbdErrorCode(err error) uint32 {
+	if err == nil {
+		return 0
+	}
+
+	for _, mapping := range errnoMapping {
+		if errors.Is(err, mapping.errno) {
+			return mapping.nbdError
+		}
+	}
+	return nbdEIO
+}
@@ -0,0 +1,160 @@
+//go:build go1.18
+// +build go1.18
+
+package nbd
+
+// Fuzz targets for what a client controls. Run them with e.g.
+//
+//	go test -fuzz FuzzHandle ./nbd/
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/javgh/sia-nbdserver/blockdev"
+)
+
+type (
+	// memoryBackend is a device held in memory, failing the fuzz target
+	// if a request beyond its end gets through to it.
+	memoryBackend struct {
+		t    *testing.T
+		data []byte
+	}
+)
+
+func (m *memoryBackend) check(offset int64, length int64) {
+	if !blockdev.InRange(m.Size(), offset, length) {
+		m.t.Fatalf("request of %d bytes at %d beyond the end got through", length, offset)
+	}
+}
+
+func (m *memoryBackend) ReadAt(ctx context.Context, buf []byte, offset int64) (int, error) {
+	m.check(offset, int64(len(buf)))
+	return copy(buf, m.data[offset:]), nil
+}
+
+func (m *memoryBackend) WriteAt(ctx context.Context, buf []byte, offset int64) (int, error) {
+	m.check(offset, int64(len(buf)))
+	return copy(m.data[offset:], buf), nil
+}
+
+func (m *memoryBackend) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (m *memoryBackend) Trim(ctx context.Context, offset int64, length int64) error {
+	m.check(offset, length)
+	return nil
+}
+
+func (m *memoryBackend) WriteZeroes(ctx context.Context, offset int64, length int64, mayDiscard bool) error {
+	m.check(offset, length)
+	copy(m.data[offset:offset+length], make([]byte, length))
+	return nil
+}
+
+func (m *memoryBackend) Size() int64 {
+	return int64(len(m.data))
+}
+
+func (m *memoryBackend) Close() error {
+	return nil
+}
+
+func (m *memoryBackend) Available() bool {
+	return true
+}
+
+// clientSession encodes what a well-behaved client sends: the handshake,
+// NBD_OPT_GO and the given requests.
+func clientSession(requests ...nbdRequest) []byte {
+	var session bytes.Buffer
+	binary.Write(&session, binary.BigEndian, nbdClientFlags(nbdFlagCFixedNewstyle))
+	binary.Write(&session, binary.BigEndian, nbdClientOption{
+		NbdOptionMagic:  nbdOptionMagic,
+		NbdOptionID:     nbdOptGo,
+		NbdOptionLength: 8,
+	})
+	binary.Write(&session, binary.BigEndian, []uint32{0, 1<<16 | nbdInfoBlockSize})
+	for _, request := range requests {
+		request.NbdRequestMagic = nbdRequestMagic
+		binary.Write(&session, binary.BigEndian, request)
+		if request.NbdCommandType == nbdCmdWrite {
+			session.Write(make([]byte, request.NbdLength))
+		}
+	}
+	return session.Bytes()
+}
+
+// FuzzHandle feeds arbitrary client input to the negotiation and the
+// transmission phase.
+func FuzzHandle(f *testing.F) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	f.Add(clientSession())
+	f.Add(clientSession(
+		nbdRequest{NbdCommandType: nbdCmdWrite, NbdOffset: 4096, NbdLength: 512},
+		nbdRequest{NbdCommandType: nbdCmdRead, NbdOffset: 0, NbdLength: 8192},
+		nbdRequest{NbdCommandType: nbdCmdFlush},
+		nbdRequest{NbdCommandType: nbdCmdTrim, NbdOffset: 1 << 20, NbdLength: 4096},
+		nbdRequest{NbdCommandType: nbdCmdWriteZeroes, NbdOffset: 0, NbdLength: 1 << 31},
+		nbdRequest{NbdCommandType: nbdCmdRead, NbdOffset: 1<<64 - 512, NbdLength: 1024},
+		nbdRequest{NbdCommandType: nbdCmdWrite, NbdOffset: 1<<63 - 1, NbdLength: 1},
+		nbdRequest{NbdCommandType: nbdCmdDisc},
+	))
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		server, client := net.Pipe()
+		go func() {
+			client.Write(input)
+			client.Close()
+		}()
+		go io.Copy(ioutil.Discard, client)
+
+		settings := ServerSettings{ExportSize: 1 << 20, MaxRequestSize: 1 << 16}
+		handle(server, settings, &memoryBackend{t: t, data: make([]byte, 1<<20)})
+		server.Close()
+	})
+}
+
+func FuzzReadRequest(f *testing.F) {
+	f.Add(make([]byte, nbdRequestLength))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		request, err := readRequest(bytes.NewReader(input), make([]byte, nbdRequestLength))
+		if len(input) < nbdRequestLength {
+			if err == nil {
+				t.Fatal("short request accepted")
+			}
+			return
+		}
+
+		var encoded bytes.Buffer
+		binary.Write(&encoded, binary.BigEndian, request)
+		if !bytes.Equal(encoded.Bytes(), input[:nbdRequestLength]) {
+			t.Fatalf("request %+v does not round-trip", request)
+		}
+	})
+}
+
+// FuzzOptionData checks that the export name and information requests of
+// NBD_OPT_GO are only ever taken from within the option data.
+func FuzzOptionData(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0, 0, 1, 0, 3})
+	f.Add([]byte{0, 0, 0, 3, 's', 'i', 'a', 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0, 0})
+	f.Fuzz(func(t *testing.T, optionData []byte) {
+		name, ok := requestedExport(optionData)
+		if ok && name != ExportName && !bytes.Contains(optionData, []byte(name)) {
+			t.Fatalf("export name %q is not part of the option data", name)
+		}
+		requestsInfo(optionData, nbdInfoBlockSize)
+	})
+}
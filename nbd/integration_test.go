@@ -0,0 +1,425 @@
+//go:build integration
+// +build integration
+
+package nbd
+
+// End-to-end tests that serve a local file device (blockdev.File) over the
+// unix socket, in a separate process that can be killed. They only run on
+// demand:
+//
+//	go test -tags integration -v ./nbd/
+//
+// With NBD_INTEGRATION_DEVICE=/dev/nbd0 (as root, with nbd-client and
+// e2fsprogs installed), TestIntegrationKernel also attaches the kernel NBD
+// client and puts a filesystem on the device.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/javgh/sia-nbdserver/blockdev"
+)
+
+const (
+	integrationHelperEnv = "NBD_INTEGRATION_HELPER"
+	integrationDeviceEnv = "NBD_INTEGRATION_DEVICE"
+	integrationSize      = 64 * 1024 * 1024
+	integrationBlockSize = 4096
+)
+
+type (
+	// testClient is a minimal userspace NBD client that sends one request
+	// at a time.
+	testClient struct {
+		conn   net.Conn
+		size   uint64
+		flags  uint16
+		handle uint64
+	}
+
+	// testServer is a server running in a helper process.
+	testServer struct {
+		cmd        *exec.Cmd
+		socketPath string
+	}
+)
+
+// TestIntegrationHelperServer is not a test, but the server process that the
+// other tests start and kill.
+func TestIntegrationHelperServer(t *testing.T) {
+	arguments := os.Getenv(integrationHelperEnv)
+	if arguments == "" {
+		t.Skip("only runs as helper process")
+	}
+	parts := strings.SplitN(arguments, "|", 3)
+	size, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := blockdev.OpenFile(parts[0], size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Serve(ServerSettings{SocketPath: parts[1], ExportSize: uint64(size)}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func startTestServer(t *testing.T, dir string) *testServer {
+	socketPath := filepath.Join(dir, "nbd.sock")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestIntegrationHelperServer$")
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s|%s|%d", integrationHelperEnv,
+		filepath.Join(dir, "device"), socketPath, integrationSize))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testServer{cmd: cmd, socketPath: socketPath}
+}
+
+// kill stops the server the hard way, as a crash or the OOM killer would.
+func (s *testServer) kill() {
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+}
+
+func dialTestClient(t *testing.T, socketPath string) *testClient {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		conn, err = net.Dial("unix", socketPath)
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &testClient{conn: conn}
+	err = client.handshake()
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return client
+}
+
+func (c *testClient) handshake() error {
+	var header nbdNewStyleHeader
+	err := binary.Read(c.conn, binary.BigEndian, &header)
+	if err != nil {
+		return err
+	}
+	if header.NbdMagic != nbdMagic || header.NbdOptionMagic != nbdOptionMagic {
+		return errors.New("unexpected server greeting")
+	}
+	err = binary.Write(c.conn, binary.BigEndian, nbdClientFlags(nbdFlagCFixedNewstyle))
+	if err != nil {
+		return err
+	}
+
+	// NBD_OPT_GO for the default export without any information requests
+	optionData := make([]byte, 6)
+	err = binary.Write(c.conn, binary.BigEndian, nbdClientOption{
+		NbdOptionMagic:  nbdOptionMagic,
+		NbdOptionID:     nbdOptGo,
+		NbdOptionLength: uint32(len(optionData)),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(optionData)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var reply nbdOptionReply
+		err = binary.Read(c.conn, binary.BigEndian, &reply)
+		if err != nil {
+			return err
+		}
+		payload := make([]byte, reply.NbdOptionReplyLength)
+		_, err = io.ReadFull(c.conn, payload)
+		if err != nil {
+			return err
+		}
+
+		switch reply.NbdOptionReplyType {
+		case nbdRepAck:
+			return nil
+		case nbdRepInfo:
+			if len(payload) >= 12 && binary.BigEndian.Uint16(payload) == nbdInfoExport {
+				c.size = binary.BigEndian.Uint64(payload[2:10])
+				c.flags = binary.BigEndian.Uint16(payload[10:12])
+			}
+		default:
+			return fmt.Errorf("export refused with reply type %d", reply.NbdOptionReplyType)
+		}
+	}
+}
+
+// request sends a request and waits for its reply, returning the data of
+// reads and the NBD error of the reply.
+func (c *testClient) request(command uint16, flags uint16, offset uint64, length uint32,
+	data []byte) ([]byte, uint32, error) {
+	c.handle += 1
+	err := binary.Write(c.conn, binary.BigEndian, nbdRequest{
+		NbdRequestMagic: nbdRequestMagic,
+		NbdCommandFlags: flags,
+		NbdCommandType:  command,
+		NbdHandle:       c.handle,
+		NbdOffset:       offset,
+		NbdLength:       length,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if data != nil {
+		_, err = c.conn.Write(data)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var reply nbdSimpleReply
+	err = binary.Read(c.conn, binary.BigEndian, &reply)
+	if err != nil {
+		return nil, 0, err
+	}
+	if reply.NbdSimpleReplyMagic != nbdSimpleReplyMagic || reply.NbdHandle != c.handle {
+		return nil, 0, errors.New("unexpected reply")
+	}
+	if command != nbdCmdRead || reply.NbdError != 0 {
+		return nil, reply.NbdError, nil
+	}
+
+	buf := make([]byte, length)
+	_, err = io.ReadFull(c.conn, buf)
+	return buf, 0, err
+}
+
+func (c *testClient) mustRequest(t *testing.T, command uint16, flags uint16, offset uint64,
+	length uint32, data []byte) []byte {
+	buf, nbdError, err := c.request(command, flags, offset, length, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nbdError != 0 {
+		t.Fatalf("request %d at %d failed with NBD error %d", command, offset, nbdError)
+	}
+	return buf
+}
+
+func (c *testClient) close() {
+	c.request(nbdCmdDisc, 0, 0, 0, nil)
+	c.conn.Close()
+}
+
+func integrationDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "nbd-integration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// randomWorkload writes blocks of random data at random offsets, in the
+// manner of fio's randwrite, and records them in shadow.
+func randomWorkload(t *testing.T, client *testClient, rng *rand.Rand, shadow []byte, writes int) {
+	blocks := len(shadow) / integrationBlockSize
+	for i := 0; i < writes; i++ {
+		count := 1 + rng.Intn(16)
+		block := rng.Intn(blocks - count)
+		offset := block * integrationBlockSize
+		data := make([]byte, count*integrationBlockSize)
+		rng.Read(data)
+
+		client.mustRequest(t, nbdCmdWrite, 0, uint64(offset), uint32(len(data)), data)
+		copy(shadow[offset:], data)
+	}
+}
+
+func verifyShadow(t *testing.T, client *testClient, shadow []byte) {
+	const chunk = 1024 * 1024
+	for offset := 0; offset < len(shadow); offset += chunk {
+		buf := client.mustRequest(t, nbdCmdRead, 0, uint64(offset), chunk, nil)
+		if !bytes.Equal(shadow[offset:offset+chunk], buf) {
+			t.Fatalf("data at %d-%d does not match what was written", offset, offset+chunk)
+		}
+	}
+}
+
+func TestIntegrationWorkload(t *testing.T) {
+	dir := integrationDir(t)
+	defer os.RemoveAll(dir)
+	server := startTestServer(t, dir)
+	defer server.kill()
+
+	client := dialTestClient(t, server.socketPath)
+	defer client.close()
+	assert.Equal(t, uint64(integrationSize), client.size)
+	assert.True(t, client.flags&nbdFlagSendFlush != 0)
+	assert.True(t, client.flags&nbdFlagSendTrim != 0)
+	assert.True(t, client.flags&nbdFlagSendWriteZeroes != 0)
+
+	rng := rand.New(rand.NewSource(1))
+	shadow := make([]byte, integrationSize)
+	randomWorkload(t, client, rng, shadow, 2000)
+	client.mustRequest(t, nbdCmdFlush, 0, 0, 0, nil)
+	verifyShadow(t, client, shadow)
+
+	// zeroes read back as zeroes whether or not they may be punched out
+	client.mustRequest(t, nbdCmdWriteZeroes, 0, 0, 1024*1024, nil)
+	client.mustRequest(t, nbdCmdWriteZeroes, nbdCmdFlagNoHole, 2*1024*1024, 1024*1024, nil)
+	copy(shadow[0:], make([]byte, 1024*1024))
+	copy(shadow[2*1024*1024:], make([]byte, 1024*1024))
+	verifyShadow(t, client, shadow)
+
+	_, nbdError, err := client.request(nbdCmdWrite, 0, integrationSize, integrationBlockSize,
+		make([]byte, integrationBlockSize))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(nbdENOSPC), nbdError)
+}
+
+func TestIntegrationRecovery(t *testing.T) {
+	dir := integrationDir(t)
+	defer os.RemoveAll(dir)
+	rng := rand.New(rand.NewSource(2))
+	shadow := make([]byte, integrationSize)
+
+	for round := 0; round < 3; round++ {
+		server := startTestServer(t, dir)
+		client := dialTestClient(t, server.socketPath)
+		verifyShadow(t, client, shadow)
+
+		randomWorkload(t, client, rng, shadow, 500)
+		client.mustRequest(t, nbdCmdFlush, 0, 0, 0, nil)
+
+		// the server is killed with a write in flight, which may or may
+		// not make it; either way, the flushed data has to survive and
+		// the server has to come back on the same socket
+		offset := uint64(rng.Intn(integrationSize/integrationBlockSize)) * integrationBlockSize
+		data := make([]byte, integrationBlockSize)
+		rng.Read(data)
+		err := binary.Write(client.conn, binary.BigEndian, nbdRequest{
+			NbdRequestMagic: nbdRequestMagic,
+			NbdCommandType:  nbdCmdWrite,
+			NbdHandle:       1 << 32,
+			NbdOffset:       offset,
+			NbdLength:       integrationBlockSize,
+		})
+		assert.Nil(t, err)
+		client.conn.Write(data)
+		server.kill()
+		client.conn.Close()
+
+		server = startTestServer(t, dir)
+		client = dialTestClient(t, server.socketPath)
+		buf := client.mustRequest(t, nbdCmdRead, 0, offset, integrationBlockSize, nil)
+		if !bytes.Equal(buf, shadow[offset:offset+integrationBlockSize]) {
+			assert.Equal(t, data, buf, "write in flight left a torn block")
+			copy(shadow[offset:], data)
+		}
+		verifyShadow(t, client, shadow)
+		client.close()
+		server.kill()
+	}
+}
+
+// run runs a command, failing the test with its output if it fails.
+func run(t *testing.T, name string, args ...string) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %s: %s\n%s", name, strings.Join(args, " "), err, output)
+	}
+}
+
+func TestIntegrationKernel(t *testing.T) {
+	device := os.Getenv(integrationDeviceEnv)
+	if device == "" {
+		t.Skip("set " + integrationDeviceEnv + " (e.g. /dev/nbd0) to attach the kernel NBD client")
+	}
+	for _, tool := range []string{"nbd-client", "mkfs.ext4", "fsck.ext4", "mount", "umount"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(err)
+		}
+	}
+
+	dir := integrationDir(t)
+	defer os.RemoveAll(dir)
+	mountPoint := filepath.Join(dir, "mnt")
+	err := os.Mkdir(mountPoint, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := startTestServer(t, dir)
+	dialTestClient(t, server.socketPath).close()
+	run(t, "nbd-client", "-b", "4096", "-u", server.socketPath, device)
+	run(t, "mkfs.ext4", "-q", device)
+	run(t, "mount", device, mountPoint)
+
+	rng := rand.New(rand.NewSource(3))
+	files := make(map[string][]byte)
+	for i := 0; i < 32; i++ {
+		name := filepath.Join(mountPoint, fmt.Sprintf("file%d", i))
+		data := make([]byte, 1+rng.Intn(1024*1024))
+		rng.Read(data)
+		err = ioutil.WriteFile(name, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = data
+	}
+	syscall.Sync()
+
+	// kill the server underneath the mounted filesystem
+	server.kill()
+	exec.Command("umount", "-l", mountPoint).Run()
+	exec.Command("nbd-client", "-d", device).Run()
+
+	server = startTestServer(t, dir)
+	defer server.kill()
+	dialTestClient(t, server.socketPath).close()
+	run(t, "nbd-client", "-b", "4096", "-u", server.socketPath, device)
+	defer exec.Command("nbd-client", "-d", device).Run()
+
+	// 0 is clean and 1 is corrected, e.g. by replaying the journal
+	err = exec.Command("fsck.ext4", "-f", "-y", device).Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 1 {
+		t.Fatalf("fsck.ext4 found uncorrectable errors: %s", err)
+	} else if err != nil && !ok {
+		t.Fatal(err)
+	}
+
+	run(t, "mount", device, mountPoint)
+	defer exec.Command("umount", mountPoint).Run()
+	for name, data := range files {
+		contents, err := ioutil.ReadFile(name)
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(data, contents), name)
+	}
+}
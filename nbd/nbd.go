@@ -1,19 +1,84 @@
 package nbd
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"syscall"
 	"time"
+
+	"github.com/javgh/sia-nbdserver/blockdev"
+	"github.com/javgh/sia-nbdserver/notify"
+	"github.com/javgh/sia-nbdserver/tracing"
 )
 
 type (
+	// Backend is the device being served. Available turns false once it
+	// shuts down, which stops the server.
 	Backend interface {
+		blockdev.Device
 		Available() bool
-		ReadAt(buf []byte, offset int64) (int, error)
-		WriteAt(buf []byte, offset int64) (int, error)
+	}
+
+	ServerSettings struct {
+		SocketPath string
+		ExportSize uint64
+
+		// ListenAddress makes the server listen on TCP at this host
+		// and port instead of on the unix socket.
+		ListenAddress string
+
+		// ExportDescription is shown to clients listing the exports
+		// (e.g. with nbd-client -l or nbdinfo --list); may be empty.
+		ExportDescription string
+
+		// Access maps export names to the clients that may use them.
+		// If empty, every client may use every export.
+		Access map[string][]AccessRule
+		// ReadOnly serves every export read-only to every client,
+		// whatever the access rules say.
+		ReadOnly bool
+
+		// TLSConfig enables NBD_OPT_STARTTLS, which TCP clients are
+		// then required to use; may be nil.
+		TLSConfig *tls.Config
+
+		// MaxRequestSize is advertised to clients that ask for block
+		// size constraints; larger requests are rejected with EINVAL
+		// (0 = 256 MiB).
+		MaxRequestSize uint32
+
+		// HandshakeTimeout bounds how long a client may take to pick
+		// an export, as clients are served one at a time and one that
+		// goes quiet would keep the others out (0 = 30 seconds).
+		HandshakeTimeout time.Duration
+
+		// Notifier receives events about clients attaching and
+		// detaching; may be nil.
+		Notifier *notify.Notifier
+
+		// Connections counts the requests of each client; may be nil.
+		Connections *Connections
+		// ClientRateLimit limits the bytes read and written per second by
+		// each client (0 = unlimited).
+		ClientRateLimit uint64
+
+		// Listening is called once the socket is listening, before any
+		// client is accepted (e.g. to drop privileges); may be nil. An
+		// error stops the server.
+		Listening func() error
+	}
+
+	deadlineListener interface {
+		net.Listener
+		SetDeadline(t time.Time) error
 	}
 
 	nbdNewStyleHeader struct {
@@ -43,6 +108,13 @@ type (
 		NbdTransmissionFlags uint16
 	}
 
+	nbdRepInfoBlockSizePayload struct {
+		NbdRepInfoType        uint16
+		NbdMinimumBlockSize   uint32
+		NbdPreferredBlockSize uint32
+		NbdMaximumBlockSize   uint32
+	}
+
 	nbdRequest struct {
 		NbdRequestMagic uint32
 		NbdCommandFlags uint16
@@ -70,38 +142,84 @@ const (
 
 	nbdFlagCFixedNewstyle = 1 << 0
 
-	nbdOptAbort = 2
-	nbdOptList  = 3
-	nbdOptGo    = 7
+	nbdOptAbort    = 2
+	nbdOptList     = 3
+	nbdOptStartTLS = 5
+	nbdOptGo       = 7
+
+	nbdRepAck        = 1
+	nbdRepServer     = 2
+	nbdRepInfo       = 3
+	nbdRepErrUnsup   = 1<<31 + 1
+	nbdRepErrPolicy  = 1<<31 + 2
+	nbdRepErrInvalid = 1<<31 + 3
+	nbdRepErrTLSReqd = 1<<31 + 5
+	nbdRepErrUnknown = 1<<31 + 6
+
+	nbdInfoExport    = 0
+	nbdInfoBlockSize = 3
+
+	nbdFlagHasFlags        = 1 << 0
+	nbdFlagReadOnly        = 1 << 1
+	nbdFlagSendFlush       = 1 << 2
+	nbdFlagSendTrim        = 1 << 5
+	nbdFlagSendWriteZeroes = 1 << 6
+
+	nbdCmdRead        = 0
+	nbdCmdWrite       = 1
+	nbdCmdDisc        = 2
+	nbdCmdFlush       = 3
+	nbdCmdTrim        = 4
+	nbdCmdWriteZeroes = 6
+
+	nbdCmdFlagNoHole = 1 << 1
+
+	nbdEPERM     = 1
+	nbdEIO       = 5
+	nbdENOMEM    = 12
+	nbdEINVAL    = 22
+	nbdENOSPC    = 28
+	nbdESHUTDOWN = 108
+
+	nbdRequestLength     = 28
+	nbdSimpleReplyLength = 16
 
-	nbdRepAck      = 1
-	nbdRepServer   = 2
-	nbdRepInfo     = 3
-	nbdRepErrUnsup = 1<<31 + 1
+	maxOptionLength  = 65536
+	maxRequestLength = 268435456
 
-	nbdInfoExport = 0
+	minimumBlockSize   = 1
+	preferredBlockSize = 4096
 
-	nbdFlagHasFlags = 1 << 0
+	interruptInterval       = 2 * time.Second
+	defaultHandshakeTimeout = 30 * time.Second
+)
 
-	nbdCmdRead  = 0
-	nbdCmdWrite = 1
-	nbdCmdDisc  = 2
+// ExportName is the name of the only export, which clients also get if they
+// do not ask for one by name.
+const ExportName = "sia"
 
-	maxOptionLength  = 65536
-	maxRequestLength = 268435456
+func handle(conn net.Conn, settings ServerSettings, backend Backend) error {
+	maxRequestSize := settings.MaxRequestSize
+	if maxRequestSize == 0 || maxRequestSize > maxRequestLength {
+		maxRequestSize = maxRequestLength
+	}
+	handshakeTimeout := settings.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = defaultHandshakeTimeout
+	}
 
-	exportName        = "sia"
-	interruptInterval = 2 * time.Second
-)
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return err
+	}
 
-func handle(conn net.Conn, exportSize uint64, backend Backend) error {
 	newStyleHeader := nbdNewStyleHeader{
 		NbdMagic:          nbdMagic,
 		NbdOptionMagic:    nbdOptionMagic,
 		NbdHandshakeFlags: nbdFlagFixedNewstyle,
 	}
 
-	err := binary.Write(conn, binary.BigEndian, newStyleHeader)
+	err = binary.Write(conn, binary.BigEndian, newStyleHeader)
 	if err != nil {
 		return err
 	}
@@ -124,6 +242,8 @@ func handle(conn net.Conn, exportSize uint64, backend Backend) error {
 		return errors.New("unexpected client flags")
 	}
 
+	identity := ""
+	readOnly := false
 	handshakeOngoing := true
 	for handshakeOngoing {
 		var clientOption nbdClientOption
@@ -148,36 +268,66 @@ func handle(conn net.Conn, exportSize uint64, backend Backend) error {
 			}
 		}
 
-		switch clientOption.NbdOptionID {
-		case nbdOptList:
-			optionReply := nbdOptionReply{
-				NbdOptionReplyMagic:  nbdOptionReplyMagic,
-				NbdOptionID:          clientOption.NbdOptionID,
-				NbdOptionReplyType:   nbdRepServer,
-				NbdOptionReplyLength: uint32(4 /* length of export name as uint32 */ + len(exportName)),
-			}
-			err = binary.Write(conn, binary.BigEndian, optionReply)
+		_, usingTLS := conn.(*tls.Conn)
+		if !usingTLS && settings.requiresTLS(conn.RemoteAddr()) &&
+			clientOption.NbdOptionID != nbdOptStartTLS && clientOption.NbdOptionID != nbdOptAbort {
+			err = sendOptionReply(conn, clientOption.NbdOptionID, nbdRepErrTLSReqd)
 			if err != nil {
 				return err
 			}
+			continue
+		}
+
+		switch clientOption.NbdOptionID {
+		case nbdOptStartTLS:
+			if settings.TLSConfig == nil {
+				err = sendOptionReply(conn, clientOption.NbdOptionID, nbdRepErrUnsup)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if usingTLS || len(optionData) > 0 {
+				err = sendOptionReply(conn, clientOption.NbdOptionID, nbdRepErrInvalid)
+				if err != nil {
+					return err
+				}
+				continue
+			}
 
-			err = binary.Write(conn, binary.BigEndian, uint32(len(exportName)))
+			err = sendOptionReply(conn, clientOption.NbdOptionID, nbdRepAck)
 			if err != nil {
 				return err
 			}
 
-			err = binary.Write(conn, binary.BigEndian, []byte(exportName))
+			tlsConn := tls.Server(conn, settings.TLSConfig)
+			err = tlsConn.Handshake()
 			if err != nil {
 				return err
 			}
+			conn = tlsConn
+			identity = peerIdentity(conn)
+			if identity != "" {
+				log.Printf("Client authenticated as %s\n", identity)
+			}
+		case nbdOptList:
+			if len(optionData) > 0 {
+				err = sendOptionReply(conn, clientOption.NbdOptionID, nbdRepErrInvalid)
+				if err != nil {
+					return err
+				}
+				continue
+			}
 
-			optionReply = nbdOptionReply{
-				NbdOptionReplyMagic:  nbdOptionReplyMagic,
-				NbdOptionID:          clientOption.NbdOptionID,
-				NbdOptionReplyType:   nbdRepAck,
-				NbdOptionReplyLength: 0,
+			// clients that may not use the export do not get to see it
+			if allowed, _ := settings.exportAccess(conn.RemoteAddr(), identity, ExportName); allowed {
+				err = sendExport(conn, clientOption.NbdOptionID, ExportName, settings.ExportDescription)
+				if err != nil {
+					return err
+				}
 			}
-			err = binary.Write(conn, binary.BigEndian, optionReply)
+
+			err = sendOptionReply(conn, clientOption.NbdOptionID, nbdRepAck)
 			if err != nil {
 				return err
 			}
@@ -194,10 +344,25 @@ func handle(conn net.Conn, exportSize uint64, backend Backend) error {
 			}
 			return nil
 		case nbdOptGo:
-			// We won't process the option data that the client
-			// sent along. The export name doesn't matter and
-			// dealing with any information requests the client may have
-			// is not implemented.
+			name, ok := requestedExport(optionData)
+			if !ok || name != ExportName {
+				err = sendOptionReply(conn, clientOption.NbdOptionID, nbdRepErrUnknown)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			var allowed bool
+			allowed, readOnly = settings.exportAccess(conn.RemoteAddr(), identity, name)
+			if !allowed {
+				log.Printf("Refusing export %s to %s (identity %q)\n", name, conn.RemoteAddr(), identity)
+				err = sendOptionReply(conn, clientOption.NbdOptionID, nbdRepErrPolicy)
+				if err != nil {
+					return err
+				}
+				continue
+			}
 
 			// send NBD_INFO_EXPORT
 			optionReply := nbdOptionReply{
@@ -211,16 +376,47 @@ func handle(conn net.Conn, exportSize uint64, backend Backend) error {
 				return err
 			}
 
+			var transmissionFlags uint16 = nbdFlagHasFlags | nbdFlagSendFlush |
+				nbdFlagSendTrim | nbdFlagSendWriteZeroes
+			if readOnly {
+				transmissionFlags |= nbdFlagReadOnly
+			}
+
 			infoPayload := nbdRepInfoPayload{
 				NbdRepInfoType:       nbdInfoExport,
-				NbdExportSize:        exportSize,
-				NbdTransmissionFlags: nbdFlagHasFlags,
+				NbdExportSize:        settings.ExportSize,
+				NbdTransmissionFlags: transmissionFlags,
 			}
 			err = binary.Write(conn, binary.BigEndian, infoPayload)
 			if err != nil {
 				return err
 			}
 
+			if requestsInfo(optionData, nbdInfoBlockSize) {
+				// send NBD_INFO_BLOCK_SIZE
+				optionReply = nbdOptionReply{
+					NbdOptionReplyMagic:  nbdOptionReplyMagic,
+					NbdOptionID:          clientOption.NbdOptionID,
+					NbdOptionReplyType:   nbdRepInfo,
+					NbdOptionReplyLength: 14, // size of nbdRepInfoBlockSizePayload struct
+				}
+				err = binary.Write(conn, binary.BigEndian, optionReply)
+				if err != nil {
+					return err
+				}
+
+				blockSizePayload := nbdRepInfoBlockSizePayload{
+					NbdRepInfoType:        nbdInfoBlockSize,
+					NbdMinimumBlockSize:   minimumBlockSize,
+					NbdPreferredBlockSize: preferredBlockSize,
+					NbdMaximumBlockSize:   maxRequestSize,
+				}
+				err = binary.Write(conn, binary.BigEndian, blockSizePayload)
+				if err != nil {
+					return err
+				}
+			}
+
 			// send NBD_REP_ACK
 			optionReply = nbdOptionReply{
 				NbdOptionReplyMagic:  nbdOptionReplyMagic,
@@ -233,7 +429,12 @@ func handle(conn net.Conn, exportSize uint64, backend Backend) error {
 				return err
 			}
 
-			// entering transmission phase now
+			// entering transmission phase now, where a client may
+			// well be idle for a long time
+			err = conn.SetDeadline(time.Time{})
+			if err != nil {
+				return err
+			}
 			handshakeOngoing = false
 		default:
 			// reply with 'not supported' for everything else
@@ -250,11 +451,19 @@ func handle(conn net.Conn, exportSize uint64, backend Backend) error {
 		}
 	}
 
-	buf := make([]byte, 0)
+	// Replies to reads are assembled in place: the reply header goes in
+	// front of the data and the backend reads directly behind it, so that
+	// the data is neither copied nor written to the socket separately.
+	client := settings.Connections.open(conn.RemoteAddr().String(), identity, readOnly,
+		settings.ClientRateLimit)
+	defer client.close()
+
+	buf := make([]byte, nbdSimpleReplyLength)
+	requestHeader := make([]byte, nbdRequestLength)
+	replyHeader := make([]byte, nbdSimpleReplyLength)
 	transmissionOngoing := true
 	for transmissionOngoing {
-		var request nbdRequest
-		err = binary.Read(conn, binary.BigEndian, &request)
+		request, err := readRequest(conn, requestHeader)
 		if err != nil {
 			return err
 		}
@@ -263,58 +472,142 @@ func handle(conn net.Conn, exportSize uint64, backend Backend) error {
 			return errors.New("did not receive request magic")
 		}
 
-		if request.NbdLength > maxRequestLength {
-			return errors.New("request is too large")
+		if request.NbdLength > maxRequestSize &&
+			(request.NbdCommandType == nbdCmdRead || request.NbdCommandType == nbdCmdWrite) {
+			log.Printf("Rejecting request of %d bytes\n", request.NbdLength)
+			err = rejectRequest(conn, request, replyHeader, nbdEINVAL)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !withinExport(request, settings.ExportSize) {
+			// reads fail with EINVAL, writes as if the device were full
+			log.Printf("Rejecting request of %d bytes at %d beyond the end\n",
+				request.NbdLength, request.NbdOffset)
+			nbdError := uint32(nbdENOSPC)
+			if request.NbdCommandType == nbdCmdRead {
+				nbdError = nbdEINVAL
+			}
+			err = rejectRequest(conn, request, replyHeader, nbdError)
+			if err != nil {
+				return err
+			}
+			continue
 		}
 
-		if int(request.NbdLength) > cap(buf) {
+		// trims and zeroes carry no data, however long their range
+		dataLength := int(request.NbdLength)
+		if request.NbdCommandType != nbdCmdRead && request.NbdCommandType != nbdCmdWrite {
+			dataLength = 0
+		}
+		if nbdSimpleReplyLength+dataLength > cap(buf) {
 			// increase buffer capacity as needed
-			buf = make([]byte, request.NbdLength)
+			buf = make([]byte, nbdSimpleReplyLength+dataLength)
 		}
-		buf = buf[0:request.NbdLength]
+		buf = buf[0 : nbdSimpleReplyLength+dataLength]
+		data := buf[nbdSimpleReplyLength:]
 
 		switch request.NbdCommandType {
 		case nbdCmdRead:
-			_, err := backend.ReadAt(buf, int64(request.NbdOffset))
+			client.throttle(request.NbdLength)
+			ctx, span := startRequestSpan("nbd.read", request)
+			_, err := backend.ReadAt(ctx, data, int64(request.NbdOffset))
+			span.SetError(err)
+			span.End()
+			client.record(readRequestKind, request.NbdLength, err)
 			if err != nil {
-				// Taking some liberty with error handling
-				// and just disconnecting here.
-				return err
+				// an error reply carries no data
+				log.Printf("Read failed: %s\n", err)
+				err = replyError(conn, replyHeader, err, request.NbdHandle)
+				if err != nil {
+					return err
+				}
+				continue
 			}
 
-			reply := nbdSimpleReply{
-				NbdSimpleReplyMagic: nbdSimpleReplyMagic,
-				NbdError:            0,
-				NbdHandle:           request.NbdHandle,
+			putSimpleReply(buf, 0, request.NbdHandle)
+			_, err = conn.Write(buf)
+			if err != nil {
+				return err
 			}
-			err = binary.Write(conn, binary.BigEndian, reply)
+		case nbdCmdWrite:
+			_, err = io.ReadFull(conn, data)
 			if err != nil {
 				return err
 			}
 
-			err = binary.Write(conn, binary.BigEndian, buf)
+			if readOnly {
+				client.record(writeRequestKind, request.NbdLength, errReadOnly)
+				putSimpleReply(replyHeader, nbdEPERM, request.NbdHandle)
+				_, err = conn.Write(replyHeader)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			client.throttle(request.NbdLength)
+			ctx, span := startRequestSpan("nbd.write", request)
+			_, err := backend.WriteAt(ctx, data, int64(request.NbdOffset))
+			span.SetError(err)
+			span.End()
+			client.record(writeRequestKind, request.NbdLength, err)
 			if err != nil {
-				return err
+				// Let the client see e.g. a full device
+				// instead of a disconnect.
+				log.Printf("Write failed: %s\n", err)
 			}
-		case nbdCmdWrite:
-			_, err = io.ReadFull(conn, buf)
+
+			err = replyError(conn, replyHeader, err, request.NbdHandle)
 			if err != nil {
 				return err
 			}
+		case nbdCmdFlush:
+			ctx, span := startRequestSpan("nbd.flush", request)
+			err := backend.Flush(ctx)
+			span.SetError(err)
+			span.End()
+			client.record(flushRequestKind, 0, err)
+			if err != nil {
+				log.Printf("Flush failed: %s\n", err)
+			}
 
-			_, err := backend.WriteAt(buf, int64(request.NbdOffset))
+			err = replyError(conn, replyHeader, err, request.NbdHandle)
 			if err != nil {
-				// Taking some liberty with error handling
-				// and just disconnecting here.
 				return err
 			}
+		case nbdCmdTrim, nbdCmdWriteZeroes:
+			if readOnly {
+				client.record(writeRequestKind, 0, errReadOnly)
+				putSimpleReply(replyHeader, nbdEPERM, request.NbdHandle)
+				_, err = conn.Write(replyHeader)
+				if err != nil {
+					return err
+				}
+				continue
+			}
 
-			reply := nbdSimpleReply{
-				NbdSimpleReplyMagic: nbdSimpleReplyMagic,
-				NbdError:            0,
-				NbdHandle:           request.NbdHandle,
+			var err error
+			if request.NbdCommandType == nbdCmdTrim {
+				ctx, span := startRequestSpan("nbd.trim", request)
+				err = backend.Trim(ctx, int64(request.NbdOffset), int64(request.NbdLength))
+				span.SetError(err)
+				span.End()
+			} else {
+				ctx, span := startRequestSpan("nbd.write_zeroes", request)
+				err = backend.WriteZeroes(ctx, int64(request.NbdOffset), int64(request.NbdLength),
+					request.NbdCommandFlags&nbdCmdFlagNoHole == 0)
+				span.SetError(err)
+				span.End()
 			}
-			err = binary.Write(conn, binary.BigEndian, reply)
+			client.record(writeRequestKind, 0, err)
+			if err != nil {
+				log.Printf("Trim or write zeroes failed: %s\n", err)
+			}
+
+			err = replyError(conn, replyHeader, err, request.NbdHandle)
 			if err != nil {
 				return err
 			}
@@ -326,19 +619,205 @@ func handle(conn net.Conn, exportSize uint64, backend Backend) error {
 	return nil
 }
 
-func Serve(socketPath string, exportSize uint64, backend Backend) error {
-	unixAddr, err := net.ResolveUnixAddr("unix", socketPath)
+// readRequest reads and decodes a request header into a reusable buffer,
+// which avoids the reflection binary.Read would use for every request.
+func readRequest(r io.Reader, header []byte) (nbdRequest, error) {
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nbdRequest{}, err
+	}
+
+	return nbdRequest{
+		NbdRequestMagic: binary.BigEndian.Uint32(header[0:4]),
+		NbdCommandFlags: binary.BigEndian.Uint16(header[4:6]),
+		NbdCommandType:  binary.BigEndian.Uint16(header[6:8]),
+		NbdHandle:       binary.BigEndian.Uint64(header[8:16]),
+		NbdOffset:       binary.BigEndian.Uint64(header[16:24]),
+		NbdLength:       binary.BigEndian.Uint32(header[24:28]),
+	}, nil
+}
+
+// rejectRequest replies with nbdError to a request without passing it on to
+// the backend, discarding the data of a write.
+func rejectRequest(conn net.Conn, request nbdRequest, replyHeader []byte, nbdError uint32) error {
+	if request.NbdCommandType == nbdCmdWrite {
+		_, err := io.CopyN(ioutil.Discard, conn, int64(request.NbdLength))
+		if err != nil {
+			return err
+		}
+	}
+
+	putSimpleReply(replyHeader, nbdError, request.NbdHandle)
+	_, err := conn.Write(replyHeader)
+	return err
+}
+
+// withinExport reports whether the range of a read, write, trim or zero
+// write lies within an export of the given size. Offsets are unsigned on the
+// wire, so that huge ones would turn negative as an int64.
+func withinExport(request nbdRequest, exportSize uint64) bool {
+	switch request.NbdCommandType {
+	case nbdCmdRead, nbdCmdWrite, nbdCmdTrim, nbdCmdWriteZeroes:
+		return request.NbdOffset <= exportSize && uint64(request.NbdLength) <= exportSize-request.NbdOffset
+	default:
+		return true
+	}
+}
+
+// requestsInfo reports whether the data of an NBD_OPT_GO option (export
+// name followed by a list of information requests) asks for infoType.
+func requestsInfo(optionData []byte, infoType uint16) bool {
+	if len(optionData) < 6 {
+		return false
+	}
+	nameLength := binary.BigEndian.Uint32(optionData[0:4])
+	if nameLength > uint32(len(optionData)-6) {
+		return false
+	}
+
+	requests := optionData[4+nameLength:]
+	count := int(binary.BigEndian.Uint16(requests[0:2]))
+	for i := 0; i < count && 2+2*i+2 <= len(requests); i++ {
+		if binary.BigEndian.Uint16(requests[2+2*i:]) == infoType {
+			return true
+		}
+	}
+	return false
+}
+
+// sendExport answers NBD_OPT_LIST with one export. The description follows
+// the name without a length of its own and may be empty.
+func sendExport(conn net.Conn, optionID uint32, name string, description string) error {
+	reply := make([]byte, 4, 4+len(name)+len(description))
+	binary.BigEndian.PutUint32(reply, uint32(len(name)))
+	reply = append(reply, name...)
+	reply = append(reply, description...)
+
+	err := binary.Write(conn, binary.BigEndian, nbdOptionReply{
+		NbdOptionReplyMagic:  nbdOptionReplyMagic,
+		NbdOptionID:          optionID,
+		NbdOptionReplyType:   nbdRepServer,
+		NbdOptionReplyLength: uint32(len(reply)),
+	})
 	if err != nil {
 		return err
 	}
 
+	_, err = conn.Write(reply)
+	return err
+}
+
+// sendOptionReply sends an option reply without data.
+func sendOptionReply(conn net.Conn, optionID uint32, replyType uint32) error {
+	return binary.Write(conn, binary.BigEndian, nbdOptionReply{
+		NbdOptionReplyMagic:  nbdOptionReplyMagic,
+		NbdOptionID:          optionID,
+		NbdOptionReplyType:   replyType,
+		NbdOptionReplyLength: 0,
+	})
+}
+
+// replyError sends a simple reply without data, with the NBD error value
+// that corresponds to err (which may be nil).
+func replyError(conn net.Conn, replyHeader []byte, err error, handle uint64) error {
+	putSimpleReply(replyHeader, nbdErrorCode(err), handle)
+	_, err = conn.Write(replyHeader)
+	return err
+}
+
+// putSimpleReply encodes a simple reply header into the start of buf.
+func putSimpleReply(buf []byte, nbdError uint32, handle uint64) {
+	binary.BigEndian.PutUint32(buf[0:4], nbdSimpleReplyMagic)
+	binary.BigEndian.PutUint32(buf[4:8], nbdError)
+	binary.BigEndian.PutUint64(buf[8:16], handle)
+}
+
+func startRequestSpan(name string, request nbdRequest) (context.Context, *tracing.Span) {
+	ctx, span := tracing.StartSpan(context.Background(), name)
+	span.SetAttribute("nbd.handle", request.NbdHandle)
+	span.SetAttribute("nbd.offset", request.NbdOffset)
+	span.SetAttribute("nbd.length", request.NbdLength)
+	return ctx, span
+}
+
+// removeStaleSocket removes the socket left behind by a server that was
+// killed, as listening on it would fail otherwise. A socket that a server
+// still accepts clients on is left alone.
+func removeStaleSocket(socketPath string) {
+	fileInfo, err := os.Lstat(socketPath)
+	if err != nil || fileInfo.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		log.Printf("Removing stale socket %s\n", socketPath)
+		err = os.Remove(socketPath)
+		if err != nil {
+			log.Printf("Unable to remove stale socket: %s\n", err)
+		}
+	}
+}
+
+// listen opens the TCP listener if a listen address is given and the unix
+// socket otherwise.
+func listen(settings ServerSettings) (deadlineListener, error) {
+	if settings.ListenAddress != "" {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", settings.ListenAddress)
+		if err != nil {
+			return nil, err
+		}
+		ln, err := net.ListenTCP("tcp", tcpAddr)
+		if err != nil {
+			return nil, err
+		}
+		return ln, nil
+	}
+
+	removeStaleSocket(settings.SocketPath)
+	unixAddr, err := net.ResolveUnixAddr("unix", settings.SocketPath)
+	if err != nil {
+		return nil, err
+	}
 	ln, err := net.ListenUnix("unix", unixAddr)
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+func Serve(settings ServerSettings, backend Backend) error {
+	for name := range settings.Access {
+		if name != ExportName {
+			return fmt.Errorf("unknown export %s (the only export is %s)", name, ExportName)
+		}
+	}
+
+	notifier := settings.Notifier
+	ln, err := listen(settings)
 	if err != nil {
 		return err
 	}
-	log.Printf("Server listens at %s - connect with:\n", socketPath)
+	listenAddress := ln.Addr().String()
+	if settings.Listening != nil {
+		err = settings.Listening()
+		if err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	log.Printf("Server listens at %s - connect with:\n", listenAddress)
 	log.Printf("  # modprobe nbd\n")
-	log.Printf("  # nbd-client -b 4096 -u %s /dev/nbd0\n", socketPath)
+	if tcpAddr, ok := ln.Addr().(*net.TCPAddr); ok {
+		log.Printf("  # nbd-client -b 4096 <host> %d /dev/nbd0\n", tcpAddr.Port)
+	} else {
+		log.Printf("  # nbd-client -b 4096 -u %s /dev/nbd0\n", listenAddress)
+	}
 
 	for backend.Available() {
 		// Wake up from Accept() periodically to
@@ -351,13 +830,23 @@ func Serve(socketPath string, exportSize uint64, backend Backend) error {
 			}
 			return err
 		}
+		if !settings.mayConnect(conn.RemoteAddr()) {
+			log.Printf("Refusing client %s\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
 		log.Printf("Client connected")
+		notifier.Notify(notify.DeviceAttached, "client connected to %s", listenAddress)
 
-		err = handle(conn, exportSize, backend)
+		err = handle(conn, settings, backend)
 		if err != nil {
 			log.Printf("Client disconnected with error: %s", err)
+			notifier.Notify(notify.DeviceDetached, "client disconnected from %s with error: %s",
+				listenAddress, err)
 		} else {
 			log.Printf("Client disconnected")
+			notifier.Notify(notify.DeviceDetached, "client disconnected from %s", listenAddress)
 		}
 
 		err = conn.Close()
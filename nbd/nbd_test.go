@@ -0,0 +1,240 @@
+package nbd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadRequest(t *testing.T) {
+	expected := nbdRequest{
+		NbdRequestMagic: nbdRequestMagic,
+		NbdCommandFlags: 1,
+		NbdCommandType:  nbdCmdWrite,
+		NbdHandle:       0x0102030405060708,
+		NbdOffset:       1 << 40,
+		NbdLength:       4096,
+	}
+
+	var encoded bytes.Buffer
+	err := binary.Write(&encoded, binary.BigEndian, expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, nbdRequestLength, encoded.Len())
+
+	request, err := readRequest(&encoded, make([]byte, nbdRequestLength))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, request)
+}
+
+func TestPutSimpleReply(t *testing.T) {
+	var expected bytes.Buffer
+	err := binary.Write(&expected, binary.BigEndian, nbdSimpleReply{
+		NbdSimpleReplyMagic: nbdSimpleReplyMagic,
+		NbdError:            nbdENOSPC,
+		NbdHandle:           42,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, nbdSimpleReplyLength)
+	putSimpleReply(buf, nbdENOSPC, 42)
+	assert.Equal(t, expected.Bytes(), buf)
+}
+
+func TestNbdErrorCode(t *testing.T) {
+	assert.Equal(t, uint32(0), nbdErrorCode(nil))
+	assert.Equal(t, uint32(nbdENOSPC),
+		nbdErrorCode(fmt.Errorf("budget exhausted: %w", syscall.ENOSPC)))
+	assert.Equal(t, uint32(nbdEPERM), nbdErrorCode(syscall.EROFS))
+	assert.Equal(t, uint32(nbdESHUTDOWN),
+		nbdErrorCode(fmt.Errorf("no longer available: %w", syscall.ESHUTDOWN)))
+	assert.Equal(t, uint32(nbdEIO), nbdErrorCode(errors.New("download failed")))
+}
+
+func TestWithinExport(t *testing.T) {
+	size := uint64(1 << 20)
+	assert.True(t, withinExport(nbdRequest{NbdCommandType: nbdCmdRead, NbdOffset: 0, NbdLength: 1 << 20}, size))
+	assert.True(t, withinExport(nbdRequest{NbdCommandType: nbdCmdWrite, NbdOffset: 1 << 20, NbdLength: 0}, size))
+	assert.False(t, withinExport(nbdRequest{NbdCommandType: nbdCmdWrite, NbdOffset: 1<<20 - 1, NbdLength: 2}, size))
+	assert.False(t, withinExport(nbdRequest{NbdCommandType: nbdCmdTrim, NbdOffset: 1<<64 - 1, NbdLength: 2}, size),
+		"expected wrap-around to be caught")
+	assert.False(t, withinExport(nbdRequest{NbdCommandType: nbdCmdRead, NbdOffset: 1 << 63, NbdLength: 1}, size),
+		"expected offsets that are negative as int64 to be caught")
+	assert.True(t, withinExport(nbdRequest{NbdCommandType: nbdCmdFlush, NbdOffset: 1 << 63}, size))
+}
+
+func TestSendExport(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		sendExport(server, nbdOptList, "sia", "backup")
+		server.Close()
+	}()
+
+	var reply nbdOptionReply
+	err := binary.Read(client, binary.BigEndian, &reply)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(nbdRepServer), reply.NbdOptionReplyType)
+	assert.Equal(t, uint32(4+3+6), reply.NbdOptionReplyLength)
+
+	data := make([]byte, reply.NbdOptionReplyLength)
+	_, err = io.ReadFull(client, data)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), binary.BigEndian.Uint32(data))
+	assert.Equal(t, "siabackup", string(data[4:]))
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan error)
+	go func() {
+		done <- handle(server, ServerSettings{HandshakeTimeout: 50 * time.Millisecond}, nil)
+	}()
+
+	// read the greeting, but never answer it
+	var header nbdNewStyleHeader
+	err := binary.Read(client, binary.BigEndian, &header)
+	assert.Nil(t, err)
+
+	select {
+	case err = <-done:
+		var netErr net.Error
+		assert.True(t, errors.As(err, &netErr) && netErr.Timeout(), "expected a timeout, got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a quiet client to be dropped")
+	}
+}
+
+func TestRequestsInfo(t *testing.T) {
+	optionData := func(name string, infoTypes ...uint16) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, uint32(len(name)))
+		buf.WriteString(name)
+		binary.Write(&buf, binary.BigEndian, uint16(len(infoTypes)))
+		for _, infoType := range infoTypes {
+			binary.Write(&buf, binary.BigEndian, infoType)
+		}
+		return buf.Bytes()
+	}
+
+	assert.True(t, requestsInfo(optionData("sia", nbdInfoExport, nbdInfoBlockSize), nbdInfoBlockSize))
+	assert.False(t, requestsInfo(optionData("sia", nbdInfoExport), nbdInfoBlockSize))
+	assert.False(t, requestsInfo(optionData(""), nbdInfoBlockSize))
+	assert.False(t, requestsInfo([]byte{0, 0, 0, 9, 's'}, nbdInfoBlockSize), "expected truncated data to be ignored")
+}
+
+func TestExportAccess(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, host, _ := net.ParseCIDR("192.168.1.5/32")
+	settings := ServerSettings{
+		Access: map[string][]AccessRule{
+			ExportName: {
+				{Network: host, ReadOnly: true},
+				{Network: lan},
+			},
+		},
+	}
+	client := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+	}
+
+	allowed, readOnly := settings.exportAccess(client("192.168.1.5"), "", ExportName)
+	assert.True(t, allowed)
+	assert.True(t, readOnly, "expected first matching rule to apply")
+
+	allowed, readOnly = settings.exportAccess(client("192.168.1.6"), "", ExportName)
+	assert.True(t, allowed)
+	assert.False(t, readOnly)
+
+	allowed, _ = settings.exportAccess(client("10.0.0.1"), "", ExportName)
+	assert.False(t, allowed)
+	assert.False(t, settings.mayConnect(client("10.0.0.1")))
+	assert.True(t, settings.mayConnect(client("192.168.1.6")))
+
+	allowed, readOnly = settings.exportAccess(&net.UnixAddr{Name: "@", Net: "unix"}, "", ExportName)
+	assert.True(t, allowed, "expected unix socket clients to be left to file permissions")
+	assert.False(t, readOnly)
+
+	allowed, _ = ServerSettings{}.exportAccess(client("10.0.0.1"), "", ExportName)
+	assert.True(t, allowed, "expected everyone to be allowed without rules")
+
+	settings.ReadOnly = true
+	allowed, readOnly = settings.exportAccess(client("192.168.1.6"), "", ExportName)
+	assert.True(t, allowed)
+	assert.True(t, readOnly, "expected a read-only server to override the rules")
+	_, readOnly = ServerSettings{ReadOnly: true}.exportAccess(&net.UnixAddr{Name: "@", Net: "unix"}, "", ExportName)
+	assert.True(t, readOnly)
+}
+
+func TestExportAccessIdentity(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	settings := ServerSettings{
+		Access: map[string][]AccessRule{
+			ExportName: {
+				{Identity: "backup", ReadOnly: true},
+				{Network: lan, Identity: "desktop"},
+			},
+		},
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.6"), Port: 40000}
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+
+	allowed, readOnly := settings.exportAccess(remote, "backup", ExportName)
+	assert.True(t, allowed, "expected identity without network to match from anywhere")
+	assert.True(t, readOnly)
+
+	allowed, readOnly = settings.exportAccess(client, "desktop", ExportName)
+	assert.True(t, allowed)
+	assert.False(t, readOnly)
+
+	allowed, _ = settings.exportAccess(remote, "desktop", ExportName)
+	assert.False(t, allowed, "expected network to still apply")
+
+	allowed, _ = settings.exportAccess(client, "", ExportName)
+	assert.False(t, allowed, "expected unauthenticated client to be refused")
+
+	assert.True(t, settings.mayConnect(remote), "expected connect before authentication")
+	assert.False(t, settings.requiresTLS(client))
+	settings.TLSConfig = &tls.Config{}
+	assert.True(t, settings.requiresTLS(client))
+	assert.False(t, settings.requiresTLS(&net.UnixAddr{Name: "@", Net: "unix"}))
+}
+
+func TestRequestedExport(t *testing.T) {
+	optionData := func(name string) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, uint32(len(name)))
+		buf.WriteString(name)
+		binary.Write(&buf, binary.BigEndian, uint16(0))
+		return buf.Bytes()
+	}
+
+	name, ok := requestedExport(optionData("other"))
+	assert.True(t, ok)
+	assert.Equal(t, "other", name)
+
+	name, ok = requestedExport(optionData(""))
+	assert.True(t, ok)
+	assert.Equal(t, ExportName, name, "expected empty name to select the default export")
+
+	_, ok = requestedExport([]byte{0, 0, 0, 9, 's'})
+	assert.False(t, ok)
+
+	// a length that is negative as an int32
+	_, ok = requestedExport([]byte{0xff, 0xff, 0xff, 0xff, 0, 0})
+	assert.False(t, ok)
+	assert.False(t, requestsInfo([]byte{0xff, 0xff, 0xff, 0xff, 0, 1, 0, 3}, nbdInfoBlockSize))
+}
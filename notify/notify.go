@@ -0,0 +1,160 @@
+// Package notify delivers notifications about significant events (failing
+// uploads, degraded redundancy, a nearly full or filling cache, clients attaching
+// or detaching) to a webhook and/or a local script, so that alerting does not
+// require scraping the log.
+//
+// A nil *Notifier is valid and discards all events.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+type (
+	EventType string
+
+	Event struct {
+		Type    EventType `json:"type"`
+		Time    time.Time `json:"time"`
+		Message string    `json:"message"`
+	}
+
+	Notifier struct {
+		webhookURLs []string
+		scriptPath  string
+		client      *http.Client
+		events      chan Event
+	}
+)
+
+const (
+	UploadFailed       EventType = "upload_failed"
+	RedundancyDegraded EventType = "redundancy_degraded"
+	CacheDiskFull      EventType = "cache_disk_full"
+	CacheGrowing       EventType = "cache_growing"
+	CacheFileDamaged   EventType = "cache_file_damaged"
+	ScrubFailed        EventType = "scrub_failed"
+	ContractsExpiring  EventType = "contracts_expiring"
+	DeviceAttached     EventType = "device_attached"
+	DeviceDetached     EventType = "device_detached"
+	WritesPaused       EventType = "writes_paused"
+	WritesResumed      EventType = "writes_resumed"
+	EpochRecorded      EventType = "epoch_recorded"
+
+	maxQueuedEvents = 64
+	deliveryTimeout = 10 * time.Second
+)
+
+// New returns a notifier that POSTs every event as JSON to webhookURL and
+// runs the script at scriptPath with the event in the environment variables
+// SIA_NBDSERVER_EVENT and SIA_NBDSERVER_MESSAGE and as JSON on stdin. Either
+// may be empty. If both are empty, New returns nil.
+func New(webhookURL string, scriptPath string) *Notifier {
+	webhookURLs := []string{}
+	if webhookURL != "" {
+		webhookURLs = append(webhookURLs, webhookURL)
+	}
+	return newNotifier(webhookURLs, scriptPath)
+}
+
+// NewWebhooks returns a notifier that POSTs every event as JSON to each of
+// webhookURLs. If there are none, it returns nil.
+func NewWebhooks(webhookURLs []string) *Notifier {
+	return newNotifier(webhookURLs, "")
+}
+
+func newNotifier(webhookURLs []string, scriptPath string) *Notifier {
+	if len(webhookURLs) == 0 && scriptPath == "" {
+		return nil
+	}
+
+	n := &Notifier{
+		webhookURLs: webhookURLs,
+		scriptPath:  scriptPath,
+		client:      &http.Client{Timeout: deliveryTimeout},
+		events:      make(chan Event, maxQueuedEvents),
+	}
+	go n.run()
+	return n
+}
+
+// Notify queues an event for delivery. It never blocks; if the queue is
+// full, the event is dropped and logged.
+func (n *Notifier) Notify(eventType EventType, format string, v ...interface{}) {
+	if n == nil {
+		return
+	}
+
+	event := Event{
+		Type:    eventType,
+		Time:    time.Now(),
+		Message: fmt.Sprintf(format, v...),
+	}
+
+	select {
+	case n.events <- event:
+	default:
+		log.Printf("Dropping %s notification: too many pending notifications\n", eventType)
+	}
+}
+
+func (n *Notifier) run() {
+	for event := range n.events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Unable to encode %s notification: %s\n", event.Type, err)
+			continue
+		}
+
+		for _, webhookURL := range n.webhookURLs {
+			err = n.postWebhook(webhookURL, payload)
+			if err != nil {
+				log.Printf("Unable to deliver %s notification to webhook %s: %s\n",
+					event.Type, webhookURL, err)
+			}
+		}
+
+		if n.scriptPath != "" {
+			err = n.runScript(event, payload)
+			if err != nil {
+				log.Printf("Unable to deliver %s notification to script: %s\n", event.Type, err)
+			}
+		}
+	}
+}
+
+func (n *Notifier) postWebhook(webhookURL string, payload []byte) error {
+	resp, err := n.client.Post(webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook replied with %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (n *Notifier) runScript(event Event, payload []byte) error {
+	cmd := exec.Command(n.scriptPath)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("SIA_NBDSERVER_EVENT=%s", event.Type),
+		fmt.Sprintf("SIA_NBDSERVER_MESSAGE=%s", event.Message))
+	cmd.Stdin = bytes.NewReader(payload)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(output))
+	}
+
+	return nil
+}
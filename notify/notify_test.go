@@ -0,0 +1,58 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNilNotifier(t *testing.T) {
+	notifier := New("", "")
+	assert.Nil(t, notifier, "expected nil notifier without targets")
+
+	// must not panic
+	notifier.Notify(DeviceAttached, "client connected")
+}
+
+func TestWebhook(t *testing.T) {
+	events := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		err := json.NewDecoder(r.Body).Decode(&event)
+		assert.Nil(t, err)
+		events <- event
+	}))
+	defer server.Close()
+
+	notifier := New(server.URL, "")
+	notifier.Notify(UploadFailed, "upload of page %d failed", 42)
+
+	event := <-events
+	assert.Equal(t, UploadFailed, event.Type)
+	assert.Equal(t, "upload of page 42 failed", event.Message)
+}
+
+func TestWebhooks(t *testing.T) {
+	assert.Nil(t, NewWebhooks(nil), "expected nil notifier without targets")
+
+	events := make(chan Event, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		err := json.NewDecoder(r.Body).Decode(&event)
+		assert.Nil(t, err)
+		events <- event
+	}))
+	defer server.Close()
+
+	notifier := NewWebhooks([]string{server.URL + "/a", server.URL + "/b"})
+	notifier.Notify(EpochRecorded, "flush %d recorded", 7)
+
+	for i := 0; i < 2; i++ {
+		event := <-events
+		assert.Equal(t, EpochRecorded, event.Type)
+		assert.Equal(t, "flush 7 recorded", event.Message)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches to the given user and group (the user's primary
+// group if empty) for good. Listening sockets stay usable. As the cache
+// files are created on demand, the data directory is handed over to the
+// user first.
+func dropPrivileges(userName string, groupName string, dataDirectory string) error {
+	account, err := user.Lookup(userName)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(account.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s has a non-numeric uid", userName)
+	}
+
+	gidString := account.Gid
+	if groupName != "" {
+		group, err := user.LookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		gidString = group.Gid
+	}
+	gid, err := strconv.Atoi(gidString)
+	if err != nil {
+		return fmt.Errorf("group of %s has a non-numeric gid", userName)
+	}
+
+	err = filepath.Walk(dataDirectory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+	if err != nil {
+		return err
+	}
+
+	// the group needs to go first, as it can no longer be changed after
+	// the user has
+	err = syscall.Setgroups([]int{gid})
+	if err != nil {
+		return err
+	}
+	err = syscall.Setgid(gid)
+	if err != nil {
+		return err
+	}
+	err = syscall.Setuid(uid)
+	if err != nil {
+		return err
+	}
+
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return errors.New("privileges could be regained after dropping them")
+	}
+
+	probe, err := ioutil.TempFile(dataDirectory, "probe")
+	if err != nil {
+		return fmt.Errorf("%s cannot write to the data directory (%s); "+
+			"consider pointing $XDG_DATA_HOME somewhere it can reach", userName, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	log.Printf("Dropped privileges to user %s (uid %d, gid %d)\n", userName, uid, gid)
+	return nil
+}
+
+// fileMode is a flag for permission bits given in octal, like chmod.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(*m))
+}
+
+func (m *fileMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode&^0777 != 0 {
+		return fmt.Errorf("invalid mode %s (expected octal permissions like 0640)", value)
+	}
+	if mode&0600 != 0600 {
+		return fmt.Errorf("mode %s needs to allow the owner to read and write", value)
+	}
+	*m = fileMode(mode)
+	return nil
+}
+
+func (m *fileMode) Type() string {
+	return "mode"
+}
+
+// groupID is a flag for a group given by name or ID, with 0 meaning none.
+type groupID int
+
+func (g *groupID) String() string {
+	if *g == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(*g))
+}
+
+func (g *groupID) Set(value string) error {
+	group, err := user.LookupGroup(value)
+	if err != nil {
+		group, err = user.LookupGroupId(value)
+		if err != nil {
+			return fmt.Errorf("unknown group %s", value)
+		}
+	}
+	gid, err := strconv.Atoi(group.Gid)
+	if err != nil {
+		return fmt.Errorf("group %s has a non-numeric gid", value)
+	}
+	*g = groupID(gid)
+	return nil
+}
+
+func (g *groupID) Type() string {
+	return "group"
+}
@@ -0,0 +1,210 @@
+package sia
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+type (
+	// PageInfo describes a single page for debugging purposes.
+	PageInfo struct {
+		Page           int       `json:"page"`
+		State          string    `json:"state"`
+		OnSia          bool      `json:"on_sia"`
+		Generation     int       `json:"generation"`
+		LastAccess     time.Time `json:"last_access"`
+		LastWrite      time.Time `json:"last_write"`
+		DirtySince     time.Time `json:"dirty_since"`
+		UploadFailures int       `json:"upload_failures"`
+		VerifiedAt     time.Time `json:"verified_at"`
+
+		// Checksum is the SHA-256 of the cache file; only set for
+		// cached pages and only if requested.
+		Checksum string `json:"checksum,omitempty"`
+	}
+)
+
+var stateNames = map[state]string{
+	zero:            "zero",
+	notCached:       "remote",
+	cachedUnchanged: "clean",
+	cachedChanged:   "dirty",
+	cachedUploading: "uploading",
+}
+
+func (s state) String() string {
+	return stateNames[s]
+}
+
+// matchesStateFilter reports whether a page in the given state is selected
+// by filter, which is either empty (all pages), the name of a state,
+// "cached" (clean, dirty or uploading) or "dirty" (dirty or uploading).
+func matchesStateFilter(state state, filter string) (bool, error) {
+	switch filter {
+	case "":
+		return true, nil
+	case "cached":
+		return isCached(state), nil
+	case "dirty":
+		return isDirty(state), nil
+	}
+
+	for s, name := range stateNames {
+		if name == filter {
+			return s == state, nil
+		}
+	}
+	return false, fmt.Errorf("unknown page state %q", filter)
+}
+
+// Pages reports the details of all pages that have been touched and match
+// filter (see matchesStateFilter), ordered by page number. Computing
+// checksums reads every selected cached page from disk.
+func (b *Backend) Pages(filter string, checksums bool) ([]PageInfo, error) {
+	_, err := matchesStateFilter(zero, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	pages := []page{}
+	for page, details := range b.cache.brain.pages {
+		matches, _ := matchesStateFilter(details.state, filter)
+		if details.state != zero && matches {
+			pages = append(pages, page)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i] < pages[j]
+	})
+
+	infos := make([]PageInfo, 0, len(pages))
+	for _, page := range pages {
+		details := b.cache.brain.pages.get(page)
+		ioDetails, ok := b.cache.pages[page]
+		if !ok {
+			ioDetails = &pageIODetails{}
+		}
+		info := PageInfo{
+			Page:           int(page),
+			State:          details.state.String(),
+			OnSia:          ioDetails.onSia,
+			Generation:     ioDetails.generation,
+			LastAccess:     details.lastAccess,
+			LastWrite:      details.lastWrite,
+			UploadFailures: ioDetails.uploadFailures,
+			VerifiedAt:     b.scrub.record.Verified[page],
+		}
+		if isDirty(details.state) {
+			info.DirtySince = details.dirtySince
+		}
+
+		if checksums && isCached(details.state) {
+			info.Checksum, err = b.checksum(page)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// checksum hashes the cache file of a page as it would be uploaded. The mutex
+// needs to be held.
+func (b *Backend) checksum(page page) (string, error) {
+	err := b.writeCombined(page)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := b.openCacheFile(page)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, b.pageReader(f, page))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (b *Backend) checkPage(pageNumber int) (page, error) {
+	if b.state != available {
+		return 0, errUnavailable
+	}
+	if pageNumber < 0 || pageNumber >= b.cache.pageCount {
+		return 0, fmt.Errorf("page %d is out of range (device has %d pages)", pageNumber, b.cache.pageCount)
+	}
+	return page(pageNumber), nil
+}
+
+// FlushPage uploads a page with data not on Sia yet within the next
+// maintenance round, without waiting for it to become idle. With ordered
+// uploads, pages that became dirty before it go first. It reports whether
+// the page has any data to upload.
+func (b *Backend) FlushPage(pageNumber int) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	page, err := b.checkPage(pageNumber)
+	if err != nil {
+		return false, err
+	}
+
+	dirty := b.cache.brain.requestUpload(page)
+	if dirty {
+		b.audit.record(auditForceUpload, fmt.Sprintf("page %d", page), "requested via admin API")
+	}
+	return dirty, nil
+}
+
+// FlushAll is FlushPage for every page with data not on Sia yet. It returns
+// these pages.
+func (b *Backend) FlushAll() ([]int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state != available {
+		return nil, errUnavailable
+	}
+
+	pages := []int{}
+	for _, page := range b.cache.brain.dirtyPages.sorted() {
+		b.cache.brain.requestUpload(page)
+		b.audit.record(auditForceUpload, fmt.Sprintf("page %d", page), "flush of all pages requested via admin API")
+		pages = append(pages, int(page))
+	}
+	return pages, nil
+}
+
+// EvictPage removes a page from the cache right away. Pages with data not
+// on Sia yet cannot be evicted; flush them first.
+func (b *Backend) EvictPage(pageNumber int) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	page, err := b.checkPage(pageNumber)
+	if err != nil {
+		return err
+	}
+
+	actions, err := b.cache.brain.evict(page)
+	if err != nil {
+		return fmt.Errorf("unable to evict page %d: %s", pageNumber, err)
+	}
+	b.audit.record(auditEvict, fmt.Sprintf("page %d", page), "requested via admin API")
+	_, err = b.handleActions(context.Background(), actions)
+	return err
+}
@@ -0,0 +1,67 @@
+package sia
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPages(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	backend := newTestBackend(t, 10, dataDirectory)
+	backend.mutex = &sync.Mutex{}
+	now := time.Now()
+
+	backend.cache.brain.setState(page(4), notCached)
+	backend.cache.setOnSia(page(4))
+	backend.cache.pages.get(page(4)).generation = 2
+	backend.cache.brain.setState(page(1), cachedUnchanged)
+	backend.cache.brain.markDirty(page(7), now)
+	backend.cache.brain.pages.get(page(7)).lastWrite = now
+	backend.cache.brain.setState(page(8), cachedUploading)
+	backend.cache.pages.get(page(8)).uploadFailures = 2
+	backend.cache.brain.pages.get(page(9)) // touched, but still zero
+
+	for _, page := range []page{1, 7, 8} {
+		err = ioutil.WriteFile(backend.asCachePath(page), []byte("abc"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pages, err := backend.Pages("", false)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(pages))
+	assert.Equal(t, PageInfo{Page: 1, State: "clean"}, pages[0])
+	assert.Equal(t, PageInfo{Page: 4, State: "remote", OnSia: true, Generation: 2}, pages[1])
+	assert.Equal(t, "dirty", pages[2].State)
+	assert.Equal(t, now, pages[2].LastWrite)
+	assert.Equal(t, now, pages[2].DirtySince)
+	assert.Equal(t, 2, pages[3].UploadFailures)
+
+	pages, err = backend.Pages("dirty", true)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(pages), "expected uploading pages to count as dirty")
+	assert.Equal(t, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", pages[0].Checksum)
+
+	pages, err = backend.Pages("uploading", false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(pages))
+	assert.Equal(t, 8, pages[0].Page)
+
+	pages, err = backend.Pages("cached", false)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(pages))
+
+	_, err = backend.Pages("bogus", false)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,88 @@
+package sia
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type (
+	// auditEntry is one line of the audit log.
+	auditEntry struct {
+		Time      time.Time `json:"time"`
+		Operation string    `json:"operation"`
+		Target    string    `json:"target"`
+		Reason    string    `json:"reason"`
+	}
+
+	// auditLog appends a line of JSON for every operation that deletes
+	// data or overrides the normal course of the cache, so that what
+	// happened can be reconstructed after an incident. Entries are never
+	// rewritten. A nil *auditLog records nothing.
+	auditLog struct {
+		mutex sync.Mutex
+		file  *os.File
+		clock Clock
+	}
+)
+
+const auditLogFile = "audit.log"
+
+// Operations recorded in the audit log.
+const (
+	auditTrash       = "trash"
+	auditDelete      = "delete"
+	auditPurge       = "purge"
+	auditUndelete    = "undelete"
+	auditForceUpload = "force-upload"
+	auditEvict       = "evict"
+	auditGeometry    = "geometry"
+	auditQuarantine  = "quarantine"
+	auditRepair      = "repair"
+	auditStaleRead   = "stale-read"
+)
+
+func openAuditLog(dataDirectory string, clock Clock) (*auditLog, error) {
+	file, err := os.OpenFile(filepath.Join(dataDirectory, auditLogFile),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file, clock: clock}, nil
+}
+
+// record appends an entry. Failing to do so is logged, but does not stop
+// the operation.
+func (a *auditLog) record(operation string, target string, reason string) {
+	if a == nil {
+		return
+	}
+
+	encoded, err := json.Marshal(auditEntry{
+		Time:      a.clock.Now(),
+		Operation: operation,
+		Target:    target,
+		Reason:    reason,
+	})
+	if err != nil {
+		log.Printf("Unable to encode audit log entry: %s\n", err)
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	_, err = a.file.Write(append(encoded, '\n'))
+	if err != nil {
+		log.Printf("Unable to write audit log entry: %s\n", err)
+	}
+}
+
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+	return a.file.Close()
+}
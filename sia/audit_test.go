@@ -0,0 +1,44 @@
+package sia
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	for i := 0; i < 2; i++ {
+		audit, err := openAuditLog(dataDirectory, systemClock{})
+		assert.Nil(t, err)
+		audit.record(auditTrash, "nbd/page1.gen1", "superseded by generation 2")
+		assert.Nil(t, audit.close())
+	}
+	var nilAudit *auditLog
+	nilAudit.record(auditDelete, "nbd/page1", "ignored")
+
+	f, err := os.Open(filepath.Join(dataDirectory, auditLogFile))
+	assert.Nil(t, err)
+	defer f.Close()
+
+	entries := []auditEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry auditEntry
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	assert.Equal(t, 2, len(entries), "expected entries to be appended")
+	assert.Equal(t, auditTrash, entries[1].Operation)
+	assert.Equal(t, "superseded by generation 2", entries[1].Reason)
+}
@@ -1,14 +1,22 @@
 package sia
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"os"
-	"context"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	//"reflect"
 
@@ -17,19 +25,130 @@ import (
 	"go.sia.tech/siad/modules"
 	//"go.sia.tech/siad/node/api/client"
 
+	"go.sia.tech/renterd/bus"
 	"go.sia.tech/renterd/worker"
 
+	"github.com/javgh/sia-nbdserver/blockdev"
 	"github.com/javgh/sia-nbdserver/config"
+	"github.com/javgh/sia-nbdserver/notify"
+	"github.com/javgh/sia-nbdserver/tracing"
 )
 
 type (
 	backendState int
 
+	// ShutdownLevel determines how much Shutdown does to secure data
+	// that is not on Sia yet.
+	ShutdownLevel int
+
 	Backend struct {
-		state      		backendState
-		mutex      		*sync.Mutex
-		cache      		*cache
-		workerClient	*worker.Client
+		state         backendState
+		mutex         *sync.Mutex
+		cache         *cache
+		workerClient  *worker.Client
+		busClient     *bus.Client
+		siaPathPrefix string
+		// pageRoot is the directory below which the pages are stored.
+		pageRoot string
+		// size is the exact size of the device, which the last page may
+		// extend beyond.
+		size          int64
+		dataDirectory string
+		dataLock      *os.File
+		changes       *changeJournal
+		cacheMode     os.FileMode
+		cacheGID      int
+		logger        *repeatedLogger
+		notifier      *notify.Notifier
+		cacheDiskFull bool
+		writesPaused  bool
+		ghost         *ghostCache
+		zeroTemplate  *zeroTemplate
+		cacheKey      *cacheKey
+		integrity     *integrity
+		trash         *trash
+		audit         *auditLog
+		device        DeviceInfo
+		clock         Clock
+		schedule      *maintenanceSchedule
+		breaker       circuitBreaker
+		watchdog      watchdog
+		uploadStalls  UploadStalls
+		healthCursor  page
+		listing       remoteListing
+		layout        Layout
+		nodes         []siaNode
+		activeNode    int
+
+		// balanceReads spreads downloads over the nodes by latency.
+		balanceReads bool
+		readStats    []readStats
+		readCount    int
+		lastExplored int
+
+		// uploads bounds the pages being uploaded and downloads the
+		// pages of a read that are downloaded ahead of it; see
+		// prefetchPages. Both adapt to how the Sia daemon keeps up.
+		uploads    concurrencyLimit
+		downloads  concurrencyLimit
+		prefetches map[page]*prefetch
+
+		// previousCacheKey is still accepted for cache files that have
+		// not been re-encrypted yet; may be nil.
+		previousCacheKey *cacheKey
+
+		savedUploadQueue []byte
+
+		lifetime      LifetimeStats
+		savedLifetime []byte
+
+		// startedAt separates pages left over from a previous run, which
+		// are uploaded with priority, from pages written to since.
+		startedAt           time.Time
+		shutdownInterrupted int32
+
+		// flushTimes maps epochs to the time of the flush that started
+		// them until an epoch marker covers them.
+		flushTimes               map[uint64]time.Time
+		recordedEpoch            uint64
+		uploadedSinceEpochMarker bool
+
+		uploadFailureThreshold int
+		pauseWritesAfter       int
+		uploadStallTimeout     time.Duration
+		growth                 growthTrend
+		scrub                  scrubber
+		contracts              contractWatch
+		uploadParameters       UploadParameters
+		uploadQuery            string
+		minimumRedundancy      float64
+		warningRedundancy      float64
+		storageBudget          uint64
+		writeCombineBytes      int
+
+		// staleReads serves pages whose newest generation is unreadable
+		// from older generations in the trash; stalePages are the pages
+		// served that way since they were last uploaded.
+		staleReads bool
+
+		cachingMode  CacheMode
+		discard      bool
+		detectZeroes DetectZeroes
+		stalePages   map[page]StalePage
+		paranoid     bool
+
+		// follower serves the device read-only as of the epoch markers
+		// recorded by another server; see refreshFollower.
+		follower       bool
+		follow         followState
+		epochPublisher *notify.Notifier
+
+		// readiness tells why uploads are held, if they are.
+		readiness struct {
+			reason    string
+			since     time.Time
+			lastCheck time.Time
+		}
 	}
 
 	BackendSettings struct {
@@ -39,6 +158,205 @@ type (
 		IdleInterval     time.Duration
 		SiaDaemonAddress string
 		SiaPasswordFile  string
+		SiaPathPrefix    string
+		DataDirectory    string
+
+		// CacheFileMode is the mode of the cache files (0 = 0600), which
+		// the data directory gets as well, plus search permission.
+		// CacheGID is the group to own them (0 = leave as is).
+		CacheFileMode os.FileMode
+		CacheGID      int
+
+		// CacheMode determines whether writes are synced to disk as they
+		// happen, when clients flush or never.
+		CacheMode CacheMode
+		// Discard lets Trim and WriteZeroes drop whole pages from the
+		// cache and Sia instead of ignoring trims and writing zeroes.
+		Discard bool
+		// DetectZeroes turns writes of nothing but zeroes into
+		// WriteZeroes.
+		DetectZeroes DetectZeroes
+
+		// Label is stored along with the UUID of the device on Sia; if
+		// empty, the stored label is kept.
+		Label string
+
+		// Layout is used for devices without any pages on Sia yet. Other
+		// devices keep the layout their pages are stored in.
+		Layout Layout
+		// Resize allows Size to differ from the size the device was
+		// created with. Truncate additionally allows it to be too small
+		// for the pages on Sia, which are then deleted; it implies
+		// Resize.
+		Resize   bool
+		Truncate bool
+
+		// FallbackSiaDaemonAddresses are further renterd nodes sharing the
+		// bus of SiaDaemonAddress. Requests go to them while the primary
+		// node at SiaDaemonAddress is failing.
+		FallbackSiaDaemonAddresses []string
+		// BalanceReads downloads pages from whichever node has been
+		// fastest, rather than from the one in use for everything else.
+		BalanceReads bool
+		// ParallelDownloads is the number of pages a read spanning several
+		// pages that are only on Sia downloads concurrently, each held in
+		// memory until the read gets to it (0 or 1 = one at a time).
+		ParallelDownloads int
+		// MaxUploads is the number of pages that may be uploading at once
+		// (0 = unlimited). Both it and ParallelDownloads are upper bounds;
+		// fewer are used while the Sia daemon responds slowly or fails.
+		MaxUploads int
+
+		// WriteReservePages is the number of cache pages below the hard
+		// limit that only writes may fill, so that a write burst is not
+		// held up by pages that were merely read.
+		WriteReservePages int
+		// ReadOverflowPages is the number of pages by which reads may
+		// exceed the hard limit while all cached pages are dirty.
+		ReadOverflowPages int
+
+		// Bounds for adapting the idle interval of each page to its write
+		// pattern (0 = same as IdleInterval). Leaving both at 0 keeps the
+		// idle interval fixed.
+		MinIdleInterval time.Duration
+		MaxIdleInterval time.Duration
+
+		// OrderedUploads uploads all pages that were written to before a
+		// flush before any page written to after it.
+		OrderedUploads bool
+
+		// Notifier receives events about significant state changes; may be nil.
+		Notifier *notify.Notifier
+		// UploadFailureThreshold is the number of consecutive failed uploads
+		// of a page after which an UploadFailed event is sent.
+		UploadFailureThreshold int
+		// PauseWritesAfter is the number of consecutive failed uploads of
+		// a page or failed maintenance cycles after which writes are paused
+		// until uploads succeed again (0 = never).
+		PauseWritesAfter int
+		// UploadStallTimeout is how long an upload may take to complete
+		// before it is started over (0 = wait forever).
+		UploadStallTimeout time.Duration
+		// StartupWait is how long to wait for the Sia daemon to become
+		// available at startup (0 = fail right away).
+		StartupWait time.Duration
+		// GrowthWarning is how far ahead to warn about the pages not yet
+		// uploaded reaching the limit of the cache (0 = never).
+		GrowthWarning time.Duration
+		// ScrubInterval is how often each page on Sia is downloaded and
+		// verified while the device is idle (0 = never).
+		ScrubInterval time.Duration
+		// StaleReads serves a page whose newest generation on Sia cannot
+		// be downloaded intact from the newest older generation still in
+		// the trash, so that a damaged device can be evacuated.
+		StaleReads bool
+		// ContractWarning is how far ahead to warn about contracts ending
+		// without having been renewed (0 = never).
+		ContractWarning time.Duration
+
+		// Bounds for data that has not been uploaded yet (0 = unlimited).
+		// Beyond them, uploads are forced and writes are throttled harder.
+		MaxDirtyAge   time.Duration
+		MaxDirtyBytes uint64
+
+		// UploadParameters set the erasure coding of page uploads and pass
+		// further options on to the worker.
+		UploadParameters UploadParameters
+
+		// MinimumRedundancy needs to be reached before an upload is
+		// considered complete. Pages below WarningRedundancy cause a
+		// warning when they are downloaded.
+		MinimumRedundancy float64
+		WarningRedundancy float64
+
+		// StorageBudget limits the projected storage on Sia in bytes,
+		// including redundancy (0 = unlimited). Once exhausted, writes to
+		// pages that have not been allocated yet fail with ENOSPC.
+		StorageBudget uint64
+
+		// WriteCombineBytes is the size of the per-page buffer that merges
+		// adjacent small writes before they hit the cache file (0 = off).
+		WriteCombineBytes int
+
+		// GhostCacheBytes limits the compressed copies of evicted clean
+		// pages that are kept to avoid downloading them again (0 = off).
+		GhostCacheBytes uint64
+
+		// CacheKeyFile holds the key to encrypt the cache files with; if
+		// empty, they hold the device contents in plaintext.
+		CacheKeyFile string
+		// PreviousCacheKeyFile holds the key that is being replaced by
+		// CacheKeyFile. Cache files encrypted with it remain readable and
+		// are re-encrypted when opened.
+		PreviousCacheKeyFile string
+
+		// IntegrityKeyFile holds the key to authenticate the pages on Sia
+		// with; if empty, downloaded pages are not checked.
+		IntegrityKeyFile string
+
+		// TrashRetention is how long deleted objects are kept on Sia
+		// before they are removed for good (0 = remove right away).
+		TrashRetention time.Duration
+
+		// MaintenanceInterval is how often uploads are started and
+		// checked on, evictions done and metadata stored (0 = 5 s).
+		// MaintenanceJitter adds a random delay of up to this much to each
+		// interval.
+		MaintenanceInterval time.Duration
+		MaintenanceJitter   time.Duration
+
+		// BreakerThreshold is the number of consecutive failed requests to
+		// the Sia daemon after which no more are sent, except for a probe
+		// every BreakerProbeInterval (0 = keep sending requests).
+		BreakerThreshold     int
+		BreakerProbeInterval time.Duration
+
+		// WatchdogTimeout is how long a request may wait for space in the
+		// cache before it is reported (0 = never). With WatchdogExpand,
+		// such a request is then allowed to exceed the hard limit.
+		WatchdogTimeout time.Duration
+		WatchdogExpand  bool
+
+		// Paranoid verifies the invariants of the cache after every
+		// operation and crashes with a dump of the state if one does not
+		// hold.
+		Paranoid bool
+
+		// Follower serves the device of another server read-only, as of
+		// its latest epoch marker, which is looked for again every
+		// FollowInterval (0 = 1 min). Nothing is ever written to Sia.
+		Follower       bool
+		FollowInterval time.Duration
+		// EpochPublisher receives an EpochRecorded event whenever an
+		// epoch marker has been stored, so that followers can apply it
+		// right away; may be nil.
+		EpochPublisher *notify.Notifier
+
+		// Clock provides the time for the backend and its cache brain
+		// (nil = system clock).
+		Clock Clock
+	}
+
+	DirtyData struct {
+		Pages       int
+		Bytes       uint64
+		OldestWrite time.Time
+	}
+
+	// Usage breaks the pages of the device down by where their data
+	// lives. Every page is zero, remote only or cached; cached pages may
+	// additionally be dirty and pages may be both cached and on Sia.
+	Usage struct {
+		Pages       int    `json:"pages"`
+		ZeroPages   int    `json:"zero_pages"`
+		RemotePages int    `json:"remote_pages"`
+		CachedPages int    `json:"cached_pages"`
+		DirtyPages  int    `json:"dirty_pages"`
+		RemoteBytes uint64 `json:"remote_bytes"`
+		CacheBytes  uint64 `json:"cache_bytes"`
+		GhostBytes  uint64 `json:"ghost_bytes"`
+
+		Lifetime LifetimeStats `json:"lifetime"`
 	}
 
 	pageAccess struct {
@@ -50,368 +368,1113 @@ type (
 	}
 
 	pageIODetails struct {
-		file *os.File
+		file            cacheFile
+		uploadFailures  int
+		lastUploadError string
+
+		// generation is the newest complete generation on Sia;
+		// uploadingGeneration the one currently being uploaded.
+		generation          int
+		uploadingGeneration int
+		uploadStartedAt     time.Time
+
+		// uploadingSlots are the slots stored in the pack being uploaded,
+		// or nil if all of them count as stored.
+		uploadingSlots []bool
+
+		// onSia is set once any generation of the page is on Sia.
+		onSia bool
+
+		// redundancyHistory holds the latest redundancy samples of the
+		// page on Sia, oldest first.
+		redundancyHistory []RedundancySample
+
+		combined combinedWrite
 	}
 
+	// ioPageTable is the sparse counterpart to pageTable for I/O details.
+	ioPageTable map[page]*pageIODetails
+
 	cache struct {
-		brain     *cacheBrain
-		pageCount int
-		pages     []pageIODetails
+		brain       *cacheBrain
+		pageCount   int
+		pages       ioPageTable
+		remotePages int
 	}
 )
 
 const (
-	siaPathPrefix         = "nbd"
 	pageSize              = 64 * 1024 * 1024
 	waitInterval          = 5 * time.Second
 	defaultDataPieces     = 10
 	defaultParityPieces   = 20
-	minimumRedundancy     = 2.5
 	writeThrottleInterval = 5 * time.Millisecond
 	writeThrottleLeeway   = 5
+	dirtyThrottleBoost    = 4
 	useCachedRenterInfo   = true
+	minShards             = 2
+	totalShards           = 5
+	cacheDiskFullFraction = 0.9
+	downloadBufferSize    = 1024 * 1024
 )
 
+// PageSize is the size of the pages a device is stored in on Sia and in
+// the cache.
+const PageSize = pageSize
+
+// MaxSize is the largest size of a device. Its page count still fits in an
+// int32 and its size in bytes comfortably in an int64, so that devices work
+// the same on 32-bit architectures.
+const MaxSize = math.MaxInt32 * pageSize
+
+// pageCountFor returns the number of pages of a device of the given size,
+// which must not exceed MaxSize.
+func pageCountFor(size uint64) int {
+	return int((size + pageSize - 1) / pageSize)
+}
+
+// errUnavailable is returned once the backend is shutting down. It wraps
+// ESHUTDOWN, which lets NBD clients know that the server is going away.
+var errUnavailable = fmt.Errorf("backend is no longer available: %w", syscall.ESHUTDOWN)
+
+var _ blockdev.Device = (*Backend)(nil)
+
+var shardParameters = fmt.Sprintf("?minshards=%d&totalshards=%d", minShards, totalShards)
+
+var actionSpanNames = map[actionType]string{
+	zeroCache:      "cache.zero",
+	deleteCache:    "cache.delete",
+	download:       "sia.download",
+	startUpload:    "sia.upload",
+	postponeUpload: "sia.postpone_upload",
+	openFile:       "cache.open",
+	closeFile:      "cache.close",
+	waitAndRetry:   "cache.wait_and_retry",
+}
+
 const (
 	available backendState = iota
 	shuttingDown
 	unavailable
 )
 
+const (
+	// ShutdownNone aborts uploads in progress and leaves data that is
+	// not on Sia yet in the cache, possibly not yet written to disk.
+	ShutdownNone ShutdownLevel = iota
+	// ShutdownCache is ShutdownNone, but makes sure that the cache is
+	// on disk, so that the data survives a crash or power loss.
+	ShutdownCache
+	// ShutdownRemote waits until all data is on Sia.
+	ShutdownRemote
+)
+
+var shutdownLevelNames = map[ShutdownLevel]string{
+	ShutdownNone:   "none",
+	ShutdownCache:  "cache",
+	ShutdownRemote: "remote",
+}
+
+func (l ShutdownLevel) String() string {
+	return shutdownLevelNames[l]
+}
+
+// ParseShutdownLevel is the inverse of ShutdownLevel.String.
+func ParseShutdownLevel(s string) (ShutdownLevel, error) {
+	for level, name := range shutdownLevelNames {
+		if name == s {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown shutdown level %q (expected none, cache or remote)", s)
+}
+
 func NewBackend(settings BackendSettings) (*Backend, error) {
-	dataDirectory := config.PrependDataDirectory("")
+	dataDirectory := settings.DataDirectory
+	clock := settings.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	err := ValidateSiaPathPrefix(settings.SiaPathPrefix)
+	if err != nil {
+		return nil, err
+	}
+	uploadParameters := settings.UploadParameters.withDefaults()
+	err = checkUploadParameters(uploadParameters, settings.MinimumRedundancy)
+	if err != nil {
+		return nil, err
+	}
+
 	log.Printf("Storing cache in %s\n", dataDirectory)
-	err := os.MkdirAll(dataDirectory, 0700)
+	err = os.MkdirAll(dataDirectory, 0700)
+	if err != nil {
+		return nil, err
+	}
+	dataLock, err := lockDataDirectory(dataDirectory)
 	if err != nil {
 		return nil, err
 	}
+	// the backend holds the lock from here on, unless it fails to start
+	started := false
+	defer func() {
+		if !started {
+			dataLock.Close()
+		}
+	}()
 
-	pageCount := settings.Size / pageSize
-	if settings.Size%pageSize > 0 {
-		pageCount += 1
+	if settings.Size > MaxSize {
+		return nil, fmt.Errorf("size %d exceeds the maximum of %d bytes", settings.Size, uint64(MaxSize))
+	}
+	if settings.Follower && (settings.Resize || settings.Truncate) {
+		return nil, errors.New("a follower cannot resize the device")
 	}
+	pageCount := pageCountFor(settings.Size)
 
 	cacheBrain, err := newCacheBrain(
-		int(pageCount), settings.HardMaxCached, settings.SoftMaxCached, settings.IdleInterval)
+		pageCount, settings.HardMaxCached, settings.SoftMaxCached, settings.IdleInterval)
+	if err != nil {
+		return nil, err
+	}
+	err = configureBrain(cacheBrain, settings)
 	if err != nil {
 		return nil, err
 	}
 
 	cache := cache{
 		brain:     cacheBrain,
-		pageCount: int(pageCount),
-		pages:     make([]pageIODetails, pageCount),
+		pageCount: pageCount,
+		pages:     make(ioPageTable),
 	}
 
 	siaPass, err := config.ReadPasswordFile(settings.SiaPasswordFile)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println( siaPass )
 
-	/*
-	httpClient := client.Client{
-		Address:  settings.SiaDaemonAddress,
-		Password: siaPassword,
+	ghost, err := newGhostCache(dataDirectory, settings.GhostCacheBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := loadCacheKey(settings.CacheKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	previousKey, err := loadCacheKey(settings.PreviousCacheKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		log.Printf("Encrypting cache files\n")
+	} else if previousKey != nil {
+		return nil, errors.New("previous cache key given without a new one")
+	}
+
+	pageIntegrity, err := newIntegrity(settings.IntegrityKeyFile, dataDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheFormat, err := readCacheFormat(dataDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []siaNode{newSiaNode(settings.SiaDaemonAddress, siaPass)}
+	for _, address := range settings.FallbackSiaDaemonAddresses {
+		nodes = append(nodes, newSiaNode(address, siaPass))
+	}
+
+	// The remote listing may take a while for large devices, so scan the
+	// cache in the meantime.
+	startupBegin := clock.Now()
+	var remote remoteDevice
+	var activeNode int
+	var listErr error
+	listed := make(chan struct{})
+	go func() {
+		activeNode, remote, listErr = waitForSia(context.Background(), clock,
+			settings.StartupWait, nodes, settings.SiaPathPrefix, settings.Layout)
+		close(listed)
+	}()
+
+	cachedPages := getCachedPages(dataDirectory, pageCount)
+	<-listed
+	if listErr != nil {
+		return nil, listErr
+	}
+	if settings.Follower {
+		if remote.info.CreatedAt.IsZero() {
+			return nil, fmt.Errorf("there is no device under %s to follow", settings.SiaPathPrefix)
+		}
+		err = discardFollowerCache(dataDirectory, cachedPages)
+		if err != nil {
+			return nil, err
+		}
+		cachedPages = nil
 	}
-	*/
+	remotePages := remote.pages
+	cacheBrain.pagesPerObject = remote.info.PagesPerObject
+	cacheBrain.readOnly = settings.Follower
+	if remote.layout != settings.Layout {
+		log.Printf("Pages are stored in the %s layout; switch to the %s layout with migrate-layout\n",
+			remote.layout, settings.Layout)
+	}
+	workerClient := nodes[activeNode].workerClient
 
-	workerClient := worker.NewClient("http://127.0.0.1:9980/api/worker", "r3n7rD#aP1g1mm1D4C42hH*")
+	audit, err := openAuditLog(dataDirectory, clock)
+	if err != nil {
+		return nil, err
+	}
 
-	uploadedPages, err := getUploadedPages(workerClient, false)
+	trash := newTrash(dataDirectory, settings.TrashRetention)
+	err = trash.load(context.Background(), workerClient, settings.SiaPathPrefix)
 	if err != nil {
 		return nil, err
 	}
+	remotePages = trash.withoutTrashed(remotePages)
+
+	// Data beyond the end is most likely due to a mistyped size, so it is
+	// only given up on request.
+	beyondSize := []remotePage{}
+	withinSize := []remotePage{}
+	for _, remotePage := range remotePages {
+		if remotePage.page >= page(cache.pageCount) {
+			beyondSize = append(beyondSize, remotePage)
+		} else {
+			withinSize = append(withinSize, remotePage)
+		}
+	}
+	if len(beyondSize) > 0 {
+		if !settings.Truncate {
+			return nil, fmt.Errorf("%d object(s) on Sia lie beyond the end of the device at %d bytes; "+
+				"use a larger --size, or --truncate to delete them", len(beyondSize), settings.Size)
+		}
+		audit.record(auditGeometry, fmt.Sprintf("%d bytes", settings.Size),
+			fmt.Sprintf("%d object(s) on Sia lie beyond the end of the device", len(beyondSize)))
+	}
+	remotePages = withinSize
+	log.Printf("Found %d remote and %d cached pages in %s\n",
+		len(remotePages), len(cachedPages), clock.Now().Sub(startupBegin).Round(time.Millisecond))
+
+	generations := expandPacks(latestGenerations(remotePages), remote.info.PagesPerObject, cache.pageCount)
+	for page, generation := range generations {
+		if int64(page) >= int64(cache.pageCount) {
+			continue
+		}
+		cache.brain.setState(page, notCached)
+		cache.pages.get(page).generation = generation
+		cache.setOnSia(page)
+	}
 
-	for _, page := range uploadedPages {
-		cache.brain.pages[page].state = notCached
+	cachedPages, err = quarantineCacheFiles(dataDirectory, cachedPages, remote.info.UUID, generations,
+		clock.Now(), audit, settings.Notifier)
+	if err != nil {
+		return nil, err
 	}
 
-	cachedPages := getCachedPages(int(pageCount))
 	actions := []action{}
 	for _, page := range cachedPages {
-		log.Printf("Cache for page %d found - assuming it contains unsynced data\n", page)
 		actions = append(actions, action{
 			actionType: openFile,
 			page:       page,
 		})
-		cache.brain.pages[page].state = cachedChanged
-		cache.brain.cacheCount += 1
+		cache.brain.setState(page, cachedChanged)
+		cache.brain.pages.get(page).dirtySince = clock.Now()
+	}
+	// pages left from the previous run are cached regardless of the limits
+	if cache.brain.cacheCount > cache.brain.heldLimit {
+		cache.brain.heldLimit = cache.brain.cacheCount
 	}
 
 	backend := Backend{
-		state:      		available,
-		mutex:      		&sync.Mutex{},
-		cache:      		&cache,
-		workerClient:		workerClient,
+		state:         available,
+		mutex:         &sync.Mutex{},
+		cache:         &cache,
+		workerClient:  workerClient,
+		busClient:     nodes[activeNode].busClient,
+		nodes:         nodes,
+		activeNode:    activeNode,
+		balanceReads:  settings.BalanceReads,
+		uploads:       newConcurrencyLimit("uploads", settings.MaxUploads),
+		downloads:     newConcurrencyLimit("downloads", settings.ParallelDownloads),
+		prefetches:    make(map[page]*prefetch),
+		readStats:     make([]readStats, len(nodes)),
+		siaPathPrefix: settings.SiaPathPrefix,
+		pageRoot:      pageRoot(settings.SiaPathPrefix, remote.info),
+		size:          int64(settings.Size),
+		layout:        remote.layout,
+		dataDirectory: dataDirectory,
+		dataLock:      dataLock,
+		cacheMode:     settings.CacheFileMode,
+		cacheGID:      settings.CacheGID,
+		logger:        newRepeatedLogger(repeatedLogInterval),
+		notifier:      settings.Notifier,
+		ghost:         ghost,
+		zeroTemplate:  newZeroTemplate(dataDirectory),
+		cacheKey:      key,
+		integrity:     pageIntegrity,
+		trash:         trash,
+		audit:         audit,
+		clock:         clock,
+		schedule:      newMaintenanceSchedule(settings.MaintenanceInterval, settings.MaintenanceJitter),
+		breaker: circuitBreaker{
+			threshold:     settings.BreakerThreshold,
+			probeInterval: settings.BreakerProbeInterval,
+		},
+		watchdog: watchdog{
+			timeout: settings.WatchdogTimeout,
+			expand:  settings.WatchdogExpand,
+		},
+		flushTimes: make(map[uint64]time.Time),
+
+		previousCacheKey:       previousKey,
+		uploadFailureThreshold: settings.UploadFailureThreshold,
+		pauseWritesAfter:       settings.PauseWritesAfter,
+		uploadStallTimeout:     settings.UploadStallTimeout,
+		growth:                 growthTrend{horizon: settings.GrowthWarning},
+		scrub:                  newScrubber(settings.ScrubInterval),
+		contracts:              newContractWatch(settings.ContractWarning),
+		uploadParameters:       uploadParameters,
+		uploadQuery:            uploadParameters.query(),
+		minimumRedundancy:      settings.MinimumRedundancy,
+		warningRedundancy:      settings.WarningRedundancy,
+		storageBudget:          settings.StorageBudget,
+		writeCombineBytes:      settings.WriteCombineBytes,
+		staleReads:             settings.StaleReads,
+		cachingMode:            settings.CacheMode,
+		discard:                settings.Discard && remote.info.PagesPerObject <= 1,
+		detectZeroes:           settings.DetectZeroes,
+		stalePages:             make(map[page]StalePage),
+		paranoid:               settings.Paranoid,
+		follower:               settings.Follower,
+		follow:                 followState{interval: settings.FollowInterval},
+		epochPublisher:         settings.EpochPublisher,
+	}
+	if backend.follow.interval == 0 {
+		backend.follow.interval = defaultFollowInterval
+	}
+	if remote.info.PagesPerObject > 1 {
+		log.Printf("Storing %d pages per object on Sia\n", remote.info.PagesPerObject)
+		if settings.Discard {
+			log.Printf("Discarding is not supported for devices that store several pages per object\n")
+		}
 	}
 
-	fmt.Println("backend.handleActions")
-
-	_, err = backend.handleActions(actions)
+	err = backend.setDataDirectoryOwnership()
 	if err != nil {
 		return nil, err
 	}
 
-	go func() {
-		for !backend.unavailable() {
-			time.Sleep(waitInterval)
-			err2 := backend.maintenance()
-			if err2 != nil {
-				log.Printf("Error while doing maintenance: %s", err2)
-			}
-		}
-	}()
-
-	return &backend, nil
-}
-
-func (b *Backend) handleActions(actions []action) (bool, error) {
-	for _, action := range actions {
-		switch action.actionType {
-		case zeroCache:
-			log.Printf("Initializing cache for page %d with zeroes\n", action.page)
+	err = backend.restoreUploadQueue()
+	if err != nil {
+		return nil, err
+	}
 
-			buf := make([]byte, pageSize)
-			_, err := b.cache.pages[action.page].file.Write(buf)
-			if err != nil {
-				return false, err
-			}
-		case deleteCache:
-			log.Printf("Deleting cache for page %d\n", action.page)
+	err = backend.restoreLifetimeStats()
+	if err != nil {
+		return nil, err
+	}
 
-			cachePath := asCachePath(action.page)
-			err := os.Remove(cachePath)
-			if err != nil {
-				return false, err
-			}
-		case download:
-			log.Printf("Downloading page %d\n", action.page)
+	backend.changes, err = openChangeJournal(dataDirectory, settings.Size, currentBootID())
+	if err != nil {
+		return nil, err
+	}
 
-			siaPath, err := modules.NewSiaPath(asSiaPath(action.page))
-			if err != nil {
-				return false, err
-			}
+	err = backend.restoreScrubRecord()
+	if err != nil {
+		return nil, err
+	}
 
-			cachePath := asCachePath(action.page)
-			fmt.Println( siaPath, cachePath )
-			//_, err = b.httpClient.RenterDownloadFullGet(siaPath, cachePath, false)
-			//_, err = b.httpClient.RenterDownloadFullGet(siaPath, cachePath, false, true)
-			f, err := os.Create( cachePath )
-      if err != nil {
-        return false, err
-      }
+	err = backend.identifyDevice(context.Background(), remote.info, settings.Label, settings.Size,
+		settings.Resize || settings.Truncate)
+	if err != nil {
+		return nil, err
+	}
 
-			err = b.workerClient.DownloadObject( context.Background(), f, siaPath.String()+"?minshards=2&totalshards=5" )
-			f.Close()
-			fmt.Println("DownloadObject", siaPath.String(), "END" )
-			if err != nil {
-				return false, err
-			}
-		case startUpload:
-			log.Printf("Uploading page %d\n", action.page)
+	// after identifyDevice, which tells how many pages each object holds
+	err = backend.resumeEpochs(context.Background())
+	if err != nil {
+		return nil, err
+	}
 
-			siaPath, err := modules.NewSiaPath(asSiaPath(action.page))
-			if err != nil {
-				return false, err
-			}
+	if pageIntegrity != nil {
+		err = pageIntegrity.load(context.Background(), workerClient, settings.SiaPathPrefix)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			cachePath := asCachePath(action.page)
+	if !backend.follower {
+		backend.cleanUpGenerations(context.Background(), remotePages)
+	}
+	for _, remotePage := range beyondSize {
+		err = backend.deleteObject(context.Background(), remotePage, "beyond the end of the device")
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			fmt.Println( cachePath, siaPath )
-			//err = b.httpClient.RenterUploadForcePost(
-			//	cachePath, siaPath, defaultDataPieces, defaultParityPieces, true)
-			//if err != nil {
-			//	return false, err
-			//}
+	err = backend.migrateCacheFormat(cacheFormat, cachedPages)
+	if err != nil {
+		return nil, err
+	}
 
-			f, err := os.Open( cachePath )
-			if err != nil {
-        return false, err
-      }
+	cachedPages = backend.keepCleanPages(cachedPages)
+	for _, page := range cachedPages {
+		log.Printf("Cache for page %d found - assuming it contains unsynced data\n", page)
+		backend.cache.brain.requestUpload(page)
+	}
+	if len(cachedPages) > 0 {
+		log.Printf("Uploading %d page(s) (%d MiB) left from the previous run first\n",
+			len(cachedPages), backend.backlogBytes()/(1024*1024))
+	}
+	backend.startedAt = clock.Now()
 
-			fmt.Println("UploadObject", siaPath.String(), "START" )
-			err = b.workerClient.UploadObject( context.Background(), f, siaPath.String()+"?minshards=2&totalshards=5" )
-			fmt.Println("UploadObject", siaPath.String(), "END" )
-			f.Close()
-			if err != nil {
+	_, err = backend.handleActions(context.Background(), actions)
+	if err != nil {
+		return nil, err
+	}
 
-        return false, err
-      }
-		case postponeUpload:
-			log.Printf("Postponing upload for page %d\n", action.page)
+	if backend.follower {
+		err = backend.refreshFollower(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Following the device read-only\n")
+	}
 
-			siaPath, err := modules.NewSiaPath(asSiaPath(action.page))
-			if err != nil {
-				return false, err
-			}
+	go backend.maintenanceLoop()
 
-			fmt.Println( siaPath )
-			//err = b.httpClient.RenterFileDeletePost(siaPath)
-			if err != nil {
-				return false, err
-			}
-		case openFile:
-			if b.cache.pages[action.page].file != nil {
-				panic("file handling is inconsistent")
-			}
+	started = true
+	return &backend, nil
+}
 
-			file, err := os.OpenFile(asCachePath(action.page), os.O_RDWR|os.O_CREATE, 0600)
-			if err != nil {
-				return false, err
-			}
+// configureBrain applies the settings that can change at runtime to the
+// cache brain.
+func configureBrain(cacheBrain *cacheBrain, settings BackendSettings) error {
+	if settings.SoftMaxCached >= settings.HardMaxCached {
+		return errors.New("soft limit needs to be lower than hard limit")
+	}
+	if settings.WriteReservePages < 0 ||
+		settings.WriteReservePages > settings.HardMaxCached-settings.SoftMaxCached {
+		return errors.New("write reserve needs to be at most the hard limit minus the soft limit")
+	}
+	if settings.ReadOverflowPages < 0 {
+		return errors.New("read overflow must not be negative")
+	}
 
-			b.cache.pages[action.page].file = file
-		case closeFile:
-			if b.cache.pages[action.page].file == nil {
-				panic("file handling is inconsistent")
-			}
+	minIdleInterval := settings.IdleInterval
+	if settings.MinIdleInterval > 0 {
+		if settings.MinIdleInterval > settings.IdleInterval {
+			return errors.New("minimum idle interval needs to be at most the idle interval")
+		}
+		minIdleInterval = settings.MinIdleInterval
+	}
+	maxIdleInterval := settings.IdleInterval
+	if settings.MaxIdleInterval > 0 {
+		if settings.MaxIdleInterval < settings.IdleInterval {
+			return errors.New("maximum idle interval needs to be at least the idle interval")
+		}
+		maxIdleInterval = settings.MaxIdleInterval
+	}
 
-			err := b.cache.pages[action.page].file.Close()
-			if err != nil {
-				return false, err
-			}
+	cacheBrain.holdLimit()
+	cacheBrain.hardMaxCached = settings.HardMaxCached
+	cacheBrain.softMaxCached = settings.SoftMaxCached
+	cacheBrain.writeReserve = settings.WriteReservePages
+	cacheBrain.readOverflow = settings.ReadOverflowPages
+	cacheBrain.idleInterval = settings.IdleInterval
+	cacheBrain.minIdleInterval = minIdleInterval
+	cacheBrain.maxIdleInterval = maxIdleInterval
+	cacheBrain.orderedUploads = settings.OrderedUploads
+	cacheBrain.maxDirtyAge = settings.MaxDirtyAge
+	maxDirtyBytes := settings.MaxDirtyBytes
+	if maxDirtyBytes > MaxSize {
+		maxDirtyBytes = MaxSize
+	}
+	cacheBrain.maxDirtyPages = pageCountFor(maxDirtyBytes)
+	cacheBrain.uploadLimit = settings.MaxUploads
 
-			b.cache.pages[action.page].file = nil
-		case waitAndRetry:
-			return true, nil
-		default:
-			panic("unknown action")
+	// keep adapted idle intervals within the new bounds
+	for _, details := range cacheBrain.pages {
+		if details.idleInterval < minIdleInterval && details.idleInterval != 0 {
+			details.idleInterval = minIdleInterval
+		}
+		if details.idleInterval > maxIdleInterval {
+			details.idleInterval = maxIdleInterval
 		}
 	}
-
-	return false, nil
+	return nil
 }
 
-func (b *Backend) maintenance() error {
+// Reconfigure applies the settings that can change at runtime: cache
+// limits, write reserve and read overflow, idle intervals, ordered uploads,
+// dirty data limits, redundancy thresholds, storage budget, upload failure
+// threshold and stall timeout, write combining, the watchdog, concurrency
+// limits, the scrub interval, the contract warning and the size of an
+// enabled ghost cache. All other settings are ignored.
+func (b *Backend) Reconfigure(settings BackendSettings) error {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	if b.state == unavailable {
-		return nil
-	}
-
-	actions := b.cache.brain.maintenance(time.Now())
-	_, err := b.handleActions(actions)
+	err := checkUploadParameters(b.uploadParameters, settings.MinimumRedundancy)
 	if err != nil {
 		return err
 	}
-
-	anyUploading := false
-	for i := 0; i < b.cache.brain.pageCount; i++ {
-		if b.cache.brain.pages[i].state == cachedUploading {
-			anyUploading = true
-			break
-		}
-	}
-
-	if !anyUploading {
-		return nil
-	}
-
-	uploadedPages, err := getUploadedPages(b.workerClient, true)
+	err = configureBrain(b.cache.brain, settings)
 	if err != nil {
 		return err
 	}
 
-	for _, page := range uploadedPages {
-		if b.cache.brain.pages[page].state == cachedUploading {
-			log.Printf("Upload complete for page %d\n", page)
-			b.cache.brain.pages[page].state = cachedUnchanged
+	if settings.WriteCombineBytes < b.writeCombineBytes {
+		err = b.writeAllCombined()
+		if err != nil {
+			return err
 		}
 	}
-
+	b.writeCombineBytes = settings.WriteCombineBytes
+
+	b.uploadFailureThreshold = settings.UploadFailureThreshold
+	b.pauseWritesAfter = settings.PauseWritesAfter
+	b.updateWritePause()
+	b.uploadStallTimeout = settings.UploadStallTimeout
+	b.growth.horizon = settings.GrowthWarning
+	b.scrub.interval = settings.ScrubInterval
+	b.contracts.warning = settings.ContractWarning
+	b.watchdog.timeout = settings.WatchdogTimeout
+	b.watchdog.expand = settings.WatchdogExpand
+	b.minimumRedundancy = settings.MinimumRedundancy
+	b.warningRedundancy = settings.WarningRedundancy
+	b.storageBudget = settings.StorageBudget
+	b.uploads.setMax(settings.MaxUploads)
+	b.cache.brain.uploadLimit = b.uploads.inEffect()
+	b.downloads.setMax(settings.ParallelDownloads)
+	if b.ghost != nil && settings.GhostCacheBytes > 0 {
+		b.ghost.maxBytes = settings.GhostCacheBytes
+		b.ghost.evict()
+	}
 	return nil
 }
 
-func (b *Backend) unavailable() bool {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
-	return b.state == unavailable
-}
+func (b *Backend) handleActions(ctx context.Context, actions []action) (bool, error) {
+	b.assertUniqueActions(actions)
+	for _, action := range actions {
+		actionCtx, span := tracing.StartSpan(ctx, actionSpanNames[action.actionType])
+		span.SetAttribute("page", int(action.page))
+		retry, err := b.handleAction(actionCtx, action)
+		span.SetError(err)
+		span.End()
+		if err != nil {
+			if action.actionType == startUpload {
+				b.uploadFailed(action.page, err)
+			}
+			return false, err
+		}
 
-func (b *Backend) Available() bool {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+		if retry {
+			return true, nil
+		}
+	}
 
-	return b.state == available
+	b.assertInvariants()
+	return false, nil
 }
 
-func (b *Backend) ReadAt(buf []byte, offset int64) (int, error) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+func (b *Backend) handleAction(ctx context.Context, action action) (bool, error) {
+	switch action.actionType {
+	case zeroCache:
+		log.Printf("Initializing cache for page %d with zeroes\n", action.page)
 
-	if b.state != available {
-		return 0, errors.New("backend is no longer available")
-	}
+		err := b.zeroCacheFile(action.page)
+		if err != nil {
+			return false, err
+		}
+	case deleteCache:
+		log.Printf("Deleting cache for page %d\n", action.page)
 
-	n := 0
-	for _, pageAccess := range determinePages(offset, len(buf)) {
-		for {
-			actions := b.cache.brain.prepareAccess(pageAccess.page, false, time.Now())
-			retry, err := b.handleActions(actions)
+		cachePath := b.asCachePath(action.page)
+		if b.cache.pages.get(action.page).onSia {
+			err := b.ghost.store(action.page, b.cache.pages.get(action.page).generation, cachePath, b.now())
 			if err != nil {
-				return n, err
+				log.Printf("Unable to keep ghost copy of page %d: %s\n", action.page, err)
 			}
+		}
 
-			if !retry {
-				break
-			} else {
-				b.mutex.Unlock()
-				time.Sleep(waitInterval)
-				b.mutex.Lock()
-			}
+		err := os.Remove(cachePath)
+		if err != nil {
+			return false, err
 		}
+		err = removeCacheFileHeader(b.dataDirectory, action.page)
+		if err != nil {
+			return false, err
+		}
+	case download:
+		generation := b.cache.pages.get(action.page).generation
+		if b.preallocated(generation) {
+			log.Printf("Initializing cache for preallocated page %d with zeroes\n", action.page)
 
-		partialN, err := b.cache.pages[pageAccess.page].file.ReadAt(
-			buf[pageAccess.sliceLow:pageAccess.sliceHigh], pageAccess.offset)
-		n += partialN
+			err := b.zeroCacheFile(action.page)
+			if err != nil {
+				return false, err
+			}
+			break
+		}
+		restored, err := b.ghost.restore(action.page, generation, b.asCachePath(action.page))
 		if err != nil {
-			return n, err
+			log.Printf("Unable to restore ghost copy of page %d: %s\n", action.page, err)
+		}
+		if restored {
+			log.Printf("Restored page %d from ghost copy\n", action.page)
+			break
 		}
-	}
-	return n, nil
-}
 
-func (b *Backend) WriteAt(buf []byte, offset int64) (int, error) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+		prefetched, err := b.usePrefetched(action.page, generation)
+		if err != nil {
+			return false, err
+		}
+		if prefetched {
+			break
+		}
 
-	if b.state != available {
-		return 0, errors.New("backend is no longer available")
+		if b.breaker.open {
+			return false, errSiaUnavailable
+		}
+
+		b.logger.Printf(downloadLogKey(action.page), b.now(), "Downloading page %d\n", action.page)
+
+		siaPath, err := modules.NewSiaPath(b.asSiaPath(action.page, generation))
+		if err != nil {
+			return false, err
+		}
+
+		b.checkReadHealth(ctx, action.page, siaPath.String())
+
+		start := b.now()
+		err = b.balancedDownload(ctx, action.page, generation, siaPath.String())
+		b.downloads.record(b.now().Sub(start), err)
+		if err != nil && b.staleReads && !b.breaker.open {
+			err = b.downloadStale(ctx, action.page, generation, err)
+		}
+		if err != nil {
+			return false, err
+		}
+		b.countDownload()
+		b.logger.Resolve(downloadLogKey(action.page), b.now())
+	case startUpload:
+		b.logger.Printf(uploadLogKey(action.page), b.now(), "Uploading page %d\n", action.page)
+
+		err := b.writeCombined(action.page)
+		if err != nil {
+			return false, err
+		}
+
+		// Upload to a new generation, so that the previous one stays
+		// intact until this upload is complete.
+		generation := b.cache.pages.get(action.page).generation + 1
+		b.cache.pages.get(action.page).uploadingGeneration = generation
+		b.cache.pages.get(action.page).uploadStartedAt = b.now()
+		siaPath, err := modules.NewSiaPath(b.asSiaPath(action.page, generation))
+		if err != nil {
+			return false, err
+		}
+
+		f, err := b.openCacheFile(action.page)
+		if err != nil {
+			return false, err
+		}
+
+		// the SiaPath of a postponed upload is used again
+		err = b.reuse(b.asSiaPath(action.page, generation))
+		if err != nil {
+			f.Close()
+			return false, err
+		}
+
+		var src io.Reader = b.pageReader(f, action.page)
+		size := int64(pageSize)
+		var pack *packUpload
+		if b.packed() {
+			pack, err = b.packSource(ctx, action.page, src)
+			if err != nil {
+				f.Close()
+				return false, b.recordSia(err)
+			}
+			src = pack
+			size = pack.header.packSize()
+			b.cache.pages.get(action.page).uploadingSlots = pack.header.stored
+		}
+		var tagger hash.Hash
+		if b.integrity != nil {
+			tagger = b.integrity.tagger(b.packOf(action.page), generation)
+			src = io.TeeReader(src, tagger)
+		}
+
+		b.listing.invalidate()
+		start := b.now()
+		err = b.workerClient.UploadObject(ctx, src, siaPath.String()+b.uploadQuery)
+		if pack != nil {
+			err = pack.finish(err)
+		}
+		err = b.recordSia(err)
+		b.recordUpload(b.now().Sub(start), err)
+		if err == nil {
+			b.lifetime.Uploads += 1
+			b.lifetime.BytesUploaded += uint64(size)
+		}
+		f.Close()
+		if err != nil {
+			return false, err
+		}
+
+		if tagger != nil {
+			err = b.integrity.record(b.packOf(action.page), generation, tagger.Sum(nil),
+				b.cache.pages.get(action.page).generation)
+			if err != nil {
+				return false, err
+			}
+		}
+	case postponeUpload:
+		log.Printf("Postponing upload for page %d\n", action.page)
+
+		// The new generation may or may not have made it to Sia. Either
+		// way, it is outdated now, while the previous generation remains
+		// valid for the data that has not been changed since.
+		generation := b.cache.pages.get(action.page).uploadingGeneration
+		siaPath := b.asSiaPath(action.page, generation)
+		err := b.deleteObject(ctx, remotePage{page: b.packOf(action.page), generation: generation, siaPath: siaPath},
+			"postponed upload")
+		if err != nil {
+			log.Printf("Unable to delete outdated %s: %s\n", siaPath, err)
+		}
+	case openFile:
+		if b.cache.pages.get(action.page).file != nil {
+			panic("file handling is inconsistent")
+		}
+
+		file, err := b.openCacheFile(action.page)
+		if err != nil {
+			return false, err
+		}
+		err = b.writeCacheFileHeader(action.page, "")
+		if err != nil {
+			file.Close()
+			return false, err
+		}
+
+		b.cache.pages.get(action.page).file = file
+	case closeFile:
+		if b.cache.pages.get(action.page).file == nil {
+			panic("file handling is inconsistent")
+		}
+
+		err := b.writeCombined(action.page)
+		if err != nil {
+			return false, err
+		}
+
+		err = b.cache.pages.get(action.page).file.Close()
+		if err != nil {
+			return false, err
+		}
+
+		b.cache.pages.get(action.page).file = nil
+	case waitAndRetry:
+		return true, nil
+	default:
+		panic("unknown action")
 	}
 
-	writeThrottleLevel := b.cache.brain.cacheCount - (b.cache.brain.softMaxCached + writeThrottleLeeway)
-	if writeThrottleLevel >= 0 {
-		writeThrottleMultiplier := int64(math.Pow(2, float64(writeThrottleLevel)))
-		writeThrottleDuration := time.Duration(writeThrottleMultiplier * int64(writeThrottleInterval))
+	return false, nil
+}
 
-		b.mutex.Unlock()
-		time.Sleep(writeThrottleDuration)
-		b.mutex.Lock()
+// downloadPage downloads a generation of a page into its cache file via
+// the given node. The mutex needs to be held.
+func (b *Backend) downloadPage(ctx context.Context, page page, generation int, siaPath string,
+	workerClient *worker.Client) error {
+	err := b.fillCacheFile(page, generation, func(w io.Writer) error {
+		err := workerClient.DownloadObject(ctx, w, siaPath+shardParameters)
+		if workerClient == b.workerClient {
+			b.recordSia(err)
+		}
+		return err
+	})
+	return err
+}
+
+// fillCacheFile replaces the cache file of a page with what download
+// writes, verifying it against the integrity manifest.
+func (b *Backend) fillCacheFile(page page, generation int, download func(io.Writer) error) error {
+	cachePath := b.asCachePath(page)
+	err := os.Remove(cachePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := b.openCacheFile(page)
+	if err != nil {
+		return err
 	}
 
-	n := 0
-	for _, pageAccess := range determinePages(offset, len(buf)) {
-		for {
-			actions := b.cache.brain.prepareAccess(pageAccess.page, true, time.Now())
-			retry, err := b.handleActions(actions)
+	var dst io.Writer = &cacheFileWriter{file: f}
+	cacheWriter := dst
+	var unpacker *unpacker
+	if b.packed() {
+		unpacker = slotWriter(dst, int(page-b.packOf(page)))
+		dst = unpacker
+	}
+	var tagger hash.Hash
+	if b.integrity != nil {
+		tagger = b.integrity.tagger(b.packOf(page), generation)
+		dst = io.MultiWriter(dst, tagger)
+	}
+
+	w := bufio.NewWriterSize(dst, downloadBufferSize)
+	err = download(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && unpacker != nil {
+		err = unpacker.finishSlot(cacheWriter, int(page-b.packOf(page)))
+	}
+	f.Close()
+	if err == nil && tagger != nil {
+		err = b.verifyDownload(b.packOf(page), generation, tagger.Sum(nil))
+	}
+	if err != nil {
+		os.Remove(cachePath)
+		return err
+	}
+	if unpacker != nil {
+		b.packSlotsSeen(page, generation, *unpacker.header)
+	}
+	return nil
+}
+
+// maintenance does one maintenance cycle. The mutex needs to be held.
+func (b *Backend) maintenance() error {
+	if b.state == unavailable {
+		return nil
+	}
+
+	ctx, span := tracing.StartSpan(context.Background(), "maintenance")
+	defer span.End()
+	defer b.persistUploadQueue()
+	defer b.persistLifetimeStats()
+
+	b.checkCacheDisk()
+	b.checkCacheGrowth()
+
+	// bound how long writes linger in memory
+	err := b.writeAllCombined()
+	if err != nil {
+		return err
+	}
+
+	// leave dirty pages in the cache while the Sia daemon is failing
+	if !b.probe(ctx) {
+		return errSiaUnavailable
+	}
+	b.returnToPrimary(ctx)
+	b.checkRenterReady(ctx)
+	b.checkContractExpiry(ctx)
+	b.checkStalledUploads()
+
+	actions := b.cache.brain.maintenance(b.now())
+	_, err = b.handleActions(ctx, actions)
+	if err != nil {
+		span.SetError(err)
+		return err
+	}
+
+	if b.follower {
+		b.followStep(ctx)
+	} else {
+		b.recordEpoch(ctx)
+		b.storeManifest(ctx)
+		b.maintainTrash(ctx)
+	}
+
+	err = b.samplePageHealth(ctx)
+	if err != nil {
+		log.Printf("Unable to sample redundancy of pages: %s\n", err)
+	}
+	b.scrubStep(ctx)
+
+	if b.cache.brain.uploadingPages() == 0 {
+		return nil
+	}
+
+	var hosts map[string]bool
+	for _, page := range b.cache.brain.dirtyPages.sorted() {
+		if b.cache.brain.pages.state(page) != cachedUploading {
+			continue
+		}
+
+		remotePages, err := b.remoteGenerations(ctx, page)
+		if err != nil {
+			return err
+		}
+		remotePage, ok := findGeneration(remotePages, b.cache.pages.get(page).uploadingGeneration)
+		if !ok {
+			continue
+		}
+
+		if hosts == nil {
+			hosts, err = b.activeHosts(ctx)
 			if err != nil {
-				return n, err
+				return err
 			}
+		}
 
-			if !retry {
-				break
-			} else {
-				b.mutex.Unlock()
-				time.Sleep(waitInterval)
-				b.mutex.Lock()
+		// Keep the previous generation around until the new one is
+		// stored redundantly enough to be relied upon on its own.
+		redundancy, err := b.redundancyOn(ctx, remotePage.siaPath, hosts)
+		if err != nil {
+			return err
+		}
+
+		if redundancy < b.minimumRedundancy {
+			b.logger.Printf(redundancyLogKey(page), b.now(),
+				"Waiting for page %d to reach redundancy %.1f (currently %.1f)\n",
+				page, b.minimumRedundancy, redundancy)
+			continue
+		}
+		b.logger.Resolve(redundancyLogKey(page), b.now())
+		b.recordRedundancy(page, redundancy)
+
+		log.Printf("Upload complete for page %d\n", page)
+		b.logger.Resolve(uploadLogKey(page), b.now())
+		b.cache.pages.get(page).uploadFailures = 0
+		b.cache.pages.get(page).lastUploadError = ""
+		b.cache.pages.get(page).generation = remotePage.generation
+		b.cache.setOnSia(page)
+		b.uploadedSinceEpochMarker = true
+		b.cache.brain.uploadComplete(page, b.now())
+		b.packUploaded(page, remotePage.generation)
+		delete(b.stalePages, page)
+		if b.cache.pages.get(page).file != nil {
+			err = b.writeCacheFileHeader(page, "")
+			if err != nil {
+				log.Printf("Unable to update header of cache file of page %d: %s\n", page, err)
 			}
 		}
+		b.deleteSupersededGenerations(ctx, remotePages, page, remotePage.generation)
+	}
+
+	return nil
+}
+
+// persistUploadQueue saves the upload queue and logs any errors, as failing
+// to persist it only affects the order of uploads after a restart. The
+// mutex needs to be held.
+func (b *Backend) persistUploadQueue() {
+	err := b.saveUploadQueue()
+	if err != nil {
+		log.Printf("Unable to save upload queue: %s\n", err)
+	}
+}
+
+// uploadFailed puts the page back into the changed state, so that
+// maintenance will retry the upload, and sends a notification once the
+// failures exceed the configured threshold. The mutex needs to be held.
+func (b *Backend) uploadFailed(page page, err error) {
+	if b.cache.brain.pages.state(page) == cachedUploading {
+		b.cache.brain.setState(page, cachedChanged)
+	}
+
+	b.cache.pages.get(page).uploadFailures += 1
+	b.cache.pages.get(page).lastUploadError = err.Error()
+	b.lifetime.UploadFailures += 1
+	if b.cache.pages.get(page).uploadFailures == b.uploadFailureThreshold {
+		b.notifier.Notify(notify.UploadFailed, "upload of page %d failed %d times in a row: %s",
+			page, b.cache.pages.get(page).uploadFailures, err)
+	}
+}
+
+// checkReadHealth warns if a page that is about to be downloaded is stored
+// with less redundancy than desired. The mutex needs to be held.
+func (b *Backend) checkReadHealth(ctx context.Context, page page, siaPath string) {
+	redundancy, err := b.redundancy(ctx, siaPath)
+	if err != nil {
+		log.Printf("Unable to determine redundancy of page %d: %s\n", page, err)
+		return
+	}
+	b.recordRedundancy(page, redundancy)
+
+	if redundancy < b.warningRedundancy {
+		b.logger.Printf(readHealthLogKey(page), b.now(),
+			"Warning: page %d is stored with redundancy %.1f (below %.1f)\n",
+			page, redundancy, b.warningRedundancy)
+		b.notifier.Notify(notify.RedundancyDegraded, "page %d is stored with redundancy %.1f (below %.1f)",
+			page, redundancy, b.warningRedundancy)
+	} else {
+		b.logger.Resolve(readHealthLogKey(page), b.now())
+	}
+}
+
+// checkCacheDisk sends a notification when the file system holding the
+// cache becomes nearly full. The mutex needs to be held.
+func (b *Backend) checkCacheDisk() {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(b.dataDirectory, &stat)
+	if err != nil || stat.Blocks == 0 {
+		return
+	}
+
+	usedFraction := 1 - float64(stat.Bavail)/float64(stat.Blocks)
+	if usedFraction < cacheDiskFullFraction {
+		b.cacheDiskFull = false
+		return
+	}
+
+	if !b.cacheDiskFull {
+		log.Printf("File system holding the cache is %.0f%% full\n", usedFraction*100)
+		b.notifier.Notify(notify.CacheDiskFull, "file system holding the cache at %s is %.0f%% full",
+			b.dataDirectory, usedFraction*100)
+		b.cacheDiskFull = true
+	}
+}
+
+func (b *Backend) unavailable() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 
-		partialN, err := b.cache.pages[pageAccess.page].file.WriteAt(
-			buf[pageAccess.sliceLow:pageAccess.sliceHigh], pageAccess.offset)
+	return b.state == unavailable
+}
+
+func (b *Backend) Available() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state == available
+}
+
+// Size returns the size of the device in bytes.
+func (b *Backend) Size() int64 {
+	return b.size
+}
+
+// Close shuts the backend down, keeping pages that have not been uploaded
+// yet in the cache, like Shutdown(ShutdownCache).
+func (b *Backend) Close() error {
+	return b.Shutdown(ShutdownCache)
+}
+
+// ReadAt reads from the device. The mutex is taken for one page at a time,
+// so that requests spanning many pages interleave with other operations.
+// Reads that reach past the end of the device fail as a whole, so that the
+// part of the last page beyond the end is never read.
+func (b *Backend) ReadAt(ctx context.Context, buf []byte, offset int64) (int, error) {
+	if !blockdev.InRange(b.size, offset, int64(len(buf))) {
+		return 0, blockdev.ErrReadBeyondEnd
+	}
+
+	pageAccesses := determinePages(offset, len(buf))
+	defer b.dropPrefetches(b.prefetchPages(ctx, pageAccesses))
+
+	n := 0
+	for _, pageAccess := range pageAccesses {
+		partialN, err := b.readPage(ctx, pageAccess, buf[pageAccess.sliceLow:pageAccess.sliceHigh])
 		n += partialN
 		if err != nil {
 			return n, err
@@ -420,140 +1483,557 @@ func (b *Backend) WriteAt(buf []byte, offset int64) (int, error) {
 	return n, nil
 }
 
-func (b *Backend) Shutdown(thorough bool) error {
+func (b *Backend) readPage(ctx context.Context, pageAccess pageAccess, buf []byte) (int, error) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	b.state = shuttingDown
-	for {
-		actions := b.cache.brain.prepareShutdown(thorough)
-		retry, err := b.handleActions(actions)
+	if b.state != available {
+		return 0, errUnavailable
+	}
+
+	if b.cache.brain.pages.state(pageAccess.page) == zero && (b.follower || b.budgetExhausted()) {
+		// avoid allocating a page just to read zeroes from it
+		for i := range buf {
+			buf[i] = 0
+		}
+		return len(buf), nil
+	}
+
+	err := b.preparePage(ctx, pageAccess.page, false)
+	if err != nil {
+		return 0, err
+	}
+
+	err = b.writeCombined(pageAccess.page)
+	if err != nil {
+		return 0, err
+	}
+
+	_, span := tracing.StartSpan(ctx, "cache.read")
+	span.SetAttribute("page", int(pageAccess.page))
+	span.SetAttribute("length", pageAccess.length)
+	n, err := b.cache.pages.get(pageAccess.page).file.ReadAt(buf, pageAccess.offset)
+	span.SetError(err)
+	span.End()
+	return n, err
+}
+
+// WriteAt writes to the device, taking the mutex for one page at a time
+// like ReadAt. With DetectZeroes, the parts of the buffer that are nothing
+// but zeroes are written like WriteZeroes would. Writes that reach past the
+// end of the device fail as a whole.
+func (b *Backend) WriteAt(ctx context.Context, buf []byte, offset int64) (int, error) {
+	return b.writeAt(ctx, buf, offset, false)
+}
+
+// writeAt writes buf one page at a time. If zeroes is set, buf is known to
+// hold nothing but zeroes; otherwise, each page is checked for zeroes if
+// DetectZeroes is enabled.
+func (b *Backend) writeAt(ctx context.Context, buf []byte, offset int64, zeroes bool) (int, error) {
+	if !blockdev.InRange(b.size, offset, int64(len(buf))) {
+		return 0, blockdev.ErrBeyondEnd
+	}
+	if b.follower {
+		return 0, errFollower
+	}
+	err := b.throttleWrite(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, pageAccess := range determinePages(offset, len(buf)) {
+		slice := buf[pageAccess.sliceLow:pageAccess.sliceHigh]
+		pageZeroes := zeroes || (b.detectZeroes != DetectZeroesOff && isZero(slice))
+		partialN, err := b.writePage(ctx, pageAccess, slice, pageZeroes)
+		n += partialN
 		if err != nil {
-			return err
+			return n, err
 		}
+	}
+	return n, nil
+}
 
-		if !retry {
-			break
-		} else {
-			b.mutex.Unlock()
-			time.Sleep(waitInterval)
-			b.mutex.Lock()
+// throttleWrite slows down writers when the cache fills up or too much data
+// has not been uploaded yet.
+func (b *Backend) throttleWrite(ctx context.Context) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state != available {
+		return errUnavailable
+	}
+
+	for b.writesPaused {
+		b.mutex.Unlock()
+		b.sleep(waitInterval)
+		b.mutex.Lock()
+
+		if b.state != available {
+			return errUnavailable
 		}
 	}
 
-	cachedPages := getCachedPages(int(b.cache.brain.pageCount))
-	for _, page := range cachedPages {
-		log.Printf("Fast shutdown leaves unsynced changes in cache for page %d\n", page)
+	writeThrottleLevel := b.cache.brain.cacheCount - (b.cache.brain.softMaxCached + writeThrottleLeeway)
+	if b.cache.brain.dirtyLimitExceeded(b.now()) || b.resumingUploads() {
+		// bound potential data loss by slowing down writers
+		// until uploads catch up
+		if writeThrottleLevel < 0 {
+			writeThrottleLevel = 0
+		}
+		writeThrottleLevel += dirtyThrottleBoost
+	}
+	if writeThrottleLevel >= 0 {
+		writeThrottleMultiplier := int64(math.Pow(2, float64(writeThrottleLevel)))
+		writeThrottleDuration := time.Duration(writeThrottleMultiplier * int64(writeThrottleInterval))
+
+		_, span := tracing.StartSpan(ctx, "write_throttle")
+		span.SetAttribute("duration_ms", writeThrottleDuration.Milliseconds())
+		b.mutex.Unlock()
+		b.sleep(writeThrottleDuration)
+		b.mutex.Lock()
+		span.End()
 	}
 
-	b.state = unavailable
 	return nil
 }
 
-func (b *Backend) Wait() {
+// writePage writes to a single page. Zeroes written to a zero page are
+// dropped rather than allocating the page, and with DetectZeroesUnmap,
+// zeroes covering a whole page discard it if discarding is enabled.
+func (b *Backend) writePage(ctx context.Context, pageAccess pageAccess, buf []byte, zeroes bool) (int, error) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	for b.state != unavailable {
+	if b.state != available {
+		return 0, errUnavailable
+	}
+
+	if zeroes {
+		if b.cache.brain.pages.state(pageAccess.page) == zero {
+			return len(buf), nil
+		}
+		pageLength := withinSize(b.size, int64(pageAccess.page)*pageSize, pageSize)
+		if b.detectZeroes == DetectZeroesUnmap && b.discard &&
+			pageAccess.offset == 0 && pageAccess.length == pageLength {
+			err := b.discardPage(ctx, pageAccess.page)
+			if err == nil {
+				return len(buf), nil
+			}
+			if err != errPageUploading {
+				return 0, err
+			}
+		}
+	}
+
+	if b.cache.brain.pages.state(pageAccess.page) == zero && b.budgetExhausted() {
+		return 0, fmt.Errorf("unable to allocate page %d: storage budget of %d bytes exhausted: %w",
+			pageAccess.page, b.storageBudget, syscall.ENOSPC)
+	}
+
+	err := b.preparePage(ctx, pageAccess.page, true)
+	if err != nil {
+		return 0, err
+	}
+
+	err = b.changes.record(uint64(pageAccess.page)*pageSize+uint64(pageAccess.offset), uint64(len(buf)))
+	if err != nil {
+		return 0, err
+	}
+
+	if pageAccess.length < b.writeCombineBytes && b.cachingMode != CacheWritethrough {
+		err = b.combineWrite(pageAccess.page, buf, pageAccess.offset)
+		if err != nil {
+			return 0, err
+		}
+		return len(buf), nil
+	}
+
+	err = b.writeCombined(pageAccess.page)
+	if err != nil {
+		return 0, err
+	}
+
+	_, span := tracing.StartSpan(ctx, "cache.write")
+	span.SetAttribute("page", int(pageAccess.page))
+	span.SetAttribute("length", pageAccess.length)
+	n, err := b.cache.pages.get(pageAccess.page).file.WriteAt(buf, pageAccess.offset)
+	span.SetError(err)
+	span.End()
+	if err != nil || b.cachingMode != CacheWritethrough {
+		return n, err
+	}
+	return n, b.syncPage(pageAccess.page)
+}
+
+// syncPage makes a write to a page survive a crash of the machine right
+// away, along with the directory entry of its cache file and the change
+// journal. The mutex needs to be held.
+func (b *Backend) syncPage(page page) error {
+	err := b.cache.pages.get(page).file.Sync()
+	if err != nil {
+		return err
+	}
+	err = b.changes.sync()
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.Open(b.dataDirectory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Flush makes sure that all writes so far survive a crash of this machine by
+// syncing the cache files to disk. It also ends the current flush epoch, so
+// that with ordered uploads, the pages written to so far are uploaded before
+// any pages written to afterwards. With CacheUnsafe, nothing is synced.
+func (b *Backend) Flush(ctx context.Context) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state != available {
+		return errUnavailable
+	}
+
+	err := b.writeAllCombined()
+	if err != nil {
+		return err
+	}
+
+	if b.cachingMode != CacheUnsafe {
+		err = b.syncCache()
+		if err != nil {
+			return err
+		}
+		err = b.changes.sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	b.cache.brain.flush()
+	b.flushTimes[b.cache.brain.epoch] = b.now()
+	b.lifetime.Flushes += 1
+	return nil
+}
+
+// budgetExhausted reports whether allocating one more page would exceed the
+// storage budget. The mutex needs to be held.
+func (b *Backend) budgetExhausted() bool {
+	if b.storageBudget == 0 {
+		return false
+	}
+
+	projectedPages := uint64(b.cache.brain.allocatedPages() + 1)
+	return b.uploadParameters.storedBytes(projectedPages) > b.storageBudget
+}
+
+// preparePage makes sure that the page is present in the cache, waiting for
+// maintenance to free up space if necessary. The mutex needs to be held.
+func (b *Backend) preparePage(ctx context.Context, page page, isWrite bool) error {
+	ctx, span := tracing.StartSpan(ctx, "cache.lookup")
+	defer span.End()
+	span.SetAttribute("page", int(page))
+
+	var wait *pageWait
+	defer func() { b.endWait(wait) }()
+
+	for {
+		actions := b.cache.brain.prepareAccess(page, isWrite, b.now())
+		retry, err := b.handleActions(ctx, actions)
+		if err != nil {
+			span.SetError(err)
+			return err
+		}
+
+		if !retry {
+			return nil
+		}
+
+		if wait == nil {
+			wait = b.beginWait(page, isWrite)
+		}
+		b.checkWait(wait)
+
 		b.mutex.Unlock()
-		time.Sleep(waitInterval)
+		b.sleep(waitInterval)
 		b.mutex.Lock()
 	}
 }
 
-func getUploadedPages(workerClient *worker.Client, checkRedundancy bool) ([]page, error) {
-	pages := []page{}
+// DirtyData reports how much data has not been uploaded to Sia yet.
+func (b *Backend) DirtyData() DirtyData {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	pages, oldestWrite := b.cache.brain.dirtyStats()
+	return DirtyData{
+		Pages:       pages,
+		Bytes:       uint64(pages) * pageSize,
+		OldestWrite: oldestWrite,
+	}
+}
+
+// Usage reports how many pages are in which state, how much storage they
+// take up on Sia (assuming the upload redundancy) and how much space the
+// cache files actually occupy on disk.
+func (b *Backend) Usage() Usage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 
-	fmt.Println("getUploadedPages")
-	//fmt.Println( useCachedRenterInfo )
+	usage := Usage{
+		Pages:       b.cache.pageCount,
+		ZeroPages:   b.cache.pageCount - b.cache.brain.allocatedPages(),
+		RemotePages: b.cache.remotePages,
+		CachedPages: len(b.cache.brain.cachedPages),
+		DirtyPages:  len(b.cache.brain.dirtyPages),
+		GhostBytes:  b.ghost.bytes(),
+		Lifetime:    b.lifetime,
+	}
+	for page := range b.cache.brain.cachedPages {
+		usage.CacheBytes += diskUsage(b.asCachePath(page))
+	}
+	usage.RemoteBytes = b.uploadParameters.storedBytes(uint64(usage.RemotePages))
 
-	_path := siaPathPrefix+"/"
-	fmt.Println( _path )
+	return usage
+}
+
+func (b *Backend) Shutdown(level ShutdownLevel) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 
-	//renterFiles, err := httpClient.RenterFilesGet(useCachedRenterInfo)
-	renterFiles, err := workerClient.ObjectEntries( context.Background(), _path )
+	if b.follower && level == ShutdownRemote {
+		return errFollowerUpload
+	}
+
+	b.state = shuttingDown
+	err := b.writeAllCombined()
 	if err != nil {
-		fmt.Println("workerClient.ObjectEntries ERROR")
-		return pages, nil
-		//return pages, err
+		return err
 	}
 
-	//_t := reflect.TypeOf( renterFiles )
+	drainBegin := b.now()
+	lastRemaining := -1
+	for {
+		if level == ShutdownRemote && atomic.LoadInt32(&b.shutdownInterrupted) != 0 {
+			log.Printf("Shutdown interrupted - no longer waiting for uploads\n")
+			level = ShutdownCache
+		}
 
-	//fmt.Println( _t )
+		actions := b.cache.brain.prepareShutdown(level == ShutdownRemote)
+		retry, err := b.handleActions(context.Background(), actions)
+		if err != nil {
+			return err
+		}
 
-	fmt.Println( renterFiles )
+		if !retry {
+			break
+		}
 
-	//return pages, nil
+		remaining := len(b.cache.brain.dirtyPages)
+		if remaining != lastRemaining {
+			log.Printf("Waiting for %d page(s) (%d MiB) to be uploaded before exiting (%s so far)\n",
+				remaining, remaining*(pageSize/(1024*1024)), b.now().Sub(drainBegin).Round(time.Second))
+			lastRemaining = remaining
+		}
 
-	for _, fileInfo := range renterFiles {
-		//if !isRelevantSiaPath(fileInfo.SiaPath.String()) {
-		//	continue
-		//}
+		// in case the process is killed while waiting
+		b.persistUploadQueue()
 
-		fmt.Println( fileInfo )
+		b.mutex.Unlock()
+		b.sleep(waitInterval)
+		b.mutex.Lock()
+	}
 
-		page, err := getPageFromSiaPath( fileInfo )
+	if level == ShutdownCache {
+		log.Printf("Syncing %d page(s) to disk\n", len(b.cache.brain.dirtyPages))
+		err = b.syncCache()
 		if err != nil {
-			return pages, err
+			return err
 		}
+	}
 
+	cachedPages := getCachedPages(b.dataDirectory, int(b.cache.brain.pageCount))
+	for _, page := range cachedPages {
+		log.Printf("Shutdown leaves changes not on Sia yet in cache for page %d\n", page)
 
-		// I think if a object is returned by workerClient.ObjectEntries
-		// its been uploaded.
+		// lets the next start tell whether the file changed meanwhile
+		checksum, err := checksumFile(b.asCachePath(page))
+		if err == nil {
+			err = b.writeCacheFileHeader(page, checksum)
+		}
+		if err != nil {
+			log.Printf("Unable to record checksum of cache file of page %d: %s\n", page, err)
+		}
+	}
+	if len(cachedPages) > 0 {
+		log.Printf("%d page(s) (%d MiB) will be uploaded first on the next start; see %s\n",
+			len(cachedPages), b.backlogBytes()/(1024*1024), uploadQueuePath(b.dataDirectory))
+	}
+
+	b.recordEpoch(context.Background())
+	b.persistUploadQueue()
+	b.persistLifetimeStats()
+	b.state = unavailable
+	err = b.audit.close()
+	changesErr := b.changes.close(true)
+	if err == nil {
+		err = changesErr
+	}
+	b.zeroTemplate.close()
+	if b.dataLock != nil {
+		b.dataLock.Close()
+	}
+	return err
+}
 
-		//uploadComplete := fileInfo.Available && fileInfo.Recoverable &&
-		//	(!checkRedundancy || fileInfo.Redundancy >= minimumRedundancy)
-		//if uploadComplete {
-			pages = append(pages, page)
-		//}
+// InterruptShutdown makes a Shutdown that is waiting for uploads stop
+// waiting and leave the remaining data in the cache instead.
+func (b *Backend) InterruptShutdown() {
+	atomic.StoreInt32(&b.shutdownInterrupted, 1)
+}
 
+// resumingUploads reports whether pages left over from a previous run are
+// still waiting to be uploaded. The mutex needs to be held.
+func (b *Backend) resumingUploads() bool {
+	for page := range b.cache.brain.dirtyPages {
+		if b.cache.brain.pages.get(page).dirtySince.Before(b.startedAt) {
+			return true
+		}
 	}
+	return false
+}
 
-	return pages, nil
+// backlogBytes returns the disk space taken up by pages with data not on
+// Sia yet. The mutex needs to be held.
+func (b *Backend) backlogBytes() uint64 {
+	bytes := uint64(0)
+	for page := range b.cache.brain.dirtyPages {
+		bytes += diskUsage(b.asCachePath(page))
+	}
+	return bytes
 }
 
-func getCachedPages(pageCount int) []page {
+// syncCache makes sure that the cache files of all pages with data not on
+// Sia yet are on disk. The mutex needs to be held.
+func (b *Backend) syncCache() error {
+	for page := range b.cache.brain.dirtyPages {
+		file := b.cache.pages.get(page).file
+		if file == nil {
+			continue
+		}
+
+		err := file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	// persist the directory entries of newly created cache files
+	dir, err := os.Open(b.dataDirectory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (b *Backend) Wait() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for b.state != unavailable {
+		b.mutex.Unlock()
+		b.sleep(waitInterval)
+		b.mutex.Lock()
+	}
+}
+
+// getCachedPages reads the cache directory once, rather than looking for
+// the cache file of every page, which would take long for large devices.
+func getCachedPages(dataDirectory string, pageCount int) []page {
 	pages := []page{}
 
-	for i := 0; i < pageCount; i++ {
-		cachePath := asCachePath(page(i))
+	fileInfos, err := ioutil.ReadDir(dataDirectory)
+	if err != nil {
+		return pages
+	}
+
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() || !strings.HasPrefix(fileInfo.Name(), "page") {
+			continue
+		}
 
-		if fileCanBeStated(cachePath) {
-			pages = append(pages, page(i))
+		pageNumber, err := parseNumber(strings.TrimPrefix(fileInfo.Name(), "page"))
+		if err != nil || pageNumber >= pageCount {
+			continue
 		}
+		pages = append(pages, page(pageNumber))
 	}
 
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i] < pages[j]
+	})
 	return pages
 }
 
-func fileCanBeStated(name string) bool {
-	_, err := os.Stat(name)
-	return err == nil
+// diskUsage returns the space allocated to a file, which is less than its
+// size for sparse cache files.
+func diskUsage(name string) uint64 {
+	fileInfo, err := os.Stat(name)
+	if err != nil {
+		return 0
+	}
+
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return uint64(fileInfo.Size())
+	}
+	return uint64(stat.Blocks) * 512
+}
+
+func (pt ioPageTable) get(page page) *pageIODetails {
+	details, ok := pt[page]
+	if !ok {
+		details = &pageIODetails{}
+		pt[page] = details
+	}
+	return details
 }
 
-func asSiaPath(page page) string {
-	return fmt.Sprintf("%s/page%d", siaPathPrefix, page)
+func (c *cache) setOnSia(page page) {
+	if !c.pages.get(page).onSia {
+		c.pages.get(page).onSia = true
+		c.remotePages += 1
+	}
 }
 
-func asCachePath(page page) string {
-	return config.PrependDataDirectory(fmt.Sprintf("page%d", page))
+func (b *Backend) asCachePath(page page) string {
+	return asCachePath(b.dataDirectory, page)
 }
 
-func isRelevantSiaPath(siaPath string) bool {
-	return strings.HasPrefix(siaPath, fmt.Sprintf("%s/page", siaPathPrefix))
+func uploadLogKey(page page) string {
+	return fmt.Sprintf("page %d upload", page)
 }
 
-func getPageFromSiaPath(siaPath string) (page, error) {
-	var page page
+func redundancyLogKey(page page) string {
+	return fmt.Sprintf("page %d redundancy check", page)
+}
 
-	format := fmt.Sprintf("/%s/page%%d", siaPathPrefix)
-	_, err := fmt.Sscanf(siaPath, format, &page)
-	if err != nil {
-		return 0, err
-	}
+func readHealthLogKey(page page) string {
+	return fmt.Sprintf("page %d read health check", page)
+}
 
-	return page, nil
+func downloadLogKey(page page) string {
+	return fmt.Sprintf("page %d download", page)
+}
+
+func asCachePath(dataDirectory string, page page) string {
+	return filepath.Join(dataDirectory, fmt.Sprintf("page%d", page))
 }
 
 func determinePages(offset int64, length int) []pageAccess {
@@ -582,9 +2062,49 @@ func determinePages(offset int64, length int) []pageAccess {
 	return pageAccesses
 }
 
+// withinSize returns how many of the length bytes at offset lie within a
+// device of the given size.
+func withinSize(size int64, offset int64, length int) int {
+	if offset >= size {
+		return 0
+	}
+	if size-offset < int64(length) {
+		return int(size - offset)
+	}
+	return length
+}
+
+// pageReader reads a page from its cache file for uploading. The last page
+// is padded with zeroes beyond the end of the device, so that every page on
+// Sia has the same size.
+func (b *Backend) pageReader(f io.ReaderAt, page page) io.Reader {
+	length := int64(withinSize(b.size, int64(page)*pageSize, pageSize))
+	if length == pageSize {
+		return io.NewSectionReader(f, 0, pageSize)
+	}
+	return io.MultiReader(io.NewSectionReader(f, 0, length),
+		io.LimitReader(zeroReader{}, pageSize-length))
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(buf []byte) (int, error) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	return len(buf), nil
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
 	}
 	return b
 }
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
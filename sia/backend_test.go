@@ -1,7 +1,17 @@
 package sia
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -64,3 +74,214 @@ func TestDeterminePages(t *testing.T) {
 	}
 	assert.Equal(t, expectedThirdPageAccess, pageAccesses[2])
 }
+
+func TestWithinSize(t *testing.T) {
+	size := int64(pageSize + 100)
+	assert.Equal(t, 10, withinSize(size, 0, 10))
+	assert.Equal(t, 10, withinSize(size, pageSize+90, 10))
+	assert.Equal(t, 5, withinSize(size, pageSize+95, 10), "expected I/O to be clamped to the end")
+	assert.Equal(t, 0, withinSize(size, pageSize+100, 10))
+	assert.Equal(t, 0, withinSize(size, 2*pageSize, 10))
+}
+
+func TestLargeDevices(t *testing.T) {
+	assert.Equal(t, math.MaxInt32, pageCountFor(MaxSize))
+
+	for _, size := range []int64{4 << 30, 2 << 40, 16 << 40} {
+		assert.Equal(t, int(size/pageSize), pageCountFor(uint64(size)))
+
+		// a request across the page boundary just before the end
+		pageAccesses := determinePages(size-pageSize-1, 2)
+		assert.Equal(t, 2, len(pageAccesses))
+		assert.Equal(t, page(size/pageSize-2), pageAccesses[0].page)
+		assert.Equal(t, int64(pageSize-1), pageAccesses[0].offset)
+		assert.Equal(t, page(size/pageSize-1), pageAccesses[1].page)
+		assert.Equal(t, int64(0), pageAccesses[1].offset)
+
+		assert.Equal(t, 10, withinSize(size, size-10, 10))
+		assert.Equal(t, 5, withinSize(size, size-5, 10))
+
+		b := newTestBackend(t, 1, "")
+		b.size = size
+		whole := b.wholePages(0, size)
+		assert.Equal(t, int(size/pageSize), len(whole))
+		assert.Equal(t, page(size/pageSize-1), whole[len(whole)-1].page)
+	}
+}
+
+func TestOutOfRange(t *testing.T) {
+	backend := newTestBackend(t, 2, "")
+	backend.size = pageSize + 100
+	ctx := context.Background()
+
+	// nothing reaches the pages, so no mutex is needed
+	for _, offset := range []int64{-1, pageSize + 95, 2 * pageSize, 1 << 62} {
+		n, err := backend.ReadAt(ctx, make([]byte, 10), offset)
+		assert.Equal(t, 0, n)
+		assert.True(t, errors.Is(err, syscall.EINVAL), "read at %d", offset)
+
+		n, err = backend.WriteAt(ctx, make([]byte, 10), offset)
+		assert.Equal(t, 0, n)
+		assert.True(t, errors.Is(err, syscall.ENOSPC), "write at %d", offset)
+
+		err = backend.WriteZeroes(ctx, offset, 10, true)
+		assert.True(t, errors.Is(err, syscall.ENOSPC), "zero write at %d", offset)
+	}
+	err := backend.WriteZeroes(ctx, 0, 1<<63-1, false)
+	assert.True(t, errors.Is(err, syscall.ENOSPC), "expected overflow to be caught")
+}
+
+func TestPageReader(t *testing.T) {
+	backend := newTestBackend(t, 2, "")
+	backend.size = pageSize + 10
+	f := bytes.NewReader(bytes.Repeat([]byte{0xff}, 20))
+
+	data, err := ioutil.ReadAll(backend.pageReader(f, page(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, pageSize, len(data), "expected the last page to be padded")
+	assert.Equal(t, bytes.Repeat([]byte{0xff}, 10), data[:10])
+	assert.Equal(t, -1, bytes.IndexByte(data[10:], 0xff), "expected zeroes beyond the end")
+}
+
+func TestBudgetExhausted(t *testing.T) {
+	backend := newTestBackend(t, 10, "")
+	assert.False(t, backend.budgetExhausted(), "expected no budget to be unlimited")
+
+	// enough for two pages at the upload redundancy
+	backend.storageBudget = 2 * pageSize * totalShards / minShards
+	assert.False(t, backend.budgetExhausted())
+
+	backend.cache.brain.setState(page(3), cachedChanged)
+	assert.False(t, backend.budgetExhausted())
+
+	backend.cache.brain.setState(page(7), notCached)
+	assert.True(t, backend.budgetExhausted(), "expected remote-only pages to count")
+}
+
+func TestUsage(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	backend := newTestBackend(t, 10, dataDirectory)
+	backend.mutex = &sync.Mutex{}
+	backend.cache.brain.setState(page(1), notCached)
+	backend.cache.setOnSia(page(1))
+	backend.cache.brain.setState(page(2), cachedUnchanged)
+	backend.cache.setOnSia(page(2))
+	backend.cache.brain.setState(page(3), cachedChanged)
+
+	err = ioutil.WriteFile(backend.asCachePath(page(3)), make([]byte, 8192), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage := backend.Usage()
+	assert.Equal(t, 10, usage.Pages)
+	assert.Equal(t, 7, usage.ZeroPages)
+	assert.Equal(t, 2, usage.RemotePages)
+	assert.Equal(t, 2, usage.CachedPages)
+	assert.Equal(t, 1, usage.DirtyPages)
+	assert.Equal(t, uint64(2*pageSize*totalShards/minShards), usage.RemoteBytes)
+	assert.True(t, usage.CacheBytes >= 8192, "expected written cache file to be counted")
+}
+
+func TestGetCachedPages(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "cachedpages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	for _, name := range []string{"page10", "page2", "page03", "page99", "uploadqueue.json"} {
+		err = ioutil.WriteFile(filepath.Join(dataDirectory, name), []byte{}, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assert.Equal(t, []page{2, 10}, getCachedPages(dataDirectory, 20))
+}
+
+func TestParseShutdownLevel(t *testing.T) {
+	for _, level := range []ShutdownLevel{ShutdownNone, ShutdownCache, ShutdownRemote} {
+		parsed, err := ParseShutdownLevel(level.String())
+		assert.Nil(t, err)
+		assert.Equal(t, level, parsed)
+	}
+
+	_, err := ParseShutdownLevel("thorough")
+	assert.NotNil(t, err)
+}
+
+func TestResumingUploads(t *testing.T) {
+	backend := newTestBackend(t, 10, "")
+	backend.startedAt = time.Now()
+
+	backend.cache.brain.markDirty(page(1), backend.startedAt.Add(-time.Hour))
+	backend.cache.brain.markDirty(page(2), backend.startedAt.Add(time.Second))
+	assert.True(t, backend.resumingUploads(), "expected page from previous run to hold up writes")
+
+	backend.cache.brain.uploadComplete(page(1), backend.startedAt.Add(time.Minute))
+	assert.False(t, backend.resumingUploads(), "expected pages written since start to be ignored")
+
+	backend.cache.brain.markDirty(page(1), backend.startedAt.Add(2*time.Minute))
+	assert.False(t, backend.resumingUploads())
+}
+
+func TestReconfigure(t *testing.T) {
+	backend := newTestBackend(t, 10, "")
+	backend.mutex = &sync.Mutex{}
+	backend.cache.brain.pages.get(page(3)).idleInterval = 10 * time.Minute
+
+	settings := BackendSettings{
+		HardMaxCached:   16,
+		SoftMaxCached:   8,
+		IdleInterval:    time.Minute,
+		MinIdleInterval: 30 * time.Second,
+		MaxIdleInterval: 5 * time.Minute,
+		MaxDirtyBytes:   pageSize + 1,
+		StorageBudget:   1 << 40,
+	}
+	assert.Nil(t, backend.Reconfigure(settings))
+	assert.Equal(t, 16, backend.cache.brain.hardMaxCached)
+	assert.Equal(t, 8, backend.cache.brain.softMaxCached)
+	assert.Equal(t, 30*time.Second, backend.cache.brain.minIdleInterval)
+	assert.Equal(t, 2, backend.cache.brain.maxDirtyPages)
+	assert.Equal(t, uint64(1<<40), backend.storageBudget)
+	assert.Equal(t, 5*time.Minute, backend.cache.brain.pages.get(page(3)).idleInterval,
+		"expected adapted idle interval to be kept within new bounds")
+
+	settings.SoftMaxCached = 16
+	assert.NotNil(t, backend.Reconfigure(settings))
+	assert.Equal(t, 8, backend.cache.brain.softMaxCached, "expected invalid settings to be rejected as a whole")
+}
+
+func TestReconfigureBelowCacheCount(t *testing.T) {
+	backend := newTestBackend(t, 10, "")
+	backend.mutex = &sync.Mutex{}
+	now := time.Now()
+	for i := 0; i < 6; i++ {
+		backend.cache.brain.prepareAccess(page(i), true, now)
+	}
+
+	settings := BackendSettings{HardMaxCached: 4, SoftMaxCached: 2, IdleInterval: time.Minute}
+	assert.Nil(t, backend.Reconfigure(settings))
+	assert.Nil(t, backend.cache.brain.checkInvariants(),
+		"expected pages cached under the previous limit to be allowed until evicted")
+	actions := backend.cache.brain.prepareAccess(page(7), true, now)
+	assert.Equal(t, []action{{actionType: waitAndRetry}}, actions)
+
+	for _, page := range []page{0, 1} {
+		backend.cache.brain.uploadComplete(page, now)
+		_, err := backend.cache.brain.evict(page)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 0, backend.cache.brain.heldLimit, "expected the previous limit to be dropped")
+	backend.cache.brain.setState(page(8), cachedUnchanged)
+	assert.NotNil(t, backend.cache.brain.checkInvariants(), "expected the new limit to be checked")
+}
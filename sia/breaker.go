@@ -0,0 +1,100 @@
+package sia
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+)
+
+type (
+	// circuitBreaker stops talking to the Sia daemon after a number of
+	// consecutive failed requests, rather than having every download and
+	// every maintenance cycle run into the same timeouts. With several
+	// nodes, the next one is tried first; the breaker only opens once all
+	// of them have failed. While it is open, cached pages are read and
+	// written as usual and dirty pages wait in the cache; only pages that
+	// would have to be downloaded fail right away. Maintenance probes the
+	// daemon every probeInterval and closes the breaker once it answers
+	// again. A zero threshold disables the breaker and failing over.
+	circuitBreaker struct {
+		threshold     int
+		probeInterval time.Duration
+
+		failures  int
+		failovers int
+		open      bool
+		openedAt  time.Time
+		lastProbe time.Time
+	}
+)
+
+const probeLogKey = "sia daemon probe"
+
+// errSiaUnavailable is returned for downloads while the breaker is open.
+var errSiaUnavailable = fmt.Errorf("Sia daemon is failing, not sending requests for now: %w", syscall.EIO)
+
+// recordSia notes the outcome of a request to the Sia daemon and returns
+// err unchanged. The mutex needs to be held.
+func (b *Backend) recordSia(err error) error {
+	cb := &b.breaker
+	if err == nil {
+		cb.failures = 0
+		cb.failovers = 0
+		return nil
+	}
+
+	cb.failures += 1
+	if cb.threshold == 0 || cb.failures < cb.threshold || cb.open {
+		return err
+	}
+
+	if cb.failovers < len(b.nodes)-1 {
+		log.Printf("Sia daemon failed %d times in a row: %s\n", cb.failures, err)
+		cb.failovers += 1
+		cb.failures = 0
+		b.useNode((b.activeNode + 1) % len(b.nodes))
+		return err
+	}
+
+	log.Printf("Sia daemon failed %d times in a row; pausing requests to it: %s\n", cb.failures, err)
+	cb.open = true
+	cb.openedAt = b.now()
+	cb.lastProbe = cb.openedAt
+	return err
+}
+
+// probe checks whether an open breaker can be closed again, trying the
+// nodes in turn. It returns false while the daemon is still considered
+// unavailable. Probes list the metadata directory, which stays small no
+// matter how many pages there are. The mutex needs to be held.
+func (b *Backend) probe(ctx context.Context) bool {
+	cb := &b.breaker
+	if !cb.open {
+		return true
+	}
+
+	now := b.now()
+	if now.Before(cb.lastProbe.Add(cb.probeInterval)) {
+		return false
+	}
+	cb.lastProbe = now
+
+	_, err := b.workerClient.ObjectEntries(ctx, metadataDirectory(b.siaPathPrefix)+"/")
+	if err != nil {
+		b.logger.Printf(probeLogKey, now, "Sia daemon still unavailable: %s\n", err)
+		if len(b.nodes) > 1 {
+			b.useNode((b.activeNode + 1) % len(b.nodes))
+		}
+		return false
+	}
+
+	b.logger.Resolve(probeLogKey, now)
+	log.Printf("Sia daemon is available again after %s; resuming requests\n",
+		now.Sub(cb.openedAt).Round(time.Second))
+	cb.open = false
+	cb.failures = 0
+	cb.failovers = 0
+	return true
+}
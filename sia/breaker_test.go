@@ -0,0 +1,76 @@
+package sia
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	b := &Backend{
+		clock:   clock,
+		breaker: circuitBreaker{threshold: 3, probeInterval: 30 * time.Second},
+		nodes:   []siaNode{newSiaNode("primary:9980", ""), newSiaNode("fallback:9980", "")},
+	}
+	b.useNode(0)
+
+	failure := errors.New("connection refused")
+	assert.Equal(t, failure, b.recordSia(failure))
+	assert.Equal(t, failure, b.recordSia(failure))
+	assert.Nil(t, b.recordSia(nil))
+	assert.False(t, b.breaker.open, "expected success to reset the failures")
+
+	// the fallback node is tried before the breaker opens
+	for i := 0; i < 3; i++ {
+		b.recordSia(failure)
+	}
+	assert.False(t, b.breaker.open)
+	assert.Equal(t, 1, b.activeNode)
+	assert.Equal(t, b.nodes[1].workerClient, b.workerClient)
+
+	for i := 0; i < 3; i++ {
+		b.recordSia(failure)
+	}
+	assert.True(t, b.breaker.open)
+
+	// no probe is sent before the interval has passed
+	clock.Sleep(10 * time.Second)
+	assert.False(t, b.probe(context.Background()))
+
+	disabled := &Backend{clock: clock}
+	for i := 0; i < 100; i++ {
+		disabled.recordSia(failure)
+	}
+	assert.False(t, disabled.breaker.open)
+}
+
+func TestPickReadNode(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	b := &Backend{
+		clock:     clock,
+		breaker:   circuitBreaker{probeInterval: 30 * time.Second},
+		nodes:     []siaNode{newSiaNode("a:9980", ""), newSiaNode("b:9980", ""), newSiaNode("c:9980", "")},
+		readStats: make([]readStats, 3),
+	}
+	b.useNode(0)
+
+	b.readStats[0].latency = 3 * time.Second
+	assert.Equal(t, 1, b.pickReadNode(), "expected node without latency to be tried")
+
+	b.readStats[1].latency = 2 * time.Second
+	b.readStats[2].latency = time.Second
+	assert.Equal(t, 2, b.pickReadNode())
+
+	b.readStats[2].lastFailed = clock.Now()
+	assert.Equal(t, 1, b.pickReadNode(), "expected recently failed node to be avoided")
+
+	clock.Sleep(time.Minute)
+	for i := 0; i < readExploreEvery-4; i++ {
+		assert.Equal(t, 2, b.pickReadNode())
+	}
+	assert.Equal(t, 1, b.pickReadNode(), "expected the next node in turn to be explored")
+}
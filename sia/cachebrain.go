@@ -2,6 +2,7 @@ package sia
 
 import (
 	"errors"
+	"fmt"
 	"sort"
 	"time"
 )
@@ -9,12 +10,26 @@ import (
 type (
 	state int
 
-	page int
+	page int64
 
 	pageDetails struct {
 		state            state
 		lastAccess       time.Time
+		lastWrite        time.Time
 		lastPostponement time.Time
+		dirtySince       time.Time
+		lastUpload       time.Time
+
+		// dirtyEpoch is the flush epoch in which the page became dirty.
+		dirtyEpoch uint64
+
+		// idleInterval is the page's own idle interval if adaptive idle
+		// intervals are enabled (0 = not adapted yet).
+		idleInterval time.Duration
+
+		// uploadRequested forces an upload of the page regardless of
+		// its idle state until it is clean again.
+		uploadRequested bool
 	}
 
 	lastAccessDetails struct {
@@ -22,13 +37,78 @@ type (
 		page       page
 	}
 
+	pageSet map[page]struct{}
+
+	// pageTable only holds entries for pages that have been touched, so
+	// that huge, sparsely used devices do not need memory for every page.
+	pageTable map[page]*pageDetails
+
 	cacheBrain struct {
 		pageCount     int
 		cacheCount    int
 		hardMaxCached int
 		softMaxCached int
 		idleInterval  time.Duration
-		pages         []pageDetails
+		pages         pageTable
+
+		// writeReserve pages below the hard limit can only be filled by
+		// writes. Maintenance evicts clean pages to keep them free.
+		writeReserve int
+		// readOverflow pages beyond the hard limit can be filled by reads
+		// while every cached page is dirty, so that reads do not have to
+		// wait for uploads to finish.
+		readOverflow int
+		// extraCapacity pages beyond the hard limit have been granted by
+		// the watchdog to requests that were stuck waiting for space.
+		extraCapacity int
+		// heldLimit is the highest cache limit in effect since the cache
+		// last fit within the current one (0 = it does). Lowering the
+		// limits does not evict pages right away; maintenance catches up.
+		heldLimit int
+
+		// Indexes over the page states, kept up to date by setState, so
+		// that maintenance only needs to look at the (comparatively
+		// few) cached pages instead of every page of the device.
+		cachedPages    pageSet
+		dirtyPages     pageSet
+		allocatedCount int
+
+		// Limits for data that has not been uploaded yet (0 = unlimited).
+		// Exceeding them forces uploads regardless of idle state.
+		maxDirtyAge   time.Duration
+		maxDirtyPages int
+
+		// uploadLimit is the number of pages that may be uploading at
+		// once (0 = unlimited). Maintenance starts no uploads beyond it.
+		uploadLimit int
+		// uploadsHeld keeps maintenance from starting uploads while the
+		// Sia daemon is not ready to store data.
+		uploadsHeld bool
+
+		// Bounds for adaptive idle intervals. Pages that keep being
+		// re-written wait longer before being uploaded, while all pages
+		// fall back to the minimum once the device has gone quiet.
+		// Adaptation is disabled if the bounds are equal.
+		minIdleInterval time.Duration
+		maxIdleInterval time.Duration
+		lastWrite       time.Time
+		// lastAccess is the time of the latest read or write.
+		lastAccess time.Time
+
+		// With ordered uploads, pages that became dirty before a flush
+		// are all uploaded before any page that became dirty after it.
+		// epoch counts the flushes so far.
+		orderedUploads bool
+		epoch          uint64
+
+		// pagesPerObject is the number of consecutive pages stored
+		// together in one pack on Sia (0 or 1 = every page on its
+		// own). Only one page of a pack is uploaded at a time.
+		pagesPerObject int
+
+		// readOnly is set for followers, which serve never-written pages
+		// as zeroes without allocating them and never upload anything.
+		readOnly bool
 	}
 
 	actionType int
@@ -58,6 +138,8 @@ const (
 	waitAndRetry
 )
 
+var errPageDirty = errors.New("page has not been uploaded yet")
+
 func newCacheBrain(pageCount int, hardMaxCached int, softMaxCached int,
 	idleInterval time.Duration) (*cacheBrain, error) {
 	if softMaxCached >= hardMaxCached {
@@ -65,12 +147,16 @@ func newCacheBrain(pageCount int, hardMaxCached int, softMaxCached int,
 	}
 
 	cacheBrain := cacheBrain{
-		pageCount:     pageCount,
-		cacheCount:    0,
-		hardMaxCached: hardMaxCached,
-		softMaxCached: softMaxCached,
-		idleInterval:  idleInterval,
-		pages:         make([]pageDetails, pageCount),
+		pageCount:       pageCount,
+		cacheCount:      0,
+		hardMaxCached:   hardMaxCached,
+		softMaxCached:   softMaxCached,
+		idleInterval:    idleInterval,
+		pages:           make(pageTable),
+		cachedPages:     make(pageSet),
+		dirtyPages:      make(pageSet),
+		minIdleInterval: idleInterval,
+		maxIdleInterval: idleInterval,
 	}
 	return &cacheBrain, nil
 }
@@ -78,39 +164,52 @@ func newCacheBrain(pageCount int, hardMaxCached int, softMaxCached int,
 func (cb *cacheBrain) maintenance(now time.Time) []action {
 	actions := []action{}
 	accesses := []lastAccessDetails{}
-
-	uploadingCount := 0
-	for i := 0; i < cb.pageCount; i++ {
-		if !isCached(cb.pages[i].state) {
-			continue
-		}
-
-		if cb.pages[i].state == cachedUploading {
-			uploadingCount += 1
-		}
-
+	for page := range cb.cachedPages {
 		accesses = append(accesses, lastAccessDetails{
-			lastAccess: cb.pages[i].lastAccess,
-			page:       page(i),
+			lastAccess: cb.pages.get(page).lastAccess,
+			page:       page,
 		})
 	}
 
 	// sort cached pages by oldest to newest access
 	sort.Slice(accesses, func(i, j int) bool {
+		if accesses[i].lastAccess.Equal(accesses[j].lastAccess) {
+			return accesses[i].page < accesses[j].page
+		}
 		return accesses[i].lastAccess.Before(accesses[j].lastAccess)
 	})
 
+	dirtyCount := len(cb.dirtyPages)
+	forcedUploads := 0
+	if cb.maxDirtyPages > 0 && dirtyCount > cb.maxDirtyPages {
+		forcedUploads = dirtyCount - cb.maxDirtyPages
+	}
+
+	oldestEpoch := cb.oldestDirtyEpoch()
+	blockedByOrdering := false
+	uploading := cb.uploadingPages()
+	uploadingPacks := cb.uploadingPacks()
+	uploadAllowed := func(page page) bool {
+		return !cb.readOnly && !cb.uploadsHeld && (cb.uploadLimit == 0 || uploading < cb.uploadLimit) &&
+			!uploadingPacks[cb.packOf(page)]
+	}
+
 	for i, access := range accesses {
 		// Define recent activity as being in the youngest 1/3 of the cache.
 		hasRecentActivity := i > ((cb.softMaxCached * 2) / 3)
-		isIdle := now.After(access.lastAccess.Add(cb.idleInterval))
+		idleInterval := cb.pageIdleInterval(access.page, now)
+		isIdle := now.After(access.lastAccess.Add(idleInterval))
 		recentlyPostponed := now.Before(
-			cb.pages[access.page].lastPostponement.Add(cb.idleInterval))
+			cb.pages.get(access.page).lastPostponement.Add(idleInterval))
 		softLimitReached := cb.cacheCount >= cb.softMaxCached
+		reserveInUse := cb.cacheCount > cb.hardMaxCached-cb.writeReserve
 
-		switch cb.pages[access.page].state {
+		switch cb.pages.get(access.page).state {
 		case cachedUnchanged:
-			if softLimitReached && !hasRecentActivity {
+			// Pages of the write reserve and beyond the hard limit are
+			// given back even if they were accessed recently, oldest
+			// first.
+			if (softLimitReached && !hasRecentActivity) || reserveInUse {
 				actions = append(actions, action{
 					actionType: closeFile,
 					page:       access.page,
@@ -119,28 +218,78 @@ func (cb *cacheBrain) maintenance(now time.Time) []action {
 					actionType: deleteCache,
 					page:       access.page,
 				})
-				cb.pages[access.page].state = notCached
-				cb.cacheCount -= 1
+				cb.setState(access.page, notCached)
 			}
 		case cachedChanged:
-			if ((softLimitReached && !hasRecentActivity) || isIdle) && !recentlyPostponed {
+			dirtyTooLong := cb.maxDirtyAge > 0 &&
+				now.After(cb.pages.get(access.page).dirtySince.Add(cb.maxDirtyAge))
+			forced := dirtyTooLong || forcedUploads > 0 || cb.pages.get(access.page).uploadRequested
+			if (((softLimitReached && !hasRecentActivity) || isIdle) && !recentlyPostponed) || forced {
+				if cb.orderedUploads && cb.pages.get(access.page).dirtyEpoch > oldestEpoch {
+					blockedByOrdering = true
+					continue
+				}
+				if !uploadAllowed(access.page) {
+					continue
+				}
+
+				if forcedUploads > 0 {
+					forcedUploads -= 1
+				}
 				actions = append(actions, action{
 					actionType: startUpload,
 					page:       access.page,
 				})
-				cb.pages[access.page].state = cachedUploading
-				uploadingCount += 1
+				cb.setState(access.page, cachedUploading)
+				uploading += 1
+				uploadingPacks[cb.packOf(access.page)] = true
 			}
 		}
 	}
 
+	if blockedByOrdering {
+		// Pages of the oldest epoch hold up everything else, so do not
+		// wait for them to become idle. Pages that are still being
+		// written to would only have their upload postponed again.
+		for _, access := range accesses {
+			details := cb.pages.get(access.page)
+			if details.state != cachedChanged || details.dirtyEpoch != oldestEpoch ||
+				now.Before(details.lastPostponement.Add(cb.minIdleInterval)) || !uploadAllowed(access.page) {
+				continue
+			}
+
+			actions = append(actions, action{
+				actionType: startUpload,
+				page:       access.page,
+			})
+			cb.setState(access.page, cachedUploading)
+			uploading += 1
+			uploadingPacks[cb.packOf(access.page)] = true
+		}
+	}
+
 	return actions
 }
 
 func (cb *cacheBrain) prepareAccess(page page, isWrite bool, now time.Time) []action {
 	actions := []action{}
 
-	if !isCached(cb.pages[page].state) && cb.cacheCount >= cb.hardMaxCached {
+	if cb.readOnly && cb.pages.state(page) == zero {
+		// the page is read as zeroes without entering the cache
+		cb.lastAccess = now
+		return actions
+	}
+
+	limit := cb.hardMaxCached
+	if !isWrite {
+		limit -= cb.writeReserve
+	}
+	if !isWrite && cb.cacheCount == len(cb.dirtyPages) {
+		// nothing could be evicted to make room before uploads complete
+		limit = cb.hardMaxCached + cb.readOverflow
+	}
+	limit += cb.extraCapacity
+	if !isCached(cb.pages.state(page)) && cb.cacheCount >= limit {
 		// wait for maintenance to free up some space first
 		actions = append(actions, action{
 			actionType: waitAndRetry,
@@ -148,7 +297,7 @@ func (cb *cacheBrain) prepareAccess(page page, isWrite bool, now time.Time) []ac
 		return actions
 	}
 
-	switch cb.pages[page].state {
+	switch cb.pages.get(page).state {
 	case zero:
 		actions = append(actions, action{
 			actionType: openFile,
@@ -158,8 +307,7 @@ func (cb *cacheBrain) prepareAccess(page page, isWrite bool, now time.Time) []ac
 			actionType: zeroCache,
 			page:       page,
 		})
-		cb.pages[page].state = cachedChanged
-		cb.cacheCount += 1
+		cb.markDirty(page, now)
 	case notCached:
 		actions = append(actions, action{
 			actionType: download,
@@ -170,14 +318,17 @@ func (cb *cacheBrain) prepareAccess(page page, isWrite bool, now time.Time) []ac
 			page:       page,
 		})
 		if isWrite {
-			cb.pages[page].state = cachedChanged
+			cb.markDirty(page, now)
 		} else {
-			cb.pages[page].state = cachedUnchanged
+			cb.setState(page, cachedUnchanged)
 		}
-		cb.cacheCount += 1
 	case cachedUnchanged:
 		if isWrite {
-			cb.pages[page].state = cachedChanged
+			if now.Before(cb.pages.get(page).lastUpload.Add(cb.pageIdleInterval(page, now))) {
+				// uploaded too early, as it is being written to again
+				cb.lengthenIdleInterval(page)
+			}
+			cb.markDirty(page, now)
 		}
 	case cachedChanged:
 		// no changes
@@ -187,48 +338,57 @@ func (cb *cacheBrain) prepareAccess(page page, isWrite bool, now time.Time) []ac
 				actionType: postponeUpload,
 				page:       page,
 			})
-			cb.pages[page].state = cachedChanged
-			cb.pages[page].lastPostponement = now
+			cb.setState(page, cachedChanged)
+			cb.pages.get(page).lastPostponement = now
+			cb.lengthenIdleInterval(page)
 		}
 	default:
 		panic("unknown state")
 	}
 
-	cb.pages[page].lastAccess = now
+	cb.pages.get(page).lastAccess = now
+	cb.lastAccess = now
+	if isWrite {
+		cb.pages.get(page).lastWrite = now
+		cb.lastWrite = now
+	}
 	return actions
 }
 
 func (cb *cacheBrain) prepareShutdown(thorough bool) []action {
 	actions := []action{}
+	oldestEpoch := cb.oldestDirtyEpoch()
+	uploadingPacks := cb.uploadingPacks()
 
-	for i := 0; i < cb.pageCount; i++ {
-		switch cb.pages[i].state {
+	for _, page := range cb.cachedPages.sorted() {
+		switch cb.pages.get(page).state {
 		case cachedUnchanged:
 			actions = append(actions, action{
 				actionType: closeFile,
-				page:       page(i),
+				page:       page,
 			})
 			actions = append(actions, action{
 				actionType: deleteCache,
-				page:       page(i),
+				page:       page,
 			})
-			cb.pages[i].state = notCached
-			cb.cacheCount -= 1
+			cb.setState(page, notCached)
 		case cachedChanged:
-			if thorough {
+			if thorough && !cb.readOnly && (!cb.orderedUploads || cb.pages.get(page).dirtyEpoch == oldestEpoch) &&
+				!uploadingPacks[cb.packOf(page)] {
 				actions = append(actions, action{
 					actionType: startUpload,
-					page:       page(i),
+					page:       page,
 				})
-				cb.pages[i].state = cachedUploading
+				cb.setState(page, cachedUploading)
+				uploadingPacks[cb.packOf(page)] = true
 			}
 		case cachedUploading:
 			if !thorough {
 				actions = append(actions, action{
 					actionType: postponeUpload,
-					page:       page(i),
+					page:       page,
 				})
-				cb.pages[i].state = cachedChanged
+				cb.setState(page, cachedChanged)
 			}
 		}
 	}
@@ -242,6 +402,288 @@ func (cb *cacheBrain) prepareShutdown(thorough bool) []action {
 	return actions
 }
 
+// requestUpload makes maintenance upload a dirty page as soon as uploads
+// are no longer held up by ordering, even if the page is not idle. It
+// reports whether the page is dirty. Nothing is uploaded in read-only mode.
+func (cb *cacheBrain) requestUpload(page page) bool {
+	if cb.readOnly || !isDirty(cb.pages.state(page)) {
+		return false
+	}
+
+	cb.pages.get(page).uploadRequested = true
+	return true
+}
+
+// evict removes a clean page from the cache. Dirty pages need to be
+// uploaded first.
+func (cb *cacheBrain) evict(page page) ([]action, error) {
+	switch cb.pages.state(page) {
+	case cachedUnchanged:
+		cb.setState(page, notCached)
+		return []action{
+			{actionType: closeFile, page: page},
+			{actionType: deleteCache, page: page},
+		}, nil
+	case cachedChanged, cachedUploading:
+		return nil, errPageDirty
+	default:
+		return nil, nil
+	}
+}
+
+// setState moves a page to a new state and updates the cache count and the
+// indexes accordingly. All state changes need to go through here.
+func (cb *cacheBrain) setState(page page, state state) {
+	previous := cb.pages.get(page).state
+	cb.pages.get(page).state = state
+
+	if isCached(previous) && !isCached(state) {
+		delete(cb.cachedPages, page)
+		cb.cacheCount -= 1
+	} else if !isCached(previous) && isCached(state) {
+		cb.cachedPages[page] = struct{}{}
+		cb.cacheCount += 1
+	}
+	if cb.cacheCount <= cb.cacheLimit() {
+		cb.heldLimit = 0
+	}
+
+	if isDirty(state) {
+		cb.dirtyPages[page] = struct{}{}
+	} else {
+		delete(cb.dirtyPages, page)
+		cb.pages.get(page).uploadRequested = false
+	}
+
+	if previous == zero && state != zero {
+		cb.allocatedCount += 1
+	} else if previous != zero && state == zero {
+		cb.allocatedCount -= 1
+	}
+}
+
+// cacheLimit returns the most pages the cache may hold under the current
+// limits.
+func (cb *cacheBrain) cacheLimit() int {
+	return cb.hardMaxCached + cb.readOverflow + cb.extraCapacity
+}
+
+// holdLimit needs to be called before the limits are lowered, so that the
+// pages cached under the current ones remain within bounds until they have
+// been evicted.
+func (cb *cacheBrain) holdLimit() {
+	if limit := cb.cacheLimit(); limit > cb.heldLimit {
+		cb.heldLimit = limit
+	}
+}
+
+func (cb *cacheBrain) markDirty(page page, now time.Time) {
+	cb.setState(page, cachedChanged)
+	cb.pages.get(page).dirtySince = now
+	cb.pages.get(page).dirtyEpoch = cb.epoch
+}
+
+// flush ends the current flush epoch.
+func (cb *cacheBrain) flush() {
+	cb.epoch += 1
+}
+
+// oldestDirtyEpoch returns the oldest epoch that still has unsynced pages.
+func (cb *cacheBrain) oldestDirtyEpoch() uint64 {
+	oldest := cb.epoch
+	for page := range cb.dirtyPages {
+		if cb.pages.get(page).dirtyEpoch < oldest {
+			oldest = cb.pages.get(page).dirtyEpoch
+		}
+	}
+	return oldest
+}
+
+// uploadComplete marks an uploading page as synced with Sia.
+func (cb *cacheBrain) uploadComplete(page page, now time.Time) {
+	cb.setState(page, cachedUnchanged)
+	cb.pages.get(page).dirtySince = time.Time{}
+	cb.pages.get(page).lastUpload = now
+	cb.shortenIdleInterval(page)
+}
+
+// pageIdleInterval returns how long a page needs to go without access
+// before it is uploaded.
+func (cb *cacheBrain) pageIdleInterval(page page, now time.Time) time.Duration {
+	if cb.minIdleInterval >= cb.maxIdleInterval {
+		return cb.idleInterval
+	}
+
+	if !now.Before(cb.lastWrite.Add(cb.minIdleInterval)) {
+		// the device has gone quiet
+		return cb.minIdleInterval
+	}
+
+	if cb.pages.get(page).idleInterval == 0 {
+		return cb.idleInterval
+	}
+	return cb.pages.get(page).idleInterval
+}
+
+func (cb *cacheBrain) lengthenIdleInterval(page page) {
+	cb.adaptIdleInterval(page, 2)
+}
+
+func (cb *cacheBrain) shortenIdleInterval(page page) {
+	cb.adaptIdleInterval(page, 0.5)
+}
+
+func (cb *cacheBrain) adaptIdleInterval(page page, factor float64) {
+	if cb.minIdleInterval >= cb.maxIdleInterval {
+		return
+	}
+
+	interval := cb.pages.get(page).idleInterval
+	if interval == 0 {
+		interval = cb.idleInterval
+	}
+
+	interval = time.Duration(float64(interval) * factor)
+	if interval < cb.minIdleInterval {
+		interval = cb.minIdleInterval
+	}
+	if interval > cb.maxIdleInterval {
+		interval = cb.maxIdleInterval
+	}
+	cb.pages.get(page).idleInterval = interval
+}
+
+// allocatedPages returns the number of pages that have been written to at
+// least once and thus occupy storage on Sia.
+func (cb *cacheBrain) allocatedPages() int {
+	return cb.allocatedCount
+}
+
+// uploadingPages returns the number of pages currently being uploaded.
+func (cb *cacheBrain) uploadingPages() int {
+	count := 0
+	for page := range cb.dirtyPages {
+		if cb.pages.state(page) == cachedUploading {
+			count += 1
+		}
+	}
+	return count
+}
+
+// dirtyStats returns the number of pages that contain data not yet
+// uploaded to Sia and the time of the oldest such write.
+func (cb *cacheBrain) dirtyStats() (int, time.Time) {
+	oldest := time.Time{}
+	for page := range cb.dirtyPages {
+		if oldest.IsZero() || cb.pages.get(page).dirtySince.Before(oldest) {
+			oldest = cb.pages.get(page).dirtySince
+		}
+	}
+	return len(cb.dirtyPages), oldest
+}
+
+// dirtyLimitExceeded reports whether the unsynced data exceeds the
+// configured limits.
+func (cb *cacheBrain) dirtyLimitExceeded(now time.Time) bool {
+	count, oldest := cb.dirtyStats()
+	if cb.maxDirtyPages > 0 && count > cb.maxDirtyPages {
+		return true
+	}
+	return cb.maxDirtyAge > 0 && count > 0 && now.After(oldest.Add(cb.maxDirtyAge))
+}
+
+// checkInvariants verifies that the counters and indexes agree with the page
+// states and that the cache stays within the limits in effect. It is meant for
+// tests and for model checking, as it looks at every touched page.
+func (cb *cacheBrain) checkInvariants() error {
+	cached, dirty, allocated := 0, 0, 0
+	uploadingPacks := make(map[page]page)
+	for page, details := range cb.pages {
+		_, inCached := cb.cachedPages[page]
+		_, inDirty := cb.dirtyPages[page]
+
+		if isCached(details.state) != inCached {
+			return fmt.Errorf("page %d in state %d is inconsistent with the cached index", page, details.state)
+		}
+		if isDirty(details.state) != inDirty {
+			return fmt.Errorf("page %d in state %d is inconsistent with the dirty index", page, details.state)
+		}
+		if details.uploadRequested && !isDirty(details.state) {
+			return fmt.Errorf("upload requested for clean page %d", page)
+		}
+		if page < 0 || int64(page) >= int64(cb.pageCount) {
+			return fmt.Errorf("page %d is out of range", page)
+		}
+		if details.state == cachedUploading {
+			if other, ok := uploadingPacks[cb.packOf(page)]; ok {
+				return fmt.Errorf("pages %d and %d of the same pack are being uploaded", other, page)
+			}
+			uploadingPacks[cb.packOf(page)] = page
+		}
+
+		if isCached(details.state) {
+			cached += 1
+		}
+		if isDirty(details.state) {
+			dirty += 1
+		}
+		if details.state != zero {
+			allocated += 1
+		}
+	}
+
+	switch {
+	case cached != cb.cacheCount || cached != len(cb.cachedPages):
+		return fmt.Errorf("%d pages are cached, but the cache count is %d and the index holds %d",
+			cached, cb.cacheCount, len(cb.cachedPages))
+	case dirty != len(cb.dirtyPages):
+		return fmt.Errorf("%d pages are dirty, but the index holds %d", dirty, len(cb.dirtyPages))
+	case allocated != cb.allocatedCount:
+		return fmt.Errorf("%d pages are allocated, but the count is %d", allocated, cb.allocatedCount)
+	case cb.cacheCount > cb.cacheLimit() && cb.cacheCount > cb.heldLimit:
+		return fmt.Errorf("%d pages are cached, exceeding the hard limit of %d plus %d for reads and %d extra "+
+			"and the earlier limit of %d", cb.cacheCount, cb.hardMaxCached, cb.readOverflow, cb.extraCapacity,
+			cb.heldLimit)
+	}
+	return nil
+}
+
+// get returns the details of a page, creating them if the page has not been
+// touched yet.
+func (pt pageTable) get(page page) *pageDetails {
+	details, ok := pt[page]
+	if !ok {
+		details = &pageDetails{}
+		pt[page] = details
+	}
+	return details
+}
+
+// state returns the state of a page without creating an entry for it.
+func (pt pageTable) state(page page) state {
+	details, ok := pt[page]
+	if !ok {
+		return zero
+	}
+	return details.state
+}
+
+// sorted returns the pages of the set in ascending order.
+func (ps pageSet) sorted() []page {
+	pages := make([]page, 0, len(ps))
+	for page := range ps {
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i] < pages[j]
+	})
+	return pages
+}
+
 func isCached(state state) bool {
 	return state == cachedUnchanged || state == cachedChanged || state == cachedUploading
 }
+
+func isDirty(state state) bool {
+	return state == cachedChanged || state == cachedUploading
+}
@@ -0,0 +1,232 @@
+package sia
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+type (
+	// brainModel executes the actions of a cache brain against a model of
+	// the cache files and of Sia, tracking which version of each page's
+	// data is where, so that lost or stale data shows up.
+	brainModel struct {
+		brain *cacheBrain
+		now   time.Time
+
+		open      map[page]bool
+		cached    map[page]bool
+		latest    map[page]int // version of the newest write
+		inCache   map[page]int
+		onSia     map[page]int
+		uploading map[page]int
+	}
+)
+
+func newBrainModel(brain *cacheBrain) *brainModel {
+	return &brainModel{
+		brain:     brain,
+		now:       time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		open:      make(map[page]bool),
+		cached:    make(map[page]bool),
+		latest:    make(map[page]int),
+		inCache:   make(map[page]int),
+		onSia:     make(map[page]int),
+		uploading: make(map[page]int),
+	}
+}
+
+// execute applies actions and reports whether access needs to be retried.
+func (m *brainModel) execute(actions []action) (bool, error) {
+	for _, action := range actions {
+		p := action.page
+		switch action.actionType {
+		case openFile:
+			if m.open[p] {
+				return false, fmt.Errorf("page %d opened twice", p)
+			}
+			m.open[p] = true
+		case closeFile:
+			if !m.open[p] {
+				return false, fmt.Errorf("page %d closed without being open", p)
+			}
+			m.open[p] = false
+		case zeroCache:
+			if !m.open[p] || m.latest[p] != 0 {
+				return false, fmt.Errorf("page %d with data zeroed", p)
+			}
+			m.cached[p] = true
+			m.inCache[p] = 0
+		case download:
+			if m.open[p] || m.cached[p] {
+				return false, fmt.Errorf("page %d downloaded over its cache", p)
+			}
+			m.cached[p] = true
+			m.inCache[p] = m.onSia[p]
+		case deleteCache:
+			if m.open[p] {
+				return false, fmt.Errorf("page %d deleted while open", p)
+			}
+			if m.inCache[p] != m.onSia[p] {
+				return false, fmt.Errorf("page %d deleted with version %d not on Sia (has %d)",
+					p, m.inCache[p], m.onSia[p])
+			}
+			m.cached[p] = false
+		case startUpload:
+			if !m.open[p] {
+				return false, fmt.Errorf("page %d uploaded while closed", p)
+			}
+			m.uploading[p] = m.inCache[p]
+		case postponeUpload:
+			delete(m.uploading, p)
+		case waitAndRetry:
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *brainModel) access(p page, isWrite bool) error {
+	for attempt := 0; ; attempt++ {
+		retry, err := m.execute(m.brain.prepareAccess(p, isWrite, m.now))
+		if err != nil || !retry {
+			break
+		}
+		if attempt > 100 {
+			return fmt.Errorf("page %d still waiting for space", p)
+		}
+		m.now = m.now.Add(time.Minute)
+		err = m.maintenance(1)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !m.cached[p] {
+		return fmt.Errorf("page %d accessed without being cached", p)
+	}
+	if isWrite {
+		m.latest[p] += 1
+		m.inCache[p] = m.latest[p]
+	} else if m.inCache[p] != m.latest[p] {
+		return fmt.Errorf("page %d read version %d instead of %d", p, m.inCache[p], m.latest[p])
+	}
+	return nil
+}
+
+// maintenance runs maintenance and completes each upload in progress with
+// the given probability.
+func (m *brainModel) maintenance(completion float64) error {
+	_, err := m.execute(m.brain.maintenance(m.now))
+	if err != nil {
+		return err
+	}
+
+	for _, p := range m.brain.dirtyPages.sorted() {
+		version, ok := m.uploading[p]
+		if !ok || m.brain.pages.state(p) != cachedUploading || rand.Float64() >= completion {
+			continue
+		}
+		if version != m.inCache[p] {
+			return fmt.Errorf("page %d uploaded version %d while holding %d", p, version, m.inCache[p])
+		}
+		m.onSia[p] = version
+		delete(m.uploading, p)
+		m.brain.uploadComplete(p, m.now)
+	}
+	return nil
+}
+
+func (m *brainModel) check() error {
+	err := m.brain.checkInvariants()
+	if err != nil {
+		return err
+	}
+
+	for p, details := range m.brain.pages {
+		switch {
+		case isCached(details.state) != m.cached[p]:
+			return fmt.Errorf("page %d in state %d disagrees with the cache", p, details.state)
+		case isCached(details.state) != m.open[p]:
+			return fmt.Errorf("page %d in state %d disagrees with its file being open", p, details.state)
+		case details.state == notCached && m.onSia[p] != m.latest[p]:
+			return fmt.Errorf("page %d lost version %d", p, m.latest[p])
+		case details.state == cachedUnchanged && m.inCache[p] != m.onSia[p]:
+			return fmt.Errorf("page %d considered clean with version %d not on Sia", p, m.inCache[p])
+		}
+	}
+	return nil
+}
+
+func TestCacheBrainModel(t *testing.T) {
+	for seed := int64(1); seed <= 50; seed++ {
+		rand.Seed(seed)
+		brain, err := newCacheBrain(16, 6, 4, 30*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		brain.minIdleInterval = 10 * time.Second
+		brain.maxIdleInterval = 2 * time.Minute
+		brain.orderedUploads = seed%2 == 0
+		brain.maxDirtyPages = int(seed % 4)
+		brain.writeReserve = int(seed % 3)
+		brain.readOverflow = int(seed % 2)
+		m := newBrainModel(brain)
+
+		for step := 0; step < 2000; step++ {
+			switch n := rand.Intn(100); {
+			case n < 70:
+				err = m.access(page(rand.Intn(brain.pageCount)), rand.Intn(2) == 0)
+			case n < 75:
+				brain.flush()
+			case n < 80:
+				p := page(rand.Intn(brain.pageCount))
+				brain.requestUpload(p)
+			case n < 83:
+				var actions []action
+				actions, err = brain.evict(page(rand.Intn(brain.pageCount)))
+				if err == errPageDirty {
+					err = nil
+				}
+				if err == nil {
+					_, err = m.execute(actions)
+				}
+			default:
+				m.now = m.now.Add(time.Duration(rand.Intn(90)) * time.Second)
+				err = m.maintenance(0.5)
+			}
+			if err == nil {
+				err = m.check()
+			}
+			if err != nil {
+				t.Fatalf("seed %d, step %d: %s", seed, step, err)
+			}
+		}
+
+		// a thorough shutdown needs to get everything onto Sia
+		for round := 0; ; round++ {
+			retry, err := m.execute(brain.prepareShutdown(true))
+			if err == nil {
+				err = m.maintenance(1)
+			}
+			if err == nil {
+				err = m.check()
+			}
+			if err != nil {
+				t.Fatalf("seed %d, shutdown: %s", seed, err)
+			}
+			if !retry {
+				break
+			}
+			if round > 100 {
+				t.Fatalf("seed %d: shutdown does not finish", seed)
+			}
+		}
+		for p, version := range m.latest {
+			if m.onSia[p] != version {
+				t.Fatalf("seed %d: page %d has version %d on Sia instead of %d", seed, p, m.onSia[p], version)
+			}
+		}
+	}
+}
@@ -23,8 +23,8 @@ func TestMaintenanceA(t *testing.T) {
 	assert.Empty(t, actions, "empty cache should require no maintenance")
 
 	for i := 0; i < 3; i++ {
-		cacheBrain.pages[i+1].lastAccess = now
-		cacheBrain.pages[i+1].state = cachedChanged
+		cacheBrain.pages.get(page(i + 1)).lastAccess = now
+		cacheBrain.setState(page(i+1), cachedChanged)
 	}
 	cacheBrain.cacheCount = 3
 	actions = cacheBrain.maintenance(now)
@@ -34,7 +34,7 @@ func TestMaintenanceA(t *testing.T) {
 	assert.Equal(t, 3, len(actions), "expected three actions")
 	for _, action := range actions {
 		assert.Equal(t, startUpload, action.actionType, "expected upload action")
-		assert.Equal(t, cachedUploading, cacheBrain.pages[action.page].state, "expected state change")
+		assert.Equal(t, cachedUploading, cacheBrain.pages.get(action.page).state, "expected state change")
 	}
 
 	actions = cacheBrain.maintenance(now.Add(time.Minute))
@@ -48,8 +48,8 @@ func TestMaintenanceB(t *testing.T) {
 	}
 
 	now := time.Now()
-	cacheBrain.pages[2].lastAccess = now
-	cacheBrain.pages[2].state = cachedUnchanged
+	cacheBrain.pages.get(2).lastAccess = now
+	cacheBrain.setState(page(2), cachedUnchanged)
 	cacheBrain.cacheCount = 1
 
 	actions := cacheBrain.maintenance(now)
@@ -57,16 +57,16 @@ func TestMaintenanceB(t *testing.T) {
 	assert.Equal(t, closeFile, actions[0].actionType, "expected close file action")
 	assert.Equal(t, deleteCache, actions[1].actionType, "expected delete action")
 	assert.Equal(t, 0, cacheBrain.cacheCount, "expected cache count to be adjusted")
-	assert.Equal(t, notCached, cacheBrain.pages[2].state, "expected state change")
+	assert.Equal(t, notCached, cacheBrain.pages.get(2).state, "expected state change")
 
-	cacheBrain.pages[2].lastAccess = now
-	cacheBrain.pages[2].state = cachedChanged
+	cacheBrain.pages.get(2).lastAccess = now
+	cacheBrain.setState(page(2), cachedChanged)
 	cacheBrain.cacheCount = 1
 
 	actions = cacheBrain.maintenance(now)
 	assert.Equal(t, 1, len(actions), "expected action when soft limit is hit")
 	assert.Equal(t, startUpload, actions[0].actionType, "expected upload action")
-	assert.Equal(t, cachedUploading, cacheBrain.pages[2].state, "expected state change")
+	assert.Equal(t, cachedUploading, cacheBrain.pages.get(2).state, "expected state change")
 
 	actions = cacheBrain.maintenance(now)
 	assert.Empty(t, actions, "should not trigger upload again")
@@ -80,13 +80,13 @@ func TestMaintenanceC(t *testing.T) {
 
 	now := time.Now()
 	for i := 0; i < 9; i++ {
-		cacheBrain.pages[i].lastAccess = now.Add(time.Duration(i * int(time.Second)))
-		cacheBrain.pages[i].state = cachedChanged
+		cacheBrain.pages.get(page(i)).lastAccess = now.Add(time.Duration(i) * time.Second)
+		cacheBrain.setState(page(i), cachedChanged)
 	}
 	cacheBrain.cacheCount = 9
 
-	cacheBrain.pages[6].state = cachedUnchanged
-	cacheBrain.pages[8].state = cachedUnchanged
+	cacheBrain.setState(page(6), cachedUnchanged)
+	cacheBrain.setState(page(8), cachedUnchanged)
 
 	actions := cacheBrain.maintenance(now.Add(time.Minute))
 	assert.Equal(t, 8, len(actions))
@@ -109,17 +109,17 @@ func TestMaintenanceD(t *testing.T) {
 	}
 
 	now := time.Now()
-	cacheBrain.pages[2].lastAccess = now
-	cacheBrain.pages[2].state = cachedUnchanged
+	cacheBrain.pages.get(2).lastAccess = now
+	cacheBrain.setState(page(2), cachedUnchanged)
 
-	cacheBrain.pages[1].lastAccess = now.Add(time.Second)
-	cacheBrain.pages[1].state = cachedUnchanged
+	cacheBrain.pages.get(1).lastAccess = now.Add(time.Second)
+	cacheBrain.setState(page(1), cachedUnchanged)
 
-	cacheBrain.pages[3].lastAccess = now.Add(2 * time.Second)
-	cacheBrain.pages[3].state = cachedUnchanged
+	cacheBrain.pages.get(3).lastAccess = now.Add(2 * time.Second)
+	cacheBrain.setState(page(3), cachedUnchanged)
 
-	cacheBrain.pages[4].lastAccess = now.Add(3 * time.Second)
-	cacheBrain.pages[4].state = cachedUnchanged
+	cacheBrain.pages.get(4).lastAccess = now.Add(3 * time.Second)
+	cacheBrain.setState(page(4), cachedUnchanged)
 
 	cacheBrain.cacheCount = 4
 
@@ -139,12 +139,12 @@ func TestMaintenanceE(t *testing.T) {
 	now := time.Now()
 
 	for i := 0; i < 9; i++ {
-		cacheBrain.pages[i].lastAccess = now
-		cacheBrain.pages[i].state = cachedUploading
+		cacheBrain.pages.get(page(i)).lastAccess = now
+		cacheBrain.setState(page(i), cachedUploading)
 	}
 
-	cacheBrain.pages[9].lastAccess = now.Add(time.Second)
-	cacheBrain.pages[9].state = cachedUnchanged
+	cacheBrain.pages.get(9).lastAccess = now.Add(time.Second)
+	cacheBrain.setState(page(9), cachedUnchanged)
 
 	cacheBrain.cacheCount = 10
 
@@ -160,23 +160,23 @@ func TestPrepareAccessA(t *testing.T) {
 
 	now := time.Now()
 
-	cacheBrain.pages[2].state = zero
+	cacheBrain.setState(page(2), zero)
 	actions := cacheBrain.prepareAccess(page(2), false, now)
 	assert.Equal(t, 2, len(actions))
 	assert.Equal(t, openFile, actions[0].actionType)
 	assert.Equal(t, zeroCache, actions[1].actionType)
-	assert.Equal(t, cachedChanged, cacheBrain.pages[2].state)
+	assert.Equal(t, cachedChanged, cacheBrain.pages.get(2).state)
 	assert.Equal(t, 1, cacheBrain.cacheCount)
 
-	cacheBrain.pages[1].state = notCached
+	cacheBrain.setState(page(1), notCached)
 	actions = cacheBrain.prepareAccess(page(1), false, now.Add(time.Second))
 	assert.Equal(t, 2, len(actions))
 	assert.Equal(t, download, actions[0].actionType)
 	assert.Equal(t, openFile, actions[1].actionType)
-	assert.Equal(t, cachedUnchanged, cacheBrain.pages[1].state)
+	assert.Equal(t, cachedUnchanged, cacheBrain.pages.get(1).state)
 	assert.Equal(t, 2, cacheBrain.cacheCount)
 
-	cacheBrain.pages[0].state = notCached
+	cacheBrain.setState(page(0), notCached)
 	actions = cacheBrain.prepareAccess(page(0), true, now.Add(2*time.Second))
 	assert.Equal(t, 1, len(actions))
 	assert.Equal(t, waitAndRetry, actions[0].actionType)
@@ -184,10 +184,10 @@ func TestPrepareAccessA(t *testing.T) {
 	actions = cacheBrain.maintenance(now.Add(3 * time.Second))
 	assert.Equal(t, 1, len(actions))
 	assert.Equal(t, startUpload, actions[0].actionType)
-	assert.Equal(t, cachedUploading, cacheBrain.pages[2].state)
+	assert.Equal(t, cachedUploading, cacheBrain.pages.get(2).state)
 	assert.Equal(t, 2, cacheBrain.cacheCount)
 
-	cacheBrain.pages[2].state = cachedUnchanged
+	cacheBrain.setState(page(2), cachedUnchanged)
 	actions = cacheBrain.maintenance(now.Add(3 * time.Second))
 	assert.Equal(t, 2, len(actions))
 	assert.Equal(t, closeFile, actions[0].actionType)
@@ -198,7 +198,7 @@ func TestPrepareAccessA(t *testing.T) {
 	assert.Equal(t, 2, len(actions))
 	assert.Equal(t, download, actions[0].actionType)
 	assert.Equal(t, openFile, actions[1].actionType)
-	assert.Equal(t, cachedChanged, cacheBrain.pages[0].state)
+	assert.Equal(t, cachedChanged, cacheBrain.pages.get(0).state)
 	assert.Equal(t, 2, cacheBrain.cacheCount)
 }
 
@@ -210,22 +210,22 @@ func TestPrepareAccessB(t *testing.T) {
 
 	now := time.Now()
 
-	cacheBrain.pages[2].state = cachedUnchanged
-	cacheBrain.pages[2].lastAccess = now
+	cacheBrain.setState(page(2), cachedUnchanged)
+	cacheBrain.pages.get(2).lastAccess = now
 	cacheBrain.cacheCount = 1
 
 	actions := cacheBrain.prepareAccess(page(2), true, now)
 	assert.Equal(t, 0, len(actions))
-	assert.Equal(t, cachedChanged, cacheBrain.pages[2].state)
+	assert.Equal(t, cachedChanged, cacheBrain.pages.get(2).state)
 
 	actions = cacheBrain.prepareAccess(page(2), true, now)
 	assert.Equal(t, 0, len(actions))
 
-	cacheBrain.pages[2].state = cachedUploading
+	cacheBrain.setState(page(2), cachedUploading)
 	actions = cacheBrain.prepareAccess(page(2), true, now)
 	assert.Equal(t, 1, len(actions))
 	assert.Equal(t, postponeUpload, actions[0].actionType)
-	assert.Equal(t, cachedChanged, cacheBrain.pages[2].state)
+	assert.Equal(t, cachedChanged, cacheBrain.pages.get(2).state)
 	assert.Equal(t, 1, cacheBrain.cacheCount)
 }
 
@@ -237,8 +237,8 @@ func TestAvoidFrequentPostponing(t *testing.T) {
 
 	now := time.Now()
 
-	cacheBrain.pages[2].state = cachedChanged
-	cacheBrain.pages[2].lastAccess = now
+	cacheBrain.setState(page(2), cachedChanged)
+	cacheBrain.pages.get(2).lastAccess = now
 	cacheBrain.cacheCount = 1
 
 	actions := cacheBrain.maintenance(now.Add(time.Minute))
@@ -267,27 +267,27 @@ func TestPrepareFastShutdown(t *testing.T) {
 	assert.Empty(t, actions, "empty cache should shutdown right away")
 
 	now := time.Now()
-	cacheBrain.pages[2].state = cachedUnchanged
-	cacheBrain.pages[2].lastAccess = now
+	cacheBrain.setState(page(2), cachedUnchanged)
+	cacheBrain.pages.get(2).lastAccess = now
 	cacheBrain.cacheCount = 1
 
 	actions = cacheBrain.prepareShutdown(false)
 	assert.Equal(t, 2, len(actions))
 	assert.Equal(t, closeFile, actions[0].actionType)
 	assert.Equal(t, deleteCache, actions[1].actionType)
-	assert.Equal(t, notCached, cacheBrain.pages[2].state)
+	assert.Equal(t, notCached, cacheBrain.pages.get(2).state)
 	assert.Equal(t, 0, cacheBrain.cacheCount)
 
-	cacheBrain.pages[3].state = cachedChanged
-	cacheBrain.pages[3].lastAccess = now
-	cacheBrain.pages[4].state = cachedUploading
-	cacheBrain.pages[4].lastAccess = now
+	cacheBrain.setState(page(3), cachedChanged)
+	cacheBrain.pages.get(3).lastAccess = now
+	cacheBrain.setState(page(4), cachedUploading)
+	cacheBrain.pages.get(4).lastAccess = now
 	cacheBrain.cacheCount = 2
 
 	actions = cacheBrain.prepareShutdown(false)
 	assert.Equal(t, 1, len(actions))
 	assert.Equal(t, postponeUpload, actions[0].actionType)
-	assert.Equal(t, cachedChanged, cacheBrain.pages[4].state)
+	assert.Equal(t, cachedChanged, cacheBrain.pages.get(4).state)
 }
 
 func TestPrepareThoroughShutdown(t *testing.T) {
@@ -300,26 +300,338 @@ func TestPrepareThoroughShutdown(t *testing.T) {
 	assert.Empty(t, actions, "empty cache should shutdown right away")
 
 	now := time.Now()
-	cacheBrain.pages[2].state = cachedUnchanged
-	cacheBrain.pages[2].lastAccess = now
+	cacheBrain.setState(page(2), cachedUnchanged)
+	cacheBrain.pages.get(2).lastAccess = now
 	cacheBrain.cacheCount = 1
 
 	actions = cacheBrain.prepareShutdown(true)
 	assert.Equal(t, 2, len(actions))
 	assert.Equal(t, closeFile, actions[0].actionType)
 	assert.Equal(t, deleteCache, actions[1].actionType)
-	assert.Equal(t, notCached, cacheBrain.pages[2].state)
+	assert.Equal(t, notCached, cacheBrain.pages.get(2).state)
 	assert.Equal(t, 0, cacheBrain.cacheCount)
 
-	cacheBrain.pages[3].state = cachedChanged
-	cacheBrain.pages[3].lastAccess = now
-	cacheBrain.pages[4].state = cachedUploading
-	cacheBrain.pages[4].lastAccess = now
+	cacheBrain.setState(page(3), cachedChanged)
+	cacheBrain.pages.get(3).lastAccess = now
+	cacheBrain.setState(page(4), cachedUploading)
+	cacheBrain.pages.get(4).lastAccess = now
 	cacheBrain.cacheCount = 2
 
 	actions = cacheBrain.prepareShutdown(true)
 	assert.Equal(t, 2, len(actions))
 	assert.Equal(t, startUpload, actions[0].actionType)
-	assert.Equal(t, cachedUploading, cacheBrain.pages[3].state)
+	assert.Equal(t, cachedUploading, cacheBrain.pages.get(3).state)
 	assert.Equal(t, waitAndRetry, actions[1].actionType)
 }
+
+func TestMaxDirtyAge(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 6, 4, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheBrain.maxDirtyAge = time.Minute
+
+	now := time.Now()
+	actions := cacheBrain.prepareAccess(page(2), true, now)
+	assert.Equal(t, 2, len(actions))
+	assert.Equal(t, now, cacheBrain.pages.get(2).dirtySince)
+
+	// keep the page busy so that it never becomes idle
+	for i := 1; i <= 3; i++ {
+		access := now.Add(time.Duration(i) * 25 * time.Second)
+		cacheBrain.prepareAccess(page(2), true, access)
+		actions = cacheBrain.maintenance(access)
+		if i < 3 {
+			assert.Empty(t, actions, "busy page should not be uploaded yet")
+			assert.False(t, cacheBrain.dirtyLimitExceeded(access))
+		}
+	}
+	assert.Equal(t, 1, len(actions), "expected forced upload")
+	assert.Equal(t, startUpload, actions[0].actionType)
+	assert.Equal(t, now, cacheBrain.pages.get(2).dirtySince, "dirty time only ends with completed upload")
+
+	cacheBrain.uploadComplete(page(2), now)
+	count, oldest := cacheBrain.dirtyStats()
+	assert.Equal(t, 0, count)
+	assert.True(t, oldest.IsZero())
+}
+
+func TestMaxDirtyPages(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 8, 6, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheBrain.maxDirtyPages = 2
+
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		cacheBrain.prepareAccess(page(i), true, now.Add(time.Duration(i)*time.Second))
+	}
+	assert.True(t, cacheBrain.dirtyLimitExceeded(now.Add(5*time.Second)))
+
+	actions := cacheBrain.maintenance(now.Add(5 * time.Second))
+	assert.Equal(t, 2, len(actions), "expected uploads of the pages over the limit")
+	assert.Equal(t, page(0), actions[0].page)
+	assert.Equal(t, page(1), actions[1].page)
+
+	actions = cacheBrain.maintenance(now.Add(6 * time.Second))
+	assert.Equal(t, 2, len(actions), "uploading pages still count as dirty")
+}
+
+func TestAdaptiveIdleInterval(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 8, 6, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheBrain.minIdleInterval = 10 * time.Second
+	cacheBrain.maxIdleInterval = 2 * time.Minute
+
+	now := time.Now()
+	cacheBrain.prepareAccess(page(1), true, now)
+	cacheBrain.prepareAccess(page(2), true, now)
+	actions := cacheBrain.maintenance(now.Add(31 * time.Second))
+	assert.Equal(t, 2, len(actions), "expected uploads after base interval")
+
+	// rewriting page 1 during its upload makes it wait longer
+	now = now.Add(40 * time.Second)
+	cacheBrain.prepareAccess(page(1), true, now)
+	assert.Equal(t, time.Minute, cacheBrain.pageIdleInterval(page(1), now))
+	cacheBrain.uploadComplete(page(2), now)
+	assert.Equal(t, 15*time.Second, cacheBrain.pageIdleInterval(page(2), now))
+
+	// keep the device busy through writes to another page
+	cacheBrain.prepareAccess(page(3), true, now.Add(35*time.Second))
+	actions = cacheBrain.maintenance(now.Add(40 * time.Second))
+	assert.Equal(t, 0, len(actions), "expected rewritten page to wait longer")
+
+	// quiet device falls back to the minimum interval
+	actions = cacheBrain.maintenance(now.Add(46 * time.Second))
+	assert.Equal(t, 2, len(actions), "expected uploads once the device is quiet")
+	assert.Equal(t, 10*time.Second, cacheBrain.pageIdleInterval(page(1), now.Add(46*time.Second)))
+}
+
+func TestOrderedUploads(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 8, 6, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheBrain.orderedUploads = true
+
+	now := time.Now()
+	cacheBrain.prepareAccess(page(1), true, now)
+	cacheBrain.flush()
+	cacheBrain.prepareAccess(page(2), true, now.Add(-time.Minute))
+	cacheBrain.prepareAccess(page(1), true, now.Add(20*time.Second))
+
+	// page 2 is idle first, but was written to after the flush
+	actions := cacheBrain.maintenance(now.Add(35 * time.Second))
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, page(1), actions[0].page, "expected page of earlier epoch to be forced out")
+	assert.Equal(t, cachedChanged, cacheBrain.pages.get(2).state)
+
+	actions = cacheBrain.maintenance(now.Add(time.Minute))
+	assert.Empty(t, actions, "expected later epoch to wait for upload to complete")
+
+	cacheBrain.uploadComplete(page(1), now.Add(time.Minute))
+	actions = cacheBrain.maintenance(now.Add(time.Minute))
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, page(2), actions[0].page)
+}
+
+func TestStateIndexes(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 8, 6, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cacheBrain.prepareAccess(page(4), true, now)
+	cacheBrain.prepareAccess(page(1), true, now)
+	cacheBrain.setState(page(7), notCached)
+	cacheBrain.prepareAccess(page(7), false, now)
+	assert.Equal(t, 3, cacheBrain.cacheCount)
+	assert.Equal(t, []page{1, 4, 7}, cacheBrain.cachedPages.sorted())
+	assert.Equal(t, []page{1, 4}, cacheBrain.dirtyPages.sorted())
+	assert.Equal(t, 3, cacheBrain.allocatedPages())
+
+	cacheBrain.maintenance(now.Add(time.Minute))
+	assert.Equal(t, 2, cacheBrain.uploadingPages())
+	cacheBrain.uploadComplete(page(4), now.Add(time.Minute))
+	assert.Equal(t, []page{1}, cacheBrain.dirtyPages.sorted())
+
+	cacheBrain.prepareShutdown(false)
+	assert.Equal(t, 1, cacheBrain.cacheCount, "expected only the dirty page to stay cached")
+	assert.Equal(t, []page{1}, cacheBrain.cachedPages.sorted())
+	assert.Equal(t, 0, cacheBrain.uploadingPages())
+	assert.Equal(t, 3, cacheBrain.allocatedPages())
+}
+
+func TestSparsePageTable(t *testing.T) {
+	// a 64 PiB device
+	cacheBrain, err := newCacheBrain(1<<30, 8, 6, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cacheBrain.prepareAccess(page(1<<29), true, now)
+	assert.Equal(t, zero, cacheBrain.pages.state(page(12345)))
+	assert.Equal(t, 1, len(cacheBrain.pages), "expected only touched pages to be materialized")
+
+	actions := cacheBrain.maintenance(now.Add(time.Minute))
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, page(1<<29), actions[0].page)
+}
+
+func TestRequestUpload(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 8, 6, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cacheBrain.prepareAccess(page(1), true, now)
+	cacheBrain.prepareAccess(page(2), false, now)
+	cacheBrain.setState(page(2), cachedUnchanged)
+
+	assert.False(t, cacheBrain.requestUpload(page(2)), "expected clean page to have nothing to upload")
+	assert.False(t, cacheBrain.requestUpload(page(3)))
+	assert.True(t, cacheBrain.requestUpload(page(1)))
+
+	actions := cacheBrain.maintenance(now.Add(time.Second))
+	assert.Equal(t, []action{{actionType: startUpload, page: page(1)}}, actions,
+		"expected requested upload to start before page is idle")
+
+	cacheBrain.uploadComplete(page(1), now.Add(2*time.Second))
+	assert.False(t, cacheBrain.pages.get(page(1)).uploadRequested)
+
+	_, err = cacheBrain.evict(page(1))
+	assert.Nil(t, err)
+	assert.Equal(t, notCached, cacheBrain.pages.state(page(1)))
+
+	cacheBrain.prepareAccess(page(4), true, now)
+	_, err = cacheBrain.evict(page(4))
+	assert.Equal(t, errPageDirty, err)
+	assert.Equal(t, cachedChanged, cacheBrain.pages.state(page(4)))
+}
+
+func TestWriteReserve(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 8, 4, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheBrain.writeReserve = 2
+
+	now := time.Now()
+	for i := 0; i < 8; i++ {
+		cacheBrain.setState(page(i), notCached)
+	}
+	for i := 0; i < 6; i++ {
+		cacheBrain.prepareAccess(page(i), false, now.Add(time.Duration(i)*time.Second))
+	}
+
+	actions := cacheBrain.prepareAccess(page(6), false, now.Add(6*time.Second))
+	assert.Equal(t, []action{{actionType: waitAndRetry}}, actions,
+		"expected reads to leave the reserve alone")
+
+	actions = cacheBrain.prepareAccess(page(6), true, now.Add(6*time.Second))
+	assert.Equal(t, download, actions[0].actionType, "expected writes to use the reserve")
+	assert.Equal(t, 7, cacheBrain.cacheCount)
+
+	cacheBrain.maintenance(now.Add(7 * time.Second))
+	assert.True(t, cacheBrain.cacheCount <= 6, "expected the reserve to be freed")
+	assert.Equal(t, cachedChanged, cacheBrain.pages.state(page(6)))
+	assert.Equal(t, cachedUnchanged, cacheBrain.pages.state(page(5)))
+	assert.Equal(t, notCached, cacheBrain.pages.state(page(0)))
+}
+
+func TestReadOverflow(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 4, 2, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheBrain.readOverflow = 1
+
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		cacheBrain.prepareAccess(page(i), true, now)
+	}
+	cacheBrain.setState(page(8), notCached)
+	cacheBrain.setState(page(9), notCached)
+
+	actions := cacheBrain.prepareAccess(page(4), true, now)
+	assert.Equal(t, []action{{actionType: waitAndRetry}}, actions)
+
+	actions = cacheBrain.prepareAccess(page(8), false, now)
+	assert.Equal(t, download, actions[0].actionType, "expected read to exceed the hard limit")
+	assert.Equal(t, 5, cacheBrain.cacheCount)
+	assert.Nil(t, cacheBrain.checkInvariants())
+
+	actions = cacheBrain.prepareAccess(page(9), false, now)
+	assert.Equal(t, []action{{actionType: waitAndRetry}}, actions,
+		"expected read to wait for the clean page to be evicted")
+
+	cacheBrain.maintenance(now)
+	assert.Equal(t, notCached, cacheBrain.pages.state(page(8)))
+	actions = cacheBrain.prepareAccess(page(9), false, now)
+	assert.Equal(t, download, actions[0].actionType)
+}
+
+func TestUploadLimit(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 6, 4, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheBrain.uploadLimit = 2
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		cacheBrain.prepareAccess(page(i), true, now)
+	}
+	cacheBrain.setState(page(3), cachedUploading)
+
+	uploads := func(actions []action) int {
+		count := 0
+		for _, action := range actions {
+			if action.actionType == startUpload {
+				count += 1
+			}
+		}
+		return count
+	}
+
+	actions := cacheBrain.maintenance(now.Add(time.Minute))
+	assert.Equal(t, 1, uploads(actions), "expected uploads up to the limit only")
+	assert.Equal(t, 2, cacheBrain.uploadingPages())
+
+	cacheBrain.uploadComplete(page(3), now.Add(time.Minute))
+	actions = cacheBrain.maintenance(now.Add(2 * time.Minute))
+	assert.Equal(t, 1, uploads(actions), "expected another upload once one completed")
+
+	cacheBrain.uploadLimit = 0
+	actions = cacheBrain.maintenance(now.Add(2 * time.Minute))
+	assert.Equal(t, 1, uploads(actions), "expected the remaining page to be uploaded without a limit")
+}
+
+func TestReadOnly(t *testing.T) {
+	cacheBrain, err := newCacheBrain(10, 6, 4, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheBrain.readOnly = true
+
+	now := time.Now()
+	actions := cacheBrain.prepareAccess(page(3), false, now)
+	assert.Empty(t, actions, "expected zero page to be read without entering the cache")
+	assert.Equal(t, zero, cacheBrain.pages.state(page(3)))
+	assert.Equal(t, 0, cacheBrain.allocatedPages())
+
+	// even a dirty page is never uploaded
+	cacheBrain.setState(page(5), cachedChanged)
+	assert.False(t, cacheBrain.requestUpload(page(5)))
+	actions = append(cacheBrain.maintenance(now.Add(time.Hour)), cacheBrain.prepareShutdown(true)...)
+	for _, action := range actions {
+		assert.NotEqual(t, startUpload, action.actionType, "expected no uploads in read-only mode")
+	}
+	assert.Nil(t, cacheBrain.checkInvariants())
+}
@@ -0,0 +1,418 @@
+package sia
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+
+	"github.com/javgh/sia-nbdserver/config"
+)
+
+type (
+	// cacheFile is the part of *os.File that the cache uses, so that cache
+	// files can be encrypted without the rest of the backend noticing.
+	cacheFile interface {
+		io.ReaderAt
+		io.WriterAt
+		Sync() error
+		Close() error
+	}
+
+	// cacheKey encrypts cache files with AES-256-GCM. Its id identifies
+	// the key in the header of encrypted cache files without revealing it.
+	cacheKey struct {
+		aead cipher.AEAD
+		id   [8]byte
+	}
+
+	// encryptedFile stores the data of a page as a header followed by
+	// blocks of cryptBlockSize bytes, each sealed with a random nonce of
+	// its own, as blocks are rewritten in place. The page number and block
+	// index are authenticated along with the data, so that blocks cannot
+	// be swapped without being noticed.
+	encryptedFile struct {
+		file *os.File
+		key  *cacheKey
+		page page
+	}
+
+	// cacheFileWriter writes to a cache file sequentially.
+	cacheFileWriter struct {
+		file   cacheFile
+		offset int64
+	}
+)
+
+const (
+	cryptMagic       = "sianbdE1"
+	cryptHeaderSize  = int64(len(cryptMagic) + 8)
+	cryptBlockSize   = 4096
+	cryptNonceSize   = 12
+	cryptTagSize     = 16
+	cryptStoredBlock = cryptNonceSize + cryptBlockSize + cryptTagSize
+)
+
+func newCacheKey(key []byte) (*cacheKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(append([]byte("sia-nbdserver cache key id"), key...))
+	cacheKey := &cacheKey{aead: aead}
+	copy(cacheKey.id[:], sum[:])
+	return cacheKey, nil
+}
+
+func (k *cacheKey) header() []byte {
+	return append([]byte(cryptMagic), k.id[:]...)
+}
+
+func (k *cacheKey) additionalData(page page, block int64) []byte {
+	ad := make([]byte, 16)
+	binary.BigEndian.PutUint64(ad[0:8], uint64(page))
+	binary.BigEndian.PutUint64(ad[8:16], uint64(block))
+	return ad
+}
+
+// readCacheHeader returns the header of an encrypted cache file, or nil if
+// the file is a plaintext cache file.
+func readCacheHeader(file *os.File) ([]byte, error) {
+	header := make([]byte, cryptHeaderSize)
+	_, err := file.ReadAt(header, 0)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(cryptMagic)) {
+		return nil, nil
+	}
+	return header, nil
+}
+
+// openCacheFile opens the cache file of a page, creating it if necessary.
+// With a cache key, the file is encrypted; plaintext cache files left from
+// running without a key and files encrypted with the previous key are
+// re-encrypted first.
+func (b *Backend) openCacheFile(page page) (cacheFile, error) {
+	cachePath := b.asCachePath(page)
+	file, err := os.OpenFile(cachePath, os.O_RDWR|os.O_CREATE, b.cacheFileMode())
+	if err != nil {
+		return nil, err
+	}
+	err = b.setCacheFileOwnership(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	header, err := readCacheHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if b.cacheKey == nil {
+		if header != nil {
+			file.Close()
+			return nil, fmt.Errorf("cache file of page %d is encrypted, but no cache key is set", page)
+		}
+		return file, nil
+	}
+
+	if b.previousCacheKey != nil && bytes.Equal(header, b.previousCacheKey.header()) {
+		file.Close()
+		err = reencryptCacheFile(cachePath, page, b.previousCacheKey, b.cacheKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to re-encrypt cache file of page %d: %s", page, err)
+		}
+		return b.openCacheFile(page)
+	}
+
+	if header == nil {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if info.Size() > 0 {
+			file.Close()
+			err = reencryptCacheFile(cachePath, page, nil, b.cacheKey)
+			if err != nil {
+				return nil, fmt.Errorf("unable to encrypt cache file of page %d: %s", page, err)
+			}
+			return b.openCacheFile(page)
+		}
+
+		_, err = file.WriteAt(b.cacheKey.header(), 0)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		header = b.cacheKey.header()
+	}
+
+	if !bytes.Equal(header, b.cacheKey.header()) {
+		file.Close()
+		return nil, fmt.Errorf("cache file of page %d is encrypted with a different key", page)
+	}
+	return &encryptedFile{file: file, key: b.cacheKey, page: page}, nil
+}
+
+// reencryptCacheFile replaces a cache file that is encrypted with previous,
+// or plaintext if previous is nil, with a copy encrypted with key.
+func reencryptCacheFile(cachePath string, page page, previous *cacheKey, key *cacheKey) error {
+	src, err := os.Open(cachePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var plain io.Reader = src
+	if previous != nil {
+		plain = io.NewSectionReader(&encryptedFile{file: src, key: previous, page: page}, 0, math.MaxInt64)
+	}
+
+	tmpPath := cachePath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	_, err = file.WriteAt(key.header(), 0)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	encrypted := &encryptedFile{file: file, key: key, page: page}
+	_, err = io.Copy(&cacheFileWriter{file: encrypted}, plain)
+	if err == nil {
+		err = encrypted.Sync()
+	}
+	if err != nil {
+		encrypted.Close()
+		return err
+	}
+
+	err = encrypted.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, cachePath)
+}
+
+// loadCacheKey reads a cache key from a key file, if one is given.
+func loadCacheKey(keyFile string) (*cacheKey, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	key, err := config.ReadKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return newCacheKey(key)
+}
+
+// Rekey re-encrypts the cache files that are encrypted with the key in
+// settings.PreviousCacheKeyFile, or not at all, with the key in
+// settings.CacheKeyFile. Each file is replaced in one step once its copy is
+// complete, so an interrupted run can simply be repeated. Ghost copies that
+// are not encrypted with the new key are dropped. The server must not be
+// running, which the lock on the data directory ensures; it can instead be
+// started with both keys, in which case it re-encrypts each cache file
+// when opening it.
+func Rekey(settings BackendSettings) error {
+	key, err := loadCacheKey(settings.CacheKeyFile)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return errors.New("no cache key to re-encrypt with")
+	}
+	previous, err := loadCacheKey(settings.PreviousCacheKeyFile)
+	if err != nil {
+		return err
+	}
+
+	dataLock, err := lockDataDirectory(settings.DataDirectory)
+	if err != nil {
+		return err
+	}
+	defer dataLock.Close()
+
+	pageCount := pageCountFor(settings.Size)
+	cachedPages := getCachedPages(settings.DataDirectory, pageCount)
+	reencrypted := 0
+	for i, page := range cachedPages {
+		cachePath := asCachePath(settings.DataDirectory, page)
+		file, err := os.Open(cachePath)
+		if err != nil {
+			return err
+		}
+		header, err := readCacheHeader(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		var from *cacheKey
+		switch {
+		case bytes.Equal(header, key.header()):
+			continue
+		case header == nil:
+		case previous != nil && bytes.Equal(header, previous.header()):
+			from = previous
+		default:
+			return fmt.Errorf("cache file of page %d is encrypted with an unknown key", page)
+		}
+
+		err = reencryptCacheFile(cachePath, page, from, key)
+		if err == nil {
+			err = refreshCacheFileChecksum(settings.DataDirectory, page)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to re-encrypt cache file of page %d: %s", page, err)
+		}
+		reencrypted += 1
+		log.Printf("Re-encrypted page %d (%d/%d cache files checked)\n", page, i+1, len(cachedPages))
+	}
+
+	ghost, err := newGhostCache(settings.DataDirectory, math.MaxUint64)
+	if err != nil {
+		return err
+	}
+	err = ghost.dropForeign(key.header())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Re-encrypted %d of %d cache files\n", reencrypted, len(cachedPages))
+	return nil
+}
+
+func storedOffset(block int64) int64 {
+	return cryptHeaderSize + block*cryptStoredBlock
+}
+
+// ReadAt decrypts the blocks covering buf. Like *os.File, it returns
+// io.EOF when reading past the end of the file.
+func (f *encryptedFile) ReadAt(buf []byte, offset int64) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	firstBlock := offset / cryptBlockSize
+	lastBlock := (offset + int64(len(buf)) - 1) / cryptBlockSize
+	stored := make([]byte, (lastBlock-firstBlock+1)*cryptStoredBlock)
+	storedN, err := f.file.ReadAt(stored, storedOffset(firstBlock))
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	n := 0
+	for block := firstBlock; block <= lastBlock; block++ {
+		start := (block - firstBlock) * cryptStoredBlock
+		if start+cryptStoredBlock > int64(storedN) {
+			return n, io.EOF
+		}
+
+		data, err := f.open(block, stored[start:start+cryptStoredBlock])
+		if err != nil {
+			return n, err
+		}
+		n += copy(buf[n:], data[(offset+int64(n))%cryptBlockSize:])
+	}
+	return n, nil
+}
+
+// WriteAt encrypts the blocks covering buf, merging in the data of blocks
+// that are only partially overwritten. Blocks beyond the end of the file
+// count as zeroes.
+func (f *encryptedFile) WriteAt(buf []byte, offset int64) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	firstBlock := offset / cryptBlockSize
+	lastBlock := (offset + int64(len(buf)) - 1) / cryptBlockSize
+	stored := make([]byte, 0, (lastBlock-firstBlock+1)*cryptStoredBlock)
+	data := make([]byte, cryptBlockSize)
+
+	n := 0
+	for block := firstBlock; block <= lastBlock; block++ {
+		blockOffset := (offset + int64(n)) % cryptBlockSize
+		length := min(cryptBlockSize-int(blockOffset), len(buf)-n)
+		if length < cryptBlockSize {
+			for i := range data {
+				data[i] = 0
+			}
+			_, err := f.ReadAt(data, block*cryptBlockSize)
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+		}
+		copy(data[blockOffset:], buf[n:n+length])
+
+		sealed, err := f.seal(block, data)
+		if err != nil {
+			return 0, err
+		}
+		stored = append(stored, sealed...)
+		n += length
+	}
+
+	_, err := f.file.WriteAt(stored, storedOffset(firstBlock))
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (f *encryptedFile) seal(block int64, data []byte) ([]byte, error) {
+	nonce := make([]byte, cryptNonceSize, cryptStoredBlock)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return f.key.aead.Seal(nonce, nonce, data, f.key.additionalData(f.page, block)), nil
+}
+
+func (f *encryptedFile) open(block int64, stored []byte) ([]byte, error) {
+	data, err := f.key.aead.Open(nil, stored[:cryptNonceSize], stored[cryptNonceSize:],
+		f.key.additionalData(f.page, block))
+	if err != nil {
+		return nil, fmt.Errorf("block %d of the cache file of page %d fails authentication", block, f.page)
+	}
+	return data, nil
+}
+
+func (f *encryptedFile) Sync() error {
+	return f.file.Sync()
+}
+
+func (f *encryptedFile) Close() error {
+	return f.file.Close()
+}
+
+func (w *cacheFileWriter) Write(buf []byte) (int, error) {
+	n, err := w.file.WriteAt(buf, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,138 @@
+package sia
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptedFile(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "cachecrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	key, err := newCacheKey(bytes.Repeat([]byte{1}, 32))
+	assert.Nil(t, err)
+	b := &Backend{dataDirectory: dataDirectory, cacheKey: key}
+
+	// plaintext cache files are encrypted when opened with a key
+	plain := make([]byte, 3*cryptBlockSize+100)
+	rand.Read(plain)
+	err = ioutil.WriteFile(b.asCachePath(page(2)), plain, 0600)
+	assert.Nil(t, err)
+
+	f, err := b.openCacheFile(page(2))
+	assert.Nil(t, err)
+	onDisk, err := ioutil.ReadFile(b.asCachePath(page(2)))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(onDisk, plain[:64]), "expected no plaintext on disk")
+
+	readBack := make([]byte, len(plain))
+	n, err := f.ReadAt(readBack, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(plain), n)
+	assert.Equal(t, plain, readBack)
+
+	// unaligned write across block boundaries
+	update := make([]byte, cryptBlockSize+10)
+	rand.Read(update)
+	_, err = f.WriteAt(update, cryptBlockSize-5)
+	assert.Nil(t, err)
+	copy(plain[cryptBlockSize-5:], update)
+
+	readBack = make([]byte, 2*cryptBlockSize)
+	_, err = f.ReadAt(readBack, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, plain[7:7+2*cryptBlockSize], readBack)
+
+	_, err = f.ReadAt(make([]byte, cryptBlockSize), 4*cryptBlockSize)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, f.Close())
+
+	// blocks of another page do not authenticate
+	onDisk, err = ioutil.ReadFile(b.asCachePath(page(2)))
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(b.asCachePath(page(3)), onDisk, 0600)
+	assert.Nil(t, err)
+	f, err = b.openCacheFile(page(3))
+	assert.Nil(t, err)
+	_, err = f.ReadAt(make([]byte, 10), 0)
+	assert.NotNil(t, err)
+	f.Close()
+
+	other, err := newCacheKey(bytes.Repeat([]byte{2}, 32))
+	assert.Nil(t, err)
+	_, err = (&Backend{dataDirectory: dataDirectory, cacheKey: other}).openCacheFile(page(2))
+	assert.NotNil(t, err, "expected file encrypted with a different key to be refused")
+	_, err = (&Backend{dataDirectory: dataDirectory}).openCacheFile(page(2))
+	assert.NotNil(t, err, "expected encrypted file to be refused without key")
+}
+
+func TestRekey(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "rekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	writeKey := func(name string, b byte) string {
+		path := filepath.Join(dataDirectory, name)
+		err := ioutil.WriteFile(path, []byte(strings.Repeat(fmt.Sprintf("%02x", b), 32)+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	settings := BackendSettings{
+		Size:                 4 * pageSize,
+		DataDirectory:        dataDirectory,
+		CacheKeyFile:         writeKey("new", 2),
+		PreviousCacheKeyFile: writeKey("old", 1),
+	}
+	previous, err := loadCacheKey(settings.PreviousCacheKeyFile)
+	assert.Nil(t, err)
+	key, err := loadCacheKey(settings.CacheKeyFile)
+	assert.Nil(t, err)
+
+	data := make([]byte, 2*cryptBlockSize)
+	rand.Read(data)
+	old := &Backend{dataDirectory: dataDirectory, cacheKey: previous}
+	for _, page := range []page{0, 3} {
+		f, err := old.openCacheFile(page)
+		assert.Nil(t, err)
+		_, err = f.WriteAt(data, 0)
+		assert.Nil(t, err)
+		f.Close()
+	}
+
+	// during the transition, files with the previous key remain readable
+	b := &Backend{dataDirectory: dataDirectory, cacheKey: key, previousCacheKey: previous}
+	f, err := b.openCacheFile(page(0))
+	assert.Nil(t, err)
+	readBack := make([]byte, len(data))
+	_, err = f.ReadAt(readBack, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, data, readBack)
+	f.Close()
+
+	assert.Nil(t, Rekey(settings))
+	assert.Nil(t, Rekey(settings), "expected repeated run to succeed")
+
+	b.previousCacheKey = nil
+	f, err = b.openCacheFile(page(3))
+	assert.Nil(t, err)
+	_, err = f.ReadAt(readBack, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, data, readBack)
+	f.Close()
+}
@@ -0,0 +1,126 @@
+package sia
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The format of the cache directory is recorded in cacheFormatFile, so that
+// a cache directory is never used by a version that does not understand it.
+// Cache directories without the file are from before headers were
+// introduced (format 1).
+const (
+	cacheFormatFile     = "cacheformat"
+	legacyCacheFormat   = 1
+	currentCacheFormat  = cacheHeaderVersion
+	cacheFormatFileMode = 0600
+)
+
+func cacheFormatPath(dataDirectory string) string {
+	return filepath.Join(dataDirectory, cacheFormatFile)
+}
+
+// readCacheFormat returns the format of the cache directory, refusing
+// formats newer than this version knows.
+func readCacheFormat(dataDirectory string) (int, error) {
+	encoded, err := ioutil.ReadFile(cacheFormatPath(dataDirectory))
+	if os.IsNotExist(err) {
+		return legacyCacheFormat, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	format, err := strconv.Atoi(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", cacheFormatFile, err)
+	}
+	if format > currentCacheFormat {
+		return 0, fmt.Errorf("the cache in %s has format %d, which is newer than this version supports (%d)",
+			dataDirectory, format, currentCacheFormat)
+	}
+	return format, nil
+}
+
+// migrateCacheFormat brings the cache directory to the current format by
+// giving the cache files a header. The cache files themselves are left as
+// they are, so nothing needs to be backed up, and RollbackCacheFormat
+// returns to the previous format. The format is only recorded once every
+// file has its header, so an interrupted migration is simply repeated. The
+// mutex needs to be held.
+func (b *Backend) migrateCacheFormat(format int, cachedPages []page) error {
+	if format == currentCacheFormat {
+		return nil
+	}
+
+	migrated := 0
+	for _, page := range cachedPages {
+		header, err := readCacheFileHeader(b.dataDirectory, page)
+		if err != nil {
+			return err
+		}
+		if header != nil {
+			continue
+		}
+		err = b.writeCacheFileHeader(page, "")
+		if err != nil {
+			return fmt.Errorf("unable to migrate cache file of page %d: %s", page, err)
+		}
+		migrated += 1
+	}
+
+	err := writeFileAtomically(cacheFormatPath(b.dataDirectory),
+		[]byte(fmt.Sprintf("%d\n", currentCacheFormat)), cacheFormatFileMode)
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrated the cache from format %d to %d (%d cache file(s))\n",
+		format, currentCacheFormat, migrated)
+	return nil
+}
+
+// RollbackCacheFormat returns the cache directory described by settings to
+// the format from before headers were introduced, so that an earlier
+// version can use it, and returns how many headers were removed. The cache
+// files are left alone. The server must not be running, which the lock on
+// the data directory ensures.
+func RollbackCacheFormat(settings BackendSettings) (int, error) {
+	dataLock, err := lockDataDirectory(settings.DataDirectory)
+	if err != nil {
+		return 0, err
+	}
+	defer dataLock.Close()
+
+	_, err = readCacheFormat(settings.DataDirectory)
+	if err != nil {
+		return 0, err
+	}
+
+	fileInfos, err := ioutil.ReadDir(settings.DataDirectory)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if fileInfo.IsDir() || !strings.HasPrefix(name, "page") || !strings.HasSuffix(name, cacheHeaderSuffix) {
+			continue
+		}
+		err = os.Remove(filepath.Join(settings.DataDirectory, name))
+		if err != nil {
+			return removed, err
+		}
+		removed += 1
+	}
+
+	err = os.Remove(cacheFormatPath(settings.DataDirectory))
+	if err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	return removed, nil
+}
@@ -0,0 +1,59 @@
+package sia
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheFormat(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "cacheformat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	b := newTestBackend(t, 4, dataDirectory)
+	b.device.UUID = "0f8c3a1e-5b7d-4e2a-9c61-2d4f8e0b7a93"
+	for _, page := range []page{1, 3} {
+		err = ioutil.WriteFile(b.asCachePath(page), []byte("data"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	format, err := readCacheFormat(dataDirectory)
+	assert.Nil(t, err)
+	assert.Equal(t, legacyCacheFormat, format)
+
+	assert.Nil(t, b.migrateCacheFormat(format, []page{1, 3}))
+	format, err = readCacheFormat(dataDirectory)
+	assert.Nil(t, err)
+	assert.Equal(t, currentCacheFormat, format)
+	for _, page := range []page{1, 3} {
+		header, err := readCacheFileHeader(dataDirectory, page)
+		assert.Nil(t, err)
+		assert.Equal(t, b.device.UUID, header.Device)
+		data, err := ioutil.ReadFile(b.asCachePath(page))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("data"), data, "expected cache files to be left alone")
+	}
+
+	settings := BackendSettings{DataDirectory: dataDirectory}
+	removed, err := RollbackCacheFormat(settings)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+	format, err = readCacheFormat(dataDirectory)
+	assert.Nil(t, err)
+	assert.Equal(t, legacyCacheFormat, format)
+	assert.Equal(t, []page{1, 3}, getCachedPages(dataDirectory, 4))
+
+	err = ioutil.WriteFile(cacheFormatPath(dataDirectory), []byte("3\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readCacheFormat(dataDirectory)
+	assert.NotNil(t, err, "expected newer formats to be refused")
+}
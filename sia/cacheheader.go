@@ -0,0 +1,157 @@
+package sia
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+type (
+	// cacheHeader binds a cache file to the device and page it belongs to,
+	// so that a stray file, e.g. one copied over from another device, is
+	// not taken for data of this one. It is kept next to the cache file,
+	// which then holds nothing but the page, as the offsets within cache
+	// files are relied upon all over. Cache files from before headers were
+	// introduced have none and are adopted as they are.
+	cacheHeader struct {
+		Version int    `json:"version"`
+		Device  string `json:"device"`
+		Page    page   `json:"page"`
+
+		// Generation is the generation on Sia that the cache file is
+		// based on, which may be older than the data in the file.
+		Generation int `json:"generation"`
+
+		// Checksum is the SHA-256 of the cache file, recorded when the
+		// server shuts down, as the file changes all the time while it
+		// is open.
+		Checksum string `json:"checksum,omitempty"`
+	}
+)
+
+const (
+	cacheHeaderVersion = 2
+	cacheHeaderSuffix  = ".header"
+)
+
+func cacheHeaderPath(dataDirectory string, page page) string {
+	return asCachePath(dataDirectory, page) + cacheHeaderSuffix
+}
+
+// readCacheFileHeader returns the header of the cache file of a page, or
+// nil if it has none.
+func readCacheFileHeader(dataDirectory string, page page) (*cacheHeader, error) {
+	encoded, err := ioutil.ReadFile(cacheHeaderPath(dataDirectory, page))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var header cacheHeader
+	err = json.Unmarshal(encoded, &header)
+	if err != nil {
+		return nil, fmt.Errorf("unreadable header: %s", err)
+	}
+	return &header, nil
+}
+
+// writeCacheFileHeader stores the header of the cache file of a page with
+// the given checksum, which is empty while the file is in use. The mutex
+// needs to be held.
+func (b *Backend) writeCacheFileHeader(page page, checksum string) error {
+	encoded, err := json.Marshal(cacheHeader{
+		Version:    cacheHeaderVersion,
+		Device:     b.device.UUID,
+		Page:       page,
+		Generation: b.cache.pages.get(page).generation,
+		Checksum:   checksum,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(cacheHeaderPath(b.dataDirectory, page), encoded, b.cacheFileMode())
+}
+
+// removeCacheFileHeader removes the header of the cache file of a page, if
+// there is one.
+func removeCacheFileHeader(dataDirectory string, page page) error {
+	err := os.Remove(cacheHeaderPath(dataDirectory, page))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func checksumFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkCacheFileHeader returns an error if the cache file of a page belongs
+// to another page or device, is based on a generation newer than the latest
+// one on Sia, or no longer matches the checksum recorded on shutdown. The
+// device is not checked if unknown.
+func checkCacheFileHeader(dataDirectory string, page page, device string, generation int) error {
+	header, err := readCacheFileHeader(dataDirectory, page)
+	if err != nil || header == nil {
+		return err
+	}
+
+	switch {
+	case header.Version != cacheHeaderVersion:
+		return fmt.Errorf("cache file has unknown version %d", header.Version)
+	case header.Page != page:
+		return fmt.Errorf("cache file belongs to page %d", header.Page)
+	case device != "" && header.Device != device:
+		return fmt.Errorf("cache file belongs to device %s", header.Device)
+	case header.Generation > generation:
+		return fmt.Errorf("cache file is based on generation %d, which is not on Sia", header.Generation)
+	}
+
+	if header.Checksum == "" {
+		return nil
+	}
+	checksum, err := checksumFile(asCachePath(dataDirectory, page))
+	if err != nil {
+		return err
+	}
+	if checksum != header.Checksum {
+		return fmt.Errorf("cache file changed since the server shut down")
+	}
+	return nil
+}
+
+// refreshCacheFileChecksum recomputes the checksum in the header of the
+// cache file of a page after it has been replaced while the server was not
+// running, as by Rekey.
+func refreshCacheFileChecksum(dataDirectory string, page page) error {
+	header, err := readCacheFileHeader(dataDirectory, page)
+	if err != nil || header == nil || header.Checksum == "" {
+		return err
+	}
+	header.Checksum, err = checksumFile(asCachePath(dataDirectory, page))
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(cacheHeaderPath(dataDirectory, page), encoded, 0600)
+}
@@ -0,0 +1,59 @@
+package sia
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheFileHeader(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "cacheheader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	b := newTestBackend(t, 4, dataDirectory)
+	b.device.UUID = "0f8c3a1e-5b7d-4e2a-9c61-2d4f8e0b7a93"
+	b.cache.pages.get(page(1)).generation = 3
+	err = ioutil.WriteFile(b.asCachePath(page(1)), []byte("data"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, checkCacheFileHeader(dataDirectory, page(1), b.device.UUID, 3),
+		"expected files without a header to be adopted")
+
+	assert.Nil(t, b.writeCacheFileHeader(page(1), ""))
+	assert.Nil(t, checkCacheFileHeader(dataDirectory, page(1), b.device.UUID, 3))
+	assert.Nil(t, checkCacheFileHeader(dataDirectory, page(1), b.device.UUID, 4),
+		"expected files with changes based on an older generation to be fine")
+	assert.Nil(t, checkCacheFileHeader(dataDirectory, page(1), "", 3))
+	assert.NotNil(t, checkCacheFileHeader(dataDirectory, page(1), "a5e2b7c9-0d14-4f3b-8e6a-97c1d2f0b384", 3))
+	assert.NotNil(t, checkCacheFileHeader(dataDirectory, page(1), b.device.UUID, 2))
+
+	// a file taken over from another page
+	err = os.Rename(cacheHeaderPath(dataDirectory, page(1)), cacheHeaderPath(dataDirectory, page(2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, checkCacheFileHeader(dataDirectory, page(2), b.device.UUID, 3))
+
+	checksum, err := checksumFile(b.asCachePath(page(1)))
+	assert.Nil(t, err)
+	assert.Nil(t, b.writeCacheFileHeader(page(1), checksum))
+	assert.Nil(t, checkCacheFileHeader(dataDirectory, page(1), b.device.UUID, 3))
+	err = ioutil.WriteFile(b.asCachePath(page(1)), []byte("changed"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, checkCacheFileHeader(dataDirectory, page(1), b.device.UUID, 3))
+	assert.Nil(t, refreshCacheFileChecksum(dataDirectory, page(1)))
+	assert.Nil(t, checkCacheFileHeader(dataDirectory, page(1), b.device.UUID, 3))
+
+	assert.Nil(t, removeCacheFileHeader(dataDirectory, page(1)))
+	assert.Nil(t, removeCacheFileHeader(dataDirectory, page(1)))
+	assert.Equal(t, []page{1}, getCachedPages(dataDirectory, 4), "expected headers not to count as pages")
+}
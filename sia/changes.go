@@ -0,0 +1,417 @@
+package sia
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	// ChangeMarker is a point in time, such as the last backup, since
+	// which the blocks written to are tracked. A marker that was Reset
+	// reports every block as changed, as the machine crashed while writes
+	// may not have reached the journal.
+	ChangeMarker struct {
+		Name          string    `json:"name"`
+		Since         time.Time `json:"since"`
+		BlockSize     uint64    `json:"block_size"`
+		ChangedBlocks int       `json:"changed_blocks"`
+		Reset         bool      `json:"reset"`
+	}
+
+	// ChangedExtent is a range of the device written to since a marker.
+	// Zero is set if the range has since been discarded or lies in pages
+	// that were never written, so that a copy can leave a hole instead
+	// of reading it.
+	ChangedExtent struct {
+		Offset uint64 `json:"offset"`
+		Length uint64 `json:"length"`
+		Zero   bool   `json:"zero,omitempty"`
+	}
+
+	// ChangeReport lists the ranges of the device written to since a
+	// marker, in order and merged where adjacent and alike.
+	ChangeReport struct {
+		ChangeMarker
+		Extents []ChangedExtent `json:"extents"`
+	}
+
+	// changeJournal keeps a bitmap of the blocks written to since each
+	// marker. Bits are written through to the bitmap files as they are
+	// set, before the data, and the files are synced along with the cache,
+	// so that no write goes untracked across restarts.
+	changeJournal struct {
+		directory string
+		size      uint64
+		bootID    string
+		markers   map[string]*changeBitmap
+	}
+
+	changeBitmap struct {
+		since time.Time
+		reset bool
+		bits  []byte
+		file  *os.File
+	}
+
+	// journalState is stored next to the bitmaps. Clean is unset while
+	// the journal is in use, so that a crash can be told from a shutdown.
+	journalState struct {
+		BootID  string                 `json:"boot_id"`
+		Clean   bool                   `json:"clean"`
+		Markers map[string]markerState `json:"markers"`
+	}
+
+	markerState struct {
+		Since time.Time `json:"since"`
+		Reset bool      `json:"reset"`
+	}
+)
+
+const (
+	// changeBlockSize is the granularity at which writes are tracked.
+	changeBlockSize = 1024 * 1024
+
+	changeDirectory  = "changes"
+	journalStateFile = "journal.json"
+	bitmapSuffix     = ".bitmap"
+	maxNameSize      = 64
+	bootIDPath       = "/proc/sys/kernel/random/boot_id"
+)
+
+// currentBootID identifies the running boot of the machine, so that a
+// restart of the process can be told from a crash of the machine. It is
+// empty if unknown.
+func currentBootID() string {
+	bootID, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bootID))
+}
+
+// validName makes sure that the name of a marker or checkpoint can be used
+// as a file name.
+func validName(kind string, name string) error {
+	if name == "" || len(name) > maxNameSize ||
+		strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.") != "" ||
+		strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".new") {
+		return fmt.Errorf("invalid %s name %q", kind, name)
+	}
+	return nil
+}
+
+// openChangeJournal continues the journal in the data directory for a
+// device of the given size. If the machine crashed while the journal was
+// in use, bits set just before may not have reached the disk, so every
+// marker is reset to report the whole device as changed.
+func openChangeJournal(dataDirectory string, size uint64, bootID string) (*changeJournal, error) {
+	j := &changeJournal{
+		directory: filepath.Join(dataDirectory, changeDirectory),
+		size:      size,
+		bootID:    bootID,
+		markers:   make(map[string]*changeBitmap),
+	}
+	err := os.MkdirAll(j.directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	state := journalState{Clean: true}
+	encoded, err := ioutil.ReadFile(filepath.Join(j.directory, journalStateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(encoded, &state)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", journalStateFile, err)
+		}
+	}
+	crashed := !state.Clean && (state.BootID == "" || state.BootID != bootID)
+
+	names := []string{}
+	for name := range state.Markers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		bitmap, err := j.openBitmap(name, state.Markers[name], false)
+		if err != nil {
+			j.close(false)
+			return nil, err
+		}
+		j.markers[name] = bitmap
+		if crashed && !bitmap.reset {
+			log.Printf("Resetting change marker %s after a crash; it reports the whole device as changed\n", name)
+			err = j.setAll(bitmap)
+			if err != nil {
+				j.close(false)
+				return nil, err
+			}
+		}
+	}
+
+	err = j.saveState(false)
+	if err != nil {
+		j.close(false)
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *changeJournal) bitmapPath(name string) string {
+	return filepath.Join(j.directory, name+bitmapSuffix)
+}
+
+func (j *changeJournal) blocks() uint64 {
+	return (j.size + changeBlockSize - 1) / changeBlockSize
+}
+
+// openBitmap opens the bitmap of a marker, fitting it to the size of the
+// device. A new bitmap starts out empty.
+func (j *changeJournal) openBitmap(name string, marker markerState, create bool) (*changeBitmap, error) {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(j.bitmapPath(name), flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	length := int64((j.blocks() + 7) / 8)
+	bits := make([]byte, length)
+	_, err = file.ReadAt(bits, 0)
+	if err != nil && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+	err = file.Truncate(length)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &changeBitmap{since: marker.Since, reset: marker.Reset, bits: bits, file: file}, nil
+}
+
+// setAll marks every block as changed and the marker as reset.
+func (j *changeJournal) setAll(bitmap *changeBitmap) error {
+	for i := uint64(0); i < j.blocks(); i++ {
+		bitmap.bits[i/8] |= 1 << (i % 8)
+	}
+	bitmap.reset = true
+	_, err := bitmap.file.WriteAt(bitmap.bits, 0)
+	if err != nil {
+		return err
+	}
+	return bitmap.file.Sync()
+}
+
+func (j *changeJournal) saveState(clean bool) error {
+	state := journalState{BootID: j.bootID, Clean: clean, Markers: make(map[string]markerState)}
+	for name, bitmap := range j.markers {
+		state.Markers[name] = markerState{Since: bitmap.since, Reset: bitmap.reset}
+	}
+	encoded, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(filepath.Join(j.directory, journalStateFile), encoded, 0600)
+}
+
+// record marks the blocks overlapping a write as changed. It needs to be
+// called before the data is written.
+func (j *changeJournal) record(offset uint64, length uint64) error {
+	if j == nil || length == 0 || len(j.markers) == 0 {
+		return nil
+	}
+	first := offset / changeBlockSize
+	last := (offset + length - 1) / changeBlockSize
+	for _, bitmap := range j.markers {
+		for i := first; i <= last && i < j.blocks(); i++ {
+			if bitmap.bits[i/8]&(1<<(i%8)) != 0 {
+				continue
+			}
+			bitmap.bits[i/8] |= 1 << (i % 8)
+			_, err := bitmap.file.WriteAt(bitmap.bits[i/8:i/8+1], int64(i/8))
+			if err != nil {
+				return fmt.Errorf("unable to record change: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// sync makes the bitmaps survive a crash of the machine.
+func (j *changeJournal) sync() error {
+	if j == nil {
+		return nil
+	}
+	for _, bitmap := range j.markers {
+		err := bitmap.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close closes the bitmaps, recording a clean shutdown if clean is set.
+func (j *changeJournal) close(clean bool) error {
+	if j == nil {
+		return nil
+	}
+	var err error
+	if clean {
+		err = j.sync()
+		if err == nil {
+			err = j.saveState(true)
+		}
+	}
+	for _, bitmap := range j.markers {
+		bitmap.file.Close()
+	}
+	return err
+}
+
+// mark starts tracking changes since now under name, replacing a marker of
+// the same name.
+func (j *changeJournal) mark(name string, now time.Time) (ChangeMarker, error) {
+	err := validName("marker", name)
+	if err != nil {
+		return ChangeMarker{}, err
+	}
+	bitmap, err := j.openBitmap(name, markerState{Since: now}, true)
+	if err != nil {
+		return ChangeMarker{}, err
+	}
+	err = bitmap.file.Sync()
+	if err != nil {
+		bitmap.file.Close()
+		return ChangeMarker{}, err
+	}
+
+	if previous, ok := j.markers[name]; ok {
+		previous.file.Close()
+	}
+	j.markers[name] = bitmap
+	return j.marker(name, bitmap), j.saveState(false)
+}
+
+// forget stops tracking changes for a marker.
+func (j *changeJournal) forget(name string) error {
+	bitmap, ok := j.markers[name]
+	if !ok {
+		return fmt.Errorf("no change marker %q", name)
+	}
+	bitmap.file.Close()
+	delete(j.markers, name)
+	err := j.saveState(false)
+	if err != nil {
+		return err
+	}
+	return os.Remove(j.bitmapPath(name))
+}
+
+func (j *changeJournal) marker(name string, bitmap *changeBitmap) ChangeMarker {
+	changed := 0
+	for i := uint64(0); i < j.blocks(); i++ {
+		if bitmap.bits[i/8]&(1<<(i%8)) != 0 {
+			changed += 1
+		}
+	}
+	return ChangeMarker{
+		Name:          name,
+		Since:         bitmap.since,
+		BlockSize:     changeBlockSize,
+		ChangedBlocks: changed,
+		Reset:         bitmap.reset,
+	}
+}
+
+// list returns the markers ordered by name.
+func (j *changeJournal) list() []ChangeMarker {
+	markers := []ChangeMarker{}
+	for name, bitmap := range j.markers {
+		markers = append(markers, j.marker(name, bitmap))
+	}
+	sort.Slice(markers, func(i, j int) bool {
+		return markers[i].Name < markers[j].Name
+	})
+	return markers
+}
+
+// report lists the ranges changed since a marker. isZero tells whether the
+// block at an offset reads as zeroes; it may be nil.
+func (j *changeJournal) report(name string, isZero func(offset uint64) bool) (ChangeReport, error) {
+	bitmap, ok := j.markers[name]
+	if !ok {
+		return ChangeReport{}, fmt.Errorf("no change marker %q", name)
+	}
+
+	report := ChangeReport{ChangeMarker: j.marker(name, bitmap), Extents: []ChangedExtent{}}
+	for i := uint64(0); i < j.blocks(); i++ {
+		if bitmap.bits[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		offset := i * changeBlockSize
+		length := uint64(changeBlockSize)
+		if offset+length > j.size {
+			length = j.size - offset
+		}
+		hole := isZero != nil && isZero(offset)
+		last := len(report.Extents) - 1
+		if last >= 0 && report.Extents[last].Offset+report.Extents[last].Length == offset &&
+			report.Extents[last].Zero == hole {
+			report.Extents[last].Length += length
+			continue
+		}
+		report.Extents = append(report.Extents, ChangedExtent{Offset: offset, Length: length, Zero: hole})
+	}
+	return report, nil
+}
+
+// MarkChanges starts tracking the blocks written to from now on under the
+// given name, e.g. right before a backup is taken, replacing an earlier
+// marker of the same name.
+func (b *Backend) MarkChanges(name string) (ChangeMarker, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.changes.mark(name, b.now())
+}
+
+// Changes reports the ranges of the device written to since a marker,
+// telling those in zero pages apart.
+func (b *Backend) Changes(name string) (ChangeReport, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.changes.report(name, func(offset uint64) bool {
+		return b.cache.brain.pages.state(page(offset/pageSize)) == zero
+	})
+}
+
+// ChangeMarkers lists the markers that changes are tracked for.
+func (b *Backend) ChangeMarkers() []ChangeMarker {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.changes.list()
+}
+
+// ForgetChanges stops tracking changes for a marker.
+func (b *Backend) ForgetChanges(name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.changes.forget(name)
+}
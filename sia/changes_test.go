@@ -0,0 +1,93 @@
+package sia
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeJournal(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	size := uint64(10*changeBlockSize + 100)
+	now := time.Unix(1600000000, 0)
+	j, err := openChangeJournal(dataDirectory, size, "boot1")
+	assert.Nil(t, err)
+	assert.Nil(t, j.record(0, 10), "expected writes without markers to be fine")
+
+	_, err = j.mark("../backup", now)
+	assert.NotNil(t, err)
+	marker, err := j.mark("backup", now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, marker.ChangedBlocks)
+
+	assert.Nil(t, j.record(changeBlockSize-1, 2))
+	assert.Nil(t, j.record(5*changeBlockSize, 1))
+	assert.Nil(t, j.record(10*changeBlockSize, 100))
+	report, err := j.report("backup", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, report.ChangedBlocks)
+	assert.Equal(t, []ChangedExtent{
+		{Offset: 0, Length: 2 * changeBlockSize},
+		{Offset: 5 * changeBlockSize, Length: changeBlockSize},
+		{Offset: 10 * changeBlockSize, Length: 100},
+	}, report.Extents)
+
+	// blocks that read as zeroes again are holes
+	report, err = j.report("backup", func(offset uint64) bool {
+		return offset >= changeBlockSize && offset < 10*changeBlockSize
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []ChangedExtent{
+		{Offset: 0, Length: changeBlockSize},
+		{Offset: changeBlockSize, Length: changeBlockSize, Zero: true},
+		{Offset: 5 * changeBlockSize, Length: changeBlockSize, Zero: true},
+		{Offset: 10 * changeBlockSize, Length: 100},
+	}, report.Extents)
+
+	// a restart keeps the bitmap
+	assert.Nil(t, j.close(true))
+	j, err = openChangeJournal(dataDirectory, size, "boot1")
+	assert.Nil(t, err)
+	report, err = j.report("backup", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, report.ChangedBlocks)
+	assert.False(t, report.Reset)
+	assert.Equal(t, now, report.Since.Local())
+
+	// so does a crash of the process, as bits are written through
+	assert.Nil(t, j.record(7*changeBlockSize, 1))
+	j.close(false)
+	j, err = openChangeJournal(dataDirectory, size, "boot1")
+	assert.Nil(t, err)
+	report, err = j.report("backup", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, report.ChangedBlocks)
+
+	// a crash of the machine resets the marker
+	j.close(false)
+	j, err = openChangeJournal(dataDirectory, size, "boot2")
+	assert.Nil(t, err)
+	report, err = j.report("backup", nil)
+	assert.Nil(t, err)
+	assert.True(t, report.Reset)
+	assert.Equal(t, []ChangedExtent{{Offset: 0, Length: size}}, report.Extents)
+
+	// marking again starts over
+	marker, err = j.mark("backup", now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.False(t, marker.Reset)
+	assert.Equal(t, 0, marker.ChangedBlocks)
+
+	assert.Nil(t, j.forget("backup"))
+	assert.Empty(t, j.list())
+	assert.NotNil(t, j.forget("backup"))
+	assert.Nil(t, j.close(true))
+}
@@ -0,0 +1,396 @@
+package sia
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/javgh/sia-nbdserver/config"
+	"go.sia.tech/renterd/worker"
+)
+
+type (
+	// Checkpoint is a local restore point of a device. The cache files of
+	// the pages that were not on Sia yet are reflinked into the checkpoint,
+	// while the other pages are recorded by their generation on Sia, so
+	// that a checkpoint is taken in an instant, whatever the upload
+	// backlog, and takes up space only as the cache moves on.
+	Checkpoint struct {
+		Name        string       `json:"name"`
+		CreatedAt   time.Time    `json:"createdAt"`
+		Size        uint64       `json:"size"`
+		Generations map[page]int `json:"generations"`
+		Cached      []page       `json:"cached"`
+	}
+)
+
+const (
+	checkpointDirectory = "checkpoints"
+	checkpointFile      = "checkpoint.json"
+)
+
+func checkpointPath(dataDirectory string, name string) string {
+	return filepath.Join(dataDirectory, checkpointDirectory, name)
+}
+
+func readCheckpoint(dataDirectory string, name string) (Checkpoint, error) {
+	encoded, err := ioutil.ReadFile(filepath.Join(checkpointPath(dataDirectory, name), checkpointFile))
+	if os.IsNotExist(err) {
+		return Checkpoint{}, fmt.Errorf("no checkpoint %q", name)
+	}
+	if err != nil {
+		return Checkpoint{}, err
+	}
+
+	var checkpoint Checkpoint
+	err = json.Unmarshal(encoded, &checkpoint)
+	if err != nil {
+		return Checkpoint{}, fmt.Errorf("checkpoint %s: %s", name, err)
+	}
+	return checkpoint, nil
+}
+
+// cloneFile reflinks src to dst, creating dst with the mode of src.
+func cloneFile(dst string, src string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	fileInfo, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = reflink(dstFile, srcFile)
+	if err != nil {
+		dstFile.Close()
+		return fmt.Errorf("unable to reflink %s: %s", src, err)
+	}
+	return dstFile.Close()
+}
+
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Checkpoint takes a local restore point of the device under the given
+// name, replacing an earlier one of the same name. The cache directory
+// needs to be on a filesystem with reflinks, such as btrfs or XFS.
+func (b *Backend) Checkpoint(name string) (Checkpoint, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state != available {
+		return Checkpoint{}, errUnavailable
+	}
+	err := validName("checkpoint", name)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	if b.packed() {
+		// restoring would need to roll back packs rather than pages
+		return Checkpoint{}, errors.New("checkpoints are not supported for devices that store several pages per object")
+	}
+	err = b.writeAllCombined()
+	if err != nil {
+		return Checkpoint{}, err
+	}
+
+	checkpoint := Checkpoint{
+		Name:        name,
+		CreatedAt:   b.now(),
+		Size:        uint64(b.size),
+		Generations: make(map[page]int),
+		Cached:      []page{},
+	}
+	// only the indexes are looked at, as the device may be huge and mostly
+	// zero pages
+	checkpoint.Cached = append(checkpoint.Cached, b.cache.brain.dirtyPages.sorted()...)
+	for p, details := range b.cache.pages {
+		state := b.cache.brain.pages.state(p)
+		if details.onSia && state != zero && !isDirty(state) && int64(p) < int64(b.cache.pageCount) {
+			checkpoint.Generations[p] = details.generation
+		}
+	}
+
+	// the new checkpoint is put together next to the old one, so that the
+	// old one survives if taking the new one fails
+	directory := checkpointPath(b.dataDirectory, name)
+	pending := directory + ".new"
+	err = os.RemoveAll(pending)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	err = os.MkdirAll(pending, 0700)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	err = b.fillCheckpoint(pending, checkpoint)
+	if err == nil {
+		err = os.RemoveAll(directory)
+	}
+	if err == nil {
+		err = os.Rename(pending, directory)
+	}
+	if err == nil {
+		err = syncDirectory(filepath.Dir(directory))
+	}
+	if err != nil {
+		os.RemoveAll(pending)
+		return Checkpoint{}, err
+	}
+
+	log.Printf("Took checkpoint %s with %d cached page(s)\n", name, len(checkpoint.Cached))
+	return checkpoint, nil
+}
+
+// fillCheckpoint reflinks the cached pages of a checkpoint into directory
+// and stores the checkpoint there. The mutex needs to be held.
+func (b *Backend) fillCheckpoint(directory string, checkpoint Checkpoint) error {
+	for _, page := range checkpoint.Cached {
+		err := cloneFile(asCachePath(directory, page), b.asCachePath(page))
+		if err != nil {
+			return err
+		}
+	}
+
+	encoded, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomically(filepath.Join(directory, checkpointFile), encoded, 0600)
+	if err != nil {
+		return err
+	}
+	return syncDirectory(directory)
+}
+
+// Checkpoints lists the checkpoints of the device, oldest first.
+func (b *Backend) Checkpoints() ([]Checkpoint, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return listCheckpoints(b.dataDirectory)
+}
+
+func listCheckpoints(dataDirectory string) ([]Checkpoint, error) {
+	checkpoints := []Checkpoint{}
+	fileInfos, err := ioutil.ReadDir(filepath.Join(dataDirectory, checkpointDirectory))
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.IsDir() || validName("checkpoint", fileInfo.Name()) != nil {
+			continue
+		}
+		checkpoint, err := readCheckpoint(dataDirectory, fileInfo.Name())
+		if err != nil {
+			log.Printf("Ignoring %s: %s\n", fileInfo.Name(), err)
+			continue
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].CreatedAt.Before(checkpoints[j].CreatedAt)
+	})
+	return checkpoints, nil
+}
+
+// DeleteCheckpoint removes a checkpoint.
+func (b *Backend) DeleteCheckpoint(name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err := validName("checkpoint", name)
+	if err != nil {
+		return err
+	}
+	_, err = readCheckpoint(b.dataDirectory, name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(checkpointPath(b.dataDirectory, name))
+}
+
+// RestoreCheckpoint turns the device described by settings back into the
+// state of a checkpoint. The cache is replaced by the cached pages of the
+// checkpoint, which are uploaded once the server starts again. Pages that
+// have been uploaded since are rolled back by trashing their newer
+// generations, which requires the generation of the checkpoint to still be
+// on Sia, e.g. in the trash. Nothing is changed unless every page can be
+// restored. The server must not be running in the meantime.
+func RestoreCheckpoint(settings BackendSettings, name string) (Checkpoint, error) {
+	err := validName("checkpoint", name)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	dataLock, err := lockDataDirectory(settings.DataDirectory)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	defer dataLock.Close()
+
+	checkpoint, err := readCheckpoint(settings.DataDirectory, name)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	if checkpoint.Size != settings.Size {
+		return Checkpoint{}, fmt.Errorf("checkpoint %s is of a device with a size of %d bytes rather than %d",
+			name, checkpoint.Size, settings.Size)
+	}
+
+	siaPass, err := config.ReadPasswordFile(settings.SiaPasswordFile)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	ctx := context.Background()
+	workerClient := worker.NewClient(fmt.Sprintf("http://%s/api/worker", settings.SiaDaemonAddress), siaPass)
+	info, remotePages, _, err := discoverDevice(ctx, workerClient, settings.SiaPathPrefix, settings.Layout)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	trash := newTrash(settings.DataDirectory, settings.TrashRetention)
+	err = trash.load(ctx, workerClient, settings.SiaPathPrefix)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+
+	cached := make(map[page]bool)
+	for _, page := range checkpoint.Cached {
+		cached[page] = true
+	}
+	byPage := make(map[page][]remotePage)
+	for _, remotePage := range remotePages {
+		byPage[remotePage.page] = append(byPage[remotePage.page], remotePage)
+	}
+	current := latestGenerations(trash.withoutTrashed(remotePages))
+
+	// plan the rollback before changing anything
+	rollback := []remotePage{}
+	untrash := []string{}
+	for p, generation := range current {
+		if cached[p] {
+			continue
+		}
+		wanted, ok := checkpoint.Generations[p]
+		if !ok {
+			// the page was zero, so all of its generations go
+			rollback = append(rollback, trash.withoutTrashed(byPage[p])...)
+			continue
+		}
+		if generation == wanted {
+			continue
+		}
+		remotePage, found := findGeneration(byPage[p], wanted)
+		if !found || generation < wanted {
+			return Checkpoint{}, fmt.Errorf("generation %d of page %d is no longer on Sia; "+
+				"checkpoint %s cannot be restored", wanted, p, name)
+		}
+		for _, newer := range trash.withoutTrashed(byPage[p]) {
+			if newer.generation > wanted {
+				rollback = append(rollback, newer)
+			}
+		}
+		if trash.contains(remotePage.siaPath) {
+			untrash = append(untrash, remotePage.siaPath)
+		}
+	}
+	for p, wanted := range checkpoint.Generations {
+		if _, ok := current[p]; ok {
+			continue
+		}
+		remotePage, found := findGeneration(byPage[p], wanted)
+		if !found {
+			return Checkpoint{}, fmt.Errorf("generation %d of page %d is no longer on Sia; "+
+				"checkpoint %s cannot be restored", wanted, p, name)
+		}
+		untrash = append(untrash, remotePage.siaPath)
+	}
+
+	changes, err := openChangeJournal(settings.DataDirectory, settings.Size, currentBootID())
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	defer changes.close(true)
+
+	// bring back the generations of the checkpoint before trashing the
+	// newer ones, so that an interruption never leaves a page without any
+	for _, siaPath := range untrash {
+		delete(trash.entries, siaPath)
+	}
+	now := time.Now()
+	for _, remotePage := range rollback {
+		err = changes.record(uint64(remotePage.page)*pageSize, pageSize)
+		if err != nil {
+			return Checkpoint{}, err
+		}
+		if trash.retention == 0 {
+			err = workerClient.DeleteObject(ctx, remotePage.siaPath)
+			if err != nil {
+				return Checkpoint{}, err
+			}
+			continue
+		}
+		trash.entries[remotePage.siaPath] = TrashEntry{
+			SiaPath:    remotePage.siaPath,
+			Page:       int(remotePage.page),
+			Generation: remotePage.generation,
+			DeletedAt:  now,
+			Reason:     "restored checkpoint " + name,
+		}
+	}
+	if len(untrash) > 0 || (len(rollback) > 0 && trash.retention > 0) {
+		err = storeTrash(ctx, workerClient, settings.SiaPathPrefix, trash)
+		if err != nil {
+			return Checkpoint{}, err
+		}
+	}
+
+	for _, page := range getCachedPages(settings.DataDirectory, pageCountFor(settings.Size)) {
+		err = changes.record(uint64(page)*pageSize, pageSize)
+		if err == nil {
+			err = os.Remove(asCachePath(settings.DataDirectory, page))
+		}
+		if err == nil {
+			err = removeCacheFileHeader(settings.DataDirectory, page)
+		}
+		if err != nil {
+			return Checkpoint{}, err
+		}
+	}
+	directory := checkpointPath(settings.DataDirectory, name)
+	for _, page := range checkpoint.Cached {
+		err = changes.record(uint64(page)*pageSize, pageSize)
+		if err == nil {
+			err = cloneFile(asCachePath(settings.DataDirectory, page), asCachePath(directory, page))
+		}
+		if err != nil {
+			return Checkpoint{}, err
+		}
+	}
+
+	log.Printf("Restored checkpoint %s of device %s: %d cached page(s), %d object(s) rolled back\n",
+		name, info.UUID, len(checkpoint.Cached), len(rollback))
+	return checkpoint, syncDirectory(settings.DataDirectory)
+}
@@ -0,0 +1,65 @@
+package sia
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	b := newTestBackend(t, 4, dataDirectory)
+	b.mutex = &sync.Mutex{}
+	b.clock = &manualClock{now: time.Unix(1600000000, 0)}
+	b.cache.brain.setState(page(1), notCached)
+	b.cache.setOnSia(page(1))
+	b.cache.pages.get(page(1)).generation = 3
+	b.cache.brain.setState(page(2), cachedUnchanged)
+
+	_, err = b.Checkpoint("../escape")
+	assert.NotNil(t, err)
+	checkpoint, err := b.Checkpoint("first")
+	assert.Nil(t, err)
+	assert.Equal(t, map[page]int{1: 3}, checkpoint.Generations, "expected unwritten pages to be left out")
+	assert.Empty(t, checkpoint.Cached)
+
+	checkpoints, err := b.Checkpoints()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(checkpoints))
+	assert.Equal(t, "first", checkpoints[0].Name)
+	assert.Equal(t, uint64(4*pageSize), checkpoints[0].Size)
+
+	// dirty pages need reflinks, which the filesystem may lack
+	b.cache.brain.setState(page(3), cachedChanged)
+	err = ioutil.WriteFile(b.asCachePath(page(3)), []byte("data"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint, err = b.Checkpoint("first")
+	if err == nil {
+		assert.Equal(t, []page{3}, checkpoint.Cached)
+		data, err := ioutil.ReadFile(asCachePath(checkpointPath(dataDirectory, "first"), page(3)))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("data"), data)
+	} else {
+		t.Logf("no reflinks in %s: %s", dataDirectory, err)
+		checkpoints, err = b.Checkpoints()
+		assert.Nil(t, err)
+		assert.Empty(t, checkpoints[0].Cached, "expected a failed checkpoint to leave the old one alone")
+	}
+
+	assert.Nil(t, b.DeleteCheckpoint("first"))
+	assert.NotNil(t, b.DeleteCheckpoint("first"))
+	checkpoints, err = b.Checkpoints()
+	assert.Nil(t, err)
+	assert.Empty(t, checkpoints)
+}
@@ -0,0 +1,41 @@
+package sia
+
+import "time"
+
+type (
+	// Clock is where the backend takes the current time from and how it
+	// waits. Tests can supply their own to advance time by hand, rather
+	// than waiting for idle intervals and throttling delays to pass.
+	Clock interface {
+		Now() time.Time
+		Sleep(d time.Duration)
+	}
+
+	systemClock struct{}
+)
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// now returns the current time of the backend's clock, defaulting to the
+// system clock.
+func (b *Backend) now() time.Time {
+	if b.clock == nil {
+		return time.Now()
+	}
+	return b.clock.Now()
+}
+
+// sleep waits on the backend's clock, defaulting to the system clock.
+func (b *Backend) sleep(d time.Duration) {
+	if b.clock == nil {
+		time.Sleep(d)
+		return
+	}
+	b.clock.Sleep(d)
+}
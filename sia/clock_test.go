@@ -0,0 +1,48 @@
+package sia
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// manualClock only moves when told to; sleeping advances it right away.
+type manualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Sleep(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	c.slept = append(c.slept, d)
+}
+
+func TestThrottleWriteClock(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	b := newTestBackend(t, 20, "")
+	b.mutex = &sync.Mutex{}
+	b.clock = clock
+	b.startedAt = clock.Now()
+
+	assert.Nil(t, b.throttleWrite(context.Background()))
+	assert.Empty(t, clock.slept, "expected no throttling with an empty cache")
+
+	// leftover dirty data from before the start slows writers down
+	b.cache.brain.setState(page(1), cachedChanged)
+	b.cache.brain.pages.get(1).dirtySince = clock.Now().Add(-time.Hour)
+	assert.Nil(t, b.throttleWrite(context.Background()))
+	assert.Equal(t, []time.Duration{16 * writeThrottleInterval}, clock.slept)
+	assert.Equal(t, time.Unix(1600000000, 0).Add(16*writeThrottleInterval), clock.Now())
+}
@@ -0,0 +1,142 @@
+package sia
+
+import (
+	"log"
+	"time"
+)
+
+type (
+	// concurrencyLimit adapts how many operations of a kind may be in
+	// flight at once to how well the Sia daemon keeps up (additive
+	// increase, multiplicative decrease): the limit grows by one after as
+	// many operations as the limit went well and is halved after one that
+	// failed or took much longer than usual. A max of 0 means unlimited.
+	concurrencyLimit struct {
+		name      string
+		limit     int
+		max       int
+		successes int
+
+		// baseline is a moving average of how long an operation takes,
+		// which follows faster operations more quickly than slower ones.
+		baseline time.Duration
+	}
+
+	// Concurrency reports the current limits for uploads and downloads
+	// (0 = unlimited).
+	Concurrency struct {
+		Uploads          int
+		MaxUploads       int
+		Downloads        int
+		MaxDownloads     int
+		UploadBaseline   time.Duration
+		DownloadBaseline time.Duration
+	}
+)
+
+const (
+	// congestionFactor is how much longer than the baseline an operation
+	// may take before it counts as a sign that the Sia daemon is
+	// overwhelmed.
+	congestionFactor = 3
+	// baselineWeightUp and baselineWeightDown are the weights of a new
+	// sample in the baseline if it is slower or faster respectively.
+	baselineWeightUp   = 0.05
+	baselineWeightDown = 0.3
+)
+
+func newConcurrencyLimit(name string, max int) concurrencyLimit {
+	return concurrencyLimit{
+		name:  name,
+		limit: max,
+		max:   max,
+	}
+}
+
+// allows reports whether another operation may start while inFlight are
+// in flight.
+func (cl *concurrencyLimit) allows(inFlight int) bool {
+	return cl.max == 0 || inFlight < cl.limit
+}
+
+// record adapts the limit to how an operation went.
+func (cl *concurrencyLimit) record(took time.Duration, err error) {
+	if cl.max == 0 {
+		return
+	}
+
+	congested := err != nil ||
+		(cl.baseline > 0 && took > congestionFactor*cl.baseline)
+	if err == nil {
+		cl.updateBaseline(took)
+	}
+
+	if congested {
+		cl.successes = 0
+		if cl.limit > 1 {
+			cl.limit /= 2
+			log.Printf("Lowering the limit of concurrent %s to %d\n", cl.name, cl.limit)
+		}
+		return
+	}
+
+	cl.successes += 1
+	if cl.successes >= cl.limit && cl.limit < cl.max {
+		cl.successes = 0
+		cl.limit += 1
+	}
+}
+
+func (cl *concurrencyLimit) updateBaseline(took time.Duration) {
+	if cl.baseline == 0 {
+		cl.baseline = took
+		return
+	}
+
+	weight := baselineWeightUp
+	if took < cl.baseline {
+		weight = baselineWeightDown
+	}
+	cl.baseline = time.Duration(weight*float64(took) + (1-weight)*float64(cl.baseline))
+}
+
+// setMax changes the upper bound, keeping the limit below it.
+func (cl *concurrencyLimit) setMax(max int) {
+	if max == cl.max {
+		return
+	}
+	if cl.max == 0 || cl.limit > max {
+		cl.limit = max
+	}
+	cl.max = max
+}
+
+// inEffect is the limit to enforce, with 0 meaning unlimited.
+func (cl *concurrencyLimit) inEffect() int {
+	if cl.max == 0 {
+		return 0
+	}
+	return cl.limit
+}
+
+// recordUpload adapts the upload limit, which maintenance applies to the
+// pages being uploaded. The mutex needs to be held.
+func (b *Backend) recordUpload(took time.Duration, err error) {
+	b.uploads.record(took, err)
+	b.cache.brain.uploadLimit = b.uploads.inEffect()
+}
+
+// Concurrency reports the current limits for uploads and downloads.
+func (b *Backend) Concurrency() Concurrency {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return Concurrency{
+		Uploads:          b.uploads.inEffect(),
+		MaxUploads:       b.uploads.max,
+		Downloads:        b.downloads.inEffect(),
+		MaxDownloads:     b.downloads.max,
+		UploadBaseline:   b.uploads.baseline,
+		DownloadBaseline: b.downloads.baseline,
+	}
+}
@@ -0,0 +1,41 @@
+package sia
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	cl := newConcurrencyLimit("uploads", 8)
+	assert.True(t, cl.allows(7))
+	assert.False(t, cl.allows(8))
+
+	cl.record(10*time.Second, nil)
+	assert.Equal(t, 10*time.Second, cl.baseline)
+	assert.Equal(t, 8, cl.limit, "expected the limit to stay at the maximum")
+
+	cl.record(time.Minute, nil)
+	assert.Equal(t, 4, cl.limit, "expected a slow operation to halve the limit")
+	cl.record(time.Second, errors.New("no hosts"))
+	assert.Equal(t, 2, cl.limit, "expected a failure to halve the limit")
+	cl.record(time.Second, errors.New("no hosts"))
+	cl.record(time.Second, errors.New("no hosts"))
+	assert.Equal(t, 1, cl.limit, "expected at least one operation to be allowed")
+
+	for i := 0; i < 1+2+3; i++ {
+		cl.record(10*time.Second, nil)
+	}
+	assert.Equal(t, 4, cl.limit, "expected the limit to grow by one per window")
+
+	cl.setMax(3)
+	assert.Equal(t, 3, cl.inEffect())
+	cl.setMax(0)
+	assert.Equal(t, 0, cl.inEffect())
+	assert.True(t, cl.allows(1000))
+	cl.record(time.Hour, errors.New("no hosts"))
+	cl.setMax(6)
+	assert.Equal(t, 6, cl.inEffect(), "expected a new limit to start at the maximum")
+}
@@ -0,0 +1,195 @@
+package sia
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/javgh/sia-nbdserver/notify"
+	"go.sia.tech/renterd/api"
+)
+
+type (
+	// ContractExpiry tells how soon the contracts holding the pages end,
+	// estimated from the block height. PagesAtRisk are pages whose last
+	// redundancy sample found them stored with fewer than one copy on
+	// contracts that do not end within the warning period.
+	ContractExpiry struct {
+		Warning     time.Duration
+		CheckedAt   time.Time
+		BlockHeight uint64
+		Contracts   int
+		Expiring    []ExpiringContract
+		PagesAtRisk []int
+	}
+
+	// ExpiringContract is a contract that ends within the warning period,
+	// unless it is renewed.
+	ExpiringContract struct {
+		Host        string
+		WindowStart uint64
+		EndsIn      time.Duration
+	}
+
+	// contractWatch keeps track of the contracts ending within warning.
+	contractWatch struct {
+		warning     time.Duration
+		lastCheck   time.Time
+		blockHeight uint64
+		contracts   int
+		expiring    map[string]ExpiringContract
+		atRisk      map[page]bool
+		warned      bool
+	}
+)
+
+const (
+	// blockTime is the average time between blocks, for estimating when
+	// a contract ends.
+	blockTime = 10 * time.Minute
+	// contractCheckInterval is how often the contracts are looked at.
+	contractCheckInterval = 10 * time.Minute
+)
+
+func newContractWatch(warning time.Duration) contractWatch {
+	return contractWatch{
+		warning:  warning,
+		expiring: make(map[string]ExpiringContract),
+		atRisk:   make(map[page]bool),
+	}
+}
+
+// expiringContracts returns the hosts whose last contract reaches the
+// start of its proof window within warning. Hosts are no longer paid to
+// keep data beyond that point.
+func expiringContracts(contracts []api.ContractMetadata, height uint64,
+	warning time.Duration) map[string]ExpiringContract {
+	windowStarts := make(map[string]uint64)
+	for _, contract := range contracts {
+		host := contract.HostKey.String()
+		if contract.WindowStart > windowStarts[host] {
+			windowStarts[host] = contract.WindowStart
+		}
+	}
+
+	expiring := make(map[string]ExpiringContract)
+	for host, windowStart := range windowStarts {
+		blocksLeft := uint64(0)
+		if windowStart > height {
+			blocksLeft = windowStart - height
+		}
+		endsIn := time.Duration(blocksLeft) * blockTime
+		if endsIn < warning {
+			expiring[host] = ExpiringContract{
+				Host:        host,
+				WindowStart: windowStart,
+				EndsIn:      endsIn,
+			}
+		}
+	}
+	return expiring
+}
+
+// survivingHosts returns the hosts whose contracts do not end within the
+// warning period.
+func (cw *contractWatch) survivingHosts(hosts map[string]bool) map[string]bool {
+	surviving := make(map[string]bool)
+	for host := range hosts {
+		if _, ok := cw.expiring[host]; !ok {
+			surviving[host] = true
+		}
+	}
+	return surviving
+}
+
+// checkContractExpiry warns when contracts are about to end without having
+// been renewed, as the pages stored with their hosts are lost once enough
+// of them have. Requests that fail are left to the breaker. The mutex needs
+// to be held.
+func (b *Backend) checkContractExpiry(ctx context.Context) {
+	if b.contracts.warning == 0 {
+		b.contracts.expiring = make(map[string]ExpiringContract)
+		b.contracts.atRisk = make(map[page]bool)
+		b.contracts.warned = false
+		return
+	}
+	now := b.now()
+	if now.Before(b.contracts.lastCheck.Add(contractCheckInterval)) {
+		return
+	}
+
+	state, err := b.busClient.ConsensusState(ctx)
+	if err != nil {
+		return
+	}
+	contracts, err := b.busClient.ActiveContracts(ctx)
+	if err != nil {
+		return
+	}
+	b.contracts.lastCheck = now
+	b.contracts.blockHeight = state.BlockHeight
+	b.contracts.contracts = len(contracts)
+	b.contracts.expiring = expiringContracts(contracts, state.BlockHeight, b.contracts.warning)
+
+	if len(b.contracts.expiring) == 0 {
+		if b.contracts.warned {
+			log.Printf("No contracts end within %s any more\n", b.contracts.warning)
+			b.contracts.warned = false
+		}
+		b.contracts.atRisk = make(map[page]bool)
+		return
+	}
+
+	if !b.contracts.warned {
+		first := b.expiringList()[0]
+		log.Printf("Contracts with %d host(s) end within %s unless renewed, the first in about %s (host %s)\n",
+			len(b.contracts.expiring), b.contracts.warning, first.EndsIn.Round(time.Hour), first.Host)
+		b.notifier.Notify(notify.ContractsExpiring,
+			"contracts with %d host(s) end within %s unless renewed, the first in about %s",
+			len(b.contracts.expiring), b.contracts.warning, first.EndsIn.Round(time.Hour))
+		b.contracts.warned = true
+	}
+}
+
+// expiringList lists the contracts ending within the warning period,
+// soonest first. The mutex needs to be held.
+func (b *Backend) expiringList() []ExpiringContract {
+	expiring := []ExpiringContract{}
+	for _, contract := range b.contracts.expiring {
+		expiring = append(expiring, contract)
+	}
+	sort.Slice(expiring, func(i, j int) bool {
+		if expiring[i].EndsIn != expiring[j].EndsIn {
+			return expiring[i].EndsIn < expiring[j].EndsIn
+		}
+		return expiring[i].Host < expiring[j].Host
+	})
+	return expiring
+}
+
+// pagesAtRisk lists the pages that would become unrecoverable if the
+// expiring contracts ended now. The mutex needs to be held.
+func (b *Backend) pagesAtRisk() []int {
+	pages := []int{}
+	for page := range b.contracts.atRisk {
+		pages = append(pages, int(page))
+	}
+	sort.Ints(pages)
+	return pages
+}
+
+// ContractExpiry reports on the contracts that end soon.
+func (b *Backend) ContractExpiry() ContractExpiry {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return ContractExpiry{
+		Warning:     b.contracts.warning,
+		CheckedAt:   b.contracts.lastCheck,
+		BlockHeight: b.contracts.blockHeight,
+		Contracts:   b.contracts.contracts,
+		Expiring:    b.expiringList(),
+		PagesAtRisk: b.pagesAtRisk(),
+	}
+}
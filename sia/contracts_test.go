@@ -0,0 +1,36 @@
+package sia
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.sia.tech/core/types"
+	"go.sia.tech/renterd/api"
+)
+
+func TestExpiringContracts(t *testing.T) {
+	soon := types.PublicKey{1}
+	later := types.PublicKey{2}
+	past := types.PublicKey{3}
+	renewed := types.PublicKey{4}
+	contracts := []api.ContractMetadata{
+		{HostKey: soon, WindowStart: 1000 + 144},
+		{HostKey: later, WindowStart: 1000 + 4032},
+		{HostKey: past, WindowStart: 990},
+		// the host keeps the data as long as its last contract lasts
+		{HostKey: renewed, WindowStart: 1000 + 72},
+		{HostKey: renewed, WindowStart: 1000 + 4320},
+	}
+
+	expiring := expiringContracts(contracts, 1000, 7*24*time.Hour)
+	assert.Equal(t, 2, len(expiring))
+	assert.Equal(t, 24*time.Hour, expiring[soon.String()].EndsIn)
+	assert.Equal(t, time.Duration(0), expiring[past.String()].EndsIn)
+
+	cw := newContractWatch(7 * 24 * time.Hour)
+	cw.expiring = expiring
+	hosts := map[string]bool{soon.String(): true, later.String(): true, past.String(): true,
+		renewed.String(): true}
+	assert.Equal(t, map[string]bool{later.String(): true, renewed.String(): true}, cw.survivingHosts(hosts))
+}
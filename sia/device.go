@@ -0,0 +1,385 @@
+package sia
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/javgh/sia-nbdserver/config"
+	"go.sia.tech/renterd/worker"
+)
+
+type (
+	// DeviceInfo identifies a device on Sia. It is stored next to the
+	// epoch marker, so that devices can be told apart and found without
+	// knowing their SiaPath prefix.
+	DeviceInfo struct {
+		UUID      string    `json:"uuid"`
+		Label     string    `json:"label,omitempty"`
+		Size      uint64    `json:"size"`
+		CreatedAt time.Time `json:"createdAt"`
+
+		// Namespaced is set for devices that store their pages below
+		// their UUID; see pageRoot.
+		Namespaced bool `json:"namespaced,omitempty"`
+
+		// Preallocated is set for devices that had every page uploaded
+		// as zeroes when they were created; see preallocatePages.
+		Preallocated bool `json:"preallocated,omitempty"`
+
+		// PagesPerObject is the number of consecutive pages stored in
+		// one pack on Sia, chosen when the device is created; see
+		// packHeader. 0 stores every page on its own.
+		PagesPerObject int `json:"pagesPerObject,omitempty"`
+	}
+
+	// DiscoveredDevice is a device found under the renter, along with its
+	// latest epoch marker, which is nil if none has been recorded yet.
+	DiscoveredDevice struct {
+		SiaPathPrefix string
+		Info          DeviceInfo
+		Epoch         *EpochMarker
+	}
+)
+
+const deviceInfoName = "device"
+
+func deviceInfoPath(siaPathPrefix string) string {
+	return fmt.Sprintf("%s/%s", metadataDirectory(siaPathPrefix), deviceInfoName)
+}
+
+func newUUID() (string, error) {
+	var u [16]byte
+	_, err := rand.Read(u[:])
+	if err != nil {
+		return "", err
+	}
+
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
+
+func readDeviceInfo(ctx context.Context, workerClient *worker.Client,
+	siaPathPrefix string) (*DeviceInfo, error) {
+	entries, err := workerClient.ObjectEntries(ctx, metadataDirectory(siaPathPrefix)+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, entry := range entries {
+		if strings.TrimPrefix(entry, "/") == deviceInfoPath(siaPathPrefix) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	err = workerClient.DownloadObject(ctx, &buf, deviceInfoPath(siaPathPrefix)+shardParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	var info DeviceInfo
+	err = json.Unmarshal(buf.Bytes(), &info)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", deviceInfoPath(siaPathPrefix), err)
+	}
+	return &info, nil
+}
+
+// pageRoot is the directory holding the pages of a device. Pages are stored
+// below the UUID of the device, so that pages left behind under the same
+// prefix by an earlier device are never taken for its own. Devices from
+// before that keep their pages directly below the prefix.
+func pageRoot(siaPathPrefix string, info DeviceInfo) string {
+	if info.Namespaced {
+		return siaPathPrefix + "/" + info.UUID
+	}
+	return siaPathPrefix
+}
+
+// discoverDevice reads the device info and lists the pages of the device
+// along with their layout. A device without device info is new, unless it
+// has pages directly below the prefix from before devices had a UUID. A new
+// device gets its UUID right away, but it is only stored by identifyDevice.
+func discoverDevice(ctx context.Context, workerClient *worker.Client, siaPathPrefix string,
+	layout Layout) (DeviceInfo, []remotePage, Layout, error) {
+	info, err := readDeviceInfo(ctx, workerClient, siaPathPrefix)
+	if err != nil {
+		return DeviceInfo{}, nil, layout, err
+	}
+	if info != nil {
+		remotePages, remoteLayout, err := listRemotePages(ctx, workerClient, pageRoot(siaPathPrefix, *info), layout)
+		return *info, remotePages, remoteLayout, err
+	}
+
+	remotePages, remoteLayout, err := listRemotePages(ctx, workerClient, siaPathPrefix, layout)
+	if err != nil || len(remotePages) > 0 {
+		return DeviceInfo{}, remotePages, remoteLayout, err
+	}
+
+	uuid, err := newUUID()
+	if err != nil {
+		return DeviceInfo{}, nil, layout, err
+	}
+	return DeviceInfo{UUID: uuid, Namespaced: true}, remotePages, layout, nil
+}
+
+// identifyDevice stores the device info found by discoverDevice on Sia,
+// assigning a UUID to a device that does not have one yet and keeping label
+// and size up to date. An empty label leaves the stored one alone. The size
+// of an existing device only changes with resize, so that a mistyped size
+// does not go unnoticed.
+func (b *Backend) identifyDevice(ctx context.Context, discovered DeviceInfo, label string,
+	size uint64, resize bool) error {
+	info := &discovered
+	if !info.CreatedAt.IsZero() && info.Size != 0 && size != info.Size && !resize {
+		return fmt.Errorf("device %s has a size of %d bytes rather than %d; use --resize to change it",
+			info.UUID, info.Size, size)
+	}
+	if b.follower {
+		switch {
+		case info.CreatedAt.IsZero() || info.Size == 0:
+			return errors.New("the device has no device info to follow yet; start the server it belongs to first")
+		case label != "" && label != info.Label:
+			return errors.New("a follower cannot change the label of the device")
+		}
+	}
+
+	changed := false
+	if info.UUID == "" {
+		uuid, err := newUUID()
+		if err != nil {
+			return err
+		}
+		info.UUID = uuid
+	}
+	if info.CreatedAt.IsZero() {
+		info.CreatedAt = b.now()
+		changed = true
+	}
+	if label != "" && label != info.Label {
+		info.Label = label
+		changed = true
+	}
+	if size != info.Size {
+		info.Size = size
+		changed = true
+	}
+	b.device = *info
+
+	if info.Label != "" {
+		log.Printf("Device %s (%s)\n", info.UUID, info.Label)
+	} else {
+		log.Printf("Device %s\n", info.UUID)
+	}
+	if !changed {
+		return nil
+	}
+	if b.follower {
+		return errors.New("a follower cannot change the device info")
+	}
+	return storeDeviceInfo(ctx, b.workerClient, b.siaPathPrefix, *info)
+}
+
+func storeDeviceInfo(ctx context.Context, workerClient *worker.Client, siaPathPrefix string,
+	info DeviceInfo) error {
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return workerClient.UploadObject(ctx, bytes.NewReader(encoded),
+		deviceInfoPath(siaPathPrefix)+shardParameters)
+}
+
+// CreateDevice sets up a new device under the renter described by settings,
+// with the size and label given there, and returns its device info. Pages
+// start out as zeroes without being stored, so nothing else needs to be
+// uploaded but an empty integrity manifest, if enabled. With preallocate,
+// every page is uploaded as zeroes right away instead. With pagesPerObject
+// above 1, that many consecutive pages are stored together in one object,
+// which cannot be changed later. A device that already exists is left
+// alone.
+func CreateDevice(settings BackendSettings, preallocate bool, pagesPerObject int) (DeviceInfo, error) {
+	if settings.Size > MaxSize {
+		return DeviceInfo{}, fmt.Errorf("size %d exceeds the maximum of %d bytes", settings.Size, uint64(MaxSize))
+	}
+	err := validatePagesPerObject(pagesPerObject)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	if preallocate && pagesPerObject > 1 {
+		return DeviceInfo{}, errors.New("devices that store several pages per object cannot be preallocated")
+	}
+	uploadParameters := settings.UploadParameters.withDefaults()
+	err = uploadParameters.validate()
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+
+	siaPass, err := config.ReadPasswordFile(settings.SiaPasswordFile)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+
+	ctx := context.Background()
+	workerClient := worker.NewClient(fmt.Sprintf("http://%s/api/worker", settings.SiaDaemonAddress), siaPass)
+	info, _, _, err := discoverDevice(ctx, workerClient, settings.SiaPathPrefix, settings.Layout)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	if !info.CreatedAt.IsZero() || !info.Namespaced {
+		return DeviceInfo{}, fmt.Errorf("a device already exists under %s", settings.SiaPathPrefix)
+	}
+
+	info.Label = settings.Label
+	info.Size = settings.Size
+	info.CreatedAt = time.Now()
+	if pagesPerObject > 1 {
+		info.PagesPerObject = pagesPerObject
+	}
+	pageIntegrity, err := newIntegrity(settings.IntegrityKeyFile, settings.DataDirectory)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	if preallocate {
+		err = preallocatePages(ctx, workerClient, pageRoot(settings.SiaPathPrefix, info), settings.Layout,
+			settings.Size, uploadParameters.query(), pageIntegrity)
+		if err != nil {
+			return DeviceInfo{}, err
+		}
+		info.Preallocated = true
+		if pageIntegrity != nil {
+			pageIntegrity.manifest.Sequence += 1
+		}
+	}
+	if pageIntegrity != nil {
+		encoded, err := pageIntegrity.encode()
+		if err != nil {
+			return DeviceInfo{}, err
+		}
+		err = workerClient.UploadObject(ctx, bytes.NewReader(encoded),
+			manifestPath(settings.SiaPathPrefix)+shardParameters)
+		if err != nil {
+			return DeviceInfo{}, err
+		}
+	}
+
+	// the device info goes last, as it marks the device as created
+	err = storeDeviceInfo(ctx, workerClient, settings.SiaPathPrefix, info)
+	return info, err
+}
+
+// Device returns the UUID, label and size of the device.
+func (b *Backend) Device() DeviceInfo {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.device
+}
+
+// ListDevices finds the devices stored under the renter described by
+// settings by looking for metadata directories, including those of devices
+// nested below other prefixes. Devices that have neither recorded an epoch
+// marker nor been started since device info was introduced are not found.
+func ListDevices(settings BackendSettings) ([]DiscoveredDevice, error) {
+	siaPass, err := config.ReadPasswordFile(settings.SiaPasswordFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	workerClient := worker.NewClient(fmt.Sprintf("http://%s/api/worker", settings.SiaDaemonAddress), siaPass)
+	prefixes, err := findPrefixes(ctx, workerClient, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := []DiscoveredDevice{}
+	for _, siaPathPrefix := range prefixes {
+		device := DiscoveredDevice{SiaPathPrefix: siaPathPrefix}
+		info, err := readDeviceInfo(ctx, workerClient, siaPathPrefix)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			device.Info = *info
+		}
+		device.Epoch, err = readEpochMarker(ctx, workerClient, siaPathPrefix)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].SiaPathPrefix < devices[j].SiaPathPrefix
+	})
+	return devices, nil
+}
+
+// findPrefixes returns the SiaPath prefixes with a metadata directory in
+// directory and the directories below it. Directories that may not be part
+// of a prefix, such as those holding pages, are not looked into.
+func findPrefixes(ctx context.Context, workerClient *worker.Client, directory string,
+	depth int) ([]string, error) {
+	entries, err := workerClient.ObjectEntries(ctx, directory+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := []string{}
+	for _, name := range subdirectories(directory, entries) {
+		if strings.HasSuffix(name, metadataSuffix) {
+			prefixes = append(prefixes, joinSiaPath(directory, strings.TrimSuffix(name, metadataSuffix)))
+			continue
+		}
+		if depth+1 >= maxPrefixDepth || !validPrefixName(name) {
+			continue
+		}
+
+		nested, err := findPrefixes(ctx, workerClient, joinSiaPath(directory, name), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, nested...)
+	}
+	return prefixes, nil
+}
+
+// subdirectories returns the names of the directories among the entries of
+// a listing of directory.
+func subdirectories(directory string, entries []string) []string {
+	names := []string{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry, "/") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(entry, "/"), "/")
+		if directory != "" {
+			name = strings.TrimPrefix(name, directory+"/")
+		}
+		if name != "" && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func joinSiaPath(directory string, name string) string {
+	if directory == "" {
+		return name
+	}
+	return directory + "/" + name
+}
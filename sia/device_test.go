@@ -0,0 +1,78 @@
+package sia
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUUID(t *testing.T) {
+	format := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		uuid, err := newUUID()
+		assert.Nil(t, err)
+		assert.True(t, format.MatchString(uuid), "unexpected UUID %s", uuid)
+		assert.False(t, seen[uuid], "expected UUIDs to differ")
+		seen[uuid] = true
+	}
+}
+
+func TestPageRoot(t *testing.T) {
+	info := DeviceInfo{UUID: "0f8c3a1e-5b7d-4e2a-9c61-2d4f8e0b7a93"}
+	assert.Equal(t, "nbd", pageRoot("nbd", info), "expected pages of older devices directly below the prefix")
+
+	info.Namespaced = true
+	assert.Equal(t, "nbd/0f8c3a1e-5b7d-4e2a-9c61-2d4f8e0b7a93", pageRoot("nbd", info))
+	assert.Equal(t, "nbd/0f8c3a1e-5b7d-4e2a-9c61-2d4f8e0b7a93/1/page1024.gen2",
+		LayoutSharded.siaPath(pageRoot("nbd", info), page(1024), 2))
+}
+
+func TestIdentifyDeviceSize(t *testing.T) {
+	b := newTestBackend(t, 4, "")
+	b.mutex = &sync.Mutex{}
+	info := DeviceInfo{
+		UUID:       "0f8c3a1e-5b7d-4e2a-9c61-2d4f8e0b7a93",
+		Size:       4 * pageSize,
+		CreatedAt:  time.Unix(1600000000, 0),
+		Namespaced: true,
+	}
+
+	err := b.identifyDevice(context.Background(), info, "", 8*pageSize, false)
+	assert.NotNil(t, err, "expected a different size to be refused")
+
+	err = b.identifyDevice(context.Background(), info, "", 4*pageSize, false)
+	assert.Nil(t, err)
+	assert.Equal(t, info, b.Device())
+}
+
+func TestIdentifyDeviceFollower(t *testing.T) {
+	b := newTestBackend(t, 4, "")
+	b.mutex = &sync.Mutex{}
+	b.follower = true
+	info := DeviceInfo{
+		UUID:       "0f8c3a1e-5b7d-4e2a-9c61-2d4f8e0b7a93",
+		Size:       4 * pageSize,
+		CreatedAt:  time.Unix(1600000000, 0),
+		Label:      "backup",
+		Namespaced: true,
+	}
+
+	err := b.identifyDevice(context.Background(), DeviceInfo{UUID: info.UUID}, "", 4*pageSize, false)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "no device info")
+	}
+	err = b.identifyDevice(context.Background(), info, "other", 4*pageSize, false)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "label")
+	}
+
+	err = b.identifyDevice(context.Background(), info, "", 4*pageSize, false)
+	assert.Nil(t, err)
+	assert.Equal(t, info, b.Device())
+}
@@ -0,0 +1,297 @@
+package sia
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/javgh/sia-nbdserver/blockdev"
+)
+
+type (
+	// CacheMode determines when writes reach the disk, named after the
+	// cache modes of qemu.
+	CacheMode int
+
+	// DetectZeroes determines what happens to writes of nothing but
+	// zeroes, named after the detect-zeroes option of qemu.
+	DetectZeroes int
+)
+
+const (
+	// CacheWriteback syncs the cache to disk when a client flushes.
+	CacheWriteback CacheMode = iota
+	// CacheWritethrough syncs every write to disk before completing it.
+	CacheWritethrough
+	// CacheUnsafe never syncs the cache, ignoring flushes of clients.
+	// Writes may be lost if the machine crashes.
+	CacheUnsafe
+)
+
+const (
+	// DetectZeroesOff writes zeroes like any other data.
+	DetectZeroesOff DetectZeroes = iota
+	// DetectZeroesOn keeps writes of zeroes from allocating zero pages.
+	DetectZeroesOn
+	// DetectZeroesUnmap additionally lets them discard whole pages if
+	// discarding is enabled.
+	DetectZeroesUnmap
+)
+
+var (
+	cacheModeNames = map[CacheMode]string{
+		CacheWriteback:    "writeback",
+		CacheWritethrough: "writethrough",
+		CacheUnsafe:       "unsafe",
+	}
+
+	// cacheModeAliases are the cache modes of qemu that behave like
+	// one of the above here.
+	cacheModeAliases = map[string]CacheMode{
+		"none":       CacheWriteback,
+		"directsync": CacheWritethrough,
+	}
+
+	detectZeroesNames = map[DetectZeroes]string{
+		DetectZeroesOff:   "off",
+		DetectZeroesOn:    "on",
+		DetectZeroesUnmap: "unmap",
+	}
+)
+
+// zeroChunkSize is how much of a range WriteZeroes writes at once.
+const zeroChunkSize = 1024 * 1024
+
+var errPageUploading = errors.New("page is being uploaded")
+
+func (m CacheMode) String() string {
+	return cacheModeNames[m]
+}
+
+// ParseCacheMode is the inverse of CacheMode.String, also accepting the
+// qemu cache modes none and directsync.
+func ParseCacheMode(name string) (CacheMode, error) {
+	for mode, modeName := range cacheModeNames {
+		if name == modeName {
+			return mode, nil
+		}
+	}
+	if mode, ok := cacheModeAliases[name]; ok {
+		return mode, nil
+	}
+	return 0, fmt.Errorf("unknown cache mode %q (valid: writeback, writethrough, unsafe, none, directsync)", name)
+}
+
+func (d DetectZeroes) String() string {
+	return detectZeroesNames[d]
+}
+
+// ParseDetectZeroes is the inverse of DetectZeroes.String.
+func ParseDetectZeroes(name string) (DetectZeroes, error) {
+	for detectZeroes, detectZeroesName := range detectZeroesNames {
+		if name == detectZeroesName {
+			return detectZeroes, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown detect-zeroes mode %q (valid: off, on, unmap)", name)
+}
+
+// isZero reports whether buf holds nothing but zeroes.
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// discard turns a page back into zeroes by dropping it from the cache. The
+// page needs to have been removed from Sia already. Pages being uploaded
+// cannot be discarded until the upload is done.
+func (cb *cacheBrain) discard(page page) ([]action, error) {
+	switch cb.pages.state(page) {
+	case zero:
+		return nil, nil
+	case cachedUploading:
+		return nil, errPageUploading
+	case notCached:
+		cb.setState(page, zero)
+		return nil, nil
+	default:
+		cb.setState(page, zero)
+		return []action{
+			{actionType: closeFile, page: page},
+			{actionType: deleteCache, page: page},
+		}, nil
+	}
+}
+
+// Trim discards the pages that lie entirely within the range, which then
+// read as zeroes and take up no space in the cache or on Sia. The rest of
+// the range is left alone, as trimming is merely a hint. Nothing is
+// discarded unless discarding is enabled.
+func (b *Backend) Trim(ctx context.Context, offset int64, length int64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state != available {
+		return errUnavailable
+	}
+	if !blockdev.InRange(b.size, offset, length) {
+		return blockdev.ErrBeyondEnd
+	}
+	if b.follower {
+		return errFollower
+	}
+	if !b.discard {
+		return nil
+	}
+
+	for _, pageAccess := range b.wholePages(offset, length) {
+		err := b.discardPage(ctx, pageAccess.page)
+		if err == errPageUploading {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteZeroes makes the range read as zeroes. If mayDiscard is set and
+// discarding is enabled, pages that lie entirely within the range are
+// discarded rather than filled with zeroes, and zero pages are left
+// unallocated.
+func (b *Backend) WriteZeroes(ctx context.Context, offset int64, length int64, mayDiscard bool) error {
+	if !blockdev.InRange(b.size, offset, length) {
+		return blockdev.ErrBeyondEnd
+	}
+	if b.follower {
+		return errFollower
+	}
+
+	b.mutex.Lock()
+	if b.state != available {
+		b.mutex.Unlock()
+		return errUnavailable
+	}
+	discarded := make(map[page]bool)
+	if mayDiscard && b.discard {
+		for _, pageAccess := range b.wholePages(offset, length) {
+			err := b.discardPage(ctx, pageAccess.page)
+			if err == errPageUploading {
+				continue
+			}
+			if err != nil {
+				b.mutex.Unlock()
+				return err
+			}
+			discarded[pageAccess.page] = true
+		}
+	}
+	b.mutex.Unlock()
+
+	zeroes := make([]byte, min64(zeroChunkSize, length))
+	for length > 0 {
+		chunk := min64(int64(len(zeroes)), length)
+		chunk = min64(chunk, pageSize-offset%pageSize)
+		if !discarded[page(offset/pageSize)] {
+			_, err := b.writeAt(ctx, zeroes[:chunk], offset, mayDiscard)
+			if err != nil {
+				return err
+			}
+		}
+		offset += chunk
+		length -= chunk
+	}
+	return nil
+}
+
+// wholePages returns the accesses of the range that cover whole pages,
+// counting the last page as whole up to the end of the device. The pages
+// are worked out from the ends of the range, as it may span far more bytes
+// than fit in an int. The mutex needs to be held.
+func (b *Backend) wholePages(offset int64, length int64) []pageAccess {
+	whole := []pageAccess{}
+	if offset < 0 || length <= 0 || offset >= b.size {
+		return whole
+	}
+	if length > b.size-offset {
+		length = b.size - offset
+	}
+
+	end := offset + length
+	first := page((offset + pageSize - 1) / pageSize)
+	last := page(end / pageSize)
+	if end == b.size {
+		last = page((end + pageSize - 1) / pageSize)
+	}
+	for p := first; p < last; p++ {
+		whole = append(whole, pageAccess{
+			page:   p,
+			length: withinSize(b.size, int64(p)*pageSize, pageSize),
+		})
+	}
+	return whole
+}
+
+// discardPage removes a page from Sia and the cache, so that it reads as
+// zeroes. The older generations go first, so that the page is still intact
+// if deleting its newest generation fails. The mutex needs to be held.
+func (b *Backend) discardPage(ctx context.Context, page page) error {
+	state := b.cache.brain.pages.state(page)
+	if state == zero {
+		return nil
+	}
+	if state == cachedUploading {
+		return errPageUploading
+	}
+
+	err := b.changes.record(uint64(page)*pageSize, pageSize)
+	if err != nil {
+		return err
+	}
+
+	if details, ok := b.cache.pages[page]; ok && details.onSia {
+		remotePages, err := b.remoteGenerations(ctx, page)
+		if err != nil {
+			return err
+		}
+		if _, ok := findGeneration(remotePages, details.generation); !ok {
+			remotePages = append(remotePages, remotePage{
+				page:       page,
+				generation: details.generation,
+				siaPath:    b.asSiaPath(page, details.generation),
+			})
+		}
+		sort.Slice(remotePages, func(i, j int) bool {
+			return remotePages[i].generation < remotePages[j].generation
+		})
+		for _, remotePage := range remotePages {
+			err = b.deleteObject(ctx, remotePage, "discarded")
+			if err != nil {
+				return fmt.Errorf("unable to discard page %d: %s", page, err)
+			}
+		}
+
+		details.onSia = false
+		b.cache.remotePages -= 1
+		b.listing.invalidate()
+	}
+
+	if details, ok := b.cache.pages[page]; ok {
+		details.combined.data = details.combined.data[:0]
+	}
+	delete(b.stalePages, page)
+	actions, err := b.cache.brain.discard(page)
+	if err != nil {
+		return err
+	}
+	log.Printf("Discarding page %d\n", page)
+	_, err = b.handleActions(ctx, actions)
+	return err
+}
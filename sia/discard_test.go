@@ -0,0 +1,102 @@
+package sia
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCacheMode(t *testing.T) {
+	for name, expected := range map[string]CacheMode{
+		"writeback":    CacheWriteback,
+		"writethrough": CacheWritethrough,
+		"unsafe":       CacheUnsafe,
+		"none":         CacheWriteback,
+		"directsync":   CacheWritethrough,
+	} {
+		mode, err := ParseCacheMode(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, mode, name)
+	}
+	_, err := ParseCacheMode("writearound")
+	assert.NotNil(t, err)
+
+	for _, detectZeroes := range []DetectZeroes{DetectZeroesOff, DetectZeroesOn, DetectZeroesUnmap} {
+		parsed, err := ParseDetectZeroes(detectZeroes.String())
+		assert.Nil(t, err)
+		assert.Equal(t, detectZeroes, parsed)
+	}
+	_, err = ParseDetectZeroes("yes")
+	assert.NotNil(t, err)
+}
+
+func TestWholePages(t *testing.T) {
+	b := newTestBackend(t, 4, "")
+	b.size = 3*pageSize + pageSize/2
+
+	pages := func(offset int64, length int64) []page {
+		whole := []page{}
+		for _, pageAccess := range b.wholePages(offset, length) {
+			whole = append(whole, pageAccess.page)
+		}
+		return whole
+	}
+	assert.Equal(t, []page{}, pages(0, pageSize-1))
+	assert.Equal(t, []page{0}, pages(0, pageSize))
+	assert.Equal(t, []page{1, 2}, pages(pageSize/2, 3*pageSize-1))
+	assert.Equal(t, []page{3}, pages(3*pageSize, pageSize), "expected the last page to end with the device")
+	assert.Equal(t, []page{3}, pages(3*pageSize, 10*pageSize))
+	assert.Equal(t, []page{}, pages(4*pageSize, pageSize))
+}
+
+func TestDiscard(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	cb, err := newCacheBrain(4, 3, 2, 30*time.Second)
+	assert.Nil(t, err)
+
+	actions, err := cb.discard(0)
+	assert.Nil(t, err)
+	assert.Empty(t, actions, "expected nothing to do for a zero page")
+
+	cb.setState(1, notCached)
+	actions, err = cb.discard(1)
+	assert.Nil(t, err)
+	assert.Empty(t, actions)
+	assert.Equal(t, zero, cb.pages.state(1))
+
+	cb.markDirty(2, now)
+	assert.Equal(t, 1, cb.cacheCount)
+	actions, err = cb.discard(2)
+	assert.Nil(t, err)
+	assert.Equal(t, []action{{actionType: closeFile, page: 2}, {actionType: deleteCache, page: 2}}, actions)
+	assert.Equal(t, zero, cb.pages.state(2))
+	assert.Equal(t, 0, cb.cacheCount)
+	assert.Empty(t, cb.dirtyPages)
+
+	cb.setState(3, cachedUploading)
+	_, err = cb.discard(3)
+	assert.Equal(t, errPageUploading, err)
+	assert.Equal(t, cachedUploading, cb.pages.state(3))
+
+	assert.True(t, isZero(make([]byte, 100)))
+	assert.False(t, isZero([]byte{0, 0, 1}))
+}
+
+func TestDetectZeroes(t *testing.T) {
+	b := newTestBackend(t, 4, "")
+	b.mutex = &sync.Mutex{}
+	b.detectZeroes = DetectZeroesOn
+
+	zeroes := make([]byte, 4096)
+	n, err := b.WriteAt(context.Background(), zeroes, pageSize+100)
+	assert.Nil(t, err)
+	assert.Equal(t, len(zeroes), n)
+	assert.Equal(t, zero, b.cache.brain.pages.state(1), "expected zeroes not to allocate a zero page")
+	assert.Equal(t, 0, b.cache.brain.allocatedPages())
+
+	assert.Nil(t, b.WriteZeroes(context.Background(), 0, 2*pageSize, true))
+	assert.Equal(t, 0, b.cache.brain.allocatedPages())
+}
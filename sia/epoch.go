@@ -0,0 +1,162 @@
+package sia
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/javgh/sia-nbdserver/config"
+	"github.com/javgh/sia-nbdserver/notify"
+	"go.sia.tech/renterd/worker"
+)
+
+type (
+	// EpochMarker records which point in time the pages on Sia correspond
+	// to. It is stored on Sia whenever all pages written to before a flush
+	// have been uploaded.
+	EpochMarker struct {
+		// Flush is the number of flushes whose preceding writes are
+		// all on Sia. It continues across restarts, each of which
+		// counts as a flush.
+		Flush uint64 `json:"flush"`
+
+		// FlushedAt is the time of that flush; zero if the flush was
+		// implied by a restart.
+		FlushedAt  time.Time `json:"flushedAt"`
+		RecordedAt time.Time `json:"recordedAt"`
+
+		// Ordered is set if uploads were ordered by flush epochs. Only
+		// then do the pages on Sia not contain writes from after the
+		// flush, except for pages that were written to again while
+		// being uploaded.
+		Ordered bool `json:"ordered"`
+
+		// Generations maps every page on Sia to its generation at the
+		// time the marker was recorded.
+		Generations map[page]int `json:"generations"`
+	}
+)
+
+const (
+	metadataSuffix  = ".meta"
+	epochMarkerName = "epoch"
+	epochLogKey     = "epoch"
+)
+
+// metadataDirectory is kept next to the pages rather than among them, as
+// everything below the SiaPath prefix is expected to be a page.
+func metadataDirectory(siaPathPrefix string) string {
+	return siaPathPrefix + metadataSuffix
+}
+
+func epochMarkerPath(siaPathPrefix string) string {
+	return fmt.Sprintf("%s/%s", metadataDirectory(siaPathPrefix), epochMarkerName)
+}
+
+// recordEpoch stores a new epoch marker if uploads have caught up with a
+// flush since the last marker. The mutex needs to be held.
+func (b *Backend) recordEpoch(ctx context.Context) {
+	oldestEpoch := b.cache.brain.oldestDirtyEpoch()
+	if oldestEpoch <= b.recordedEpoch || !b.uploadedSinceEpochMarker {
+		return
+	}
+
+	marker := EpochMarker{
+		Flush:       oldestEpoch,
+		FlushedAt:   b.flushTimes[oldestEpoch],
+		RecordedAt:  b.now(),
+		Ordered:     b.cache.brain.orderedUploads,
+		Generations: make(map[page]int),
+	}
+	for page, details := range b.cache.pages {
+		if details.onSia {
+			marker.Generations[page] = details.generation
+		}
+	}
+
+	encoded, err := json.Marshal(marker)
+	if err != nil {
+		b.logger.Printf(epochLogKey, b.now(), "Unable to encode epoch marker: %s\n", err)
+		return
+	}
+
+	err = b.workerClient.UploadObject(ctx, bytes.NewReader(encoded),
+		epochMarkerPath(b.siaPathPrefix)+shardParameters)
+	if err != nil {
+		b.logger.Printf(epochLogKey, b.now(), "Unable to store epoch marker: %s\n", err)
+		return
+	}
+	b.logger.Resolve(epochLogKey, b.now())
+	b.epochPublisher.Notify(notify.EpochRecorded, "flush %d recorded", oldestEpoch)
+
+	b.recordedEpoch = oldestEpoch
+	b.uploadedSinceEpochMarker = false
+	for epoch := range b.flushTimes {
+		if epoch <= oldestEpoch {
+			delete(b.flushTimes, epoch)
+		}
+	}
+}
+
+// resumeEpochs continues counting flushes from the last epoch marker, so
+// that epoch markers keep increasing across restarts. The marker also tells
+// which slots of the packs on Sia are empty.
+func (b *Backend) resumeEpochs(ctx context.Context) error {
+	marker, err := readEpochMarker(ctx, b.workerClient, b.siaPathPrefix)
+	if err != nil || marker == nil {
+		return err
+	}
+
+	b.recordedEpoch = marker.Flush
+	if b.cache.brain.epoch <= marker.Flush {
+		b.cache.brain.epoch = marker.Flush + 1
+	}
+	b.forgetEmptySlots(marker.Generations)
+	return nil
+}
+
+func readEpochMarker(ctx context.Context, workerClient *worker.Client,
+	siaPathPrefix string) (*EpochMarker, error) {
+	entries, err := workerClient.ObjectEntries(ctx, metadataDirectory(siaPathPrefix)+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, entry := range entries {
+		if strings.TrimPrefix(entry, "/") == epochMarkerPath(siaPathPrefix) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	err = workerClient.DownloadObject(ctx, &buf, epochMarkerPath(siaPathPrefix)+shardParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	var marker EpochMarker
+	err = json.Unmarshal(buf.Bytes(), &marker)
+	if err != nil {
+		return nil, err
+	}
+	return &marker, nil
+}
+
+// ReadEpochMarker fetches the latest epoch marker of the device described
+// by settings. It returns nil if no marker has been recorded yet.
+func ReadEpochMarker(settings BackendSettings) (*EpochMarker, error) {
+	siaPass, err := config.ReadPasswordFile(settings.SiaPasswordFile)
+	if err != nil {
+		return nil, err
+	}
+
+	workerClient := worker.NewClient(fmt.Sprintf("http://%s/api/worker", settings.SiaDaemonAddress), siaPass)
+	return readEpochMarker(context.Background(), workerClient, settings.SiaPathPrefix)
+}
@@ -0,0 +1,36 @@
+package sia
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEpochMarkerOutsidePages(t *testing.T) {
+	assert.Equal(t, "nbd.meta/epoch", epochMarkerPath("nbd"))
+
+	_, _, err := parseSiaPath("nbd", epochMarkerPath("nbd"))
+	assert.NotNil(t, err, "expected epoch marker not to be mistaken for a page")
+}
+
+func TestEpochMarkerRoundTrip(t *testing.T) {
+	marker := EpochMarker{
+		Flush:       7,
+		Ordered:     true,
+		Generations: map[page]int{3: 2, 12: 1},
+	}
+
+	encoded, err := json.Marshal(marker)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded EpochMarker
+	err = json.Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, marker.Generations, decoded.Generations)
+	assert.Equal(t, uint64(7), decoded.Flush)
+}
@@ -0,0 +1,432 @@
+package sia
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/javgh/sia-nbdserver/config"
+	"go.sia.tech/renterd/worker"
+)
+
+type (
+	// EvacuationReport tells where the pages of an evacuated device came
+	// from. Failed pages could not be recovered and read as zeroes in the
+	// image.
+	EvacuationReport struct {
+		Image      string
+		Cached     int
+		Downloaded int
+		Stale      int
+		Zero       int
+		Failed     []int
+	}
+
+	// evacuation copies the pages of a device into an image file.
+	evacuation struct {
+		ctx          context.Context
+		workerClient *worker.Client
+		image        *os.File
+		size         int64
+		root         string
+		layout       Layout
+		integrity    *integrity
+		trash        *trash
+
+		// pagesPerObject is that of the device info; cached holds the
+		// pages copied from the cache, which packs must not overwrite.
+		pagesPerObject int
+		cached         map[page]bool
+
+		mutex  sync.Mutex
+		report EvacuationReport
+	}
+
+	// imageWriter writes a page into the image sequentially, dropping
+	// what lies beyond the end of the device.
+	imageWriter struct {
+		image  *os.File
+		offset int64
+		end    int64
+	}
+)
+
+// sparseBlockSize is the granularity at which zeroes are left out of the
+// image, that of the blocks of most filesystems.
+const sparseBlockSize = 4096
+
+// Evacuate copies every page of a device that can be recovered into a
+// sparse image named after the device in the target directory, for when
+// its data needs to leave Sia in a hurry. Zero pages and the blocks of
+// other pages that hold nothing but zeroes are left as holes. Pages in the cache go first, as
+// dirty ones exist nowhere else, followed by the newest generation of the
+// others, downloaded parallel at a time. A page whose newest generation is
+// unreadable is taken from an older generation in the trash. The server
+// must not be running for the device in the meantime.
+func Evacuate(settings BackendSettings, target string, parallel int) (EvacuationReport, error) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	siaPass, err := config.ReadPasswordFile(settings.SiaPasswordFile)
+	if err != nil {
+		return EvacuationReport{}, err
+	}
+	key, err := loadCacheKey(settings.CacheKeyFile)
+	if err != nil {
+		return EvacuationReport{}, err
+	}
+	previousKey, err := loadCacheKey(settings.PreviousCacheKeyFile)
+	if err != nil {
+		return EvacuationReport{}, err
+	}
+
+	ctx := context.Background()
+	workerClient := worker.NewClient(fmt.Sprintf("http://%s/api/worker", settings.SiaDaemonAddress), siaPass)
+	info, err := readDeviceInfo(ctx, workerClient, settings.SiaPathPrefix)
+	if err != nil {
+		return EvacuationReport{}, err
+	}
+	name := filepath.Base(settings.SiaPathPrefix)
+	size := settings.Size
+	root := settings.SiaPathPrefix
+	pagesPerObject := 0
+	if info != nil {
+		name = info.UUID
+		size = info.Size
+		root = pageRoot(settings.SiaPathPrefix, *info)
+		pagesPerObject = info.PagesPerObject
+	}
+
+	remotePages, layout, err := listRemotePages(ctx, workerClient, root, settings.Layout)
+	if err != nil {
+		return EvacuationReport{}, err
+	}
+
+	err = os.MkdirAll(settings.DataDirectory, 0700)
+	if err != nil {
+		return EvacuationReport{}, err
+	}
+	dataLock, err := lockDataDirectory(settings.DataDirectory)
+	if err != nil {
+		return EvacuationReport{}, err
+	}
+	defer dataLock.Close()
+
+	trash := newTrash(settings.DataDirectory, settings.TrashRetention)
+	err = trash.load(ctx, workerClient, settings.SiaPathPrefix)
+	if err != nil {
+		return EvacuationReport{}, err
+	}
+	pageIntegrity, err := newIntegrity(settings.IntegrityKeyFile, settings.DataDirectory)
+	if err != nil {
+		return EvacuationReport{}, err
+	}
+	if pageIntegrity != nil {
+		err = pageIntegrity.load(ctx, workerClient, settings.SiaPathPrefix)
+		if err != nil {
+			return EvacuationReport{}, err
+		}
+	}
+
+	imagePath := filepath.Join(target, name+".img")
+	image, err := os.OpenFile(imagePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return EvacuationReport{}, err
+	}
+	defer image.Close()
+	err = image.Truncate(int64(size))
+	if err != nil {
+		return EvacuationReport{}, err
+	}
+
+	e := &evacuation{
+		ctx:          ctx,
+		workerClient: workerClient,
+		image:        image,
+		size:         int64(size),
+		root:         root,
+		layout:       layout,
+		integrity:    pageIntegrity,
+		trash:        trash,
+		report:       EvacuationReport{Image: imagePath},
+
+		pagesPerObject: pagesPerObject,
+		cached:         make(map[page]bool),
+	}
+
+	pageCount := pageCountFor(size)
+	cachedPages := getCachedPages(settings.DataDirectory, pageCount)
+	for i, page := range cachedPages {
+		err = e.copyCached(settings.DataDirectory, page, key, previousKey)
+		if err != nil {
+			log.Printf("Unable to copy page %d from the cache, downloading it instead: %s\n", page, err)
+			continue
+		}
+		e.cached[page] = true
+		e.report.Cached += 1
+		log.Printf("Copied page %d from the cache (%d/%d)\n", page, i+1, len(cachedPages))
+	}
+
+	pending := []page{}
+	latest := latestGenerations(trash.withoutTrashed(remotePages))
+	for page := range latest {
+		if len(e.uncachedPages(page)) > 0 {
+			pending = append(pending, page)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i] < pending[j]
+	})
+
+	pages := make(chan page)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range pages {
+				e.download(page, latest[page])
+			}
+		}()
+	}
+	for _, page := range pending {
+		pages <- page
+	}
+	close(pages)
+	wg.Wait()
+
+	sort.Ints(e.report.Failed)
+	e.report.Zero = pageCount - e.report.Cached - e.report.Downloaded - e.report.Stale - len(e.report.Failed)
+	err = image.Sync()
+	if err != nil {
+		return e.report, err
+	}
+	return e.report, image.Close()
+}
+
+// copyCached copies a page from its cache file into the image.
+func (e *evacuation) copyCached(dataDirectory string, page page, key *cacheKey, previousKey *cacheKey) error {
+	file, err := os.Open(asCachePath(dataDirectory, page))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header, err := readCacheHeader(file)
+	if err != nil {
+		return err
+	}
+	var f io.ReaderAt = file
+	switch {
+	case header == nil:
+	case key != nil && bytes.Equal(header, key.header()):
+		f = &encryptedFile{file: file, key: key, page: page}
+	case previousKey != nil && bytes.Equal(header, previousKey.header()):
+		f = &encryptedFile{file: file, key: previousKey, page: page}
+	default:
+		return errors.New("encrypted with an unknown key")
+	}
+
+	buf := make([]byte, withinSize(e.size, int64(page)*pageSize, pageSize))
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return writeSparse(e.image, buf[:n], int64(page)*pageSize)
+}
+
+// uncachedPages returns the pages of the device stored in the object named
+// after page that have not been copied from the cache.
+func (e *evacuation) uncachedPages(first page) []page {
+	count := page(1)
+	if e.pagesPerObject > 1 {
+		count = page(e.pagesPerObject)
+	}
+
+	pages := []page{}
+	for p := first; p < first+count && int64(p)*pageSize < e.size; p++ {
+		if !e.cached[p] {
+			pages = append(pages, p)
+		}
+	}
+	return pages
+}
+
+// download copies the newest generation of a page from Sia into the image,
+// falling back to older generations in the trash. For packs, page is the
+// first page of the pack.
+func (e *evacuation) download(page page, newest int) {
+	written, err := e.downloadGeneration(page, newest)
+	if err == nil {
+		e.record(func(report *EvacuationReport) { report.Downloaded += written })
+		log.Printf("Downloaded page %d\n", page)
+		return
+	}
+	log.Printf("Unable to download page %d: %s\n", page, err)
+
+	for _, generation := range e.trash.staleGenerations(page, newest) {
+		written, staleErr := e.downloadGeneration(page, generation)
+		if staleErr != nil {
+			log.Printf("Unable to download stale generation %d of page %d: %s\n", generation, page, staleErr)
+			continue
+		}
+		e.record(func(report *EvacuationReport) { report.Stale += written })
+		log.Printf("WARNING: took page %d from stale generation %d, as generation %d is unreadable\n",
+			page, generation, newest)
+		return
+	}
+	e.record(func(report *EvacuationReport) {
+		for _, failed := range e.uncachedPages(page) {
+			report.Failed = append(report.Failed, int(failed))
+		}
+	})
+}
+
+// downloadGeneration downloads a generation of a page, verifies it against
+// the integrity manifest and writes it into the image. It returns the
+// number of pages written, which is more than one for packs.
+func (e *evacuation) downloadGeneration(page page, generation int) (int, error) {
+	if e.pagesPerObject > 1 {
+		return e.downloadPack(page, generation)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, pageSize))
+	var dst io.Writer = buf
+	var tagger hash.Hash
+	if e.integrity != nil {
+		tagger = e.integrity.tagger(page, generation)
+		dst = io.MultiWriter(buf, tagger)
+	}
+
+	siaPath := e.layout.siaPath(e.root, page, generation)
+	err := e.workerClient.DownloadObject(e.ctx, dst, siaPath+shardParameters)
+	if err != nil {
+		return 0, err
+	}
+	if buf.Len() != pageSize {
+		return 0, fmt.Errorf("downloaded %d bytes instead of %d", buf.Len(), pageSize)
+	}
+	if tagger != nil {
+		err = e.integrity.verify(page, generation, tagger.Sum(nil))
+		if err != nil && err != errNoTag {
+			return 0, err
+		}
+	}
+
+	length := withinSize(e.size, int64(page)*pageSize, pageSize)
+	err = writeSparse(e.image, buf.Bytes()[:length], int64(page)*pageSize)
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// downloadPack downloads a generation of the pack starting at first,
+// writing the pages it stores into the image as they arrive, except for
+// those copied from the cache. Should the pack turn out to be damaged, the
+// pages written are zeroed again.
+func (e *evacuation) downloadPack(first page, generation int) (int, error) {
+	uncached := make(map[page]bool)
+	for _, p := range e.uncachedPages(first) {
+		uncached[p] = true
+	}
+	writers := make(map[int]*imageWriter)
+	unpacker := newUnpacker(func(slot int) io.Writer {
+		p := first + page(slot)
+		if !uncached[p] {
+			return nil
+		}
+		if writers[slot] == nil {
+			offset := int64(p) * pageSize
+			writers[slot] = &imageWriter{
+				image:  e.image,
+				offset: offset,
+				end:    offset + int64(withinSize(e.size, offset, pageSize)),
+			}
+		}
+		return writers[slot]
+	})
+
+	var dst io.Writer = unpacker
+	var tagger hash.Hash
+	if e.integrity != nil {
+		tagger = e.integrity.tagger(first, generation)
+		dst = io.MultiWriter(unpacker, tagger)
+	}
+
+	siaPath := e.layout.siaPath(e.root, first, generation)
+	err := e.workerClient.DownloadObject(e.ctx, dst, siaPath+shardParameters)
+	if err == nil {
+		err = unpacker.finish()
+	}
+	if err == nil && tagger != nil {
+		err = e.integrity.verify(first, generation, tagger.Sum(nil))
+		if err == errNoTag {
+			err = nil
+		}
+	}
+	if err != nil {
+		for slot := range writers {
+			offset := int64(first+page(slot)) * pageSize
+			_, zeroErr := e.image.WriteAt(make([]byte, writers[slot].end-offset), offset)
+			if zeroErr != nil {
+				log.Printf("Unable to zero page %d of the image again: %s\n", first+page(slot), zeroErr)
+			}
+		}
+		return 0, err
+	}
+	return len(writers), nil
+}
+
+func (w *imageWriter) Write(buf []byte) (int, error) {
+	if w.offset < w.end {
+		err := writeSparse(w.image, buf[:min64(int64(len(buf)), w.end-w.offset)], w.offset)
+		if err != nil {
+			return 0, err
+		}
+	}
+	w.offset += int64(len(buf))
+	return len(buf), nil
+}
+
+// writeSparse writes buf into the image at offset, leaving out the blocks
+// that hold nothing but zeroes, so that they stay holes. The image needs to
+// read as zeroes there already.
+func writeSparse(image *os.File, buf []byte, offset int64) error {
+	start := 0
+	for i := 0; i < len(buf); {
+		end := i + int(sparseBlockSize-(offset+int64(i))%sparseBlockSize)
+		if end > len(buf) {
+			end = len(buf)
+		}
+		if isZero(buf[i:end]) {
+			if start < i {
+				_, err := image.WriteAt(buf[start:i], offset+int64(start))
+				if err != nil {
+					return err
+				}
+			}
+			start = end
+		}
+		i = end
+	}
+	if start < len(buf) {
+		_, err := image.WriteAt(buf[start:], offset+int64(start))
+		return err
+	}
+	return nil
+}
+
+func (e *evacuation) record(update func(report *EvacuationReport)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	update(&e.report)
+}
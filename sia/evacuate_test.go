@@ -0,0 +1,84 @@
+package sia
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyCached(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "evacuate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	key, err := newCacheKey(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := bytes.Repeat([]byte{1}, pageSize)
+	err = ioutil.WriteFile(asCachePath(dataDirectory, page(0)), plain, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(asCachePath(dataDirectory, page(1)), bytes.Repeat([]byte{2}, pageSize), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reencryptCacheFile(asCachePath(dataDirectory, page(1)), page(1), nil, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := os.Create(filepath.Join(dataDirectory, "device.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+
+	// the device ends halfway through page 1
+	e := &evacuation{image: image, size: pageSize + pageSize/2}
+	assert.Nil(t, e.copyCached(dataDirectory, page(0), key, nil))
+	assert.Nil(t, e.copyCached(dataDirectory, page(1), key, nil))
+	assert.NotNil(t, e.copyCached(dataDirectory, page(1), nil, nil), "expected a missing key to be an error")
+
+	copied, err := ioutil.ReadFile(image.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, pageSize+pageSize/2, len(copied))
+	assert.True(t, bytes.Equal(plain, copied[:pageSize]))
+	assert.True(t, bytes.Equal(bytes.Repeat([]byte{2}, pageSize/2), copied[pageSize:]))
+}
+
+func TestWriteSparse(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "evacuate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	image, err := os.Create(filepath.Join(dataDirectory, "device.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	size := 64 * sparseBlockSize
+	assert.Nil(t, image.Truncate(int64(size)))
+
+	// data at both ends, split across blocks, with zeroes in between
+	buf := make([]byte, size-100)
+	for i := 0; i < sparseBlockSize+10; i++ {
+		buf[i] = 1
+	}
+	buf[len(buf)-1] = 2
+	assert.Nil(t, writeSparse(image, buf, 100))
+
+	written, err := ioutil.ReadFile(image.Name())
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(append(make([]byte, 100), buf...), written))
+	assert.True(t, diskUsage(image.Name()) < uint64(size/2), "expected the zeroes to be left out")
+}
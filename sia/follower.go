@@ -0,0 +1,198 @@
+package sia
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type (
+	// FollowStatus tells which flush of the device a follower serves.
+	FollowStatus struct {
+		// Flush and FlushedAt are those of the epoch marker served;
+		// both are zero until the other server has recorded one, in
+		// which case the newest generations at startup are served.
+		Flush       uint64    `json:"flush"`
+		FlushedAt   time.Time `json:"flushed_at"`
+		RefreshedAt time.Time `json:"refreshed_at"`
+	}
+
+	// followState tracks the epoch marker a follower last applied.
+	// published is set without holding the mutex once the server that
+	// writes to the device has announced a new marker.
+	followState struct {
+		interval  time.Duration
+		status    FollowStatus
+		applied   bool
+		published int32
+	}
+)
+
+// defaultFollowInterval is how often a follower looks for a new epoch
+// marker if no interval is given.
+const defaultFollowInterval = time.Minute
+
+const followLogKey = "follow"
+
+// errFollower is returned for writes to a device that is being followed. It
+// wraps EROFS, which lets NBD clients know that the device is read-only.
+var errFollower = fmt.Errorf("device is followed read-only: %w", syscall.EROFS)
+
+// errFollowerUpload is returned for a shutdown that would wait for uploads,
+// as a follower never uploads anything.
+var errFollowerUpload = errors.New("a follower has nothing to upload; shut it down with the cache level instead")
+
+// discardFollowerCache removes the cache files left from a previous run of
+// a follower. They are copies of pages on Sia, but there is no telling of
+// which generation, so they are downloaded again as needed.
+func discardFollowerCache(dataDirectory string, cachedPages []page) error {
+	for _, page := range cachedPages {
+		err := os.Remove(asCachePath(dataDirectory, page))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = removeCacheFileHeader(dataDirectory, page)
+		if err != nil {
+			return err
+		}
+	}
+	if len(cachedPages) > 0 {
+		log.Printf("Discarded the cache of %d page(s) from the previous run\n", len(cachedPages))
+	}
+	return nil
+}
+
+// Following reports whether the backend serves a followed device.
+func (b *Backend) Following() bool {
+	return b.follower
+}
+
+// EpochPublished makes a follower look for a new epoch marker in the next
+// maintenance cycle rather than once the follow interval has passed.
+func (b *Backend) EpochPublished() error {
+	if !b.follower {
+		return errors.New("not following a device")
+	}
+	atomic.StoreInt32(&b.follow.published, 1)
+	return nil
+}
+
+// followStep looks for a new epoch marker once the follow interval has
+// passed since the last look or a new one has been published. The mutex
+// needs to be held.
+func (b *Backend) followStep(ctx context.Context) {
+	published := atomic.SwapInt32(&b.follow.published, 0) != 0
+	if !published && b.now().Sub(b.follow.status.RefreshedAt) < b.follow.interval {
+		return
+	}
+
+	err := b.refreshFollower(ctx)
+	if err != nil {
+		b.logger.Printf(followLogKey, b.now(), "Unable to refresh the followed device: %s\n", err)
+		return
+	}
+	b.logger.Resolve(followLogKey, b.now())
+}
+
+// refreshFollower switches to the pages of the newest epoch marker, so that
+// the follower serves the device as of the last flush whose writes are all
+// on Sia. Without a marker, the generations found at startup are kept. The
+// mutex needs to be held.
+func (b *Backend) refreshFollower(ctx context.Context) error {
+	marker, err := readEpochMarker(ctx, b.workerClient, b.siaPathPrefix)
+	if err != nil {
+		return b.recordSia(err)
+	}
+	b.follow.status.RefreshedAt = b.now()
+	if marker == nil || (b.follow.applied && marker.Flush == b.follow.status.Flush) {
+		return nil
+	}
+
+	// tags of the new generations
+	if b.integrity != nil {
+		err = b.integrity.load(ctx, b.workerClient, b.siaPathPrefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	changed, err := b.applyGenerations(ctx, marker.Generations)
+	if err != nil {
+		return err
+	}
+	b.follow.status.Flush = marker.Flush
+	b.follow.status.FlushedAt = marker.FlushedAt
+	b.follow.applied = true
+	log.Printf("Serving flush %d of the followed device (%d page(s) changed)\n", marker.Flush, changed)
+	return nil
+}
+
+// applyGenerations makes the pages on Sia those of generations, evicting the
+// cached copies of pages whose generation changed. It returns the number of
+// pages that changed. The mutex needs to be held.
+func (b *Backend) applyGenerations(ctx context.Context, generations map[page]int) (int, error) {
+	changed := []page{}
+	for page, generation := range generations {
+		if int64(page) >= int64(b.cache.pageCount) {
+			continue
+		}
+		details := b.cache.pages.get(page)
+		if !details.onSia || details.generation != generation {
+			changed = append(changed, page)
+		}
+	}
+	for page, details := range b.cache.pages {
+		if _, ok := generations[page]; details.onSia && !ok {
+			changed = append(changed, page)
+		}
+	}
+
+	// Evict before switching generations, so that the ghost cache keeps
+	// the evicted data under the generation it belongs to.
+	actions := []action{}
+	for _, page := range changed {
+		evictions, err := b.cache.brain.evict(page)
+		if err != nil {
+			return 0, fmt.Errorf("unable to evict page %d: %s", page, err)
+		}
+		actions = append(actions, evictions...)
+	}
+	_, err := b.handleActions(ctx, actions)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, page := range changed {
+		details := b.cache.pages.get(page)
+		delete(b.stalePages, page)
+		generation, ok := generations[page]
+		if !ok {
+			details.onSia = false
+			b.cache.remotePages -= 1
+			b.cache.brain.setState(page, zero)
+			continue
+		}
+
+		details.generation = generation
+		b.cache.setOnSia(page)
+		b.cache.brain.setState(page, notCached)
+	}
+	b.listing.invalidate()
+	b.assertInvariants()
+	return len(changed), nil
+}
+
+// followStatus reports the flush served by a follower, or nil if the
+// backend is not one. The mutex needs to be held.
+func (b *Backend) followStatus() *FollowStatus {
+	if !b.follower {
+		return nil
+	}
+	status := b.follow.status
+	return &status
+}
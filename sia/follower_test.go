@@ -0,0 +1,101 @@
+package sia
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyGenerations(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "follower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	b := newTestBackend(t, 10, dataDirectory)
+	b.follower = true
+	for _, page := range []page{1, 2, 3} {
+		b.cache.brain.setState(page, notCached)
+		b.cache.pages.get(page).generation = 1
+		b.cache.setOnSia(page)
+	}
+
+	// page 2 is cached at generation 1
+	err = ioutil.WriteFile(b.asCachePath(2), []byte("old"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.cache.brain.setState(page(2), cachedUnchanged)
+	b.cache.pages.get(2).file, err = os.Open(b.asCachePath(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := b.applyGenerations(context.Background(), map[page]int{1: 1, 2: 2, 4: 1, 12: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, changed)
+
+	assert.Equal(t, notCached, b.cache.brain.pages.state(1))
+	assert.Equal(t, notCached, b.cache.brain.pages.state(2), "expected page 2 to be evicted")
+	assert.Equal(t, 2, b.cache.pages.get(2).generation)
+	_, err = os.Stat(b.asCachePath(2))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, zero, b.cache.brain.pages.state(3), "expected page 3 to be gone from Sia")
+	assert.False(t, b.cache.pages.get(3).onSia)
+	assert.Equal(t, notCached, b.cache.brain.pages.state(4))
+	assert.Equal(t, 3, b.cache.remotePages)
+	assert.Nil(t, b.checkInvariants())
+
+	changed, err = b.applyGenerations(context.Background(), map[page]int{1: 1, 2: 2, 4: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, changed)
+}
+
+func TestFollowerRejectsWrites(t *testing.T) {
+	b := newTestBackend(t, 4, "")
+	b.mutex = &sync.Mutex{}
+	b.follower = true
+
+	_, err := b.WriteAt(context.Background(), make([]byte, 512), 0)
+	assert.True(t, errors.Is(err, syscall.EROFS))
+	assert.True(t, errors.Is(b.Trim(context.Background(), 0, pageSize), syscall.EROFS))
+	assert.True(t, errors.Is(b.WriteZeroes(context.Background(), 0, pageSize, true), syscall.EROFS))
+	assert.False(t, b.repairFromCache(page(1), errors.New("damaged")))
+}
+
+func TestFollowerReadsZeroPages(t *testing.T) {
+	b := newTestBackend(t, 4, "")
+	b.mutex = &sync.Mutex{}
+	b.follower = true
+	b.cache.brain.readOnly = true
+
+	buf := []byte{1, 2, 3}
+	n, err := b.ReadAt(context.Background(), buf, pageSize+10)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []byte{0, 0, 0}, buf)
+	assert.Equal(t, zero, b.cache.brain.pages.state(page(1)), "expected zero page not to be allocated")
+	assert.Equal(t, 0, b.cache.brain.allocatedPages())
+
+	for _, action := range b.cache.brain.maintenance(time.Now().Add(time.Hour)) {
+		assert.NotEqual(t, startUpload, action.actionType, "expected a follower not to upload")
+	}
+	assert.Equal(t, errFollowerUpload, b.Shutdown(ShutdownRemote))
+}
+
+func TestEpochPublished(t *testing.T) {
+	b := newTestBackend(t, 4, "")
+	assert.NotNil(t, b.EpochPublished(), "expected only followers to accept published epochs")
+
+	b.follower = true
+	assert.Nil(t, b.EpochPublished())
+	assert.Equal(t, int32(1), b.follow.published)
+}
@@ -0,0 +1,71 @@
+//go:build go1.18
+// +build go1.18
+
+package sia
+
+// Fuzz targets for the page math that client offsets go through. Run them
+// with e.g.
+//
+//	go test -fuzz FuzzDeterminePages ./sia/
+
+import (
+	"math"
+	"testing"
+)
+
+// FuzzDeterminePages checks that the page accesses of a request cover it
+// exactly and never leave their page.
+func FuzzDeterminePages(f *testing.F) {
+	f.Add(int64(0), 4096)
+	f.Add(int64(pageSize-1), 2)
+	f.Add(int64(3*pageSize), pageSize)
+	f.Add(int64(1<<41-4096), 8192)
+	f.Add(int64(math.MaxInt64-pageSize), pageSize)
+	f.Fuzz(func(t *testing.T, offset int64, length int) {
+		if offset < 0 || length < 0 || length > 4*pageSize || offset > math.MaxInt64-int64(length) {
+			t.Skip()
+		}
+
+		position := offset
+		slicePos := 0
+		for _, access := range determinePages(offset, length) {
+			switch {
+			case access.offset < 0 || access.length <= 0:
+				t.Fatalf("empty or negative access %+v", access)
+			case access.offset+int64(access.length) > pageSize:
+				t.Fatalf("access %+v leaves its page", access)
+			case int64(access.page)*pageSize+access.offset != position:
+				t.Fatalf("access %+v does not continue at %d", access, position)
+			case access.sliceLow != slicePos || access.sliceHigh-access.sliceLow != access.length:
+				t.Fatalf("access %+v does not continue the slice at %d", access, slicePos)
+			}
+			position += int64(access.length)
+			slicePos = access.sliceHigh
+		}
+		if slicePos != length {
+			t.Fatalf("accesses cover %d of %d bytes", slicePos, length)
+		}
+	})
+}
+
+// FuzzWithinSize checks that requests are cut off at the end of the device,
+// including devices whose size is not a multiple of the page size.
+func FuzzWithinSize(f *testing.F) {
+	f.Add(int64(pageSize), int64(0), pageSize)
+	f.Add(int64(pageSize+4096), int64(pageSize), pageSize)
+	f.Add(int64(1<<44), int64(1<<44-1), 2)
+	f.Add(int64(1<<44), int64(math.MaxInt64), 1)
+	f.Fuzz(func(t *testing.T, size int64, offset int64, length int) {
+		if size < 0 || offset < 0 || length < 0 {
+			t.Skip()
+		}
+
+		within := withinSize(size, offset, length)
+		if within < 0 || within > length {
+			t.Fatalf("%d of %d bytes within size", within, length)
+		}
+		if within > 0 && offset+int64(within) > size {
+			t.Fatalf("%d bytes at %d reach beyond %d", within, offset, size)
+		}
+	})
+}
@@ -0,0 +1,275 @@
+package sia
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type (
+	// ghostCache keeps compressed copies of clean pages after they have
+	// been evicted from the cache, so that reading them again shortly
+	// afterwards does not require a download from Sia. Copies are tied to
+	// the generation of the page they were taken from, so that outdated
+	// copies are never used. A nil *ghostCache is valid and keeps nothing.
+	ghostCache struct {
+		directory string
+		maxBytes  uint64
+		usedBytes uint64
+		entries   map[page]ghostEntry
+	}
+
+	ghostEntry struct {
+		generation int
+		size       uint64
+		lastUse    time.Time
+	}
+)
+
+const (
+	ghostDirectory = "ghost"
+	ghostSuffix    = ".gz"
+)
+
+func newGhostCache(dataDirectory string, maxBytes uint64) (*ghostCache, error) {
+	if maxBytes == 0 {
+		return nil, nil
+	}
+
+	gc := ghostCache{
+		directory: filepath.Join(dataDirectory, ghostDirectory),
+		maxBytes:  maxBytes,
+		entries:   make(map[page]ghostEntry),
+	}
+
+	err := os.MkdirAll(gc.directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos, err := ioutil.ReadDir(gc.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fileInfo := range fileInfos {
+		page, generation, err := parseGhostName(fileInfo.Name())
+		if err != nil {
+			// most likely left over from an interrupted store
+			os.Remove(filepath.Join(gc.directory, fileInfo.Name()))
+			continue
+		}
+
+		gc.entries[page] = ghostEntry{
+			generation: generation,
+			size:       uint64(fileInfo.Size()),
+			lastUse:    fileInfo.ModTime(),
+		}
+		gc.usedBytes += uint64(fileInfo.Size())
+	}
+	gc.evict()
+
+	return &gc, nil
+}
+
+func ghostName(page page, generation int) string {
+	return fmt.Sprintf("page%d%s%d%s", page, generationSeparator, generation, ghostSuffix)
+}
+
+// parseGhostName is the inverse of ghostName.
+func parseGhostName(name string) (page, int, error) {
+	var pageNumber, generation int
+	_, err := fmt.Sscanf(name, "page%d"+generationSeparator+"%d"+ghostSuffix, &pageNumber, &generation)
+	if err != nil || pageNumber < 0 || ghostName(page(pageNumber), generation) != name {
+		return 0, 0, fmt.Errorf("%s is not a ghost copy", name)
+	}
+	return page(pageNumber), generation, nil
+}
+
+func (gc *ghostCache) path(page page, generation int) string {
+	return filepath.Join(gc.directory, ghostName(page, generation))
+}
+
+// store compresses the cache file of a clean page.
+func (gc *ghostCache) store(page page, generation int, cachePath string, now time.Time) error {
+	if gc == nil {
+		return nil
+	}
+	gc.remove(page)
+
+	src, err := os.Open(cachePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	path := gc.path(page, generation)
+	tmpPath := path + ".tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	zw, err := gzip.NewWriterLevel(dst, gzip.BestSpeed)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		dst.Close()
+		return err
+	}
+
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := os.Stat(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+
+	gc.entries[page] = ghostEntry{
+		generation: generation,
+		size:       uint64(fileInfo.Size()),
+		lastUse:    now,
+	}
+	gc.usedBytes += uint64(fileInfo.Size())
+	gc.evict()
+	return nil
+}
+
+// has reports whether there is a copy of the given generation of a page.
+func (gc *ghostCache) has(page page, generation int) bool {
+	if gc == nil {
+		return false
+	}
+	entry, ok := gc.entries[page]
+	return ok && entry.generation == generation
+}
+
+// restore decompresses the copy of a page into cachePath, if there is a
+// copy of the given generation. The copy is dropped afterwards, as the page
+// is cached again.
+func (gc *ghostCache) restore(page page, generation int, cachePath string) (bool, error) {
+	if gc == nil {
+		return false, nil
+	}
+
+	entry, ok := gc.entries[page]
+	if !ok {
+		return false, nil
+	}
+	defer gc.remove(page)
+	if entry.generation != generation {
+		return false, nil
+	}
+
+	src, err := os.Open(gc.path(page, generation))
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return false, err
+	}
+
+	dst, err := os.Create(cachePath)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = io.Copy(dst, zr)
+	if err != nil {
+		dst.Close()
+		os.Remove(cachePath)
+		return false, err
+	}
+
+	err = dst.Close()
+	if err != nil {
+		os.Remove(cachePath)
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (gc *ghostCache) remove(page page) {
+	entry, ok := gc.entries[page]
+	if !ok {
+		return
+	}
+
+	err := os.Remove(gc.path(page, entry.generation))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to remove ghost copy of page %d: %s\n", page, err)
+	}
+	gc.usedBytes -= entry.size
+	delete(gc.entries, page)
+}
+
+// dropForeign removes the copies whose cache file does not start with
+// header, i.e. that are not encrypted with the current cache key.
+func (gc *ghostCache) dropForeign(header []byte) error {
+	for page, entry := range gc.entries {
+		src, err := os.Open(gc.path(page, entry.generation))
+		if err != nil {
+			return err
+		}
+
+		start := make([]byte, len(header))
+		zr, err := gzip.NewReader(src)
+		if err == nil {
+			_, err = io.ReadFull(zr, start)
+		}
+		src.Close()
+		if err != nil || !bytes.Equal(start, header) {
+			gc.remove(page)
+		}
+	}
+	return nil
+}
+
+// evict removes the least recently used copies until the byte budget is
+// met again.
+func (gc *ghostCache) evict() {
+	for gc.usedBytes > gc.maxBytes {
+		var oldest page
+		oldestUse := time.Time{}
+		for page, entry := range gc.entries {
+			if oldestUse.IsZero() || entry.lastUse.Before(oldestUse) {
+				oldest = page
+				oldestUse = entry.lastUse
+			}
+		}
+		gc.remove(oldest)
+	}
+}
+
+func (gc *ghostCache) bytes() uint64 {
+	if gc == nil {
+		return 0
+	}
+	return gc.usedBytes
+}
@@ -0,0 +1,90 @@
+package sia
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGhostCache(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "ghostcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	cachePath := filepath.Join(dataDirectory, "page")
+	writePage := func(data []byte) {
+		err := ioutil.WriteFile(cachePath, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// random data does not compress, so each copy takes up about 4 KiB
+	data := make([]byte, 4096)
+	rand.Read(data)
+	gc, err := newGhostCache(dataDirectory, 6000)
+	assert.Nil(t, err)
+
+	writePage(data)
+	assert.Nil(t, gc.store(page(1), 3, cachePath, time.Now()))
+	restored, err := gc.restore(page(1), 4, cachePath)
+	assert.Nil(t, err)
+	assert.False(t, restored, "expected copy of older generation to be ignored")
+	assert.Equal(t, uint64(0), gc.bytes(), "expected outdated copy to be dropped")
+
+	assert.Nil(t, gc.store(page(1), 4, cachePath, time.Now()))
+	os.Remove(cachePath)
+	restored, err = gc.restore(page(1), 4, cachePath)
+	assert.Nil(t, err)
+	assert.True(t, restored)
+	readBack, err := ioutil.ReadFile(cachePath)
+	assert.Nil(t, err)
+	assert.Equal(t, data, readBack)
+	assert.Equal(t, uint64(0), gc.bytes(), "expected restored copy to be dropped")
+
+	assert.Nil(t, gc.store(page(1), 4, cachePath, time.Now()))
+	gc.entries[page(1)] = ghostEntry{
+		generation: 4,
+		size:       gc.entries[page(1)].size,
+		lastUse:    time.Now().Add(-time.Minute),
+	}
+	assert.Nil(t, gc.store(page(2), 1, cachePath, time.Now()))
+	_, ok := gc.entries[page(1)]
+	assert.False(t, ok, "expected least recently stored copy to be evicted")
+	_, ok = gc.entries[page(2)]
+	assert.True(t, ok)
+
+	// copies survive a restart, leftovers do not
+	leftover := filepath.Join(dataDirectory, ghostDirectory, ghostName(page(5), 1)+".tmp")
+	assert.Nil(t, ioutil.WriteFile(leftover, []byte{}, 0600))
+	gc, err = newGhostCache(dataDirectory, 6000)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(gc.entries))
+	assert.Equal(t, 1, gc.entries[page(2)].generation)
+	_, err = os.Stat(leftover)
+	assert.True(t, os.IsNotExist(err))
+
+	var disabled *ghostCache
+	restored, err = disabled.restore(page(2), 1, cachePath)
+	assert.Nil(t, err)
+	assert.False(t, restored)
+}
+
+func TestParseGhostName(t *testing.T) {
+	page, generation, err := parseGhostName(ghostName(page(42), 7))
+	assert.Nil(t, err)
+	assert.Equal(t, 42, int(page))
+	assert.Equal(t, 7, generation)
+
+	for _, name := range []string{"page42.gen7", "page042.gen7.gz", "page42.gen7.gz.tmp", "page-1.gen1.gz"} {
+		_, _, err = parseGhostName(name)
+		assert.NotNil(t, err, name)
+	}
+}
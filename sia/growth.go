@@ -0,0 +1,147 @@
+package sia
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/javgh/sia-nbdserver/notify"
+)
+
+type (
+	// growthTrend follows how fast the dirty backlog grows, i.e. how much
+	// faster pages are written than uploaded, to warn before the cache
+	// fills up rather than once writes are throttled.
+	growthTrend struct {
+		// horizon is how far ahead reaching the limit is warned about
+		// (0 = never).
+		horizon time.Duration
+
+		lastSample time.Time
+		lastDirty  int
+		// rate is a moving average of the growth in pages per second.
+		rate         float64
+		growingSince time.Time
+		warned       bool
+	}
+
+	// CacheGrowth reports the trend of the dirty backlog. LimitIn is the
+	// predicted time until it reaches Limit, or 0 if it is not growing
+	// persistently.
+	CacheGrowth struct {
+		DirtyPages   int
+		Limit        int
+		PagesPerHour float64
+		GrowingSince time.Time
+		LimitIn      time.Duration
+		Warning      bool
+	}
+)
+
+const (
+	// growthTimeConstant is how quickly the growth rate follows changes.
+	growthTimeConstant = 5 * time.Minute
+	// growthPersistence is how long the backlog needs to keep growing
+	// before its trend is trusted.
+	growthPersistence = 10 * time.Minute
+)
+
+// sample updates the trend with the number of dirty pages at now.
+func (gt *growthTrend) sample(now time.Time, dirty int) {
+	if gt.lastSample.IsZero() {
+		gt.lastSample = now
+		gt.lastDirty = dirty
+		return
+	}
+
+	elapsed := now.Sub(gt.lastSample)
+	if elapsed <= 0 {
+		return
+	}
+	weight := 1 - math.Exp(-float64(elapsed)/float64(growthTimeConstant))
+	rate := float64(dirty-gt.lastDirty) / elapsed.Seconds()
+	gt.rate = weight*rate + (1-weight)*gt.rate
+	gt.lastSample = now
+	gt.lastDirty = dirty
+
+	if gt.rate <= 0 {
+		gt.growingSince = time.Time{}
+	} else if gt.growingSince.IsZero() {
+		gt.growingSince = now
+	}
+}
+
+// limitIn predicts how long until the backlog reaches limit, returning 0
+// if it has not been growing for growthPersistence.
+func (gt *growthTrend) limitIn(now time.Time, limit int) time.Duration {
+	if gt.growingSince.IsZero() || now.Sub(gt.growingSince) < growthPersistence {
+		return 0
+	}
+
+	remaining := limit - gt.lastDirty
+	if remaining <= 0 {
+		// already there, which the throttling takes care of
+		return 0
+	}
+	return time.Duration(float64(remaining) / gt.rate * float64(time.Second))
+}
+
+// dirtyPageLimit is where writes start to be held back: the hard limit of
+// the cache or the bound on dirty data, whichever is lower.
+func (cb *cacheBrain) dirtyPageLimit() int {
+	limit := cb.hardMaxCached
+	if cb.maxDirtyPages > 0 && cb.maxDirtyPages < limit {
+		limit = cb.maxDirtyPages
+	}
+	return limit
+}
+
+// checkCacheGrowth warns when the dirty backlog has been growing for a
+// while and is predicted to reach its limit within the horizon. The mutex
+// needs to be held.
+func (b *Backend) checkCacheGrowth() {
+	now := b.now()
+	dirty, _ := b.cache.brain.dirtyStats()
+	b.growth.sample(now, dirty)
+	if b.growth.horizon == 0 {
+		b.growth.warned = false
+		return
+	}
+
+	limit := b.cache.brain.dirtyPageLimit()
+	limitIn := b.growth.limitIn(now, limit)
+	if limitIn == 0 || limitIn > b.growth.horizon {
+		if b.growth.warned && b.growth.growingSince.IsZero() {
+			log.Printf("Pages not yet on Sia no longer growing (%d pages)\n", dirty)
+			b.growth.warned = false
+		}
+		return
+	}
+
+	if !b.growth.warned {
+		log.Printf("Pages not yet on Sia growing by %.1f per hour, reaching the limit of %d in about %s\n",
+			b.growth.rate*3600, limit, limitIn.Round(time.Minute))
+		b.notifier.Notify(notify.CacheGrowing,
+			"%d pages not yet on Sia, growing by %.1f per hour; writes will be held back in about %s",
+			dirty, b.growth.rate*3600, limitIn.Round(time.Minute))
+		b.growth.warned = true
+	}
+}
+
+// CacheGrowth reports how fast the pages not yet uploaded to Sia are
+// growing.
+func (b *Backend) CacheGrowth() CacheGrowth {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	dirty, _ := b.cache.brain.dirtyStats()
+	limit := b.cache.brain.dirtyPageLimit()
+	return CacheGrowth{
+		DirtyPages:   dirty,
+		Limit:        limit,
+		PagesPerHour: b.growth.rate * 3600,
+		GrowingSince: b.growth.growingSince,
+		LimitIn:      b.growth.limitIn(b.now(), limit),
+		Warning:      b.growth.warned,
+	}
+}
@@ -0,0 +1,69 @@
+package sia
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrowthTrend(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	gt := growthTrend{}
+
+	// one page per minute for half an hour
+	for dirty := 0; dirty <= 30; dirty++ {
+		gt.sample(now, dirty)
+		if dirty == 5 {
+			assert.Equal(t, time.Duration(0), gt.limitIn(now, 100),
+				"expected no prediction before the growth persisted")
+		}
+		now = now.Add(time.Minute)
+	}
+	now = now.Add(-time.Minute)
+	assert.InDelta(t, 60, gt.rate*3600, 1)
+	assert.InDelta(t, 70*time.Minute, gt.limitIn(now, 100), float64(2*time.Minute))
+	assert.Equal(t, time.Duration(0), gt.limitIn(now, 30), "expected no prediction at the limit")
+
+	// uploads catch up
+	for dirty := 30; dirty >= 20; dirty-- {
+		now = now.Add(time.Minute)
+		gt.sample(now, dirty)
+	}
+	assert.True(t, gt.growingSince.IsZero())
+	assert.Equal(t, time.Duration(0), gt.limitIn(now, 100))
+}
+
+func TestCheckCacheGrowth(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	b := newTestBackend(t, 64, "")
+	b.mutex = &sync.Mutex{}
+	b.clock = clock
+	b.growth.horizon = 2 * time.Hour
+
+	// a page every five minutes, while the hard limit is 6
+	for i := 0; i < 16; i++ {
+		if i%5 == 0 {
+			b.cache.brain.setState(page(i/5), cachedChanged)
+		}
+		b.checkCacheGrowth()
+		clock.Sleep(time.Minute)
+	}
+
+	growth := b.CacheGrowth()
+	assert.True(t, growth.Warning)
+	assert.Equal(t, 4, growth.DirtyPages)
+	assert.Equal(t, 6, growth.Limit)
+	assert.True(t, growth.LimitIn > 0 && growth.LimitIn < b.growth.horizon)
+
+	// uploads catch up
+	for i := 0; i < 4; i++ {
+		b.cache.brain.setState(page(i), cachedUnchanged)
+		b.checkCacheGrowth()
+		clock.Sleep(time.Minute)
+	}
+	growth = b.CacheGrowth()
+	assert.False(t, growth.Warning)
+	assert.Equal(t, time.Duration(0), growth.LimitIn)
+}
@@ -0,0 +1,135 @@
+package sia
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/javgh/sia-nbdserver/notify"
+)
+
+type (
+	// Health summarizes whether data is making it to Sia. The backend is
+	// healthy while maintenance succeeds and no upload keeps failing.
+	Health struct {
+		Healthy             bool          `json:"healthy"`
+		WritesPaused        bool          `json:"writes_paused"`
+		SiaUnavailable      bool          `json:"sia_unavailable"`
+		SiaDaemon           string        `json:"sia_daemon,omitempty"`
+		UploadsHeld         string        `json:"uploads_held,omitempty"`
+		MaintenanceFailures int           `json:"maintenance_failures"`
+		MaintenanceError    string        `json:"maintenance_error,omitempty"`
+		FailingPages        []FailingPage `json:"failing_pages"`
+
+		// ScrubFailures are pages on Sia that could not be verified
+		// when they were last scrubbed.
+		ScrubFailures []ScrubFailure `json:"scrub_failures"`
+
+		// StalePages are served from an older generation, as their
+		// newest one could not be downloaded intact.
+		StalePages []StalePage `json:"stale_pages"`
+
+		// PagesAtRisk would become unrecoverable if the contracts ending
+		// within the contract warning period were not renewed.
+		PagesAtRisk []int `json:"pages_at_risk"`
+
+		// StuckRequests have been waiting for space in the cache for
+		// longer than the watchdog timeout.
+		StuckRequests []StuckRequest `json:"stuck_requests"`
+
+		// Following is set for followers.
+		Following *FollowStatus `json:"following,omitempty"`
+	}
+
+	// FailingPage is a page whose recent uploads have all failed.
+	FailingPage struct {
+		Page      int    `json:"page"`
+		Failures  int    `json:"failures"`
+		LastError string `json:"last_error"`
+	}
+)
+
+// Health reports on failing maintenance cycles and uploads.
+func (b *Backend) Health() Health {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stats := b.MaintenanceStats()
+	health := Health{
+		WritesPaused:        b.writesPaused,
+		SiaUnavailable:      b.breaker.open,
+		UploadsHeld:         b.readiness.reason,
+		MaintenanceFailures: stats.ConsecutiveFailures,
+		MaintenanceError:    stats.LastError,
+		FailingPages:        b.failingPages(),
+		ScrubFailures:       b.scrubFailures(),
+		StalePages:          b.stalePageList(),
+		PagesAtRisk:         b.pagesAtRisk(),
+		StuckRequests:       b.stuckRequests(),
+		Following:           b.followStatus(),
+	}
+	if len(b.nodes) > 0 {
+		health.SiaDaemon = b.nodes[b.activeNode].address
+	}
+	health.Healthy = !health.WritesPaused && !health.SiaUnavailable &&
+		health.MaintenanceFailures == 0 && len(health.FailingPages) == 0 &&
+		len(health.ScrubFailures) == 0 && len(health.StalePages) == 0 &&
+		len(health.PagesAtRisk) == 0 && len(health.StuckRequests) == 0
+	return health
+}
+
+// failingPages lists the pages whose last upload failed. The mutex needs to
+// be held.
+func (b *Backend) failingPages() []FailingPage {
+	failing := []FailingPage{}
+	for page, details := range b.cache.pages {
+		if details.uploadFailures == 0 {
+			continue
+		}
+		failing = append(failing, FailingPage{
+			Page:      int(page),
+			Failures:  details.uploadFailures,
+			LastError: details.lastUploadError,
+		})
+	}
+	sort.Slice(failing, func(i, j int) bool {
+		return failing[i].Page < failing[j].Page
+	})
+	return failing
+}
+
+// updateWritePause pauses writes once maintenance or the uploads of a page
+// have failed pauseWritesAfter times in a row, so that no more data piles up
+// in the cache while it cannot be uploaded, and resumes them once that is
+// no longer the case. The mutex needs to be held.
+func (b *Backend) updateWritePause() {
+	paused := false
+	reason := ""
+	if b.pauseWritesAfter > 0 {
+		stats := b.MaintenanceStats()
+		if stats.ConsecutiveFailures >= b.pauseWritesAfter {
+			paused = true
+			reason = fmt.Sprintf("maintenance failed %d times in a row: %s",
+				stats.ConsecutiveFailures, stats.LastError)
+		}
+		for _, failing := range b.failingPages() {
+			if !paused && failing.Failures >= b.pauseWritesAfter {
+				paused = true
+				reason = fmt.Sprintf("uploading page %d failed %d times in a row: %s",
+					failing.Page, failing.Failures, failing.LastError)
+			}
+		}
+	}
+
+	if paused == b.writesPaused {
+		return
+	}
+	b.writesPaused = paused
+	if paused {
+		log.Printf("Pausing writes, as %s\n", reason)
+		b.notifier.Notify(notify.WritesPaused, "writes paused, as %s", reason)
+	} else {
+		log.Printf("Resuming writes\n")
+		b.notifier.Notify(notify.WritesResumed, "writes resumed")
+	}
+}
@@ -0,0 +1,39 @@
+package sia
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritePause(t *testing.T) {
+	b := newTestBackend(t, 4, "")
+	b.mutex = &sync.Mutex{}
+	b.schedule = newMaintenanceSchedule(0, 0)
+	b.pauseWritesAfter = 2
+
+	assert.True(t, b.Health().Healthy)
+
+	b.cache.brain.setState(page(1), cachedUploading)
+	b.uploadFailed(page(1), errors.New("no hosts"))
+	b.updateWritePause()
+	health := b.Health()
+	assert.False(t, health.Healthy)
+	assert.False(t, health.WritesPaused)
+	assert.Equal(t, []FailingPage{{Page: 1, Failures: 1, LastError: "no hosts"}}, health.FailingPages)
+
+	b.uploadFailed(page(1), errors.New("no hosts"))
+	b.updateWritePause()
+	assert.True(t, b.Health().WritesPaused)
+
+	// an upload that goes through resumes writes
+	b.cache.pages.get(page(1)).uploadFailures = 0
+	b.updateWritePause()
+	assert.False(t, b.Health().WritesPaused)
+
+	b.schedule.stats.ConsecutiveFailures = 2
+	b.updateWritePause()
+	assert.True(t, b.Health().WritesPaused, "expected failing maintenance to pause writes")
+}
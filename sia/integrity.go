@@ -0,0 +1,325 @@
+package sia
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/javgh/sia-nbdserver/config"
+	"go.sia.tech/renterd/worker"
+)
+
+type (
+	// integrity authenticates the pages on Sia, so that the Sia daemon or
+	// the hosts cannot hand back modified data without being noticed. Every
+	// uploaded generation of a page gets an HMAC tag, which is kept in a
+	// manifest that is itself authenticated. The tags and the manifest use
+	// separate keys derived from the integrity key, which is independent of
+	// the cache key. A nil *integrity checks nothing.
+	integrity struct {
+		pageKey     []byte
+		manifestKey []byte
+		path        string
+		manifest    integrityManifest
+
+		// unstored is set while the manifest on Sia is out of date.
+		unstored bool
+	}
+
+	// integrityManifest maps pages to the tags of their generations on
+	// Sia. Sequence increases with every change, so that the newer of the
+	// local and the remote copy can be told apart.
+	integrityManifest struct {
+		Sequence uint64                  `json:"sequence"`
+		Tags     map[page]map[int][]byte `json:"tags"`
+		MAC      []byte                  `json:"mac"`
+	}
+)
+
+const (
+	manifestFile   = "manifest.json"
+	manifestName   = "manifest"
+	manifestLogKey = "manifest"
+	pageTagLabel   = "sia-nbdserver page tags"
+	manifestLabel  = "sia-nbdserver manifest"
+)
+
+var errNoTag = errors.New("no integrity tag")
+
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newIntegrity(keyFile string, dataDirectory string) (*integrity, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	key, err := config.ReadKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &integrity{
+		pageKey:     deriveKey(key, pageTagLabel),
+		manifestKey: deriveKey(key, manifestLabel),
+		path:        filepath.Join(dataDirectory, manifestFile),
+		manifest:    integrityManifest{Tags: make(map[page]map[int][]byte)},
+	}, nil
+}
+
+func manifestPath(siaPathPrefix string) string {
+	return fmt.Sprintf("%s/%s", metadataDirectory(siaPathPrefix), manifestName)
+}
+
+// tagger returns the hash that data of the given generation of a page
+// needs to be written to for computing its tag.
+func (in *integrity) tagger(page page, generation int) hash.Hash {
+	mac := hmac.New(sha256.New, in.pageKey)
+	binary.Write(mac, binary.BigEndian, uint64(page))
+	binary.Write(mac, binary.BigEndian, uint64(generation))
+	return mac
+}
+
+// verify checks the tag of a downloaded generation of a page. It returns
+// errNoTag for pages uploaded before integrity protection was enabled.
+func (in *integrity) verify(page page, generation int, tag []byte) error {
+	expected, ok := in.manifest.Tags[page][generation]
+	if !ok {
+		return errNoTag
+	}
+	if !hmac.Equal(expected, tag) {
+		return fmt.Errorf("generation %d of page %d fails integrity check", generation, page)
+	}
+	return nil
+}
+
+// record keeps the tag of a newly uploaded generation of a page, dropping
+// the tags of generations older than the valid generation.
+func (in *integrity) record(page page, generation int, tag []byte, validGeneration int) error {
+	tags, ok := in.manifest.Tags[page]
+	if !ok {
+		tags = make(map[int][]byte)
+		in.manifest.Tags[page] = tags
+	}
+	for g := range tags {
+		if g < validGeneration {
+			delete(tags, g)
+		}
+	}
+	tags[generation] = tag
+
+	in.manifest.Sequence += 1
+	in.unstored = true
+	return in.save()
+}
+
+func (in *integrity) encode() ([]byte, error) {
+	in.manifest.MAC = nil
+	unsigned, err := json.Marshal(in.manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	in.manifest.MAC = in.manifestMAC(unsigned)
+	return json.Marshal(in.manifest)
+}
+
+func (in *integrity) manifestMAC(unsigned []byte) []byte {
+	mac := hmac.New(sha256.New, in.manifestKey)
+	mac.Write(unsigned)
+	return mac.Sum(nil)
+}
+
+// decode parses a manifest and checks that it has not been tampered with.
+func (in *integrity) decode(encoded []byte) (integrityManifest, error) {
+	var manifest integrityManifest
+	err := json.Unmarshal(encoded, &manifest)
+	if err != nil {
+		return manifest, err
+	}
+
+	mac := manifest.MAC
+	manifest.MAC = nil
+	unsigned, err := json.Marshal(manifest)
+	if err != nil {
+		return manifest, err
+	}
+	if !hmac.Equal(mac, in.manifestMAC(unsigned)) {
+		return manifest, errors.New("integrity manifest fails authentication")
+	}
+	if manifest.Tags == nil {
+		manifest.Tags = make(map[page]map[int][]byte)
+	}
+	return manifest, nil
+}
+
+// save writes the manifest to the data directory.
+func (in *integrity) save() error {
+	encoded, err := in.encode()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := in.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, encoded, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, in.path)
+}
+
+// load reads the local and the remote manifest, using whichever is newer.
+// A manifest that fails authentication is an error rather than being
+// ignored, as ignoring it would disable the checks.
+func (in *integrity) load(ctx context.Context, workerClient *worker.Client, siaPathPrefix string) error {
+	encoded, err := ioutil.ReadFile(in.path)
+	if err == nil {
+		in.manifest, err = in.decode(encoded)
+		if err != nil {
+			return fmt.Errorf("%s: %s", in.path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	entries, err := workerClient.ObjectEntries(ctx, metadataDirectory(siaPathPrefix)+"/")
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, entry := range entries {
+		if strings.TrimPrefix(entry, "/") == manifestPath(siaPathPrefix) {
+			found = true
+		}
+	}
+	if !found {
+		in.unstored = in.manifest.Sequence > 0
+		return nil
+	}
+
+	var buf bytes.Buffer
+	err = workerClient.DownloadObject(ctx, &buf, manifestPath(siaPathPrefix)+shardParameters)
+	if err != nil {
+		return err
+	}
+	remote, err := in.decode(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("%s: %s", manifestPath(siaPathPrefix), err)
+	}
+
+	switch {
+	case remote.Sequence > in.manifest.Sequence:
+		in.manifest = remote
+		return in.save()
+	case remote.Sequence < in.manifest.Sequence:
+		in.unstored = true
+	}
+	return nil
+}
+
+// storeManifest brings the manifest on Sia up to date, so that the tags
+// survive the loss of the data directory. The mutex needs to be held.
+func (b *Backend) storeManifest(ctx context.Context) {
+	if b.integrity == nil || !b.integrity.unstored {
+		return
+	}
+
+	encoded, err := b.integrity.encode()
+	if err != nil {
+		b.logger.Printf(manifestLogKey, b.now(), "Unable to encode integrity manifest: %s\n", err)
+		return
+	}
+
+	err = b.workerClient.UploadObject(ctx, bytes.NewReader(encoded),
+		manifestPath(b.siaPathPrefix)+shardParameters)
+	if err != nil {
+		b.logger.Printf(manifestLogKey, b.now(), "Unable to store integrity manifest: %s\n", err)
+		return
+	}
+	b.logger.Resolve(manifestLogKey, b.now())
+	b.integrity.unstored = false
+}
+
+// verifyDownload checks the tag of a page that has just been downloaded.
+// Pages without a tag are accepted with a warning. The mutex needs to be
+// held.
+func (b *Backend) verifyDownload(page page, generation int, tag []byte) error {
+	err := b.integrity.verify(page, generation, tag)
+	if err == errNoTag {
+		log.Printf("Page %d has no integrity tag yet; it will get one with its next upload\n", page)
+		return nil
+	}
+	return err
+}
+
+// keepCleanPages marks the cache files left from the previous run that
+// match the newest generation on Sia according to the manifest as
+// unchanged, so that they are not uploaded again, and returns the others.
+func (b *Backend) keepCleanPages(cachedPages []page) []page {
+	if b.integrity == nil {
+		return cachedPages
+	}
+
+	dirty := []page{}
+	for _, page := range cachedPages {
+		clean, err := b.matchesSia(page)
+		if err != nil {
+			log.Printf("Unable to compare cache for page %d with Sia: %s\n", page, err)
+		}
+		if !clean {
+			dirty = append(dirty, page)
+			continue
+		}
+
+		b.cache.brain.setState(page, cachedUnchanged)
+		b.cache.brain.pages.get(page).dirtySince = time.Time{}
+	}
+	if len(dirty) < len(cachedPages) {
+		log.Printf("Cache for %d page(s) matches what is on Sia; not uploading them again\n",
+			len(cachedPages)-len(dirty))
+	}
+	return dirty
+}
+
+// matchesSia compares the cache file of a page with the tag of its newest
+// generation on Sia. Packs are tagged as a whole, so packed pages never
+// match.
+func (b *Backend) matchesSia(page page) (bool, error) {
+	details := b.cache.pages.get(page)
+	if !details.onSia || b.packed() {
+		return false, nil
+	}
+	expected, ok := b.integrity.manifest.Tags[page][details.generation]
+	if !ok {
+		return false, nil
+	}
+
+	f, err := b.openCacheFile(page)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	tagger := b.integrity.tagger(page, details.generation)
+	_, err = io.Copy(tagger, b.pageReader(f, page))
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal(expected, tagger.Sum(nil)), nil
+}
@@ -0,0 +1,128 @@
+package sia
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntegrity(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "integrity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	keyFile := filepath.Join(dataDirectory, "key")
+	err = ioutil.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := newIntegrity(keyFile, dataDirectory)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Equal(in.pageKey, in.manifestKey), "expected separate keys")
+
+	tag := func(page page, generation int, data string) []byte {
+		tagger := in.tagger(page, generation)
+		tagger.Write([]byte(data))
+		return tagger.Sum(nil)
+	}
+
+	assert.Equal(t, errNoTag, in.verify(page(1), 1, tag(page(1), 1, "data")))
+
+	assert.Nil(t, in.record(page(1), 1, tag(page(1), 1, "data"), 0))
+	assert.Nil(t, in.verify(page(1), 1, tag(page(1), 1, "data")))
+	assert.NotNil(t, in.verify(page(1), 1, tag(page(1), 1, "modified")))
+	assert.NotNil(t, in.verify(page(1), 1, tag(page(2), 1, "data")), "expected tag to be bound to its page")
+
+	assert.Nil(t, in.record(page(1), 2, tag(page(1), 2, "new"), 1))
+	assert.Nil(t, in.verify(page(1), 1, tag(page(1), 1, "data")), "expected valid generation to be kept")
+	assert.Nil(t, in.record(page(1), 3, tag(page(1), 3, "newer"), 2))
+	assert.Equal(t, errNoTag, in.verify(page(1), 1, tag(page(1), 1, "data")),
+		"expected superseded generation to be dropped")
+	assert.True(t, in.unstored)
+
+	encoded, err := ioutil.ReadFile(filepath.Join(dataDirectory, manifestFile))
+	assert.Nil(t, err)
+	manifest, err := in.decode(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), manifest.Sequence)
+
+	tampered := bytes.Replace(encoded, []byte(`"sequence":3`), []byte(`"sequence":4`), 1)
+	_, err = in.decode(tampered)
+	assert.NotNil(t, err)
+}
+
+func TestKeepCleanPages(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "integrity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	keyFile := filepath.Join(dataDirectory, "key")
+	err = ioutil.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newTestBackend(t, 4, dataDirectory)
+	b.integrity, err = newIntegrity(keyFile, dataDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(page page, data string) {
+		f, err := b.openCacheFile(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		_, err = f.WriteAt([]byte(data), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	upload := func(page page, generation int) {
+		f, err := b.openCacheFile(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		tagger := b.integrity.tagger(page, generation)
+		_, err = io.Copy(tagger, b.pageReader(f, page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Nil(t, b.integrity.record(page, generation, tagger.Sum(nil), generation))
+		b.cache.pages.get(page).generation = generation
+		b.cache.setOnSia(page)
+	}
+
+	// page 0 is as uploaded, page 1 was written to afterwards and page 2
+	// was never uploaded
+	write(page(0), "uploaded")
+	upload(page(0), 2)
+	write(page(1), "uploaded")
+	upload(page(1), 1)
+	write(page(1), "modified")
+	write(page(2), "new")
+
+	cachedPages := []page{0, 1, 2}
+	for _, page := range cachedPages {
+		b.cache.brain.setState(page, cachedChanged)
+	}
+	dirty := b.keepCleanPages(cachedPages)
+	assert.Equal(t, []page{1, 2}, dirty)
+	assert.Equal(t, cachedUnchanged, b.cache.brain.pages.state(page(0)))
+	assert.Equal(t, cachedChanged, b.cache.brain.pages.state(page(1)))
+	assert.Equal(t, 2, len(b.cache.brain.dirtyPages))
+
+	b.integrity = nil
+	assert.Equal(t, cachedPages, b.keepCleanPages(cachedPages), "expected all pages to be dirty without a manifest")
+}
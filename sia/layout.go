@@ -0,0 +1,178 @@
+package sia
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"go.sia.tech/renterd/worker"
+)
+
+// Layout decides where below the SiaPath prefix the pages of a device are
+// stored.
+type Layout int
+
+const (
+	// LayoutFlat stores all pages directly below the prefix.
+	LayoutFlat Layout = iota
+	// LayoutSharded stores the pages in directories of pagesPerShard
+	// pages each, as renters slow down with many objects in one
+	// directory.
+	LayoutSharded
+)
+
+const pagesPerShard = 1024
+
+var layoutNames = map[Layout]string{
+	LayoutFlat:    "flat",
+	LayoutSharded: "sharded",
+}
+
+func (l Layout) String() string {
+	return layoutNames[l]
+}
+
+// ParseLayout is the inverse of Layout.String.
+func ParseLayout(name string) (Layout, error) {
+	for layout, layoutName := range layoutNames {
+		if name == layoutName {
+			return layout, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown layout %q (valid: flat, sharded)", name)
+}
+
+func shardDirectory(siaPathPrefix string, page page) string {
+	return fmt.Sprintf("%s/%d", siaPathPrefix, int(page)/pagesPerShard)
+}
+
+func (l Layout) siaPath(siaPathPrefix string, page page, generation int) string {
+	if l == LayoutSharded {
+		return asSiaPath(shardDirectory(siaPathPrefix, page), page, generation)
+	}
+	return asSiaPath(siaPathPrefix, page, generation)
+}
+
+// parseSiaPath is the inverse of siaPath.
+func (l Layout) parseSiaPath(siaPathPrefix string, siaPath string) (page, int, error) {
+	if l == LayoutFlat {
+		return parseSiaPath(siaPathPrefix, siaPath)
+	}
+
+	name := strings.TrimPrefix(siaPath, "/")
+	rest := strings.TrimPrefix(name, siaPathPrefix+"/")
+	i := strings.Index(rest, "/")
+	if rest == name || i < 0 {
+		return 0, 0, fmt.Errorf("%s is not a page of %s", siaPath, siaPathPrefix)
+	}
+
+	directory := siaPathPrefix + "/" + rest[:i]
+	page, generation, err := parseSiaPath(directory, name)
+	if err != nil {
+		return 0, 0, err
+	}
+	if directory != shardDirectory(siaPathPrefix, page) {
+		return 0, 0, fmt.Errorf("%s is in the wrong shard", siaPath)
+	}
+	return page, generation, nil
+}
+
+// listLayouts lists the pages of a device, separated by the layout they
+// are stored in. Only a device being migrated has pages in both.
+func listLayouts(ctx context.Context, workerClient *worker.Client,
+	siaPathPrefix string) ([]remotePage, []remotePage, error) {
+	entries, err := workerClient.ObjectEntries(ctx, siaPathPrefix+"/")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	flat := []remotePage{}
+	sharded := []remotePage{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry, "/") {
+			remotePage, err := parseRemotePage(LayoutFlat, siaPathPrefix, entry)
+			if err != nil {
+				skipEntry(entry, err)
+				continue
+			}
+			flat = append(flat, remotePage)
+			continue
+		}
+
+		// other directories are the pages of other devices; see pageRoot
+		shard := strings.TrimPrefix(strings.TrimPrefix(entry, "/"), siaPathPrefix+"/")
+		if _, err := parseNumber(strings.TrimSuffix(shard, "/")); err != nil {
+			continue
+		}
+
+		shardEntries, err := workerClient.ObjectEntries(ctx, entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, shardEntry := range shardEntries {
+			remotePage, err := parseRemotePage(LayoutSharded, siaPathPrefix, shardEntry)
+			if err != nil {
+				skipEntry(shardEntry, err)
+				continue
+			}
+			sharded = append(sharded, remotePage)
+		}
+	}
+	return flat, sharded, nil
+}
+
+// skippedEntries are the objects next to the pages that are not pages
+// themselves and have been warned about.
+var skippedEntries = struct {
+	sync.Mutex
+	entries map[string]bool
+}{entries: make(map[string]bool)}
+
+// skipEntry warns about an object among the pages that is not a page, e.g.
+// one stored there by someone else, once per object. Such objects are left
+// alone rather than making the whole listing fail.
+func skipEntry(entry string, err error) {
+	skippedEntries.Lock()
+	defer skippedEntries.Unlock()
+
+	if skippedEntries.entries[entry] {
+		return
+	}
+	skippedEntries.entries[entry] = true
+	log.Printf("Ignoring %s, which is not a page: %s\n", entry, err)
+}
+
+func parseRemotePage(layout Layout, siaPathPrefix string, entry string) (remotePage, error) {
+	page, generation, err := layout.parseSiaPath(siaPathPrefix, entry)
+	if err != nil {
+		return remotePage{}, err
+	}
+	return remotePage{
+		page:       page,
+		generation: generation,
+		siaPath:    strings.TrimPrefix(entry, "/"),
+	}, nil
+}
+
+// listRemotePages lists the pages of a device along with the layout they
+// are stored in, which is the given one for a device without pages.
+func listRemotePages(ctx context.Context, workerClient *worker.Client,
+	siaPathPrefix string, layout Layout) ([]remotePage, Layout, error) {
+	flat, sharded, err := listLayouts(ctx, workerClient, siaPathPrefix)
+	if err != nil {
+		return nil, layout, err
+	}
+
+	switch {
+	case len(flat) > 0 && len(sharded) > 0:
+		return nil, layout, fmt.Errorf("%s holds pages in both the flat and the sharded layout; "+
+			"finish the migration with migrate-layout", siaPathPrefix)
+	case len(flat) > 0:
+		return flat, LayoutFlat, nil
+	case len(sharded) > 0:
+		return sharded, LayoutSharded, nil
+	}
+	return flat, layout, nil
+}
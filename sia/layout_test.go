@@ -0,0 +1,48 @@
+package sia
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayoutRoundTrip(t *testing.T) {
+	assert.Equal(t, "nbd/page42.gen3", LayoutFlat.siaPath("nbd", page(42), 3))
+	assert.Equal(t, "nbd/0/page42.gen3", LayoutSharded.siaPath("nbd", page(42), 3))
+	assert.Equal(t, "nbd/2/page2048", LayoutSharded.siaPath("nbd", page(2048), 0))
+
+	for _, layout := range []Layout{LayoutFlat, LayoutSharded} {
+		for _, p := range []page{0, 1023, 1024, 123456} {
+			for _, generation := range []int{0, 1, 17} {
+				parsedPage, parsedGeneration, err := layout.parseSiaPath("nbd",
+					"/"+layout.siaPath("nbd", p, generation))
+				assert.Nil(t, err)
+				assert.Equal(t, p, parsedPage)
+				assert.Equal(t, generation, parsedGeneration)
+			}
+		}
+	}
+}
+
+func TestParseShardedSiaPath(t *testing.T) {
+	for _, siaPath := range []string{
+		"nbd/page42",
+		"nbd/1/page42",
+		"nbd/00/page42",
+		"other/0/page42",
+		"nbd/0/sub/page42",
+	} {
+		_, _, err := LayoutSharded.parseSiaPath("nbd", siaPath)
+		assert.NotNil(t, err, siaPath)
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	for _, layout := range []Layout{LayoutFlat, LayoutSharded} {
+		parsed, err := ParseLayout(layout.String())
+		assert.Nil(t, err)
+		assert.Equal(t, layout, parsed)
+	}
+	_, err := ParseLayout("nested")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,80 @@
+package sia
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type (
+	// LifetimeStats are cumulative statistics that are kept across
+	// restarts, counted since Since.
+	LifetimeStats struct {
+		Since           time.Time `json:"since"`
+		Starts          uint64    `json:"starts"`
+		Uploads         uint64    `json:"uploads"`
+		BytesUploaded   uint64    `json:"bytes_uploaded"`
+		UploadFailures  uint64    `json:"upload_failures"`
+		Downloads       uint64    `json:"downloads"`
+		BytesDownloaded uint64    `json:"bytes_downloaded"`
+		Flushes         uint64    `json:"flushes"`
+		Repairs         uint64    `json:"repairs"`
+	}
+)
+
+const lifetimeStatsFile = "stats.json"
+
+func lifetimeStatsPath(dataDirectory string) string {
+	return filepath.Join(dataDirectory, lifetimeStatsFile)
+}
+
+// restoreLifetimeStats continues the statistics of previous runs.
+func (b *Backend) restoreLifetimeStats() error {
+	encoded, err := ioutil.ReadFile(lifetimeStatsPath(b.dataDirectory))
+	if os.IsNotExist(err) {
+		b.lifetime = LifetimeStats{Since: b.now()}
+	} else if err != nil {
+		return err
+	} else {
+		err = json.Unmarshal(encoded, &b.lifetime)
+		if err != nil {
+			return err
+		}
+		b.savedLifetime = encoded
+	}
+
+	b.lifetime.Starts += 1
+	return nil
+}
+
+// persistLifetimeStats saves the statistics if they changed since they were
+// last saved and logs any errors, as they are merely informational. The
+// mutex needs to be held.
+func (b *Backend) persistLifetimeStats() {
+	encoded, err := json.MarshalIndent(b.lifetime, "", "  ")
+	if err != nil {
+		log.Printf("Unable to save statistics: %s\n", err)
+		return
+	}
+	if bytes.Equal(encoded, b.savedLifetime) {
+		return
+	}
+
+	err = writeFileAtomically(lifetimeStatsPath(b.dataDirectory), encoded, 0600)
+	if err != nil {
+		log.Printf("Unable to save statistics: %s\n", err)
+		return
+	}
+	b.savedLifetime = encoded
+}
+
+// countDownload counts a page downloaded from Sia. The mutex needs to be
+// held.
+func (b *Backend) countDownload() {
+	b.lifetime.Downloads += 1
+	b.lifetime.BytesDownloaded += pageSize
+}
@@ -0,0 +1,39 @@
+package sia
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLifetimeStats(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "lifetime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	now := time.Unix(1600000000, 0).UTC()
+	backend := newTestBackend(t, 10, dataDirectory)
+	backend.clock = &manualClock{now: now}
+	err = backend.restoreLifetimeStats()
+	assert.Nil(t, err)
+	assert.Equal(t, LifetimeStats{Since: now, Starts: 1}, backend.lifetime)
+
+	backend.countDownload()
+	backend.lifetime.Flushes += 1
+	backend.persistLifetimeStats()
+
+	restarted := newTestBackend(t, 10, dataDirectory)
+	restarted.clock = &manualClock{now: now.Add(time.Hour)}
+	err = restarted.restoreLifetimeStats()
+	assert.Nil(t, err)
+	assert.Equal(t, now, restarted.lifetime.Since, "expected statistics to carry over")
+	assert.Equal(t, uint64(2), restarted.lifetime.Starts)
+	assert.Equal(t, uint64(1), restarted.lifetime.Downloads)
+	assert.Equal(t, uint64(pageSize), restarted.lifetime.BytesDownloaded)
+	assert.Equal(t, uint64(1), restarted.lifetime.Flushes)
+}
@@ -0,0 +1,111 @@
+package sia
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// remoteListing caches the pages on Sia, grouped by page, so that
+	// maintenance does not list the whole prefix again in every cycle
+	// while waiting for uploads to reach their redundancy. It is refreshed
+	// once page objects have been uploaded or deleted, and after
+	// remoteListingMaxAge in case they were changed by someone else. With
+	// the sharded layout, only the shard of the page looked up is listed,
+	// which keeps listings small for large devices; shardsListedAt tells
+	// when each shard was.
+	remoteListing struct {
+		pages          map[page][]remotePage
+		listedAt       time.Time
+		shardsListedAt map[int]time.Time
+		stale          int32
+	}
+)
+
+const remoteListingMaxAge = 10 * time.Minute
+
+// invalidate makes the next lookup list the pages again. It may be called
+// without holding the mutex.
+func (l *remoteListing) invalidate() {
+	atomic.StoreInt32(&l.stale, 1)
+}
+
+// remoteGenerations returns the generations of page p on Sia, or of its
+// pack if pages are packed, listing the pages if the cached listing is out
+// of date. The mutex needs to be held.
+func (b *Backend) remoteGenerations(ctx context.Context, p page) ([]remotePage, error) {
+	l := &b.listing
+	if atomic.SwapInt32(&l.stale, 0) != 0 {
+		l.pages = nil
+		l.shardsListedAt = nil
+	}
+
+	if b.layout == LayoutSharded {
+		err := b.listShard(ctx, b.packOf(p))
+		if err != nil {
+			return nil, err
+		}
+	} else if l.pages == nil || b.now().Sub(l.listedAt) >= remoteListingMaxAge {
+		remotePages, _, err := listRemotePages(ctx, b.workerClient, b.pageRoot, b.layout)
+		if err != nil {
+			l.pages = nil
+			return nil, b.recordSia(err)
+		}
+		b.recordSia(nil)
+
+		l.pages = make(map[page][]remotePage)
+		for _, remotePage := range remotePages {
+			l.pages[remotePage.page] = append(l.pages[remotePage.page], remotePage)
+		}
+		l.listedAt = b.now()
+	}
+
+	return b.trash.withoutTrashed(l.pages[b.packOf(p)]), nil
+}
+
+// listShard lists the shard holding page p again, unless it has been
+// listed recently. The mutex needs to be held.
+func (b *Backend) listShard(ctx context.Context, p page) error {
+	l := &b.listing
+	shard := int(p) / pagesPerShard
+	if l.pages != nil && b.now().Sub(l.shardsListedAt[shard]) < remoteListingMaxAge {
+		return nil
+	}
+
+	entries, err := b.workerClient.ObjectEntries(ctx, shardDirectory(b.pageRoot, p)+"/")
+	if err != nil {
+		return b.recordSia(err)
+	}
+	b.recordSia(nil)
+	l.replaceShard(shard, b.pageRoot, entries, b.now())
+	return nil
+}
+
+// replaceShard replaces the pages of a shard with those just listed. Entries
+// that are not pages are skipped.
+func (l *remoteListing) replaceShard(shard int, pageRoot string, entries []string, now time.Time) {
+	remotePages := []remotePage{}
+	for _, entry := range entries {
+		remotePage, err := parseRemotePage(LayoutSharded, pageRoot, entry)
+		if err != nil {
+			skipEntry(entry, err)
+			continue
+		}
+		remotePages = append(remotePages, remotePage)
+	}
+
+	if l.pages == nil {
+		l.pages = make(map[page][]remotePage)
+		l.shardsListedAt = make(map[int]time.Time)
+	}
+	for listed := range l.pages {
+		if int(listed)/pagesPerShard == shard {
+			delete(l.pages, listed)
+		}
+	}
+	for _, remotePage := range remotePages {
+		l.pages[remotePage.page] = append(l.pages[remotePage.page], remotePage)
+	}
+	l.shardsListedAt[shard] = now
+}
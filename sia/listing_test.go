@@ -0,0 +1,77 @@
+package sia
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteListing(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	b := newTestBackend(t, 10, "")
+	b.clock = clock
+	b.trash = &trash{entries: map[string]TrashEntry{"nbd/page3.gen1": {}}}
+	b.listing = remoteListing{
+		pages: map[page][]remotePage{
+			3: {
+				{page: 3, generation: 1, siaPath: "nbd/page3.gen1"},
+				{page: 3, generation: 2, siaPath: "nbd/page3.gen2"},
+			},
+		},
+		listedAt: clock.Now(),
+	}
+
+	clock.Sleep(remoteListingMaxAge / 2)
+	remotePages, err := b.remoteGenerations(context.Background(), page(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []remotePage{{page: 3, generation: 2, siaPath: "nbd/page3.gen2"}}, remotePages,
+		"expected cached listing without trashed generations")
+
+	remotePage, ok := findGeneration(remotePages, 2)
+	assert.True(t, ok)
+	assert.Equal(t, "nbd/page3.gen2", remotePage.siaPath)
+	_, ok = findGeneration(remotePages, 3)
+	assert.False(t, ok)
+
+	remotePages, err = b.remoteGenerations(context.Background(), page(4))
+	assert.Nil(t, err)
+	assert.Empty(t, remotePages)
+
+	b.listing.invalidate()
+	assert.Equal(t, int32(1), b.listing.stale)
+}
+
+func TestShardListing(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	b := newTestBackend(t, 2*pagesPerShard, "")
+	b.clock = clock
+	b.layout = LayoutSharded
+	b.pageRoot = "nbd"
+	b.trash = &trash{entries: map[string]TrashEntry{}}
+	inFirst := page(3)
+	inSecond := page(pagesPerShard + 3)
+	b.listing = remoteListing{
+		pages: map[page][]remotePage{
+			inFirst:  {{page: inFirst, generation: 1, siaPath: "nbd/0/page3.gen1"}},
+			inSecond: {{page: inSecond, generation: 1, siaPath: "nbd/1/page1027.gen1"}},
+		},
+		shardsListedAt: map[int]time.Time{0: clock.Now(), 1: clock.Now()},
+	}
+
+	clock.Sleep(remoteListingMaxAge / 2)
+	remotePages, err := b.remoteGenerations(context.Background(), inSecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(remotePages), "expected the recently listed shard to be cached")
+
+	// listing a shard again only replaces its own pages, skipping objects
+	// that are not pages
+	b.listing.replaceShard(1, "nbd", []string{"/nbd/1/page1027.gen2", "/nbd/1/page1030.gen1",
+		"/nbd/1/pagefoo", "/nbd/1/page1031extra", "/nbd/1/notes.txt", "/nbd/1/page1032.gen1/"}, clock.Now())
+	assert.Equal(t, []remotePage{{page: inSecond, generation: 2, siaPath: "nbd/1/page1027.gen2"}},
+		b.listing.pages[inSecond])
+	assert.Equal(t, 1, len(b.listing.pages[page(pagesPerShard+6)]))
+	assert.Equal(t, 1, len(b.listing.pages[inFirst]))
+	assert.Equal(t, clock.Now(), b.listing.shardsListedAt[1])
+}
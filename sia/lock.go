@@ -0,0 +1,51 @@
+package sia
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const lockFile = "lock"
+
+// lockDataDirectory takes an exclusive lock on the data directory, so that
+// a second process cannot open and modify the same cache files. The lock
+// is held until the returned file is closed or the process exits, even if
+// it is killed. The file records the PID of the holder for the error
+// message of the next one.
+func lockDataDirectory(dataDirectory string) (*os.File, error) {
+	path := filepath.Join(dataDirectory, lockFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		holder := make([]byte, 32)
+		n, _ := file.ReadAt(holder, 0)
+		file.Close()
+		pid, pidErr := strconv.Atoi(strings.TrimSpace(string(holder[:n])))
+		if pidErr != nil {
+			return nil, fmt.Errorf("data directory %s is in use by another process", dataDirectory)
+		}
+		return nil, fmt.Errorf("data directory %s is in use by another process (PID %d)", dataDirectory, pid)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
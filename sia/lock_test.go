@@ -0,0 +1,54 @@
+package sia
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockDataDirectory(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	lock, err := lockDataDirectory(dataDirectory)
+	assert.Nil(t, err)
+
+	_, err = lockDataDirectory(dataDirectory)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, fmt.Sprintf("data directory %s is in use by another process (PID %d)",
+			dataDirectory, os.Getpid()), err.Error())
+	}
+
+	lock.Close()
+	lock, err = lockDataDirectory(dataDirectory)
+	assert.Nil(t, err, "expected the lock to be free again once closed")
+	lock.Close()
+}
+
+func TestNewBackendReleasesLock(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	settings := BackendSettings{
+		SiaPathPrefix: "nbd",
+		DataDirectory: dataDirectory,
+		Size:          uint64(MaxSize) + 1,
+	}
+	_, err = NewBackend(settings)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "exceeds the maximum")
+	}
+
+	lock, err := lockDataDirectory(dataDirectory)
+	assert.Nil(t, err, "expected a backend that failed to start to release the lock")
+	lock.Close()
+}
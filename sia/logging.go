@@ -0,0 +1,94 @@
+package sia
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type (
+	// repeatedLogger rate limits messages that tend to repeat every
+	// maintenance cycle (e.g. a stuck upload). Messages are grouped by a key
+	// such as "page 42 upload". The first occurrence is logged right away;
+	// repetitions within the interval are only counted and reported with the
+	// next message that gets through, or in a summary once the key is
+	// resolved.
+	repeatedLogger struct {
+		mutex    sync.Mutex
+		interval time.Duration
+		entries  map[string]*repeatedLogEntry
+	}
+
+	repeatedLogEntry struct {
+		first      time.Time
+		lastLogged time.Time
+		count      int
+		suppressed int
+	}
+)
+
+const repeatedLogInterval = 5 * time.Minute
+
+func newRepeatedLogger(interval time.Duration) *repeatedLogger {
+	return &repeatedLogger{
+		interval: interval,
+		entries:  make(map[string]*repeatedLogEntry),
+	}
+}
+
+func (l *repeatedLogger) Printf(key string, now time.Time, format string, v ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry, ok := l.entries[key]
+	if !ok {
+		l.entries[key] = &repeatedLogEntry{
+			first:      now,
+			lastLogged: now,
+			count:      1,
+		}
+		log.Printf(format, v...)
+		return
+	}
+
+	entry.count += 1
+	if now.Before(entry.lastLogged.Add(l.interval)) {
+		entry.suppressed += 1
+		return
+	}
+
+	message := fmt.Sprintf(format, v...)
+	if entry.suppressed > 0 {
+		log.Printf("%s (%d similar messages suppressed)\n", trimNewline(message), entry.suppressed)
+	} else {
+		log.Print(message)
+	}
+	entry.lastLogged = now
+	entry.suppressed = 0
+}
+
+// Resolve ends the series of messages for key. If the message was repeated,
+// a summary such as "page 42 upload retried 17 times over 8m0s" is logged.
+func (l *repeatedLogger) Resolve(key string, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry, ok := l.entries[key]
+	if !ok {
+		return
+	}
+	delete(l.entries, key)
+
+	if entry.count > 1 {
+		log.Printf("%s retried %d times over %s\n",
+			key, entry.count, now.Sub(entry.first).Round(time.Second))
+	}
+}
+
+func trimNewline(s string) string {
+	if len(s) > 0 && s[len(s)-1] == '\n' {
+		return s[:len(s)-1]
+	}
+	return s
+}
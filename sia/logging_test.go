@@ -0,0 +1,64 @@
+package sia
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func captureLog(f func()) []string {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	f()
+	return strings.Split(strings.TrimSpace(buf.String()), "\n")
+}
+
+func TestRepeatedLogger(t *testing.T) {
+	logger := newRepeatedLogger(time.Minute)
+	now := time.Now()
+
+	lines := captureLog(func() {
+		for i := 0; i < 17; i++ {
+			logger.Printf("page 42 upload", now.Add(time.Duration(i)*30*time.Second),
+				"Uploading page %d\n", 42)
+		}
+		logger.Resolve("page 42 upload", now.Add(8*time.Minute))
+	})
+
+	assert.Equal(t, []string{
+		"Uploading page 42",
+		"Uploading page 42 (1 similar messages suppressed)",
+		"Uploading page 42 (1 similar messages suppressed)",
+		"Uploading page 42 (1 similar messages suppressed)",
+		"Uploading page 42 (1 similar messages suppressed)",
+		"Uploading page 42 (1 similar messages suppressed)",
+		"Uploading page 42 (1 similar messages suppressed)",
+		"Uploading page 42 (1 similar messages suppressed)",
+		"Uploading page 42 (1 similar messages suppressed)",
+		"page 42 upload retried 17 times over 8m0s",
+	}, lines)
+}
+
+func TestRepeatedLoggerSingleMessage(t *testing.T) {
+	logger := newRepeatedLogger(time.Minute)
+	now := time.Now()
+
+	lines := captureLog(func() {
+		logger.Printf("page 1 download", now, "Downloading page %d\n", 1)
+		logger.Resolve("page 1 download", now.Add(time.Second))
+		logger.Resolve("page 2 download", now.Add(time.Second))
+	})
+
+	assert.Equal(t, []string{"Downloading page 1"}, lines, "expected no summary for single message")
+}
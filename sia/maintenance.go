@@ -0,0 +1,140 @@
+package sia
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// MaintenanceStats describes the maintenance cycles so far. Duration
+	// includes the time spent waiting for the lock, which is where cycles
+	// get held up by long downloads.
+	MaintenanceStats struct {
+		Runs         uint64
+		Skipped      uint64
+		Failures     uint64
+		LastStart    time.Time
+		LastDuration time.Duration
+		LastLockWait time.Duration
+		MaxDuration  time.Duration
+
+		// ConsecutiveFailures counts the failed cycles since the last
+		// successful one, which failed with LastError.
+		ConsecutiveFailures int
+		LastError           string
+	}
+
+	// maintenanceSchedule runs maintenance every interval plus a random
+	// jitter of up to the given amount. A cycle that is due while the
+	// previous one is still running is skipped rather than queued, so that
+	// cycles do not pile up behind the lock. It keeps its own mutex, so
+	// that its statistics remain available while maintenance is stuck.
+	maintenanceSchedule struct {
+		interval time.Duration
+		jitter   time.Duration
+		running  int32
+
+		mutex sync.Mutex
+		stats MaintenanceStats
+	}
+)
+
+const maintenanceSkippedLogKey = "maintenance skipped"
+
+func newMaintenanceSchedule(interval time.Duration, jitter time.Duration) *maintenanceSchedule {
+	if interval <= 0 {
+		interval = waitInterval
+	}
+	return &maintenanceSchedule{
+		interval: interval,
+		jitter:   jitter,
+	}
+}
+
+// next returns how long to wait for the next cycle.
+func (s *maintenanceSchedule) next() time.Duration {
+	if s.jitter <= 0 {
+		return s.interval
+	}
+	return s.interval + time.Duration(rand.Int63n(int64(s.jitter)+1))
+}
+
+// maintenanceLoop triggers maintenance until the backend becomes
+// unavailable.
+func (b *Backend) maintenanceLoop() {
+	for {
+		b.sleep(b.schedule.next())
+
+		if !atomic.CompareAndSwapInt32(&b.schedule.running, 0, 1) {
+			b.schedule.mutex.Lock()
+			b.schedule.stats.Skipped += 1
+			started := b.schedule.stats.LastStart
+			b.schedule.mutex.Unlock()
+
+			b.logger.Printf(maintenanceSkippedLogKey, b.now(),
+				"Skipping maintenance, as the cycle started %s ago is still running\n",
+				b.now().Sub(started).Round(time.Second))
+			continue
+		}
+
+		if b.unavailable() {
+			return
+		}
+		go func() {
+			defer atomic.StoreInt32(&b.schedule.running, 0)
+			b.runMaintenance()
+		}()
+	}
+}
+
+// runMaintenance does one maintenance cycle and records how it went.
+func (b *Backend) runMaintenance() {
+	start := b.now()
+	b.schedule.mutex.Lock()
+	b.schedule.stats.LastStart = start
+	b.schedule.mutex.Unlock()
+
+	b.mutex.Lock()
+	lockWait := b.now().Sub(start)
+	err := b.maintenance()
+	b.mutex.Unlock()
+	duration := b.now().Sub(start)
+
+	b.schedule.mutex.Lock()
+	b.schedule.stats.Runs += 1
+	b.schedule.stats.LastDuration = duration
+	b.schedule.stats.LastLockWait = lockWait
+	if duration > b.schedule.stats.MaxDuration {
+		b.schedule.stats.MaxDuration = duration
+	}
+	if err != nil {
+		b.schedule.stats.Failures += 1
+		b.schedule.stats.ConsecutiveFailures += 1
+		b.schedule.stats.LastError = err.Error()
+	} else {
+		b.schedule.stats.ConsecutiveFailures = 0
+		b.schedule.stats.LastError = ""
+	}
+	b.schedule.mutex.Unlock()
+
+	b.mutex.Lock()
+	b.updateWritePause()
+	b.mutex.Unlock()
+
+	if err != nil {
+		b.logger.Printf("maintenance", b.now(), "Error while doing maintenance: %s\n", err)
+	} else {
+		b.logger.Resolve("maintenance", b.now())
+		b.logger.Resolve(maintenanceSkippedLogKey, b.now())
+	}
+}
+
+// MaintenanceStats reports on the maintenance cycles so far.
+func (b *Backend) MaintenanceStats() MaintenanceStats {
+	b.schedule.mutex.Lock()
+	defer b.schedule.mutex.Unlock()
+
+	return b.schedule.stats
+}
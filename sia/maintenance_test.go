@@ -0,0 +1,34 @@
+package sia
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenanceSchedule(t *testing.T) {
+	s := newMaintenanceSchedule(0, 0)
+	assert.Equal(t, waitInterval, s.next())
+
+	s = newMaintenanceSchedule(10*time.Second, 3*time.Second)
+	for i := 0; i < 100; i++ {
+		next := s.next()
+		assert.True(t, next >= 10*time.Second && next <= 13*time.Second, "unexpected interval %s", next)
+	}
+
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	b := newTestBackend(t, 4, "")
+	b.mutex = &sync.Mutex{}
+	b.clock = clock
+	b.logger = newRepeatedLogger(repeatedLogInterval)
+	b.schedule = s
+	b.state = unavailable
+
+	b.runMaintenance()
+	stats := b.MaintenanceStats()
+	assert.Equal(t, uint64(1), stats.Runs)
+	assert.Equal(t, uint64(0), stats.Failures)
+	assert.Equal(t, clock.Now(), stats.LastStart)
+}
@@ -0,0 +1,120 @@
+package sia
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/javgh/sia-nbdserver/config"
+	"go.sia.tech/renterd/worker"
+)
+
+// MigrateLayout moves the pages of a device that are not stored in the
+// given layout yet, including those in the trash, and returns how many
+// objects were moved. Objects are downloaded and uploaded again, one at a
+// time, as there is no way to rename them, with the upload parameters in
+// settings. The server must not be running for the device in the meantime.
+// An interrupted migration can be resumed.
+func MigrateLayout(settings BackendSettings, layout Layout) (int, error) {
+	uploadParameters := settings.UploadParameters.withDefaults()
+	err := uploadParameters.validate()
+	if err != nil {
+		return 0, err
+	}
+	uploadQuery := uploadParameters.query()
+
+	siaPass, err := config.ReadPasswordFile(settings.SiaPasswordFile)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	workerClient := worker.NewClient(fmt.Sprintf("http://%s/api/worker", settings.SiaDaemonAddress), siaPass)
+	info, err := readDeviceInfo(ctx, workerClient, settings.SiaPathPrefix)
+	if err != nil {
+		return 0, err
+	}
+	root := settings.SiaPathPrefix
+	if info != nil {
+		root = pageRoot(settings.SiaPathPrefix, *info)
+	}
+
+	flat, sharded, err := listLayouts(ctx, workerClient, root)
+	if err != nil {
+		return 0, err
+	}
+	pending := flat
+	if layout == LayoutFlat {
+		pending = sharded
+	}
+
+	dataLock, err := lockDataDirectory(settings.DataDirectory)
+	if err != nil {
+		return 0, err
+	}
+	defer dataLock.Close()
+
+	trash := newTrash(settings.DataDirectory, settings.TrashRetention)
+	err = trash.load(ctx, workerClient, settings.SiaPathPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, pageSize))
+	moved := 0
+	for _, remotePage := range pending {
+		siaPath := layout.siaPath(root, remotePage.page, remotePage.generation)
+		log.Printf("Moving %s to %s (%d of %d)\n", remotePage.siaPath, siaPath, moved+1, len(pending))
+
+		buf.Reset()
+		err = workerClient.DownloadObject(ctx, buf, remotePage.siaPath+shardParameters)
+		if err != nil {
+			return moved, err
+		}
+		err = workerClient.UploadObject(ctx, bytes.NewReader(buf.Bytes()), siaPath+uploadQuery)
+		if err != nil {
+			return moved, err
+		}
+
+		// the trash needs to point to the new object before the old one
+		// is gone, or it would be kept forever after an interruption
+		if entry, ok := trash.entries[remotePage.siaPath]; ok {
+			delete(trash.entries, remotePage.siaPath)
+			entry.SiaPath = siaPath
+			trash.entries[siaPath] = entry
+			err = storeTrash(ctx, workerClient, settings.SiaPathPrefix, trash)
+			if err != nil {
+				return moved, err
+			}
+		}
+
+		err = workerClient.DeleteObject(ctx, remotePage.siaPath)
+		if err != nil {
+			return moved, err
+		}
+		moved += 1
+	}
+	return moved, nil
+}
+
+// storeTrash saves the trash both locally and on Sia.
+func storeTrash(ctx context.Context, workerClient *worker.Client, siaPathPrefix string, t *trash) error {
+	err := os.MkdirAll(filepath.Dir(t.path), 0700)
+	if err != nil {
+		return err
+	}
+	err = t.save()
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(t.list())
+	if err != nil {
+		return err
+	}
+	return workerClient.UploadObject(ctx, bytes.NewReader(encoded), trashPath(siaPathPrefix)+shardParameters)
+}
@@ -0,0 +1,85 @@
+package sia
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.sia.tech/renterd/bus"
+	"go.sia.tech/renterd/worker"
+)
+
+type (
+	// remoteDevice is what is on Sia for a device at startup.
+	remoteDevice struct {
+		info   DeviceInfo
+		pages  []remotePage
+		layout Layout
+	}
+
+	// siaNode is one renterd node. All nodes are expected to share the
+	// same bus, so that they see the same objects; the first one is the
+	// primary, which is used whenever it is available.
+	siaNode struct {
+		address      string
+		workerClient *worker.Client
+		busClient    *bus.Client
+	}
+)
+
+func newSiaNode(address string, password string) siaNode {
+	return siaNode{
+		address:      address,
+		workerClient: worker.NewClient(fmt.Sprintf("http://%s/api/worker", address), password),
+		busClient:    bus.NewClient(fmt.Sprintf("http://%s/api/bus", address), password),
+	}
+}
+
+// firstAvailableNode returns the index of the first node that lists the
+// pages on Sia, along with what it found; see discoverDevice.
+func firstAvailableNode(ctx context.Context, nodes []siaNode, siaPathPrefix string,
+	layout Layout) (int, remoteDevice, error) {
+	var err error
+	for i, node := range nodes {
+		var device remoteDevice
+		device.info, device.pages, device.layout, err = discoverDevice(ctx, node.workerClient,
+			siaPathPrefix, layout)
+		if err == nil {
+			return i, device, nil
+		}
+		if len(nodes) > 1 {
+			log.Printf("Sia daemon at %s is unavailable: %s\n", node.address, err)
+		}
+	}
+	return 0, remoteDevice{}, err
+}
+
+// useNode sends all further requests to the given node. The mutex needs
+// to be held.
+func (b *Backend) useNode(i int) {
+	if i != b.activeNode {
+		log.Printf("Switching from Sia daemon at %s to %s\n", b.nodes[b.activeNode].address, b.nodes[i].address)
+	}
+	b.activeNode = i
+	b.workerClient = b.nodes[i].workerClient
+	b.busClient = b.nodes[i].busClient
+}
+
+// returnToPrimary switches back to the primary node once it answers again.
+// The mutex needs to be held.
+func (b *Backend) returnToPrimary(ctx context.Context) {
+	if b.activeNode == 0 {
+		return
+	}
+
+	now := b.now()
+	if now.Before(b.breaker.lastProbe.Add(b.breaker.probeInterval)) {
+		return
+	}
+	b.breaker.lastProbe = now
+
+	_, err := b.nodes[0].workerClient.ObjectEntries(ctx, metadataDirectory(b.siaPathPrefix)+"/")
+	if err == nil {
+		b.useNode(0)
+	}
+}
@@ -0,0 +1,525 @@
+package sia
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+type (
+	// packHeader tells which slots of a pack hold a page. A pack stores
+	// several consecutive pages in one object on Sia, the first of which
+	// names the object, so that small devices do not pay the overhead of
+	// a minimum-sized object for every page. It starts with packMagic,
+	// the number of slots and a byte per slot, followed by the stored
+	// pages in slot order. Pages that are not stored read as zeroes.
+	packHeader struct {
+		stored []bool
+	}
+
+	// packUpload is the pack uploaded for a page, with the page replaced
+	// by the data from its cache file and the other pages carried over
+	// from the previous pack, which is downloaded in the meantime. finish
+	// needs to be called once the upload is done.
+	packUpload struct {
+		io.Reader
+		header packHeader
+		finish func(uploadErr error) error
+	}
+
+	// packSection reads n bytes of a previous pack, failing if it ends
+	// early. With skip, they are consumed without being passed on.
+	packSection struct {
+		r    io.Reader
+		n    int64
+		skip bool
+	}
+
+	// unpacker passes on the pages of a pack written to it, each to the
+	// writer that dst returns for its slot; nil drops the page.
+	unpacker struct {
+		dst    func(slot int) io.Writer
+		prefix []byte
+		header *packHeader
+		slots  []int
+		size   int64
+		offset int64
+	}
+)
+
+const (
+	packMagic = "sianbdP1"
+
+	// maxPagesPerObject bounds the size of packs, as the whole pack is
+	// downloaded to read any of its pages.
+	maxPagesPerObject = 16
+)
+
+var errShortPackHeader = errors.New("pack ends within its header")
+
+// validatePagesPerObject checks the number of pages stored per object,
+// where 0 and 1 store every page on its own.
+func validatePagesPerObject(pagesPerObject int) error {
+	if pagesPerObject < 0 || pagesPerObject > maxPagesPerObject {
+		return fmt.Errorf("pages per object must be between 0 and %d", maxPagesPerObject)
+	}
+	return nil
+}
+
+// packOf returns the first page of the pack holding page, which is the page
+// itself unless pages are packed.
+func packOf(p page, pagesPerObject int) page {
+	if pagesPerObject <= 1 {
+		return p
+	}
+	return p - p%page(pagesPerObject)
+}
+
+func (cb *cacheBrain) packOf(p page) page {
+	return packOf(p, cb.pagesPerObject)
+}
+
+// uploadingPacks returns the packs that a page is being uploaded of. Only
+// one page of a pack may be uploaded at a time, as each upload carries over
+// the other pages from the previous pack.
+func (cb *cacheBrain) uploadingPacks() map[page]bool {
+	packs := make(map[page]bool)
+	for page := range cb.dirtyPages {
+		if cb.pages.state(page) == cachedUploading {
+			packs[cb.packOf(page)] = true
+		}
+	}
+	return packs
+}
+
+func (b *Backend) packOf(p page) page {
+	return packOf(p, b.device.PagesPerObject)
+}
+
+// packed reports whether several pages are stored per object.
+func (b *Backend) packed() bool {
+	return b.device.PagesPerObject > 1
+}
+
+// expandPacks turns the generations of the packs on Sia into those of the
+// pages they hold, so that the pages of a pack share their generation. Which
+// slots a pack stores is not known from the listing; until it is, every page
+// of the pack counts as stored.
+func expandPacks(generations map[page]int, pagesPerObject int, pageCount int) map[page]int {
+	if pagesPerObject <= 1 {
+		return generations
+	}
+
+	expanded := make(map[page]int)
+	for first, generation := range generations {
+		for p := first; p < first+page(pagesPerObject) && int64(p) < int64(pageCount); p++ {
+			expanded[p] = generation
+		}
+	}
+	return expanded
+}
+
+// packUploaded moves the other pages of the pack of page to the generation
+// just uploaded. Those stored in it are on Sia from now on, while the empty
+// slots stay zero. The mutex needs to be held.
+func (b *Backend) packUploaded(p page, generation int) {
+	if !b.packed() {
+		return
+	}
+
+	first := b.packOf(p)
+	stored := b.cache.pages.get(p).uploadingSlots
+	for other := first; other < first+page(b.device.PagesPerObject); other++ {
+		if other == p || int64(other) >= int64(b.cache.pageCount) {
+			continue
+		}
+		b.cache.pages.get(other).generation = generation
+		if stored != nil && !stored[other-first] {
+			continue
+		}
+		b.cache.setOnSia(other)
+		if b.cache.brain.pages.state(other) == zero {
+			b.cache.brain.setState(other, notCached)
+		}
+	}
+}
+
+// packSlotsSeen turns the other pages in the empty slots of the pack of page,
+// just downloaded at generation, back into zero pages, as they were counted
+// as stored while the header of the pack was unknown. The mutex needs to be
+// held.
+func (b *Backend) packSlotsSeen(p page, generation int, header packHeader) {
+	first := b.packOf(p)
+	for slot, stored := range header.stored {
+		other := first + page(slot)
+		details, ok := b.cache.pages[other]
+		if stored || other == p || !ok || !details.onSia || details.generation != generation {
+			continue
+		}
+		details.onSia = false
+		b.cache.remotePages -= 1
+		if b.cache.brain.pages.state(other) == notCached {
+			b.cache.brain.setState(other, zero)
+		}
+	}
+}
+
+// forgetEmptySlots makes the pages zero that an epoch marker shows to be in
+// empty slots of the current generation of their pack, as every page stored
+// in a pack is listed in the marker under its generation. Packs that have
+// been uploaded since the marker are left alone. The mutex needs to be held.
+func (b *Backend) forgetEmptySlots(generations map[page]int) {
+	if !b.packed() {
+		return
+	}
+
+	recorded := make(map[page]int)
+	for p, generation := range generations {
+		recorded[b.packOf(p)] = generation
+	}
+	for p, details := range b.cache.pages {
+		generation, ok := recorded[b.packOf(p)]
+		if !details.onSia || !ok || generation != details.generation {
+			continue
+		}
+		if listed, ok := generations[p]; ok && listed == generation {
+			continue
+		}
+		details.onSia = false
+		b.cache.remotePages -= 1
+		if b.cache.brain.pages.state(p) == notCached {
+			b.cache.brain.setState(p, zero)
+		}
+	}
+}
+
+// packOnSia reports whether the pack of page has been uploaded, which is the
+// case once any page is stored in it. The mutex needs to be held.
+func (b *Backend) packOnSia(p page) bool {
+	first := b.packOf(p)
+	for other := first; other < first+page(b.device.PagesPerObject); other++ {
+		if details, ok := b.cache.pages[other]; ok && details.onSia {
+			return true
+		}
+	}
+	return false
+}
+
+func newPackHeader(slots int) packHeader {
+	return packHeader{stored: make([]bool, slots)}
+}
+
+func (h packHeader) encode() []byte {
+	encoded := make([]byte, len(packMagic)+4, len(packMagic)+4+len(h.stored))
+	copy(encoded, packMagic)
+	binary.BigEndian.PutUint32(encoded[len(packMagic):], uint32(len(h.stored)))
+	for _, stored := range h.stored {
+		if stored {
+			encoded = append(encoded, 1)
+		} else {
+			encoded = append(encoded, 0)
+		}
+	}
+	return encoded
+}
+
+// parsePackHeader parses the header at the start of buf and returns it
+// along with its size. It returns errShortPackHeader if buf does not hold
+// all of it yet.
+func parsePackHeader(buf []byte) (packHeader, int, error) {
+	fixed := len(packMagic) + 4
+	if len(buf) < fixed {
+		return packHeader{}, 0, errShortPackHeader
+	}
+	if string(buf[:len(packMagic)]) != packMagic {
+		return packHeader{}, 0, errors.New("object is not a pack")
+	}
+	slots := binary.BigEndian.Uint32(buf[len(packMagic):fixed])
+	if slots == 0 || slots > maxPagesPerObject {
+		return packHeader{}, 0, fmt.Errorf("pack has an invalid number of slots (%d)", slots)
+	}
+	size := fixed + int(slots)
+	if len(buf) < size {
+		return packHeader{}, 0, errShortPackHeader
+	}
+
+	header := newPackHeader(int(slots))
+	for i := range header.stored {
+		switch buf[fixed+i] {
+		case 0:
+		case 1:
+			header.stored[i] = true
+		default:
+			return packHeader{}, 0, fmt.Errorf("pack has an invalid flag for slot %d", i)
+		}
+	}
+	return header, size, nil
+}
+
+func readPackHeader(r io.Reader) (packHeader, error) {
+	buf := make([]byte, len(packMagic)+4)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return packHeader{}, err
+	}
+	_, _, err = parsePackHeader(buf)
+	if err != errShortPackHeader {
+		return packHeader{}, err
+	}
+
+	flags := make([]byte, binary.BigEndian.Uint32(buf[len(packMagic):]))
+	_, err = io.ReadFull(r, flags)
+	if err != nil {
+		return packHeader{}, err
+	}
+	header, _, err := parsePackHeader(append(buf, flags...))
+	return header, err
+}
+
+// storedPages returns the number of pages stored in the pack.
+func (h packHeader) storedPages() int {
+	count := 0
+	for _, stored := range h.stored {
+		if stored {
+			count += 1
+		}
+	}
+	return count
+}
+
+// packSize returns the size of a pack with this header.
+func (h packHeader) packSize() int64 {
+	return int64(len(h.encode())) + int64(h.storedPages())*pageSize
+}
+
+func (s *packSection) Read(buf []byte) (int, error) {
+	if s.skip && s.n > 0 {
+		_, err := io.CopyN(ioutil.Discard, s.r, s.n)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		s.n = 0
+	}
+	if s.n == 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(buf)) > s.n {
+		buf = buf[:s.n]
+	}
+	n, err := s.r.Read(buf)
+	s.n -= int64(n)
+	if err == io.EOF {
+		err = nil
+		if s.n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// repack returns the pack with data as the page in slot and the other pages
+// carried over from the previous pack, along with its header. Without a
+// previous pack, the pack has the given number of slots and only stores
+// data. Pages in slots from keep on lie beyond the end of the device and are
+// dropped.
+func repack(previous io.Reader, slots int, slot int, data io.Reader, keep int) (io.Reader, packHeader, error) {
+	header := newPackHeader(slots)
+	if previous != nil {
+		var err error
+		header, err = readPackHeader(previous)
+		if err != nil {
+			return nil, packHeader{}, err
+		}
+	}
+	if slot >= len(header.stored) {
+		return nil, packHeader{}, fmt.Errorf("pack only has %d slots", len(header.stored))
+	}
+
+	updated := newPackHeader(len(header.stored))
+	readers := []io.Reader{nil}
+	for i, stored := range header.stored {
+		switch {
+		case i == slot:
+			if stored {
+				readers = append(readers, &packSection{r: previous, n: pageSize, skip: true})
+			}
+			readers = append(readers, data)
+			updated.stored[i] = true
+		case stored && i < keep:
+			readers = append(readers, &packSection{r: previous, n: pageSize})
+			updated.stored[i] = true
+		case stored:
+			readers = append(readers, &packSection{r: previous, n: pageSize, skip: true})
+		}
+	}
+	readers[0] = bytes.NewReader(updated.encode())
+	return io.MultiReader(readers...), updated, nil
+}
+
+// packSource returns the pack to upload for a new generation of page, with
+// data as the page. The previous pack is verified against the integrity
+// manifest once it has been read in full. The mutex needs to be held.
+func (b *Backend) packSource(ctx context.Context, p page, data io.Reader) (*packUpload, error) {
+	first := b.packOf(p)
+	slot := int(p - first)
+	keep := b.cache.pageCount - int(first)
+	details := b.cache.pages.get(p)
+	if !b.packOnSia(p) {
+		// none of the pages of the pack have been uploaded yet
+		src, header, err := repack(nil, b.device.PagesPerObject, slot, data, keep)
+		if err != nil {
+			return nil, err
+		}
+		return &packUpload{
+			Reader: src,
+			header: header,
+			finish: func(uploadErr error) error { return uploadErr },
+		}, nil
+	}
+
+	siaPath := b.asSiaPath(p, details.generation)
+	pr, pw := io.Pipe()
+	downloaded := make(chan error, 1)
+	go func() {
+		err := b.workerClient.DownloadObject(ctx, pw, siaPath+shardParameters)
+		pw.CloseWithError(err)
+		downloaded <- err
+	}()
+	abort := func(err error) error {
+		pr.Close()
+		<-downloaded
+		return err
+	}
+
+	var previous io.Reader = pr
+	var tagger hash.Hash
+	if b.integrity != nil {
+		tagger = b.integrity.tagger(first, details.generation)
+		previous = io.TeeReader(pr, tagger)
+	}
+
+	src, header, err := repack(previous, b.device.PagesPerObject, slot, data, keep)
+	if err != nil {
+		return nil, abort(fmt.Errorf("unable to read pack of page %d: %s", p, err))
+	}
+
+	return &packUpload{
+		Reader: src,
+		header: header,
+		finish: func(uploadErr error) error {
+			if uploadErr != nil {
+				return abort(uploadErr)
+			}
+
+			_, err := io.Copy(ioutil.Discard, previous)
+			downloadErr := <-downloaded
+			if err == nil {
+				err = downloadErr
+			}
+			if err == nil && tagger != nil {
+				err = b.verifyDownload(first, details.generation, tagger.Sum(nil))
+			}
+			if err != nil {
+				return fmt.Errorf("unable to read pack of page %d: %s", p, err)
+			}
+			return nil
+		},
+	}, nil
+}
+
+func newUnpacker(dst func(slot int) io.Writer) *unpacker {
+	return &unpacker{dst: dst}
+}
+
+// slotWriter returns an unpacker that passes on the page in one slot only.
+func slotWriter(dst io.Writer, slot int) *unpacker {
+	return newUnpacker(func(s int) io.Writer {
+		if s == slot {
+			return dst
+		}
+		return nil
+	})
+}
+
+func (u *unpacker) Write(buf []byte) (int, error) {
+	n := len(buf)
+	if u.header == nil {
+		u.prefix = append(u.prefix, buf...)
+		header, size, err := parsePackHeader(u.prefix)
+		if err == errShortPackHeader {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		u.header = &header
+		u.size = int64(size)
+		for slot, stored := range header.stored {
+			if stored {
+				u.slots = append(u.slots, slot)
+			}
+		}
+		buf = u.prefix[size:]
+		u.prefix = nil
+		u.offset = u.size
+	}
+
+	for len(buf) > 0 {
+		position := u.offset - u.size
+		index := position / pageSize
+		if index >= int64(len(u.slots)) {
+			return 0, errors.New("pack is longer than its header says")
+		}
+		chunk := buf[:min64(int64(len(buf)), pageSize-position%pageSize)]
+		if dst := u.dst(u.slots[index]); dst != nil {
+			_, err := dst.Write(chunk)
+			if err != nil {
+				return 0, err
+			}
+		}
+		u.offset += int64(len(chunk))
+		buf = buf[len(chunk):]
+	}
+	return n, nil
+}
+
+// finish checks that the whole pack has been written.
+func (u *unpacker) finish() error {
+	if u.header == nil {
+		return errShortPackHeader
+	}
+	if u.offset != u.header.packSize() {
+		return fmt.Errorf("pack holds %d bytes instead of %d", u.offset, u.header.packSize())
+	}
+	return nil
+}
+
+// stores reports whether the pack holds a page in slot. It must only be
+// called once the pack is finished.
+func (u *unpacker) stores(slot int) bool {
+	return slot < len(u.header.stored) && u.header.stored[slot]
+}
+
+// finishSlot finishes the pack and writes zeroes to dst if slot is empty,
+// for a slotWriter.
+func (u *unpacker) finishSlot(dst io.Writer, slot int) error {
+	err := u.finish()
+	if err != nil || u.stores(slot) {
+		return err
+	}
+	if slot >= len(u.header.stored) {
+		return fmt.Errorf("pack only has %d slots", len(u.header.stored))
+	}
+	_, err = io.CopyN(dst, zeroReader{}, pageSize)
+	return err
+}
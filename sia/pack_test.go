@@ -0,0 +1,289 @@
+package sia
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	repeatReader byte
+
+	// pageChecker checks that everything written to it is value.
+	pageChecker struct {
+		value byte
+		n     int64
+		wrong bool
+	}
+)
+
+func (r repeatReader) Read(buf []byte) (int, error) {
+	for i := range buf {
+		buf[i] = byte(r)
+	}
+	return len(buf), nil
+}
+
+func filledPage(value byte) io.Reader {
+	return io.LimitReader(repeatReader(value), pageSize)
+}
+
+func (c *pageChecker) Write(buf []byte) (int, error) {
+	for _, b := range buf {
+		if b != c.value {
+			c.wrong = true
+		}
+	}
+	c.n += int64(len(buf))
+	return len(buf), nil
+}
+
+func readPack(t *testing.T, src io.Reader, size int64) []byte {
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, size, int64(buf.Len()))
+	return buf.Bytes()
+}
+
+func TestPackHeader(t *testing.T) {
+	header := newPackHeader(4)
+	header.stored[1] = true
+	header.stored[3] = true
+	encoded := header.encode()
+
+	parsed, size, err := parsePackHeader(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, len(encoded), size)
+	assert.Equal(t, header.stored, parsed.stored)
+	assert.Equal(t, 2, parsed.storedPages())
+	assert.Equal(t, int64(len(encoded))+2*pageSize, parsed.packSize())
+
+	_, _, err = parsePackHeader(encoded[:len(encoded)-1])
+	assert.Equal(t, errShortPackHeader, err)
+	parsed, err = readPackHeader(bytes.NewReader(encoded))
+	assert.Nil(t, err)
+	assert.Equal(t, header.stored, parsed.stored)
+
+	_, _, err = parsePackHeader(append([]byte("notapack"), encoded[len(packMagic):]...))
+	assert.NotNil(t, err)
+	assert.NotNil(t, validatePagesPerObject(maxPagesPerObject+1))
+	assert.Nil(t, validatePagesPerObject(0))
+}
+
+func TestRepack(t *testing.T) {
+	src, updated, err := repack(nil, 4, 1, filledPage(1), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := readPack(t, src, updated.packSize())
+	assert.Equal(t, []bool{false, true, false, false}, updated.stored)
+
+	// page 0 reads as zeroes, page 1 as stored
+	zeroes := &pageChecker{}
+	u := slotWriter(zeroes, 0)
+	_, err = u.Write(first)
+	assert.Nil(t, err)
+	assert.Nil(t, u.finishSlot(zeroes, 0))
+	assert.Equal(t, int64(pageSize), zeroes.n)
+	assert.False(t, zeroes.wrong)
+
+	src, updated, err = repack(bytes.NewReader(first), 4, 2, filledPage(2), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := readPack(t, src, updated.packSize())
+
+	checkers := map[int]*pageChecker{1: {value: 1}, 2: {value: 2}}
+	u = newUnpacker(func(slot int) io.Writer {
+		if checker, ok := checkers[slot]; ok {
+			return checker
+		}
+		t.Fatalf("unexpected data for slot %d", slot)
+		return nil
+	})
+	// written in odd chunks, as downloads are
+	for offset := 0; offset < len(second); offset += 7 * 1024 * 1024 {
+		end := offset + 7*1024*1024
+		if end > len(second) {
+			end = len(second)
+		}
+		_, err = u.Write(second[offset:end])
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, u.finish())
+	assert.False(t, u.stores(0))
+	assert.True(t, u.stores(1))
+	for slot, checker := range checkers {
+		assert.Equal(t, int64(pageSize), checker.n, "slot %d", slot)
+		assert.False(t, checker.wrong, "slot %d", slot)
+	}
+
+	// page 2 lies beyond the end of a device shrunk to two pages
+	src, updated, err = repack(bytes.NewReader(second), 4, 1, filledPage(3), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third := readPack(t, src, updated.packSize())
+	header, _, err := parsePackHeader(third)
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{false, true, false, false}, header.stored)
+	assert.Equal(t, header.stored, updated.stored)
+
+	u = slotWriter(&pageChecker{}, 0)
+	_, err = u.Write(second[:len(second)-1])
+	assert.Nil(t, err)
+	assert.NotNil(t, u.finish(), "expected a truncated pack to be an error")
+
+	src, _, err = repack(bytes.NewReader(second[:len(second)-1]), 4, 1, filledPage(3), 4)
+	assert.Nil(t, err)
+	_, err = io.Copy(&bytes.Buffer{}, src)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestExpandPacks(t *testing.T) {
+	generations := map[page]int{0: 2, 4: 1}
+	assert.Equal(t, generations, expandPacks(generations, 1, 10))
+	assert.Equal(t, map[page]int{0: 2, 1: 2, 2: 2, 3: 2, 4: 1, 5: 1}, expandPacks(generations, 4, 6))
+}
+
+func TestPackUploadsSerialized(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	cb, err := newCacheBrain(10, 8, 6, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb.pagesPerObject = 4
+	for _, page := range []page{1, 2, 5} {
+		cb.prepareAccess(page, true, now)
+	}
+
+	uploads := []page{}
+	for _, action := range cb.maintenance(now.Add(time.Minute)) {
+		if action.actionType == startUpload {
+			uploads = append(uploads, action.page)
+		}
+	}
+	assert.Equal(t, []page{1, 5}, uploads)
+	assert.Nil(t, cb.checkInvariants())
+
+	cb.uploadComplete(1, now.Add(time.Minute))
+	uploads = []page{}
+	for _, action := range cb.maintenance(now.Add(2 * time.Minute)) {
+		if action.actionType == startUpload {
+			uploads = append(uploads, action.page)
+		}
+	}
+	assert.Equal(t, []page{2}, uploads)
+
+	cb.setState(1, cachedUploading)
+	assert.NotNil(t, cb.checkInvariants(), "expected two uploads of a pack to be an error")
+}
+
+func TestPackUploaded(t *testing.T) {
+	b := newTestBackend(t, 6, "")
+	b.device.PagesPerObject = 4
+	b.cache.brain.pagesPerObject = 4
+	b.pageRoot = "nbd"
+	assert.Equal(t, b.asSiaPath(4, 1), b.asSiaPath(5, 1))
+
+	b.cache.brain.setState(page(5), cachedUploading)
+	b.cache.brain.uploadComplete(5, time.Now())
+	b.cache.pages.get(5).file = os.Stdin
+	b.cache.pages.get(5).generation = 1
+	b.cache.setOnSia(5)
+	b.packUploaded(5, 1)
+
+	assert.Equal(t, notCached, b.cache.brain.pages.state(4))
+	assert.Equal(t, 1, b.cache.pages.get(4).generation)
+	assert.True(t, b.cache.pages.get(4).onSia)
+	assert.Equal(t, zero, b.cache.brain.pages.state(3))
+	_, ok := b.cache.pages[6]
+	assert.False(t, ok, "expected pages beyond the end to be left alone")
+	assert.Equal(t, 2, b.cache.remotePages)
+	assert.Nil(t, b.checkInvariants())
+}
+
+func TestPackUploadedEmptySlots(t *testing.T) {
+	b := newTestBackend(t, 8, "")
+	b.device.PagesPerObject = 4
+	b.cache.brain.pagesPerObject = 4
+
+	b.cache.brain.setState(page(5), cachedUploading)
+	b.cache.brain.uploadComplete(5, time.Now())
+	b.cache.pages.get(5).file = os.Stdin
+	b.cache.pages.get(5).generation = 1
+	b.cache.pages.get(5).uploadingSlots = []bool{false, true, false, false}
+	b.cache.setOnSia(5)
+	b.packUploaded(5, 1)
+
+	for _, p := range []page{4, 6, 7} {
+		assert.Equal(t, zero, b.cache.brain.pages.state(p), "page %d", p)
+		assert.False(t, b.cache.pages.get(p).onSia, "page %d", p)
+		assert.Equal(t, 1, b.cache.pages.get(p).generation, "page %d", p)
+	}
+	assert.Equal(t, 1, b.cache.remotePages)
+	assert.Equal(t, 1, b.cache.brain.allocatedCount)
+	assert.True(t, b.packOnSia(6), "expected the pack to be on Sia through page 5")
+	assert.False(t, b.packOnSia(2))
+	assert.Nil(t, b.checkInvariants())
+}
+
+func TestPackSlotsSeen(t *testing.T) {
+	b := newTestBackend(t, 8, "")
+	b.device.PagesPerObject = 4
+	b.cache.brain.pagesPerObject = 4
+
+	// as after startup, before the header of the pack is known
+	for p, generation := range expandPacks(map[page]int{4: 2}, 4, 8) {
+		b.cache.brain.setState(p, notCached)
+		b.cache.pages.get(p).generation = generation
+		b.cache.setOnSia(p)
+	}
+	assert.Equal(t, 4, b.cache.remotePages)
+
+	header := newPackHeader(4)
+	header.stored[1] = true
+	b.packSlotsSeen(5, 1, header)
+	assert.Equal(t, 4, b.cache.remotePages, "expected a stale generation to be ignored")
+
+	b.packSlotsSeen(4, 2, header)
+	assert.Equal(t, notCached, b.cache.brain.pages.state(4), "expected the downloaded page to be left alone")
+	assert.Equal(t, notCached, b.cache.brain.pages.state(5))
+	for _, p := range []page{6, 7} {
+		assert.Equal(t, zero, b.cache.brain.pages.state(p), "page %d", p)
+		assert.False(t, b.cache.pages.get(p).onSia, "page %d", p)
+	}
+	assert.Equal(t, 2, b.cache.remotePages)
+	assert.Nil(t, b.checkInvariants())
+}
+
+func TestForgetEmptySlots(t *testing.T) {
+	b := newTestBackend(t, 8, "")
+	b.device.PagesPerObject = 4
+	b.cache.brain.pagesPerObject = 4
+
+	for p, generation := range expandPacks(map[page]int{0: 3, 4: 2}, 4, 8) {
+		b.cache.brain.setState(p, notCached)
+		b.cache.pages.get(p).generation = generation
+		b.cache.setOnSia(p)
+	}
+
+	// the pack of pages 0 to 3 has been uploaded again since the marker
+	b.forgetEmptySlots(map[page]int{1: 2, 5: 2, 6: 2})
+	for _, p := range []page{0, 1, 2, 3, 5, 6} {
+		assert.Equal(t, notCached, b.cache.brain.pages.state(p), "page %d", p)
+	}
+	for _, p := range []page{4, 7} {
+		assert.Equal(t, zero, b.cache.brain.pages.state(p), "page %d", p)
+		assert.False(t, b.cache.pages.get(p).onSia, "page %d", p)
+	}
+	assert.Equal(t, 6, b.cache.remotePages)
+	assert.Nil(t, b.checkInvariants())
+}
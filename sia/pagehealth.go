@@ -0,0 +1,124 @@
+package sia
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+type (
+	// PageHealth is the redundancy of a page on Sia as last seen, along
+	// with earlier samples, oldest first, to show whether it is degrading.
+	PageHealth struct {
+		Page       int                `json:"page"`
+		Redundancy float64            `json:"redundancy"`
+		CheckedAt  time.Time          `json:"checked_at"`
+		History    []RedundancySample `json:"history"`
+	}
+
+	// RedundancySample is the redundancy of a page at a point in time.
+	RedundancySample struct {
+		At         time.Time `json:"at"`
+		Redundancy float64   `json:"redundancy"`
+	}
+)
+
+const (
+	// pageHealthBatch is the number of pages whose redundancy is sampled
+	// in each maintenance cycle, in turn, so that the whole device is
+	// covered eventually without querying every object each time.
+	pageHealthBatch = 16
+	// pageHealthHistory is the number of samples kept per page.
+	pageHealthHistory = 8
+)
+
+// recordRedundancy keeps a redundancy sample for a page. The mutex needs to
+// be held.
+func (b *Backend) recordRedundancy(page page, redundancy float64) {
+	details := b.cache.pages.get(page)
+	details.redundancyHistory = append(details.redundancyHistory, RedundancySample{
+		At:         b.now(),
+		Redundancy: redundancy,
+	})
+	if len(details.redundancyHistory) > pageHealthHistory {
+		details.redundancyHistory = details.redundancyHistory[1:]
+	}
+}
+
+// samplePageHealth samples the redundancy of the next few pages on Sia.
+// The mutex needs to be held.
+func (b *Backend) samplePageHealth(ctx context.Context) error {
+	remote := []page{}
+	for page, details := range b.cache.pages {
+		if details.onSia {
+			remote = append(remote, page)
+		}
+	}
+	if len(remote) == 0 {
+		return nil
+	}
+	sort.Slice(remote, func(i, j int) bool {
+		return remote[i] < remote[j]
+	})
+
+	start := sort.Search(len(remote), func(i int) bool {
+		return remote[i] >= b.healthCursor
+	})
+	hosts, err := b.activeHosts(ctx)
+	if err != nil {
+		return b.recordSia(err)
+	}
+	surviving := b.contracts.survivingHosts(hosts)
+
+	for i := 0; i < pageHealthBatch && i < len(remote); i++ {
+		page := remote[(start+i)%len(remote)]
+		siaPath := b.asSiaPath(page, b.cache.pages.get(page).generation)
+		o, _, err := b.busClient.Object(ctx, siaPath)
+		if err != nil {
+			return b.recordSia(err)
+		}
+		b.recordRedundancy(page, objectRedundancy(o, hosts))
+
+		// a page is at risk if it relies on contracts about to end
+		if len(b.contracts.expiring) > 0 && objectRedundancy(o, surviving) < 1 {
+			b.contracts.atRisk[page] = true
+		} else {
+			delete(b.contracts.atRisk, page)
+		}
+		b.healthCursor = page + 1
+	}
+	return nil
+}
+
+// WorstPages returns up to count pages with the lowest redundancy last
+// seen, lowest first.
+func (b *Backend) WorstPages(count int) []PageHealth {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	health := []PageHealth{}
+	for page, details := range b.cache.pages {
+		if !details.onSia || len(details.redundancyHistory) == 0 {
+			continue
+		}
+
+		last := details.redundancyHistory[len(details.redundancyHistory)-1]
+		health = append(health, PageHealth{
+			Page:       int(page),
+			Redundancy: last.Redundancy,
+			CheckedAt:  last.At,
+			History:    append([]RedundancySample{}, details.redundancyHistory...),
+		})
+	}
+	sort.Slice(health, func(i, j int) bool {
+		if health[i].Redundancy == health[j].Redundancy {
+			return health[i].Page < health[j].Page
+		}
+		return health[i].Redundancy < health[j].Redundancy
+	})
+
+	if len(health) > count {
+		health = health[:count]
+	}
+	return health
+}
@@ -0,0 +1,37 @@
+package sia
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorstPages(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	b := newTestBackend(t, 10, "")
+	b.mutex = &sync.Mutex{}
+	b.clock = clock
+
+	for _, page := range []page{1, 2, 3} {
+		b.cache.setOnSia(page)
+	}
+	b.recordRedundancy(page(1), 3)
+	b.recordRedundancy(page(2), 2.5)
+	for i := 0; i < pageHealthHistory+2; i++ {
+		clock.Sleep(time.Minute)
+		b.recordRedundancy(page(3), 3-float64(i)/10)
+	}
+
+	worst := b.WorstPages(2)
+	assert.Equal(t, 2, len(worst))
+	assert.Equal(t, 3, worst[0].Page)
+	assert.InDelta(t, 2.1, worst[0].Redundancy, 0.001)
+	assert.Equal(t, clock.Now(), worst[0].CheckedAt)
+	assert.Equal(t, pageHealthHistory, len(worst[0].History), "expected only the latest samples to be kept")
+	assert.InDelta(t, 2.8, worst[0].History[0].Redundancy, 0.001)
+	assert.Equal(t, 2, worst[1].Page)
+
+	assert.Equal(t, 3, len(b.WorstPages(10)))
+}
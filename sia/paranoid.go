@@ -0,0 +1,126 @@
+package sia
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+// checkInvariants verifies the invariants of the cache brain and that the
+// cache file of a page is open exactly while the page is cached. The mutex
+// needs to be held.
+func (b *Backend) checkInvariants() error {
+	err := b.cache.brain.checkInvariants()
+	if err != nil {
+		return err
+	}
+
+	for page, details := range b.cache.pages {
+		if details.file != nil && !isCached(b.cache.brain.pages.state(page)) {
+			return fmt.Errorf("page %d in state %s has its cache file open",
+				page, b.cache.brain.pages.state(page))
+		}
+	}
+	for page := range b.cache.brain.cachedPages {
+		if details, ok := b.cache.pages[page]; !ok || details.file == nil {
+			return fmt.Errorf("page %d in state %s has no cache file open",
+				page, b.cache.brain.pages.state(page))
+		}
+	}
+	return nil
+}
+
+// assertInvariants crashes with a dump of the state if an invariant does not
+// hold after a batch of actions, but only in paranoid mode, as it looks at
+// every touched page. The mutex needs to be held.
+func (b *Backend) assertInvariants() {
+	if !b.paranoid {
+		return
+	}
+	err := b.checkInvariants()
+	if err != nil {
+		b.invariantViolated(err.Error(), nil)
+	}
+}
+
+// assertUniqueActions crashes with a dump of the state if the cache brain
+// asked for the same action on the same page twice in one batch, but only in
+// paranoid mode. The mutex needs to be held.
+func (b *Backend) assertUniqueActions(actions []action) {
+	if !b.paranoid {
+		return
+	}
+	seen := make(map[action]bool)
+	for _, action := range actions {
+		if seen[action] {
+			b.invariantViolated(fmt.Sprintf("action %s for page %d emitted twice",
+				actionSpanNames[action.actionType], action.page), actions)
+		}
+		seen[action] = true
+	}
+}
+
+func (b *Backend) invariantViolated(reason string, actions []action) {
+	var dump bytes.Buffer
+	b.writeCacheState(&dump)
+	if len(actions) > 0 {
+		fmt.Fprintf(&dump, "actions:\n")
+		for _, action := range actions {
+			fmt.Fprintf(&dump, "  %s page %d\n", actionSpanNames[action.actionType], action.page)
+		}
+	}
+	log.Printf("Invariant violated: %s\n%s", reason, dump.String())
+	panic("invariant violated: " + reason)
+}
+
+// writeCacheState writes the counters of the cache brain and the details of
+// every touched page in a form meant for debugging. The mutex needs to be
+// held.
+func (b *Backend) writeCacheState(w io.Writer) {
+	cb := b.cache.brain
+	fmt.Fprintf(w, "pages: %d, cached: %d (index %d), dirty: %d, allocated: %d\n",
+		cb.pageCount, cb.cacheCount, len(cb.cachedPages), len(cb.dirtyPages), cb.allocatedCount)
+	fmt.Fprintf(w, "hard limit: %d, soft limit: %d, write reserve: %d, read overflow: %d, extra: %d\n",
+		cb.hardMaxCached, cb.softMaxCached, cb.writeReserve, cb.readOverflow, cb.extraCapacity)
+	fmt.Fprintf(w, "epoch: %d, uploads held: %t\n", cb.epoch, cb.uploadsHeld)
+
+	pages := []page{}
+	for page := range cb.pages {
+		pages = append(pages, page)
+	}
+	for page := range b.cache.pages {
+		if _, ok := cb.pages[page]; !ok {
+			pages = append(pages, page)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i] < pages[j]
+	})
+
+	for _, page := range pages {
+		fmt.Fprintf(w, "page %d: %s", page, cb.pages.state(page))
+		if details, ok := cb.pages[page]; ok {
+			fmt.Fprintf(w, ", last access %s", details.lastAccess.Format(time.RFC3339))
+			if !details.dirtySince.IsZero() {
+				fmt.Fprintf(w, ", dirty since %s (epoch %d)", details.dirtySince.Format(time.RFC3339),
+					details.dirtyEpoch)
+			}
+			if details.uploadRequested {
+				fmt.Fprintf(w, ", upload requested")
+			}
+		}
+		if details, ok := b.cache.pages[page]; ok {
+			fmt.Fprintf(w, ", file open: %t, generation %d", details.file != nil, details.generation)
+			if details.uploadingGeneration > details.generation {
+				fmt.Fprintf(w, ", uploading generation %d", details.uploadingGeneration)
+			}
+			if details.uploadFailures > 0 {
+				fmt.Fprintf(w, ", %d failed upload(s): %s", details.uploadFailures, details.lastUploadError)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,44 @@
+package sia
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParanoid(t *testing.T) {
+	b := newTestBackend(t, 4, "")
+	assert.Nil(t, b.checkInvariants())
+
+	// a cached page needs its cache file open, and only a cached one
+	b.cache.brain.setState(page(1), cachedChanged)
+	assert.NotNil(t, b.checkInvariants())
+	assert.Panics(t, func() { b.assertInvariants() })
+	b.cache.pages.get(1).file = os.Stdin
+	assert.Nil(t, b.checkInvariants())
+	b.cache.pages.get(2).file = os.Stdin
+	assert.NotNil(t, b.checkInvariants())
+	b.cache.pages.get(2).file = nil
+
+	b.cache.brain.cacheCount = 2
+	assert.NotNil(t, b.checkInvariants(), "expected the cache count to be checked")
+	b.cache.brain.cacheCount = 1
+
+	assert.NotPanics(t, func() {
+		b.assertUniqueActions([]action{{actionType: openFile, page: 1}, {actionType: zeroCache, page: 1}})
+	})
+	assert.Panics(t, func() {
+		b.assertUniqueActions([]action{{actionType: openFile, page: 1}, {actionType: openFile, page: 1}})
+	})
+
+	b.paranoid = false
+	b.cache.brain.cacheCount = 2
+	assert.NotPanics(t, func() { b.assertInvariants() })
+
+	var dump bytes.Buffer
+	b.writeCacheState(&dump)
+	assert.Contains(t, dump.String(), "page 1: dirty")
+	assert.Contains(t, dump.String(), "file open: true")
+}
@@ -0,0 +1,47 @@
+package sia
+
+import "os"
+
+// DefaultCacheFileMode keeps the cache files private to the server.
+const DefaultCacheFileMode os.FileMode = 0600
+
+// directoryMode adds search permission wherever mode allows reading, so
+// that whoever may read the cache files can also reach them.
+func directoryMode(mode os.FileMode) os.FileMode {
+	return mode | (mode&0444)>>2
+}
+
+// cacheFileMode is the configured mode of cache files.
+func (b *Backend) cacheFileMode() os.FileMode {
+	if b.cacheMode == 0 {
+		return DefaultCacheFileMode
+	}
+	return b.cacheMode
+}
+
+// setDataDirectoryOwnership applies the configured mode and group to the
+// data directory, as it may have been created with other settings.
+func (b *Backend) setDataDirectoryOwnership() error {
+	err := os.Chmod(b.dataDirectory, directoryMode(b.cacheFileMode()))
+	if err != nil {
+		return err
+	}
+	if b.cacheGID == 0 {
+		return nil
+	}
+	return os.Chown(b.dataDirectory, -1, b.cacheGID)
+}
+
+// setCacheFileOwnership applies the configured mode and group to a cache
+// file. This is done whenever one is opened, as the umask applies when it is
+// created and the settings may have changed since.
+func (b *Backend) setCacheFileOwnership(file *os.File) error {
+	err := file.Chmod(b.cacheFileMode())
+	if err != nil {
+		return err
+	}
+	if b.cacheGID == 0 {
+		return nil
+	}
+	return file.Chown(-1, b.cacheGID)
+}
@@ -0,0 +1,49 @@
+package sia
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectoryMode(t *testing.T) {
+	assert.Equal(t, os.FileMode(0700), directoryMode(0600))
+	assert.Equal(t, os.FileMode(0750), directoryMode(0640))
+	assert.Equal(t, os.FileMode(0770), directoryMode(0660))
+	assert.Equal(t, os.FileMode(0755), directoryMode(0644))
+}
+
+func TestCacheFileMode(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "permissions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	mode := func(path string) os.FileMode {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Mode().Perm()
+	}
+
+	b := &Backend{dataDirectory: dataDirectory}
+	f, err := b.openCacheFile(page(1))
+	assert.Nil(t, err)
+	f.Close()
+	assert.Equal(t, os.FileMode(0600), mode(b.asCachePath(page(1))))
+
+	// applied to existing files when they are opened again, regardless of
+	// the umask
+	b.cacheMode = 0660
+	f, err = b.openCacheFile(page(1))
+	assert.Nil(t, err)
+	f.Close()
+	assert.Equal(t, os.FileMode(0660), mode(b.asCachePath(page(1))))
+
+	assert.Nil(t, b.setDataDirectoryOwnership())
+	assert.Equal(t, os.FileMode(0770), mode(dataDirectory))
+}
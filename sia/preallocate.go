@@ -0,0 +1,60 @@
+package sia
+
+import (
+	"context"
+	"hash"
+	"io"
+	"log"
+
+	"go.sia.tech/renterd/worker"
+)
+
+// preallocatedGeneration is the generation that preallocated pages are
+// uploaded to. Devices with pages in the unversioned generation from before
+// generations were introduced are never preallocated, so it always holds
+// zeroes on preallocated devices.
+const preallocatedGeneration = 0
+
+// preallocatePages uploads a page of zeroes for every page of a new device,
+// recording their tags in the integrity manifest, if enabled. Should an
+// upload fail, the pages uploaded so far are deleted again, as the device
+// is not created.
+func preallocatePages(ctx context.Context, workerClient *worker.Client, root string, layout Layout,
+	size uint64, uploadQuery string, pageIntegrity *integrity) error {
+	pageCount := pageCountFor(size)
+	uploaded := []string{}
+	for p := 0; p < pageCount; p++ {
+		siaPath := layout.siaPath(root, page(p), preallocatedGeneration)
+		if p%100 == 0 {
+			log.Printf("Preallocating page %d of %d\n", p+1, pageCount)
+		}
+
+		var src io.Reader = io.LimitReader(zeroReader{}, pageSize)
+		var tagger hash.Hash
+		if pageIntegrity != nil {
+			tagger = pageIntegrity.tagger(page(p), preallocatedGeneration)
+			src = io.TeeReader(src, tagger)
+		}
+
+		err := workerClient.UploadObject(ctx, src, siaPath+uploadQuery)
+		if err != nil {
+			for _, uploadedPath := range uploaded {
+				if deleteErr := workerClient.DeleteObject(ctx, uploadedPath); deleteErr != nil {
+					log.Printf("Unable to delete preallocated %s: %s\n", uploadedPath, deleteErr)
+				}
+			}
+			return err
+		}
+		if tagger != nil {
+			pageIntegrity.manifest.Tags[page(p)] = map[int][]byte{preallocatedGeneration: tagger.Sum(nil)}
+		}
+		uploaded = append(uploaded, siaPath)
+	}
+	return nil
+}
+
+// preallocated reports whether a generation of a page is known to hold
+// zeroes because it was preallocated, so that it need not be downloaded.
+func (b *Backend) preallocated(generation int) bool {
+	return b.device.Preallocated && generation == preallocatedGeneration
+}
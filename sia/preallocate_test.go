@@ -0,0 +1,37 @@
+package sia
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreallocatedDownload(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "preallocate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	b := newTestBackend(t, 4, dataDirectory)
+	b.device.Preallocated = true
+	assert.True(t, b.preallocated(preallocatedGeneration))
+	assert.False(t, b.preallocated(1), "expected later generations to be downloaded")
+
+	file, err := b.openCacheFile(page(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.cache.pages.get(page(2)).file = file
+	defer file.Close()
+
+	// no Sia daemon is needed, as the page is known to hold zeroes
+	_, err = b.handleAction(context.Background(), action{actionType: download, page: page(2)})
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(b.asCachePath(page(2)))
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, pageSize), data)
+}
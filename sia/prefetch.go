@@ -0,0 +1,137 @@
+package sia
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"time"
+
+	"go.sia.tech/renterd/worker"
+)
+
+type (
+	// prefetch is a download that was started ahead of the read that
+	// needs it. Its fields are set before done is closed.
+	prefetch struct {
+		generation int
+		done       chan struct{}
+		data       []byte
+		took       time.Duration
+		err        error
+	}
+)
+
+// prefetchPages starts downloading the pages of a read that are only on
+// Sia, so that a read spanning several of them does not wait for one
+// download after the other. Only reads spanning more than one such page
+// are worth it, and only if every page is stored on its own, as the pages
+// of a pack would all download the same object. It returns the downloads
+// it started, for dropPrefetches. The mutex must not be held.
+func (b *Backend) prefetchPages(ctx context.Context, pageAccesses []pageAccess) []*prefetch {
+	if len(pageAccesses) < 2 {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state != available || b.breaker.open || b.downloads.inEffect() < 2 || b.packed() {
+		return nil
+	}
+
+	candidates := []page{}
+	for _, pageAccess := range pageAccesses {
+		page := pageAccess.page
+		if b.cache.brain.pages.state(page) != notCached || b.prefetches[page] != nil ||
+			b.ghost.has(page, b.cache.pages.get(page).generation) {
+			continue
+		}
+		candidates = append(candidates, page)
+	}
+	if len(candidates) < 2 {
+		return nil
+	}
+
+	started := []*prefetch{}
+	for _, page := range candidates {
+		if !b.downloads.allows(len(b.prefetches)) {
+			break
+		}
+
+		generation := b.cache.pages.get(page).generation
+		p := &prefetch{
+			generation: generation,
+			done:       make(chan struct{}),
+		}
+		b.prefetches[page] = p
+		started = append(started, p)
+		go p.download(ctx, b.workerClient, b.asSiaPath(page, generation), b.now)
+	}
+	return started
+}
+
+func (p *prefetch) download(ctx context.Context, workerClient *worker.Client, siaPath string,
+	now func() time.Time) {
+	defer close(p.done)
+
+	buf := bytes.NewBuffer(make([]byte, 0, pageSize))
+	start := now()
+	p.err = workerClient.DownloadObject(ctx, buf, siaPath+shardParameters)
+	p.took = now().Sub(start)
+	if p.err == nil {
+		p.data = buf.Bytes()
+	}
+}
+
+// usePrefetched fills the cache file of a page from a download started by
+// prefetchPages, waiting for it to complete if necessary. It returns false
+// if there is none for the given generation or it failed, in which case
+// the page needs to be downloaded as usual. The mutex needs to be held.
+func (b *Backend) usePrefetched(page page, generation int) (bool, error) {
+	p, ok := b.prefetches[page]
+	if !ok {
+		return false, nil
+	}
+	delete(b.prefetches, page)
+	if p.generation != generation {
+		return false, nil
+	}
+
+	<-p.done
+	b.downloads.record(p.took, p.err)
+	if p.err != nil {
+		log.Printf("Download of page %d ahead of time failed: %s\n", page, p.err)
+		return false, nil
+	}
+
+	err := b.fillCacheFile(page, generation, func(w io.Writer) error {
+		_, err := w.Write(p.data)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	b.recordSia(nil)
+	b.countDownload()
+	return true, nil
+}
+
+// dropPrefetches forgets about downloads started for a read that it did
+// not use, e.g. because it failed. The mutex must not be held.
+func (b *Backend) dropPrefetches(started []*prefetch) {
+	if len(started) == 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for page, p := range b.prefetches {
+		for _, s := range started {
+			if p == s {
+				delete(b.prefetches, page)
+			}
+		}
+	}
+}
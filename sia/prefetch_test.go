@@ -0,0 +1,78 @@
+package sia
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func finishedPrefetch(generation int, data []byte, err error) *prefetch {
+	p := &prefetch{
+		generation: generation,
+		done:       make(chan struct{}),
+		data:       data,
+		err:        err,
+	}
+	close(p.done)
+	return p
+}
+
+func TestUsePrefetched(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "prefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	backend := newTestBackend(t, 10, dataDirectory)
+	backend.prefetches = make(map[page]*prefetch)
+	backend.cache.pages.get(page(2)).generation = 3
+
+	used, err := backend.usePrefetched(page(2), 3)
+	assert.Nil(t, err)
+	assert.False(t, used, "expected no download ahead of time")
+
+	backend.prefetches[page(2)] = finishedPrefetch(2, []byte("old"), nil)
+	used, err = backend.usePrefetched(page(2), 3)
+	assert.Nil(t, err)
+	assert.False(t, used, "expected an outdated generation to be ignored")
+	assert.Equal(t, 0, len(backend.prefetches))
+
+	backend.prefetches[page(2)] = finishedPrefetch(3, nil, errors.New("no hosts"))
+	used, err = backend.usePrefetched(page(2), 3)
+	assert.Nil(t, err)
+	assert.False(t, used, "expected a failed download to be retried as usual")
+
+	backend.prefetches[page(2)] = finishedPrefetch(3, []byte("abc"), nil)
+	used, err = backend.usePrefetched(page(2), 3)
+	assert.Nil(t, err)
+	assert.True(t, used)
+	data, err := ioutil.ReadFile(backend.asCachePath(page(2)))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc"), data)
+}
+
+func TestPrefetchPages(t *testing.T) {
+	backend := newTestBackend(t, 10, "")
+	backend.mutex = &sync.Mutex{}
+	backend.prefetches = make(map[page]*prefetch)
+	backend.downloads = newConcurrencyLimit("downloads", 4)
+	backend.cache.brain.setState(page(1), notCached)
+	backend.cache.brain.setState(page(2), cachedUnchanged)
+
+	pageAccesses := determinePages(pageSize, 2*pageSize)
+	started := backend.prefetchPages(context.Background(), pageAccesses)
+	assert.Equal(t, 0, len(started), "expected no downloads for a single page only on Sia")
+
+	ours := finishedPrefetch(0, nil, nil)
+	theirs := finishedPrefetch(0, nil, nil)
+	backend.prefetches[page(1)] = ours
+	backend.prefetches[page(2)] = theirs
+	backend.dropPrefetches([]*prefetch{ours})
+	assert.Equal(t, map[page]*prefetch{page(2): theirs}, backend.prefetches)
+}
@@ -0,0 +1,72 @@
+package sia
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxPrefixDepth is how many directories deep a SiaPath prefix may be, which
+// also limits how far ListDevices looks for devices.
+const maxPrefixDepth = 8
+
+// ValidateSiaPathPrefix makes sure that a SiaPath prefix cannot be mistaken
+// for a part of another device, so that devices under different prefixes
+// never see each other's objects, however they are nested. Every directory
+// of the prefix needs a name that no device uses for its own objects: not a
+// shard number, page, UUID or metadata directory.
+func ValidateSiaPathPrefix(siaPathPrefix string) error {
+	if siaPathPrefix == "" {
+		return fmt.Errorf("empty SiaPath prefix")
+	}
+	if strings.HasPrefix(siaPathPrefix, "/") || strings.HasSuffix(siaPathPrefix, "/") {
+		return fmt.Errorf("SiaPath prefix %s may not begin or end with a slash", siaPathPrefix)
+	}
+
+	names := strings.Split(siaPathPrefix, "/")
+	if len(names) > maxPrefixDepth {
+		return fmt.Errorf("SiaPath prefix %s is more than %d directories deep", siaPathPrefix, maxPrefixDepth)
+	}
+	for _, name := range names {
+		if !validPrefixName(name) {
+			return fmt.Errorf("SiaPath prefix %s contains %q, which is reserved for the objects of a device",
+				siaPathPrefix, name)
+		}
+	}
+	return nil
+}
+
+// validPrefixName tells whether a directory name may be part of a SiaPath
+// prefix; see ValidateSiaPathPrefix.
+func validPrefixName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	if strings.HasSuffix(name, metadataSuffix) || isUUID(name) {
+		return false
+	}
+	if _, err := parseNumber(name); err == nil {
+		return false
+	}
+	if strings.HasPrefix(name, "page") {
+		_, _, err := parseSiaPath(".", "./"+name)
+		if err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// isUUID tells whether name looks like a UUID as created by newUUID.
+func isUUID(name string) bool {
+	groups := strings.Split(name, "-")
+	lengths := []int{8, 4, 4, 4, 12}
+	if len(groups) != len(lengths) {
+		return false
+	}
+	for i, group := range groups {
+		if len(group) != lengths[i] || strings.Trim(group, "0123456789abcdef") != "" {
+			return false
+		}
+	}
+	return true
+}
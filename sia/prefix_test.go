@@ -0,0 +1,39 @@
+package sia
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSiaPathPrefix(t *testing.T) {
+	for _, siaPathPrefix := range []string{"nbd", "vms/web", "backups/nbd-2", "pages", "page", "page1x"} {
+		assert.Nil(t, ValidateSiaPathPrefix(siaPathPrefix), siaPathPrefix)
+	}
+
+	uuid, err := newUUID()
+	assert.Nil(t, err)
+	for _, siaPathPrefix := range []string{
+		"",
+		"/nbd",
+		"nbd/",
+		"vms//web",
+		"vms/../nbd",
+		"nbd/1",
+		"nbd/page3",
+		"nbd/page3.gen2",
+		"nbd.meta/web",
+		"nbd/" + uuid,
+		"a/b/c/d/e/f/g/h/i",
+	} {
+		assert.NotNil(t, ValidateSiaPathPrefix(siaPathPrefix), siaPathPrefix)
+	}
+}
+
+func TestSubdirectories(t *testing.T) {
+	entries := []string{"/vms/web/", "/vms/web.meta/", "/vms/notes.txt", "/vms/db/"}
+	assert.Equal(t, []string{"web", "web.meta", "db"}, subdirectories("vms", entries))
+	assert.Equal(t, []string{"nbd", "nbd.meta"}, subdirectories("", []string{"/nbd/", "/nbd.meta/", "/file"}))
+	assert.Equal(t, "vms/web", joinSiaPath("vms", "web"))
+	assert.Equal(t, "web", joinSiaPath("", "web"))
+}
@@ -0,0 +1,90 @@
+package sia
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/javgh/sia-nbdserver/notify"
+)
+
+const quarantineDirectory = "quarantine"
+
+// expectedCacheFileSize is the size of a complete cache file, which always
+// covers a whole page, depending on whether it is encrypted.
+func expectedCacheFileSize(encrypted bool) int64 {
+	if encrypted {
+		return storedOffset(pageSize / cryptBlockSize)
+	}
+	return pageSize
+}
+
+// checkCacheFile returns an error if the cache file of a page does not
+// have the size of a complete page, e.g. because it was cut short by a
+// crash or a full disk.
+func checkCacheFile(dataDirectory string, page page) error {
+	file, err := os.Open(asCachePath(dataDirectory, page))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header, err := readCacheHeader(file)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	expected := expectedCacheFileSize(header != nil)
+	if info.Size() != expected {
+		return fmt.Errorf("cache file has %d bytes instead of %d", info.Size(), expected)
+	}
+	return nil
+}
+
+// quarantineCacheFiles moves cache files with the wrong size or a header
+// that does not fit (see checkCacheFileHeader) out of the way and returns
+// the pages whose cache files can be used. The pages of the others are
+// downloaded from Sia again when needed, or read as zeroes if they were
+// never uploaded. The files are kept for inspection, as they may hold
+// writes that did not make it to Sia.
+func quarantineCacheFiles(dataDirectory string, cachedPages []page, device string,
+	generations map[page]int, now time.Time, audit *auditLog, notifier *notify.Notifier) ([]page, error) {
+	good := []page{}
+	for _, page := range cachedPages {
+		problem := checkCacheFile(dataDirectory, page)
+		if problem == nil {
+			problem = checkCacheFileHeader(dataDirectory, page, device, generations[page])
+		}
+		if problem == nil {
+			good = append(good, page)
+			continue
+		}
+
+		err := os.MkdirAll(filepath.Join(dataDirectory, quarantineDirectory), 0700)
+		if err != nil {
+			return nil, err
+		}
+		quarantinePath := filepath.Join(dataDirectory, quarantineDirectory,
+			fmt.Sprintf("page%d.%d", page, now.Unix()))
+		err = os.Rename(asCachePath(dataDirectory, page), quarantinePath)
+		if err != nil {
+			return nil, err
+		}
+		err = os.Rename(cacheHeaderPath(dataDirectory, page), quarantinePath+cacheHeaderSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		log.Printf("Moved cache file of page %d to %s: %s\n", page, quarantinePath, problem)
+		audit.record(auditQuarantine, fmt.Sprintf("page %d", page), problem.Error())
+		notifier.Notify(notify.CacheFileDamaged, "cache file of page %d moved to %s: %s",
+			page, quarantinePath, problem)
+	}
+	return good, nil
+}
@@ -0,0 +1,55 @@
+package sia
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuarantineCacheFiles(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	key, err := newCacheKey(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func(page page, header []byte, size int64) {
+		path := asCachePath(dataDirectory, page)
+		err := ioutil.WriteFile(path, header, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Truncate(path, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	create(page(0), nil, pageSize)
+	create(page(1), nil, pageSize/2)
+	create(page(2), key.header(), expectedCacheFileSize(true))
+	create(page(3), key.header(), pageSize)
+	create(page(4), nil, 0)
+
+	now := time.Unix(1600000000, 0)
+	good, err := quarantineCacheFiles(dataDirectory, []page{0, 1, 2, 3, 4}, "", nil, now, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []page{0, 2}, good)
+	assert.Equal(t, []page{0, 2}, getCachedPages(dataDirectory, 5))
+
+	quarantined, err := ioutil.ReadDir(filepath.Join(dataDirectory, quarantineDirectory))
+	assert.Nil(t, err)
+	names := []string{}
+	for _, info := range quarantined {
+		names = append(names, info.Name())
+	}
+	assert.Equal(t, []string{"page1.1600000000", "page3.1600000000", "page4.1600000000"}, names)
+}
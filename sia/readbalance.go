@@ -0,0 +1,125 @@
+package sia
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+type (
+	// SiaDaemonStats describes how downloads from a renterd node went.
+	SiaDaemonStats struct {
+		Address   string
+		Active    bool
+		Downloads int
+		Failures  int
+		Latency   time.Duration
+	}
+
+	// readStats is the download history of a node used for balancing
+	// reads. latency is a moving average of the time a page download takes.
+	readStats struct {
+		downloads  int
+		failures   int
+		latency    time.Duration
+		lastFailed time.Time
+	}
+)
+
+const (
+	// readExploreEvery is how often a download goes to the next node in
+	// turn rather than the fastest one, so that the latencies of the other
+	// nodes stay current.
+	readExploreEvery = 10
+	// readLatencyWeight is the weight of a new sample in the moving average.
+	readLatencyWeight = 0.3
+)
+
+// balancedDownload downloads a page from the node that is expected to be
+// fastest if reads are balanced, falling back to the active node if that
+// fails. Otherwise, it uses the active node. The mutex needs to be held.
+func (b *Backend) balancedDownload(ctx context.Context, page page, generation int, siaPath string) error {
+	if !b.balanceReads || len(b.nodes) < 2 {
+		return b.downloadPage(ctx, page, generation, siaPath, b.workerClient)
+	}
+
+	i := b.pickReadNode()
+	stats := &b.readStats[i]
+	start := b.now()
+	err := b.downloadPage(ctx, page, generation, siaPath, b.nodes[i].workerClient)
+	stats.downloads += 1
+	if err == nil {
+		sample := b.now().Sub(start)
+		if stats.latency == 0 {
+			stats.latency = sample
+		} else {
+			stats.latency = time.Duration(readLatencyWeight*float64(sample) +
+				(1-readLatencyWeight)*float64(stats.latency))
+		}
+		return nil
+	}
+
+	stats.failures += 1
+	stats.lastFailed = b.now()
+	if i == b.activeNode {
+		return err
+	}
+	log.Printf("Unable to download page %d from %s, trying %s: %s\n",
+		page, b.nodes[i].address, b.nodes[b.activeNode].address, err)
+	return b.downloadPage(ctx, page, generation, siaPath, b.workerClient)
+}
+
+// pickReadNode returns the node to download from next: nodes without a
+// latency yet first, every readExploreEvery-th download the next node in
+// turn and the fastest node otherwise. Nodes whose last download failed
+// within the probe interval are left out. The mutex needs to be held.
+func (b *Backend) pickReadNode() int {
+	now := b.now()
+	usable := func(i int) bool {
+		failed := b.readStats[i].lastFailed
+		return failed.IsZero() || !now.Before(failed.Add(b.breaker.probeInterval))
+	}
+
+	b.readCount += 1
+	if b.readCount%readExploreEvery == 0 {
+		for n := 1; n <= len(b.nodes); n++ {
+			i := (b.lastExplored + n) % len(b.nodes)
+			if usable(i) {
+				b.lastExplored = i
+				return i
+			}
+		}
+	}
+
+	best := b.activeNode
+	for i := range b.nodes {
+		if !usable(i) {
+			continue
+		}
+		if b.readStats[i].latency == 0 {
+			return i
+		}
+		if !usable(best) || b.readStats[i].latency < b.readStats[best].latency {
+			best = i
+		}
+	}
+	return best
+}
+
+// SiaDaemons reports on the renterd nodes.
+func (b *Backend) SiaDaemons() []SiaDaemonStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	daemons := []SiaDaemonStats{}
+	for i, node := range b.nodes {
+		daemons = append(daemons, SiaDaemonStats{
+			Address:   node.address,
+			Active:    i == b.activeNode,
+			Downloads: b.readStats[i].downloads,
+			Failures:  b.readStats[i].failures,
+			Latency:   b.readStats[i].latency,
+		})
+	}
+	return daemons
+}
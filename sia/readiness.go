@@ -0,0 +1,81 @@
+package sia
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+type (
+	// notReadyError is returned by renterReady if the node answers but
+	// cannot store data yet.
+	notReadyError struct {
+		reason string
+	}
+)
+
+// readinessCheckInterval is how often maintenance asks the node whether it
+// is ready for uploads.
+const readinessCheckInterval = 30 * time.Second
+
+func (e notReadyError) Error() string {
+	return e.reason
+}
+
+// renterReady checks that the node has caught up with the blockchain and
+// has contracts to upload with.
+func (node siaNode) renterReady(ctx context.Context) error {
+	state, err := node.busClient.ConsensusState(ctx)
+	if err != nil {
+		return err
+	}
+	if !state.Synced {
+		return notReadyError{fmt.Sprintf("still syncing the blockchain (at height %d)", state.BlockHeight)}
+	}
+
+	contracts, err := node.busClient.ActiveContracts(ctx)
+	if err != nil {
+		return err
+	}
+	if len(contracts) == 0 {
+		return notReadyError{"no active contracts with hosts"}
+	}
+	return nil
+}
+
+// checkRenterReady holds uploads while the node is not ready to store data,
+// as they would fail right away, and resumes them once it is. Data stays
+// in the cache in the meantime. Requests that fail are left to the breaker.
+// The mutex needs to be held.
+func (b *Backend) checkRenterReady(ctx context.Context) {
+	now := b.now()
+	if now.Before(b.readiness.lastCheck.Add(readinessCheckInterval)) {
+		return
+	}
+	b.readiness.lastCheck = now
+
+	err := b.nodes[b.activeNode].renterReady(ctx)
+	if notReady, ok := err.(notReadyError); ok {
+		b.holdUploads(notReady.reason, now)
+	} else if err == nil {
+		b.holdUploads("", now)
+	}
+}
+
+// holdUploads holds uploads for the given reason or resumes them if it is
+// empty. The mutex needs to be held.
+func (b *Backend) holdUploads(reason string, now time.Time) {
+	held := b.readiness.reason != ""
+	switch {
+	case reason != "" && !held:
+		log.Printf("Holding uploads, as the Sia daemon is not ready: %s\n", reason)
+		b.readiness.since = now
+	case reason == "" && held:
+		log.Printf("Sia daemon is ready; resuming uploads held for %s\n",
+			now.Sub(b.readiness.since).Round(time.Second))
+		b.readiness.since = time.Time{}
+	}
+	b.readiness.reason = reason
+	b.cache.brain.uploadsHeld = reason != ""
+}
@@ -0,0 +1,41 @@
+package sia
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHoldUploads(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	b := newTestBackend(t, 10, "")
+	for i := 0; i < 2; i++ {
+		b.cache.brain.prepareAccess(page(i), true, now)
+	}
+
+	uploads := func(actions []action) int {
+		count := 0
+		for _, action := range actions {
+			if action.actionType == startUpload {
+				count += 1
+			}
+		}
+		return count
+	}
+
+	b.holdUploads("still syncing the blockchain (at height 1000)", now)
+	actions := b.cache.brain.maintenance(now.Add(time.Minute))
+	assert.Equal(t, 0, uploads(actions), "expected no uploads while held")
+	assert.Equal(t, 2, len(b.cache.brain.dirtyPages))
+	assert.Equal(t, "still syncing the blockchain (at height 1000)", b.readiness.reason)
+
+	b.holdUploads("no active contracts with hosts", now.Add(time.Minute))
+	assert.Equal(t, now, b.readiness.since, "expected the hold to count from its start")
+
+	b.holdUploads("", now.Add(2*time.Minute))
+	actions = b.cache.brain.maintenance(now.Add(2 * time.Minute))
+	assert.Equal(t, 2, uploads(actions), "expected uploads to resume")
+	assert.Equal(t, "", b.readiness.reason)
+	assert.False(t, b.cache.brain.uploadsHeld)
+}
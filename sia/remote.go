@@ -0,0 +1,234 @@
+package sia
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.sia.tech/renterd/object"
+)
+
+type (
+	// remotePage is one object on Sia holding a generation of a page.
+	// Every upload of a page goes to a new generation, so that the previous
+	// generation stays intact until the new one is complete. Generation 0
+	// is the unversioned SiaPath used by earlier versions.
+	remotePage struct {
+		page       page
+		generation int
+		siaPath    string
+	}
+)
+
+const (
+	generationSeparator = ".gen"
+	cleanUpConcurrency  = 8
+)
+
+func (b *Backend) asSiaPath(page page, generation int) string {
+	return b.layout.siaPath(b.pageRoot, b.packOf(page), generation)
+}
+
+func asSiaPath(siaPathPrefix string, page page, generation int) string {
+	if generation == 0 {
+		return fmt.Sprintf("%s/page%d", siaPathPrefix, page)
+	}
+	return fmt.Sprintf("%s/page%d%s%d", siaPathPrefix, page, generationSeparator, generation)
+}
+
+// parseSiaPath is the inverse of asSiaPath. The SiaPath may carry a leading
+// slash, as returned when listing objects.
+func parseSiaPath(siaPathPrefix string, siaPath string) (page, int, error) {
+	name := strings.TrimPrefix(siaPath, "/")
+	if !strings.HasPrefix(name, siaPathPrefix+"/page") {
+		return 0, 0, fmt.Errorf("%s is not a page of %s", siaPath, siaPathPrefix)
+	}
+	name = strings.TrimPrefix(name, siaPathPrefix+"/page")
+
+	generation := 0
+	if i := strings.Index(name, generationSeparator); i >= 0 {
+		var err error
+		generation, err = parseNumber(name[i+len(generationSeparator):])
+		if err != nil || generation == 0 {
+			return 0, 0, fmt.Errorf("%s has an invalid generation", siaPath)
+		}
+		name = name[:i]
+	}
+
+	pageNumber, err := parseNumber(name)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s has an invalid page number", siaPath)
+	}
+
+	return page(pageNumber), generation, nil
+}
+
+// parseNumber only accepts plain decimal numbers without sign or leading
+// zeroes, so that every page has exactly one SiaPath per generation.
+func parseNumber(s string) (int, error) {
+	if s == "" || (len(s) > 1 && s[0] == '0') || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return strconv.Atoi(s)
+}
+
+// latestGenerations returns the newest generation of every page.
+func latestGenerations(remotePages []remotePage) map[page]int {
+	latest := make(map[page]int)
+	for _, remotePage := range remotePages {
+		generation, ok := latest[remotePage.page]
+		if !ok || remotePage.generation > generation {
+			latest[remotePage.page] = remotePage.generation
+		}
+	}
+	return latest
+}
+
+// findGeneration looks up a generation among the generations of a page.
+func findGeneration(remotePages []remotePage, generation int) (remotePage, bool) {
+	for _, remotePage := range remotePages {
+		if remotePage.generation == generation {
+			return remotePage, true
+		}
+	}
+	return remotePage{}, false
+}
+
+// deleteSupersededGenerations removes all generations of page that are
+// older than generation, along with the other pages of its pack, if any.
+func (b *Backend) deleteSupersededGenerations(ctx context.Context, remotePages []remotePage,
+	page page, generation int) {
+	for _, remotePage := range remotePages {
+		if remotePage.page != b.packOf(page) || remotePage.generation >= generation {
+			continue
+		}
+
+		err := b.deleteObject(ctx, remotePage, fmt.Sprintf("superseded by generation %d", generation))
+		if err != nil {
+			log.Printf("Unable to delete superseded %s: %s\n", remotePage.siaPath, err)
+		}
+	}
+}
+
+// cleanUpGenerations deletes generations that have been superseded by a
+// newer generation which has reached the minimum redundancy. This catches
+// up on deletions that did not happen before a restart. Pages are checked
+// concurrently, as there may be many of them after a crash.
+func (b *Backend) cleanUpGenerations(ctx context.Context, remotePages []remotePage) {
+	latest := latestGenerations(remotePages)
+	candidates := []page{}
+	for page, generation := range latest {
+		if hasSupersededGenerations(remotePages, page, generation) {
+			candidates = append(candidates, page)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	hosts, err := b.activeHosts(ctx)
+	if err != nil {
+		log.Printf("Unable to determine redundancy of superseded pages: %s\n", err)
+		return
+	}
+
+	work := make(chan page)
+	var wg sync.WaitGroup
+	for i := 0; i < min(cleanUpConcurrency, len(candidates)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range work {
+				generation := latest[page]
+				redundancy, err := b.redundancyOn(ctx, b.asSiaPath(page, generation), hosts)
+				if err != nil {
+					log.Printf("Unable to determine redundancy of page %d: %s\n", page, err)
+					continue
+				}
+
+				if redundancy >= b.minimumRedundancy {
+					b.deleteSupersededGenerations(ctx, remotePages, page, generation)
+				}
+			}
+		}()
+	}
+
+	for _, page := range candidates {
+		work <- page
+	}
+	close(work)
+	wg.Wait()
+}
+
+func hasSupersededGenerations(remotePages []remotePage, page page, generation int) bool {
+	for _, remotePage := range remotePages {
+		if remotePage.page == page && remotePage.generation < generation {
+			return true
+		}
+	}
+	return false
+}
+
+// redundancy returns how many times over the object at siaPath is stored
+// on hosts that the renter still has active contracts with.
+func (b *Backend) redundancy(ctx context.Context, siaPath string) (float64, error) {
+	hosts, err := b.activeHosts(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return b.redundancyOn(ctx, siaPath, hosts)
+}
+
+// redundancyOn is like redundancy, but for a known set of hosts.
+func (b *Backend) redundancyOn(ctx context.Context, siaPath string, hosts map[string]bool) (float64, error) {
+	o, _, err := b.busClient.Object(ctx, siaPath)
+	if err != nil {
+		return 0, err
+	}
+
+	return objectRedundancy(o, hosts), nil
+}
+
+// activeHosts returns the hosts the renter has active contracts with.
+func (b *Backend) activeHosts(ctx context.Context) (map[string]bool, error) {
+	contracts, err := b.busClient.ActiveContracts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make(map[string]bool)
+	for _, contract := range contracts {
+		hosts[contract.HostKey.String()] = true
+	}
+	return hosts, nil
+}
+
+// objectRedundancy is the redundancy of the worst slab of the object,
+// counting only shards stored on the given hosts.
+func objectRedundancy(o object.Object, hosts map[string]bool) float64 {
+	if len(o.Slabs) == 0 {
+		return 0
+	}
+
+	redundancy := math.Inf(1)
+	for _, slab := range o.Slabs {
+		if slab.MinShards == 0 {
+			return 0
+		}
+
+		usableShards := 0
+		for _, shard := range slab.Shards {
+			if hosts[shard.Host.String()] {
+				usableShards += 1
+			}
+		}
+
+		redundancy = math.Min(redundancy, float64(usableShards)/float64(slab.MinShards))
+	}
+	return redundancy
+}
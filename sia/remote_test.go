@@ -0,0 +1,69 @@
+package sia
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.sia.tech/renterd/object"
+)
+
+func TestSiaPathRoundTrip(t *testing.T) {
+	assert.Equal(t, "nbd/page3", asSiaPath("nbd", 3, 0))
+	assert.Equal(t, "nbd/page3.gen7", asSiaPath("nbd", 3, 7))
+
+	for _, generation := range []int{0, 1, 12} {
+		siaPath := asSiaPath("nbd", 42, generation)
+		for _, listed := range []string{siaPath, "/" + siaPath} {
+			page, parsedGeneration, err := parseSiaPath("nbd", listed)
+			assert.Nil(t, err)
+			assert.Equal(t, 42, int(page))
+			assert.Equal(t, generation, parsedGeneration)
+		}
+	}
+}
+
+func TestParseInvalidSiaPath(t *testing.T) {
+	for _, siaPath := range []string{
+		"/other/page3",
+		"/nbd/page",
+		"/nbd/pagefoo",
+		"/nbd/page12extra",
+		"/nbd/page-1",
+		"/nbd/page03",
+		"/nbd/page3.gen",
+		"/nbd/page3.gen0",
+		"/nbd/page3.genx",
+	} {
+		_, _, err := parseSiaPath("nbd", siaPath)
+		assert.NotNil(t, err, siaPath)
+	}
+}
+
+func TestLatestGenerations(t *testing.T) {
+	latest := latestGenerations([]remotePage{
+		{page: 1, generation: 0},
+		{page: 1, generation: 2},
+		{page: 2, generation: 5},
+		{page: 1, generation: 1},
+	})
+
+	assert.Equal(t, map[page]int{1: 2, 2: 5}, latest)
+}
+
+func TestObjectRedundancy(t *testing.T) {
+	var sector object.Sector
+	goodHosts := map[string]bool{sector.Host.String(): true}
+
+	slab := func(minShards uint8, shards int) object.SlabSlice {
+		return object.SlabSlice{Slab: object.Slab{
+			MinShards: minShards,
+			Shards:    make([]object.Sector, shards),
+		}}
+	}
+
+	assert.Equal(t, 0.0, objectRedundancy(object.Object{}, goodHosts), "expected empty object to be unrecoverable")
+
+	o := object.Object{Slabs: []object.SlabSlice{slab(2, 5), slab(2, 3)}}
+	assert.Equal(t, 1.5, objectRedundancy(o, goodHosts), "expected worst slab to count")
+	assert.Equal(t, 0.0, objectRedundancy(o, map[string]bool{}), "expected shards on lost hosts to be ignored")
+}
@@ -0,0 +1,39 @@
+package sia
+
+import (
+	"fmt"
+	"log"
+)
+
+// repairFromCache uploads a page again from the cache after its copy on Sia
+// turned out to be damaged or missing, so that the only intact copy is not
+// lost with the next eviction. Only clean cache files qualify; dirty ones
+// are uploaded anyway. With integrity, the cache file must match the tag of
+// the damaged generation. Pages served from an older generation do not
+// qualify either, as that would make the stale data current, and followers
+// leave repairs to the server they follow. It reports whether a repair was
+// started. The mutex needs to be held.
+func (b *Backend) repairFromCache(page page, problem error) bool {
+	if b.follower || b.cache.brain.pages.state(page) != cachedUnchanged {
+		return false
+	}
+	if _, stale := b.stalePages[page]; stale {
+		return false
+	}
+	if b.integrity != nil {
+		intact, err := b.matchesSia(page)
+		if err != nil {
+			log.Printf("Unable to compare cache for page %d with Sia: %s\n", page, err)
+		}
+		if !intact {
+			return false
+		}
+	}
+
+	log.Printf("Re-uploading page %d from the cache, as its copy on Sia is damaged: %s\n", page, problem)
+	b.cache.brain.markDirty(page, b.now())
+	b.cache.brain.requestUpload(page)
+	b.audit.record(auditRepair, fmt.Sprintf("page %d", page), problem.Error())
+	b.lifetime.Repairs += 1
+	return true
+}
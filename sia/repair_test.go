@@ -0,0 +1,27 @@
+package sia
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepairFromCache(t *testing.T) {
+	b := newTestBackend(t, 8, "")
+	b.clock = &manualClock{now: time.Unix(1600000000, 0)}
+	b.cache.setOnSia(page(1))
+	b.cache.brain.setState(page(1), cachedUnchanged)
+	b.cache.brain.markDirty(page(2), b.now())
+
+	damaged := errors.New("downloaded 0 bytes instead of 67108864")
+	assert.True(t, b.repairFromCache(page(1), damaged))
+	assert.Equal(t, cachedChanged, b.cache.brain.pages.state(page(1)))
+	assert.True(t, b.cache.brain.pages.get(page(1)).uploadRequested)
+	assert.Equal(t, uint64(1), b.lifetime.Repairs)
+
+	assert.False(t, b.repairFromCache(page(2), damaged), "expected dirty pages to be left alone")
+	assert.False(t, b.repairFromCache(page(3), damaged), "expected pages without a cache file to be left alone")
+	assert.Equal(t, uint64(1), b.lifetime.Repairs)
+}
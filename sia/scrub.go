@@ -0,0 +1,277 @@
+package sia
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/javgh/sia-nbdserver/notify"
+)
+
+type (
+	// scrubber downloads the pages on Sia in turn while the device is idle
+	// and checks them against the integrity manifest, or only that they
+	// can be downloaded in full without one, so that damage is noticed
+	// before the data is needed. Each page is verified about once per
+	// interval (0 = never).
+	scrubber struct {
+		interval time.Duration
+		next     time.Time
+		record   scrubRecord
+		saved    []byte
+	}
+
+	// scrubRecord is what is kept across restarts: when each page was
+	// last verified and the pages that failed since.
+	scrubRecord struct {
+		Verified map[page]time.Time    `json:"verified"`
+		Failed   map[page]ScrubFailure `json:"failed"`
+	}
+
+	// ScrubFailure is a page that could not be verified when it was last
+	// scrubbed.
+	ScrubFailure struct {
+		Page  int       `json:"page"`
+		At    time.Time `json:"at"`
+		Error string    `json:"error"`
+	}
+
+	// ScrubStatus reports on the progress of scrubbing.
+	ScrubStatus struct {
+		Interval time.Duration
+		Pages    int
+		// Verified counts the pages verified within the interval.
+		Verified int
+		Failed   []ScrubFailure
+	}
+
+	// countingWriter counts what is written to it.
+	countingWriter struct {
+		n int64
+	}
+)
+
+const (
+	scrubFile = "scrub.json"
+	// scrubIdleTime is how long the device needs to go without requests
+	// before a page is scrubbed.
+	scrubIdleTime = time.Minute
+)
+
+func (w *countingWriter) Write(buf []byte) (int, error) {
+	w.n += int64(len(buf))
+	return len(buf), nil
+}
+
+func scrubPath(dataDirectory string) string {
+	return filepath.Join(dataDirectory, scrubFile)
+}
+
+func newScrubber(interval time.Duration) scrubber {
+	return scrubber{
+		interval: interval,
+		record: scrubRecord{
+			Verified: make(map[page]time.Time),
+			Failed:   make(map[page]ScrubFailure),
+		},
+	}
+}
+
+// restoreScrubRecord continues where the previous run left off.
+func (b *Backend) restoreScrubRecord() error {
+	encoded, err := ioutil.ReadFile(scrubPath(b.dataDirectory))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(encoded, &b.scrub.record)
+	if err != nil {
+		return err
+	}
+	if b.scrub.record.Verified == nil {
+		b.scrub.record.Verified = make(map[page]time.Time)
+	}
+	if b.scrub.record.Failed == nil {
+		b.scrub.record.Failed = make(map[page]ScrubFailure)
+	}
+	b.scrub.saved = encoded
+	return nil
+}
+
+// persistScrubRecord saves the record if it changed and logs any errors.
+// The mutex needs to be held.
+func (b *Backend) persistScrubRecord() {
+	encoded, err := json.Marshal(b.scrub.record)
+	if err != nil {
+		log.Printf("Unable to save scrub record: %s\n", err)
+		return
+	}
+	if bytes.Equal(encoded, b.scrub.saved) {
+		return
+	}
+
+	err = writeFileAtomically(scrubPath(b.dataDirectory), encoded, 0600)
+	if err != nil {
+		log.Printf("Unable to save scrub record: %s\n", err)
+		return
+	}
+	b.scrub.saved = encoded
+}
+
+// lastScrubbed is when a page was last verified or failed to be.
+func (b *Backend) lastScrubbed(page page) time.Time {
+	last := b.scrub.record.Verified[page]
+	if failure, ok := b.scrub.record.Failed[page]; ok && failure.At.After(last) {
+		last = failure.At
+	}
+	return last
+}
+
+// nextScrubPage returns the page on Sia that was scrubbed the longest ago,
+// if that was more than an interval ago. The mutex needs to be held.
+func (b *Backend) nextScrubPage(now time.Time) (page, bool) {
+	var next page
+	var nextScrubbed time.Time
+	found := false
+	for page, details := range b.cache.pages {
+		if !details.onSia {
+			continue
+		}
+
+		scrubbed := b.lastScrubbed(page)
+		if !found || scrubbed.Before(nextScrubbed) ||
+			(scrubbed.Equal(nextScrubbed) && page < next) {
+			next, nextScrubbed, found = page, scrubbed, true
+		}
+	}
+	if !found || now.Sub(nextScrubbed) < b.scrub.interval {
+		return 0, false
+	}
+	return next, true
+}
+
+// scrubStep verifies the next page that is due, if the device is idle and
+// enough time has passed since the previous one for all pages to be
+// verified once per interval. The mutex needs to be held.
+func (b *Backend) scrubStep(ctx context.Context) {
+	if b.scrub.interval == 0 || b.breaker.open || b.cache.remotePages == 0 {
+		return
+	}
+	now := b.now()
+	if now.Before(b.scrub.next) || now.Sub(b.cache.brain.lastAccess) < scrubIdleTime {
+		return
+	}
+	page, ok := b.nextScrubPage(now)
+	if !ok {
+		return
+	}
+	b.scrub.next = now.Add(b.scrub.interval / time.Duration(b.cache.remotePages))
+
+	err := b.scrubPage(ctx, page)
+	if err != nil {
+		log.Printf("Scrubbing page %d failed: %s\n", page, err)
+		if _, failedBefore := b.scrub.record.Failed[page]; !failedBefore {
+			b.notifier.Notify(notify.ScrubFailed, "scrubbing page %d failed: %s", page, err)
+		}
+		b.scrub.record.Failed[page] = ScrubFailure{Page: int(page), At: now, Error: err.Error()}
+		if !b.breaker.open {
+			// Sia is reachable, so the page itself is at fault
+			b.repairFromCache(page, err)
+		}
+	} else {
+		delete(b.scrub.record.Failed, page)
+		b.scrub.record.Verified[page] = now
+	}
+	b.persistScrubRecord()
+}
+
+// scrubPage downloads the newest generation of a page without caching it
+// and checks it. The mutex needs to be held.
+func (b *Backend) scrubPage(ctx context.Context, page page) error {
+	generation := b.cache.pages.get(page).generation
+	siaPath := b.asSiaPath(page, generation)
+
+	counter := &countingWriter{}
+	var dst io.Writer = counter
+	var unpacker *unpacker
+	if b.packed() {
+		unpacker = slotWriter(counter, int(page-b.packOf(page)))
+		dst = unpacker
+	}
+	var tagger hash.Hash
+	if b.integrity != nil {
+		tagger = b.integrity.tagger(b.packOf(page), generation)
+		dst = io.MultiWriter(dst, tagger)
+	}
+
+	err := b.recordSia(b.workerClient.DownloadObject(ctx, dst, siaPath+shardParameters))
+	if err != nil {
+		return err
+	}
+	if unpacker != nil {
+		err = unpacker.finishSlot(counter, int(page-b.packOf(page)))
+		if err != nil {
+			return err
+		}
+	}
+	if counter.n != pageSize {
+		return fmt.Errorf("downloaded %d bytes instead of %d", counter.n, pageSize)
+	}
+	if tagger == nil {
+		return nil
+	}
+	err = b.integrity.verify(b.packOf(page), generation, tagger.Sum(nil))
+	if err == errNoTag {
+		return nil
+	}
+	return err
+}
+
+// scrubFailures lists the pages whose last scrub failed. The mutex needs to
+// be held.
+func (b *Backend) scrubFailures() []ScrubFailure {
+	failures := []ScrubFailure{}
+	for page, failure := range b.scrub.record.Failed {
+		if details, ok := b.cache.pages[page]; ok && details.onSia {
+			failures = append(failures, failure)
+		}
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Page < failures[j].Page
+	})
+	return failures
+}
+
+// ScrubStatus reports how many pages were verified within the interval.
+func (b *Backend) ScrubStatus() ScrubStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	status := ScrubStatus{
+		Interval: b.scrub.interval,
+		Failed:   b.scrubFailures(),
+	}
+	now := b.now()
+	for page, details := range b.cache.pages {
+		if !details.onSia {
+			continue
+		}
+		status.Pages += 1
+		verified, ok := b.scrub.record.Verified[page]
+		if ok && now.Sub(verified) < b.scrub.interval {
+			status.Verified += 1
+		}
+	}
+	return status
+}
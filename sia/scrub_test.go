@@ -0,0 +1,73 @@
+package sia
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextScrubPage(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	b := newTestBackend(t, 8, "")
+	b.scrub = newScrubber(7 * 24 * time.Hour)
+	for _, page := range []page{1, 3, 5} {
+		b.cache.setOnSia(page)
+	}
+
+	next, ok := b.nextScrubPage(now)
+	assert.True(t, ok)
+	assert.Equal(t, page(1), next, "expected never scrubbed pages first, lowest first")
+
+	b.scrub.record.Verified[page(1)] = now.Add(-time.Hour)
+	b.scrub.record.Verified[page(3)] = now.Add(-8 * 24 * time.Hour)
+	b.scrub.record.Verified[page(5)] = now.Add(-9 * 24 * time.Hour)
+	next, ok = b.nextScrubPage(now)
+	assert.True(t, ok)
+	assert.Equal(t, page(5), next, "expected the page verified the longest ago")
+
+	// a failed attempt moves the page to the back of the queue
+	b.scrub.record.Failed[page(5)] = ScrubFailure{Page: 5, At: now, Error: "not found"}
+	next, ok = b.nextScrubPage(now)
+	assert.True(t, ok)
+	assert.Equal(t, page(3), next)
+
+	b.scrub.record.Verified[page(3)] = now
+	_, ok = b.nextScrubPage(now)
+	assert.False(t, ok, "expected nothing to be due within the interval")
+}
+
+func TestScrubStatus(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "scrub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	b := newTestBackend(t, 8, dataDirectory)
+	b.mutex = &sync.Mutex{}
+	b.clock = clock
+	b.scrub = newScrubber(24 * time.Hour)
+	for _, page := range []page{1, 3, 5} {
+		b.cache.setOnSia(page)
+	}
+	b.scrub.record.Verified[page(1)] = clock.Now().Add(-time.Hour)
+	b.scrub.record.Verified[page(3)] = clock.Now().Add(-48 * time.Hour)
+	b.scrub.record.Failed[page(5)] = ScrubFailure{Page: 5, At: clock.Now(), Error: "not found"}
+
+	status := b.ScrubStatus()
+	assert.Equal(t, 3, status.Pages)
+	assert.Equal(t, 1, status.Verified)
+	assert.Equal(t, []ScrubFailure{{Page: 5, At: clock.Now(), Error: "not found"}}, status.Failed)
+
+	b.persistScrubRecord()
+	restored := newTestBackend(t, 8, dataDirectory)
+	restored.scrub = newScrubber(24 * time.Hour)
+	assert.Nil(t, restored.restoreScrubRecord())
+	assert.True(t, restored.scrub.record.Verified[page(1)].Equal(b.scrub.record.Verified[page(1)]))
+	assert.Equal(t, "not found", restored.scrub.record.Failed[page(5)].Error)
+}
@@ -0,0 +1,138 @@
+package sia
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"go.sia.tech/renterd/worker"
+)
+
+const (
+	selfTestPages     = 1
+	selfTestChunkSize = 1024 * 1024
+)
+
+// SelfTest creates a tiny temporary device under a scratch SiaPath, writes
+// random data to it, forces the data to be uploaded and evicted from the
+// cache and then reads it back through a fresh backend, which requires the
+// pages to be downloaded from Sia again. Everything stored under the scratch
+// SiaPath prefix, metadata included, and the local scratch cache are removed
+// afterwards. The size, cache limits, SiaPath prefix and data directory in
+// settings are ignored.
+func SelfTest(settings BackendSettings) error {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+
+	dataDirectory, err := ioutil.TempDir("", "sia-nbdserver-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	settings.Size = selfTestPages * pageSize
+	settings.HardMaxCached = selfTestPages + 1
+	settings.SoftMaxCached = selfTestPages
+	settings.SiaPathPrefix = fmt.Sprintf("nbd-selftest-%s", hex.EncodeToString(suffix))
+	settings.DataDirectory = dataDirectory
+	log.Printf("Running self test under SiaPath prefix %s\n", settings.SiaPathPrefix)
+
+	offsets := []int64{0, pageSize/2 - selfTestChunkSize/2, pageSize - selfTestChunkSize}
+	chunks := make([][]byte, len(offsets))
+	for i := range chunks {
+		chunks[i] = make([]byte, selfTestChunkSize)
+		_, err = rand.Read(chunks[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	backend, err := NewBackend(settings)
+	if err != nil {
+		return err
+	}
+	defer backend.removeScratchDevice()
+
+	for i, offset := range offsets {
+		_, err = backend.WriteAt(context.Background(), chunks[i], offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Self test: waiting for upload to complete\n")
+	err = backend.Shutdown(ShutdownRemote)
+	if err != nil {
+		return err
+	}
+
+	if len(getCachedPages(dataDirectory, selfTestPages)) > 0 {
+		return errors.New("self test: cache still populated after thorough shutdown")
+	}
+
+	backend, err = NewBackend(settings)
+	if err != nil {
+		return err
+	}
+	defer backend.Shutdown(ShutdownNone)
+
+	log.Printf("Self test: reading data back from Sia\n")
+	buf := make([]byte, selfTestChunkSize)
+	for i, offset := range offsets {
+		_, err = backend.ReadAt(context.Background(), buf, offset)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(buf, chunks[i]) {
+			return fmt.Errorf("self test: data mismatch at offset %d", offset)
+		}
+	}
+
+	log.Printf("Self test passed\n")
+	return nil
+}
+
+// removeScratchDevice removes the pages of the scratch device along with its
+// metadata directory, which holds the device info, the epoch marker, the
+// trash and the integrity manifest.
+func (b *Backend) removeScratchDevice() {
+	ctx := context.Background()
+	for _, directory := range []string{b.siaPathPrefix, metadataDirectory(b.siaPathPrefix)} {
+		err := removeSiaDirectory(ctx, b.workerClient, directory+"/")
+		if err != nil {
+			log.Printf("Unable to list %s for removal: %s\n", directory, err)
+		}
+	}
+}
+
+// removeSiaDirectory deletes every object below directory, which ends with
+// a slash as the entries of directories do.
+func removeSiaDirectory(ctx context.Context, workerClient *worker.Client, directory string) error {
+	entries, err := workerClient.ObjectEntries(ctx, directory)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if strings.HasSuffix(entry, "/") {
+			err = removeSiaDirectory(ctx, workerClient, entry)
+		} else {
+			err = workerClient.DeleteObject(ctx, strings.TrimPrefix(entry, "/"))
+		}
+		if err != nil {
+			log.Printf("Unable to remove %s: %s\n", entry, err)
+		}
+	}
+	return nil
+}
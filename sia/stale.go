@@ -0,0 +1,81 @@
+package sia
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+type (
+	// StalePage is a page that is served from an older generation, as its
+	// newest one could not be downloaded intact.
+	StalePage struct {
+		Page       int       `json:"page"`
+		Generation int       `json:"generation"`
+		Newest     int       `json:"newest"`
+		At         time.Time `json:"at"`
+		Error      string    `json:"error"`
+	}
+)
+
+// staleGenerations returns the generations of a page older than the given
+// one that are still in the trash, newest first.
+func (t *trash) staleGenerations(page page, newest int) []int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	generations := []int{}
+	for _, entry := range t.entries {
+		if entry.Page == int(page) && entry.Generation < newest {
+			generations = append(generations, entry.Generation)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(generations)))
+	return generations
+}
+
+// downloadStale fills the cache file of a page from the newest older
+// generation in the trash that downloads intact, after the newest
+// generation failed with problem. It returns problem if there is none. The
+// mutex needs to be held.
+func (b *Backend) downloadStale(ctx context.Context, page page, newest int, problem error) error {
+	for _, generation := range b.trash.staleGenerations(b.packOf(page), newest) {
+		err := b.downloadPage(ctx, page, generation, b.asSiaPath(page, generation), b.workerClient)
+		if err != nil {
+			log.Printf("Unable to download stale generation %d of page %d: %s\n", generation, page, err)
+			if b.breaker.open {
+				break
+			}
+			continue
+		}
+
+		log.Printf("WARNING: serving page %d from stale generation %d, as generation %d is unreadable: %s\n",
+			page, generation, newest, problem)
+		b.audit.record(auditStaleRead, b.asSiaPath(page, generation),
+			fmt.Sprintf("generation %d is unreadable: %s", newest, problem))
+		b.stalePages[page] = StalePage{
+			Page:       int(page),
+			Generation: generation,
+			Newest:     newest,
+			At:         b.now(),
+			Error:      problem.Error(),
+		}
+		return nil
+	}
+	return problem
+}
+
+// stalePageList lists the pages served from older generations. The mutex
+// needs to be held.
+func (b *Backend) stalePageList() []StalePage {
+	stale := []StalePage{}
+	for _, stalePage := range b.stalePages {
+		stale = append(stale, stalePage)
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		return stale[i].Page < stale[j].Page
+	})
+	return stale
+}
@@ -0,0 +1,37 @@
+package sia
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaleGenerations(t *testing.T) {
+	trash := newTrash("", time.Hour)
+	for _, entry := range []TrashEntry{
+		{SiaPath: "nbd/page3.gen2", Page: 3, Generation: 2},
+		{SiaPath: "nbd/page3.gen4", Page: 3, Generation: 4},
+		{SiaPath: "nbd/page3.gen6", Page: 3, Generation: 6},
+		{SiaPath: "nbd/page5.gen4", Page: 5, Generation: 4},
+	} {
+		trash.entries[entry.SiaPath] = entry
+	}
+
+	assert.Equal(t, []int{4, 2}, trash.staleGenerations(page(3), 5))
+	assert.Equal(t, []int{}, trash.staleGenerations(page(5), 4))
+	assert.Equal(t, []int{}, trash.staleGenerations(page(7), 9))
+}
+
+func TestRepairSkipsStalePages(t *testing.T) {
+	b := newTestBackend(t, 8, "")
+	b.clock = &manualClock{now: time.Unix(1600000000, 0)}
+	b.cache.setOnSia(page(1))
+	b.cache.brain.setState(page(1), cachedUnchanged)
+	b.stalePages = map[page]StalePage{1: {Page: 1, Generation: 2, Newest: 3}}
+
+	assert.False(t, b.repairFromCache(page(1), errors.New("not found")))
+	assert.Equal(t, cachedUnchanged, b.cache.brain.pages.state(page(1)))
+	assert.Equal(t, []StalePage{{Page: 1, Generation: 2, Newest: 3}}, b.stalePageList())
+}
@@ -0,0 +1,63 @@
+package sia
+
+import (
+	"log"
+	"time"
+)
+
+type (
+	// UploadStalls counts uploads that did not complete within the stall
+	// timeout and were therefore started over.
+	UploadStalls struct {
+		Stalled     int
+		Uploading   int
+		LastPage    int
+		LastStalled time.Time
+	}
+)
+
+// checkStalledUploads puts pages whose upload has not completed within
+// uploadStallTimeout back into the changed state and requests a new upload
+// for them, as Sia may have accepted an upload that never becomes
+// available. The mutex needs to be held.
+func (b *Backend) checkStalledUploads() {
+	if b.uploadStallTimeout == 0 {
+		return
+	}
+
+	now := b.now()
+	for _, page := range b.cache.brain.dirtyPages.sorted() {
+		if b.cache.brain.pages.state(page) != cachedUploading {
+			continue
+		}
+
+		details := b.cache.pages.get(page)
+		if details.uploadStartedAt.IsZero() {
+			// restored from a previous run, so count from now on
+			details.uploadStartedAt = now
+			continue
+		}
+		if now.Sub(details.uploadStartedAt) < b.uploadStallTimeout {
+			continue
+		}
+
+		log.Printf("Upload of page %d has not completed after %s, starting over\n",
+			page, now.Sub(details.uploadStartedAt).Round(time.Second))
+		b.cache.brain.setState(page, cachedChanged)
+		b.cache.brain.requestUpload(page)
+		details.uploadStartedAt = time.Time{}
+		b.uploadStalls.Stalled += 1
+		b.uploadStalls.LastPage = int(page)
+		b.uploadStalls.LastStalled = now
+	}
+}
+
+// UploadStalls reports how many uploads stalled so far.
+func (b *Backend) UploadStalls() UploadStalls {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stalls := b.uploadStalls
+	stalls.Uploading = b.cache.brain.uploadingPages()
+	return stalls
+}
@@ -0,0 +1,39 @@
+package sia
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStalledUploads(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	b := newTestBackend(t, 4, "")
+	b.mutex = &sync.Mutex{}
+	b.clock = clock
+	b.uploadStallTimeout = time.Hour
+
+	b.cache.brain.setState(page(1), cachedUploading)
+	b.cache.pages.get(page(1)).uploadStartedAt = clock.Now()
+	b.cache.brain.setState(page(2), cachedUploading)
+
+	clock.Sleep(30 * time.Minute)
+	b.checkStalledUploads()
+	assert.Equal(t, cachedUploading, b.cache.brain.pages.state(page(1)))
+	assert.Equal(t, clock.Now(), b.cache.pages.get(page(2)).uploadStartedAt,
+		"expected restored upload to be timed from now on")
+
+	clock.Sleep(45 * time.Minute)
+	b.checkStalledUploads()
+	assert.Equal(t, cachedChanged, b.cache.brain.pages.state(page(1)))
+	assert.True(t, b.cache.brain.pages.get(page(1)).uploadRequested)
+	assert.Equal(t, cachedUploading, b.cache.brain.pages.state(page(2)))
+
+	stalls := b.UploadStalls()
+	assert.Equal(t, 1, stalls.Stalled)
+	assert.Equal(t, 1, stalls.Uploading)
+	assert.Equal(t, 1, stalls.LastPage)
+	assert.Equal(t, clock.Now(), stalls.LastStalled)
+}
@@ -0,0 +1,63 @@
+package sia
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// startupRetryInterval is how long to wait between attempts to reach the
+// Sia daemon at startup.
+const startupRetryInterval = 5 * time.Second
+
+// waitForSia finds the first node that lists the pages on Sia, retrying
+// for up to wait, as the Sia daemon may still be starting when the server
+// is started at boot. Within that time, it also waits for the renter to be
+// ready, but carries on without that once the time is up, as uploads are
+// held until it is.
+func waitForSia(ctx context.Context, clock Clock, wait time.Duration, nodes []siaNode,
+	siaPathPrefix string, layout Layout) (int, remoteDevice, error) {
+	var activeNode int
+	var remote remoteDevice
+	listed := false
+	err := retryStartup(clock, wait, func() error {
+		var err error
+		activeNode, remote, err = firstAvailableNode(ctx, nodes, siaPathPrefix, layout)
+		listed = err == nil
+		if err != nil {
+			return err
+		}
+		return nodes[activeNode].renterReady(ctx)
+	})
+	if err != nil && listed {
+		log.Printf("Starting although the renter is not ready: %s\n", err)
+		return activeNode, remote, nil
+	}
+	return activeNode, remote, err
+}
+
+// retryStartup calls attempt until it succeeds or wait has passed,
+// logging the progress, and returns the last error.
+func retryStartup(clock Clock, wait time.Duration, attempt func() error) error {
+	start := clock.Now()
+	for attempts := 1; ; attempts++ {
+		err := attempt()
+		if err == nil {
+			if attempts > 1 {
+				log.Printf("Sia daemon is ready after %s\n", clock.Now().Sub(start).Round(time.Second))
+			}
+			return nil
+		}
+
+		left := wait - clock.Now().Sub(start)
+		if left <= 0 {
+			return err
+		}
+		log.Printf("Waiting for the Sia daemon (attempt %d, giving up in %s): %s\n",
+			attempts, left.Round(time.Second), err)
+		if left > startupRetryInterval {
+			left = startupRetryInterval
+		}
+		clock.Sleep(left)
+	}
+}
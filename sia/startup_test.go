@@ -0,0 +1,46 @@
+package sia
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryStartup(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	errDown := errors.New("connection refused")
+
+	attempts := 0
+	err := retryStartup(clock, time.Minute, func() error {
+		attempts += 1
+		if attempts < 4 {
+			return errDown
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, attempts)
+	assert.Equal(t, 3*startupRetryInterval, clock.Now().Sub(time.Unix(1600000000, 0)))
+
+	// gives up once the time is up, without sleeping past it
+	start := clock.Now()
+	attempts = 0
+	err = retryStartup(clock, 12*time.Second, func() error {
+		attempts += 1
+		return errDown
+	})
+	assert.Equal(t, errDown, err)
+	assert.Equal(t, 4, attempts)
+	assert.Equal(t, 12*time.Second, clock.Now().Sub(start))
+
+	// fails right away without a wait
+	attempts = 0
+	err = retryStartup(clock, 0, func() error {
+		attempts += 1
+		return errDown
+	})
+	assert.Equal(t, errDown, err)
+	assert.Equal(t, 1, attempts)
+}
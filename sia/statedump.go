@@ -0,0 +1,145 @@
+package sia
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"time"
+)
+
+// stateDumpLockTimeout is how long a state dump waits for the mutex. As
+// dumps are meant for debugging hangs, the mutex may well be held forever,
+// in which case the dump goes ahead with what is available without it.
+const stateDumpLockTimeout = 5 * time.Second
+
+var backendStateNames = map[backendState]string{
+	available:    "available",
+	shuttingDown: "shutting down",
+	unavailable:  "unavailable",
+}
+
+// WriteStateDump writes the internal state of the backend to a new file in
+// the data directory for debugging hangs offline and returns its path. If
+// extra is not nil, it is called to add the state of the frontends.
+func (b *Backend) WriteStateDump(extra func(w io.Writer)) (string, error) {
+	path := filepath.Join(b.dataDirectory,
+		fmt.Sprintf("statedump-%s.txt", b.now().Format("20060102-150405.000")))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	err = b.DumpState(file, extra)
+	if err != nil {
+		file.Close()
+		return "", err
+	}
+	return path, file.Close()
+}
+
+// DumpState writes the state of the cache, the upload queue, the operations
+// in flight and the stacks of all goroutines to w. It does not wait for the
+// mutex for longer than stateDumpLockTimeout, so that it also works while
+// the backend hangs.
+func (b *Backend) DumpState(w io.Writer, extra func(w io.Writer)) error {
+	fmt.Fprintf(w, "sia-nbdserver state dump of %s at %s\n\n", b.siaPathPrefix,
+		b.now().Format(time.RFC3339Nano))
+
+	if b.lockWithin(stateDumpLockTimeout) {
+		b.writeBackendState(w)
+		b.mutex.Unlock()
+	} else {
+		fmt.Fprintf(w, "The mutex could not be acquired within %s; see the goroutines below "+
+			"for who holds it.\n", stateDumpLockTimeout)
+	}
+
+	if extra != nil {
+		fmt.Fprintln(w)
+		extra(w)
+	}
+
+	fmt.Fprintf(w, "\ngoroutines:\n")
+	return pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// lockWithin acquires the mutex unless that takes longer than timeout. If it
+// gives up, the mutex is released again as soon as it is acquired after all.
+func (b *Backend) lockWithin(timeout time.Duration) bool {
+	locked := make(chan struct{})
+	go func() {
+		b.mutex.Lock()
+		close(locked)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-locked:
+		return true
+	case <-timer.C:
+		go func() {
+			<-locked
+			b.mutex.Unlock()
+		}()
+		return false
+	}
+}
+
+// writeBackendState writes everything about the backend that is protected
+// by the mutex. The mutex needs to be held.
+func (b *Backend) writeBackendState(w io.Writer) {
+	fmt.Fprintf(w, "backend: %s, writes paused: %t, cache disk full: %t\n",
+		backendStateNames[b.state], b.writesPaused, b.cacheDiskFull)
+	if b.readiness.reason != "" {
+		fmt.Fprintf(w, "uploads held since %s: %s\n", b.readiness.since.Format(time.RFC3339),
+			b.readiness.reason)
+	}
+	fmt.Fprintf(w, "upload limit: %d of %d (baseline %s), download limit: %d of %d (baseline %s)\n",
+		b.uploads.inEffect(), b.uploads.max, b.uploads.baseline,
+		b.downloads.inEffect(), b.downloads.max, b.downloads.baseline)
+
+	openFiles := 0
+	for _, details := range b.cache.pages {
+		if details.file != nil {
+			openFiles += 1
+		}
+	}
+	fmt.Fprintf(w, "open cache files: %d\n\n", openFiles)
+
+	b.writeCacheState(w)
+
+	fmt.Fprintf(w, "\nupload queue:\n")
+	for _, entry := range b.uploadQueue() {
+		fmt.Fprintf(w, "  %d: page %d, %d bytes, %d failed attempt(s), dirty since %s (epoch %d)\n",
+			entry.Priority, entry.Page, entry.Bytes, entry.Attempts,
+			entry.DirtySince.Format(time.RFC3339), entry.Epoch)
+	}
+
+	fmt.Fprintf(w, "\nrequests waiting for space in the cache:\n")
+	for _, request := range b.stuckRequests() {
+		fmt.Fprintf(w, "  page %d, write: %t, since %s, expanded: %t\n", request.Page,
+			request.IsWrite, request.Since.Format(time.RFC3339), request.Expanded)
+	}
+
+	prefetched := []page{}
+	for page := range b.prefetches {
+		prefetched = append(prefetched, page)
+	}
+	sort.Slice(prefetched, func(i, j int) bool {
+		return prefetched[i] < prefetched[j]
+	})
+	fmt.Fprintf(w, "\ndownloads ahead of reads:\n")
+	for _, page := range prefetched {
+		prefetch := b.prefetches[page]
+		done := false
+		select {
+		case <-prefetch.done:
+			done = true
+		default:
+		}
+		fmt.Fprintf(w, "  page %d, generation %d, done: %t\n", page, prefetch.generation, done)
+	}
+}
@@ -0,0 +1,78 @@
+package sia
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpState(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "statedump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	b := newTestBackend(t, 4, dataDirectory)
+	b.mutex = &sync.Mutex{}
+	b.cache.brain.setState(page(2), cachedChanged)
+	b.cache.pages.get(2).file = os.Stdin
+	b.prefetches = map[page]*prefetch{3: {generation: 1, done: make(chan struct{})}}
+
+	path, err := b.WriteStateDump(func(w io.Writer) {
+		fmt.Fprintln(w, "connections: none")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(dump), "open cache files: 1")
+	assert.Contains(t, string(dump), "page 2: dirty")
+	assert.Contains(t, string(dump), "0: page 2")
+	assert.Contains(t, string(dump), "page 3, generation 1, done: false")
+	assert.Contains(t, string(dump), "connections: none")
+	assert.Contains(t, string(dump), "TestDumpState")
+}
+
+func TestDumpStateWhileLocked(t *testing.T) {
+	b := newTestBackend(t, 4, "")
+	b.mutex = &sync.Mutex{}
+
+	b.mutex.Lock()
+	assert.False(t, b.lockWithin(10*time.Millisecond))
+	b.mutex.Unlock()
+
+	// the mutex is released again once the dump gives up on it
+	done := make(chan struct{})
+	go func() {
+		b.mutex.Lock()
+		b.mutex.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("mutex still held")
+	}
+	assert.True(t, b.lockWithin(time.Second))
+	b.mutex.Unlock()
+
+	var dump bytes.Buffer
+	b.mutex.Lock()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.mutex.Unlock()
+	}()
+	assert.Nil(t, b.DumpState(&dump, nil))
+	assert.Contains(t, dump.String(), "pages: 4")
+}
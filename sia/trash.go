@@ -0,0 +1,308 @@
+package sia
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.sia.tech/renterd/worker"
+)
+
+type (
+	// TrashEntry is an object on Sia that has been deleted, but is only
+	// going to be removed once the retention period has passed. Until
+	// then, it stays where it is, but is ignored when looking for the
+	// generations of a page.
+	TrashEntry struct {
+		SiaPath    string    `json:"siaPath"`
+		Page       int       `json:"page"`
+		Generation int       `json:"generation"`
+		DeletedAt  time.Time `json:"deletedAt"`
+		Reason     string    `json:"reason"`
+	}
+
+	// trash keeps deleted objects around for a while, protecting against
+	// bugs that delete the only good copy of a page. It is kept both in the
+	// data directory and on Sia, as forgetting about a trashed generation
+	// could bring outdated data back. A zero retention deletes objects
+	// right away. The trash has a mutex of its own, as generations are
+	// cleaned up concurrently on startup.
+	trash struct {
+		mutex     sync.Mutex
+		path      string
+		retention time.Duration
+		entries   map[string]TrashEntry
+
+		// unstored is set while the copy on Sia is out of date.
+		unstored bool
+	}
+)
+
+const (
+	trashFile   = "trash.json"
+	trashName   = "trash"
+	trashLogKey = "trash"
+	purgeLogKey = "trash purge"
+)
+
+func newTrash(dataDirectory string, retention time.Duration) *trash {
+	return &trash{
+		path:      filepath.Join(dataDirectory, trashFile),
+		retention: retention,
+		entries:   make(map[string]TrashEntry),
+	}
+}
+
+func trashPath(siaPathPrefix string) string {
+	return fmt.Sprintf("%s/%s", metadataDirectory(siaPathPrefix), trashName)
+}
+
+// load merges the local and the remote copy of the trash. An entry that is
+// in either copy counts as trashed.
+func (t *trash) load(ctx context.Context, workerClient *worker.Client, siaPathPrefix string) error {
+	encoded, err := ioutil.ReadFile(t.path)
+	if err == nil {
+		err = t.merge(encoded)
+		if err != nil {
+			return fmt.Errorf("%s: %s", t.path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	local := len(t.entries)
+
+	entries, err := workerClient.ObjectEntries(ctx, metadataDirectory(siaPathPrefix)+"/")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.TrimPrefix(entry, "/") != trashPath(siaPathPrefix) {
+			continue
+		}
+
+		var buf bytes.Buffer
+		err = workerClient.DownloadObject(ctx, &buf, trashPath(siaPathPrefix)+shardParameters)
+		if err != nil {
+			return err
+		}
+		err = t.merge(buf.Bytes())
+		if err != nil {
+			return fmt.Errorf("%s: %s", trashPath(siaPathPrefix), err)
+		}
+		t.unstored = len(t.entries) > local
+		if t.unstored {
+			return t.save()
+		}
+		return nil
+	}
+
+	t.unstored = local > 0
+	return nil
+}
+
+func (t *trash) merge(encoded []byte) error {
+	var entries []TrashEntry
+	err := json.Unmarshal(encoded, &entries)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if _, ok := t.entries[entry.SiaPath]; !ok {
+			t.entries[entry.SiaPath] = entry
+		}
+	}
+	return nil
+}
+
+// list returns the entries, oldest first. The trash mutex needs to be held.
+func (t *trash) list() []TrashEntry {
+	entries := []TrashEntry{}
+	for _, entry := range t.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].DeletedAt.Equal(entries[j].DeletedAt) {
+			return entries[i].DeletedAt.Before(entries[j].DeletedAt)
+		}
+		return entries[i].SiaPath < entries[j].SiaPath
+	})
+	return entries
+}
+
+// save writes the trash to the data directory. The trash mutex needs to be
+// held.
+func (t *trash) save() error {
+	encoded, err := json.Marshal(t.list())
+	if err != nil {
+		return err
+	}
+
+	tmpPath := t.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, encoded, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, t.path)
+}
+
+func (t *trash) contains(siaPath string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	_, ok := t.entries[siaPath]
+	return ok
+}
+
+// withoutTrashed returns the remote pages that are not in the trash.
+func (t *trash) withoutTrashed(remotePages []remotePage) []remotePage {
+	kept := []remotePage{}
+	for _, remotePage := range remotePages {
+		if !t.contains(remotePage.siaPath) {
+			kept = append(kept, remotePage)
+		}
+	}
+	return kept
+}
+
+// deleteObject moves a generation of a page to the trash, or deletes it
+// right away without a retention period.
+func (b *Backend) deleteObject(ctx context.Context, remotePage remotePage, reason string) error {
+	if b.trash.retention == 0 {
+		b.audit.record(auditDelete, remotePage.siaPath, reason)
+		b.listing.invalidate()
+		return b.workerClient.DeleteObject(ctx, remotePage.siaPath)
+	}
+
+	b.trash.mutex.Lock()
+	defer b.trash.mutex.Unlock()
+
+	if _, ok := b.trash.entries[remotePage.siaPath]; ok {
+		return nil
+	}
+	b.trash.entries[remotePage.siaPath] = TrashEntry{
+		SiaPath:    remotePage.siaPath,
+		Page:       int(remotePage.page),
+		Generation: remotePage.generation,
+		DeletedAt:  b.now(),
+		Reason:     reason,
+	}
+	b.audit.record(auditTrash, remotePage.siaPath, reason)
+	b.trash.unstored = true
+	return b.trash.save()
+}
+
+// reuse takes a SiaPath out of the trash before it is uploaded to again,
+// so that the new object is not purged along with the old one.
+func (b *Backend) reuse(siaPath string) error {
+	b.trash.mutex.Lock()
+	defer b.trash.mutex.Unlock()
+
+	if _, ok := b.trash.entries[siaPath]; !ok {
+		return nil
+	}
+	delete(b.trash.entries, siaPath)
+	b.trash.unstored = true
+	return b.trash.save()
+}
+
+// maintainTrash removes the objects whose retention period has passed and
+// brings the copy on Sia up to date. The mutex needs to be held.
+func (b *Backend) maintainTrash(ctx context.Context) {
+	_, err := b.purgeTrash(ctx, b.now().Add(-b.trash.retention), "retention period passed")
+	if err != nil {
+		b.logger.Printf(purgeLogKey, b.now(), "Unable to purge trash: %s\n", err)
+	} else {
+		b.logger.Resolve(purgeLogKey, b.now())
+	}
+
+	b.trash.mutex.Lock()
+	defer b.trash.mutex.Unlock()
+	if !b.trash.unstored {
+		return
+	}
+
+	encoded, err := json.Marshal(b.trash.list())
+	if err != nil {
+		b.logger.Printf(trashLogKey, b.now(), "Unable to encode trash: %s\n", err)
+		return
+	}
+	err = b.workerClient.UploadObject(ctx, bytes.NewReader(encoded),
+		trashPath(b.siaPathPrefix)+shardParameters)
+	if err != nil {
+		b.logger.Printf(trashLogKey, b.now(), "Unable to store trash: %s\n", err)
+		return
+	}
+	b.logger.Resolve(trashLogKey, b.now())
+	b.trash.unstored = false
+}
+
+// purgeTrash removes the objects that were deleted before the given time
+// for good and returns how many there were. The mutex needs to be held.
+func (b *Backend) purgeTrash(ctx context.Context, before time.Time, reason string) (int, error) {
+	b.trash.mutex.Lock()
+	defer b.trash.mutex.Unlock()
+
+	purged := 0
+	for _, entry := range b.trash.list() {
+		if !entry.DeletedAt.Before(before) {
+			break
+		}
+
+		b.audit.record(auditPurge, entry.SiaPath, reason)
+		b.listing.invalidate()
+		err := b.workerClient.DeleteObject(ctx, entry.SiaPath)
+		if err != nil {
+			b.trash.save()
+			return purged, err
+		}
+		log.Printf("Purged %s from the trash\n", entry.SiaPath)
+		delete(b.trash.entries, entry.SiaPath)
+		b.trash.unstored = true
+		purged += 1
+	}
+
+	if purged == 0 {
+		return 0, nil
+	}
+	return purged, b.trash.save()
+}
+
+// Trash lists the deleted objects that have not been purged yet.
+func (b *Backend) Trash() []TrashEntry {
+	b.trash.mutex.Lock()
+	defer b.trash.mutex.Unlock()
+
+	return b.trash.list()
+}
+
+// PurgeTrash removes all objects in the trash for good right away.
+func (b *Backend) PurgeTrash() (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.purgeTrash(context.Background(), b.now().Add(time.Second), "requested via admin API")
+}
+
+// Undelete takes an object out of the trash. Superseded generations are
+// merely kept then, while a generation that is newer than the current one
+// of its page takes its place after the next restart.
+func (b *Backend) Undelete(siaPath string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.trash.contains(siaPath) {
+		return fmt.Errorf("%s is not in the trash", siaPath)
+	}
+	b.audit.record(auditUndelete, siaPath, "requested via admin API")
+	return b.reuse(siaPath)
+}
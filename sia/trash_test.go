@@ -0,0 +1,48 @@
+package sia
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrash(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	b := &Backend{siaPathPrefix: "nbd", trash: newTrash(dataDirectory, time.Hour)}
+	remotePages := []remotePage{}
+	for generation := 1; generation <= 3; generation++ {
+		remotePages = append(remotePages, remotePage{
+			page:       page(4),
+			generation: generation,
+			siaPath:    b.asSiaPath(page(4), generation),
+		})
+	}
+
+	b.deleteSupersededGenerations(context.Background(), remotePages, page(4), 3)
+	assert.Equal(t, 2, len(b.Trash()))
+	assert.Equal(t, []remotePage{remotePages[2]}, b.trash.withoutTrashed(remotePages))
+	assert.Equal(t, 3, latestGenerations(remotePages)[page(4)])
+
+	// a postponed upload is trashed, but its SiaPath is used again
+	assert.Nil(t, b.deleteObject(context.Background(), remotePages[2], "postponed upload"))
+	assert.Equal(t, 0, len(b.trash.withoutTrashed(remotePages)))
+	assert.Nil(t, b.reuse(remotePages[2].siaPath))
+	assert.Equal(t, []remotePage{remotePages[2]}, b.trash.withoutTrashed(remotePages))
+
+	reloaded := newTrash(dataDirectory, time.Hour)
+	encoded, err := ioutil.ReadFile(reloaded.path)
+	assert.Nil(t, err)
+	assert.Nil(t, reloaded.merge(encoded))
+	assert.Equal(t, 2, len(reloaded.list()))
+	assert.Equal(t, remotePages[0].siaPath, reloaded.list()[0].SiaPath)
+	assert.Equal(t, "superseded by generation 3", reloaded.list()[0].Reason)
+}
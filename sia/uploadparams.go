@@ -0,0 +1,83 @@
+package sia
+
+import (
+	"fmt"
+	"net/url"
+)
+
+type (
+	// UploadParameters are passed on to the worker with every page
+	// upload.
+	UploadParameters struct {
+		// MinShards and TotalShards set the erasure coding of new
+		// generations (0 = 2 and 5). Any MinShards of the TotalShards
+		// shards of a slab restore it, for a redundancy of
+		// TotalShards/MinShards.
+		MinShards   int
+		TotalShards int
+		// Extra are further query parameters that the worker accepts for
+		// uploads, e.g. contractset, passed on as they are.
+		Extra url.Values
+	}
+)
+
+// maxTotalShards is the most shards a slab can be split into.
+const maxTotalShards = 255
+
+// withDefaults fills in the erasure coding used if none is given.
+func (p UploadParameters) withDefaults() UploadParameters {
+	if p.MinShards == 0 {
+		p.MinShards = minShards
+	}
+	if p.TotalShards == 0 {
+		p.TotalShards = totalShards
+	}
+	return p
+}
+
+func (p UploadParameters) validate() error {
+	if p.MinShards < 1 || p.TotalShards < p.MinShards || p.TotalShards > maxTotalShards {
+		return fmt.Errorf("invalid erasure coding of %d out of %d shards", p.MinShards, p.TotalShards)
+	}
+	for key := range p.Extra {
+		if key == "minshards" || key == "totalshards" {
+			return fmt.Errorf("upload parameter %s is set by the shard counts", key)
+		}
+	}
+	return nil
+}
+
+// checkUploadParameters makes sure that the parameters are valid and that
+// uploads can reach the minimum redundancy with them.
+func checkUploadParameters(p UploadParameters, minimumRedundancy float64) error {
+	err := p.validate()
+	if err != nil {
+		return err
+	}
+	if minimumRedundancy > p.redundancy() {
+		return fmt.Errorf("minimum redundancy %.1f can never be reached with %d out of %d shards (redundancy %.1f)",
+			minimumRedundancy, p.MinShards, p.TotalShards, p.redundancy())
+	}
+	return nil
+}
+
+// query returns the parameters as the query string of an upload.
+func (p UploadParameters) query() string {
+	values := url.Values{}
+	for key, extra := range p.Extra {
+		values[key] = append([]string{}, extra...)
+	}
+	values.Set("minshards", fmt.Sprint(p.MinShards))
+	values.Set("totalshards", fmt.Sprint(p.TotalShards))
+	return "?" + values.Encode()
+}
+
+func (p UploadParameters) redundancy() float64 {
+	return float64(p.TotalShards) / float64(p.MinShards)
+}
+
+// storedBytes is how much storage on Sia the given number of pages takes
+// up, including redundancy.
+func (p UploadParameters) storedBytes(pages uint64) uint64 {
+	return pages * pageSize * uint64(p.TotalShards) / uint64(p.MinShards)
+}
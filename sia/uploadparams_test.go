@@ -0,0 +1,28 @@
+package sia
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadParameters(t *testing.T) {
+	p := UploadParameters{}.withDefaults()
+	assert.Nil(t, p.validate())
+	assert.Equal(t, shardParameters, p.query())
+	assert.Equal(t, uint64(10*pageSize*5/2), p.storedBytes(10))
+
+	p = UploadParameters{MinShards: 10, TotalShards: 30, Extra: url.Values{"contractset": {"nbd"}}}
+	assert.Nil(t, p.validate())
+	assert.Equal(t, "?contractset=nbd&minshards=10&totalshards=30", p.query())
+	assert.Equal(t, 3.0, p.redundancy())
+
+	assert.NotNil(t, UploadParameters{MinShards: 5, TotalShards: 4}.validate())
+	assert.NotNil(t, UploadParameters{MinShards: 1, TotalShards: 300}.validate())
+	assert.NotNil(t, UploadParameters{MinShards: 1, TotalShards: 3,
+		Extra: url.Values{"minshards": {"2"}}}.validate())
+
+	err := checkUploadParameters(UploadParameters{MinShards: 10, TotalShards: 20}, 2.5)
+	assert.NotNil(t, err, "expected an unreachable minimum redundancy to be an error")
+}
@@ -0,0 +1,131 @@
+package sia
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type (
+	// uploadQueueEntry is the persisted form of a page that still needs to
+	// be uploaded. Priority 0 is the page that has been dirty the longest.
+	// Bytes is the disk space taken up by its cache file.
+	uploadQueueEntry struct {
+		Page             page      `json:"page"`
+		Bytes            uint64    `json:"bytes"`
+		Priority         int       `json:"priority"`
+		Attempts         int       `json:"attempts"`
+		DirtySince       time.Time `json:"dirtySince"`
+		LastAccess       time.Time `json:"lastAccess"`
+		LastPostponement time.Time `json:"lastPostponement"`
+		Epoch            uint64    `json:"epoch"`
+	}
+)
+
+const uploadQueueFile = "uploadqueue.json"
+
+func uploadQueuePath(dataDirectory string) string {
+	return filepath.Join(dataDirectory, uploadQueueFile)
+}
+
+// uploadQueue returns all pages with unsynced data, ordered by priority.
+// The mutex needs to be held.
+func (b *Backend) uploadQueue() []uploadQueueEntry {
+	entries := []uploadQueueEntry{}
+	for _, page := range b.cache.brain.dirtyPages.sorted() {
+		details := b.cache.brain.pages.get(page)
+		entries = append(entries, uploadQueueEntry{
+			Page:             page,
+			Bytes:            diskUsage(b.asCachePath(page)),
+			Attempts:         b.cache.pages.get(page).uploadFailures,
+			DirtySince:       details.dirtySince,
+			LastAccess:       details.lastAccess,
+			LastPostponement: details.lastPostponement,
+			Epoch:            details.dirtyEpoch,
+		})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].DirtySince.Before(entries[j].DirtySince)
+	})
+	for i := range entries {
+		entries[i].Priority = i
+	}
+
+	return entries
+}
+
+// saveUploadQueue persists the upload queue if it changed since it was last
+// saved. The mutex needs to be held.
+func (b *Backend) saveUploadQueue() error {
+	encoded, err := json.MarshalIndent(b.uploadQueue(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(encoded, b.savedUploadQueue) {
+		return nil
+	}
+
+	path := uploadQueuePath(b.dataDirectory)
+	err = writeFileAtomically(path, encoded, 0600)
+	if err != nil {
+		return err
+	}
+
+	b.savedUploadQueue = encoded
+	return nil
+}
+
+// restoreUploadQueue applies a previously saved upload queue to pages that
+// were found in the cache, so that their ordering, postponements and
+// attempt counts carry over across restarts.
+func (b *Backend) restoreUploadQueue() error {
+	encoded, err := ioutil.ReadFile(uploadQueuePath(b.dataDirectory))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entries []uploadQueueEntry
+	err = json.Unmarshal(encoded, &entries)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if int(entry.Page) >= b.cache.pageCount || b.cache.brain.pages.state(entry.Page) != cachedChanged {
+			continue
+		}
+
+		details := b.cache.brain.pages.get(entry.Page)
+		details.dirtySince = entry.DirtySince
+		details.lastAccess = entry.LastAccess
+		details.lastPostponement = entry.LastPostponement
+		details.dirtyEpoch = entry.Epoch
+		b.cache.pages.get(entry.Page).uploadFailures = entry.Attempts
+
+		// a restart implies a flush
+		if entry.Epoch >= b.cache.brain.epoch {
+			b.cache.brain.epoch = entry.Epoch + 1
+		}
+	}
+
+	b.savedUploadQueue = encoded
+	return nil
+}
+
+func writeFileAtomically(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, data, perm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
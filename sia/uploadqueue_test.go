@@ -0,0 +1,89 @@
+package sia
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBackend(t *testing.T, pageCount int, dataDirectory string) *Backend {
+	cacheBrain, err := newCacheBrain(pageCount, 6, 4, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Backend{
+		cache: &cache{
+			brain:     cacheBrain,
+			pageCount: pageCount,
+			pages:     make(ioPageTable),
+		},
+		size:             int64(pageCount) * pageSize,
+		dataDirectory:    dataDirectory,
+		uploadParameters: UploadParameters{}.withDefaults(),
+		// invariant violations crash tests right away
+		paranoid: true,
+	}
+}
+
+func TestUploadQueueRoundTrip(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "uploadqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	now := time.Unix(1600000000, 0)
+	backend := newTestBackend(t, 10, dataDirectory)
+	backend.cache.brain.setState(page(3), cachedChanged)
+	backend.cache.brain.pages.get(3).lastAccess = now.Add(time.Minute)
+	backend.cache.brain.pages.get(3).lastPostponement = now.Add(30 * time.Second)
+	backend.cache.brain.pages.get(3).dirtySince = now
+	backend.cache.brain.setState(page(5), cachedUploading)
+	backend.cache.brain.pages.get(5).lastAccess = now
+	backend.cache.brain.pages.get(5).dirtySince = now.Add(-time.Minute)
+	backend.cache.brain.setState(page(7), cachedUnchanged)
+	backend.cache.pages.get(3).uploadFailures = 2
+
+	queue := backend.uploadQueue()
+	assert.Equal(t, 2, len(queue))
+	assert.Equal(t, page(5), queue[0].Page, "expected oldest dirty page first")
+	assert.Equal(t, 0, queue[0].Priority)
+	assert.Equal(t, page(3), queue[1].Page)
+	assert.Equal(t, 1, queue[1].Priority)
+	assert.Equal(t, 2, queue[1].Attempts)
+
+	err = backend.saveUploadQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// after a restart, all cached pages start out as changed
+	restarted := newTestBackend(t, 10, dataDirectory)
+	restarted.cache.brain.setState(page(3), cachedChanged)
+	restarted.cache.brain.setState(page(5), cachedChanged)
+	err = restarted.restoreUploadQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, now.Equal(restarted.cache.brain.pages.get(3).dirtySince))
+	assert.True(t, now.Add(time.Minute).Equal(restarted.cache.brain.pages.get(3).lastAccess))
+	assert.True(t, now.Add(30*time.Second).Equal(restarted.cache.brain.pages.get(3).lastPostponement))
+	assert.Equal(t, 2, restarted.cache.pages.get(3).uploadFailures)
+	assert.True(t, now.Add(-time.Minute).Equal(restarted.cache.brain.pages.get(5).dirtySince))
+}
+
+func TestRestoreMissingUploadQueue(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "uploadqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	backend := newTestBackend(t, 10, dataDirectory)
+	assert.Nil(t, backend.restoreUploadQueue())
+}
@@ -0,0 +1,109 @@
+package sia
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+type (
+	// StuckRequest is a request that has been waiting for space in the
+	// cache for longer than the watchdog timeout.
+	StuckRequest struct {
+		Page    int       `json:"page"`
+		IsWrite bool      `json:"is_write"`
+		Since   time.Time `json:"since"`
+
+		// Expanded is set if the request was given room beyond the hard
+		// limit of the cache.
+		Expanded bool `json:"expanded"`
+	}
+
+	watchdog struct {
+		timeout time.Duration
+		expand  bool
+		stuck   map[*StuckRequest]struct{}
+	}
+
+	// pageWait tracks a request in the wait-and-retry loop of preparePage.
+	pageWait struct {
+		request StuckRequest
+		stuck   bool
+	}
+)
+
+func (b *Backend) beginWait(page page, isWrite bool) *pageWait {
+	return &pageWait{request: StuckRequest{
+		Page:    int(page),
+		IsWrite: isWrite,
+		Since:   b.now(),
+	}}
+}
+
+// checkWait reports a request once it has waited longer than the watchdog
+// timeout, along with the state of the cache brain, and gives it room beyond
+// the hard limit if enabled. The mutex needs to be held.
+func (b *Backend) checkWait(w *pageWait) {
+	waited := b.now().Sub(w.request.Since)
+	if b.watchdog.timeout == 0 || w.stuck || waited < b.watchdog.timeout {
+		return
+	}
+
+	w.stuck = true
+	if b.watchdog.stuck == nil {
+		b.watchdog.stuck = make(map[*StuckRequest]struct{})
+	}
+	b.watchdog.stuck[&w.request] = struct{}{}
+	log.Printf("Request for page %d has been waiting for space in the cache for %s: %s\n",
+		w.request.Page, waited.Round(time.Second), b.cache.brain.describe())
+
+	if b.watchdog.expand {
+		w.request.Expanded = true
+		b.cache.brain.extraCapacity += 1
+		log.Printf("Allowing page %d to exceed the hard limit of the cache\n", w.request.Page)
+	}
+}
+
+// endWait forgets about a request that is no longer waiting. The mutex
+// needs to be held.
+func (b *Backend) endWait(w *pageWait) {
+	if w == nil || !w.stuck {
+		return
+	}
+
+	delete(b.watchdog.stuck, &w.request)
+	if w.request.Expanded {
+		b.cache.brain.holdLimit()
+		b.cache.brain.extraCapacity -= 1
+	}
+	log.Printf("Request for page %d continues after %s\n",
+		w.request.Page, b.now().Sub(w.request.Since).Round(time.Second))
+}
+
+// stuckRequests lists the requests the watchdog has reported, oldest first.
+// The mutex needs to be held.
+func (b *Backend) stuckRequests() []StuckRequest {
+	stuck := []StuckRequest{}
+	for request := range b.watchdog.stuck {
+		stuck = append(stuck, *request)
+	}
+	sort.Slice(stuck, func(i, j int) bool {
+		return stuck[i].Since.Before(stuck[j].Since)
+	})
+	return stuck
+}
+
+// describe summarizes the state of the cache for diagnosing requests that
+// are not making progress.
+func (cb *cacheBrain) describe() string {
+	counts := make(map[state]int)
+	for page := range cb.cachedPages {
+		counts[cb.pages.state(page)] += 1
+	}
+	return fmt.Sprintf("%d pages cached (soft limit %d, hard limit %d, write reserve %d, "+
+		"read overflow %d, extra %d), %d clean, %d dirty, %d uploading, epoch %d",
+		cb.cacheCount, cb.softMaxCached, cb.hardMaxCached, cb.writeReserve,
+		cb.readOverflow, cb.extraCapacity, counts[cachedUnchanged], counts[cachedChanged],
+		counts[cachedUploading], cb.epoch)
+}
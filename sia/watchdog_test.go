@@ -0,0 +1,46 @@
+package sia
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchdog(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	b := newTestBackend(t, 10, "")
+	b.clock = clock
+	b.watchdog = watchdog{timeout: time.Minute, expand: true}
+	for i := 0; i < 6; i++ {
+		b.cache.brain.prepareAccess(page(i), true, clock.Now())
+	}
+
+	wait := b.beginWait(page(7), true)
+	clock.Sleep(30 * time.Second)
+	b.checkWait(wait)
+	assert.Empty(t, b.stuckRequests())
+
+	clock.Sleep(time.Minute)
+	b.checkWait(wait)
+	b.checkWait(wait)
+	assert.Equal(t, []StuckRequest{{Page: 7, IsWrite: true, Since: time.Unix(1600000000, 0), Expanded: true}},
+		b.stuckRequests())
+	assert.Equal(t, 1, b.cache.brain.extraCapacity, "expected extra capacity to be granted once")
+
+	actions := b.cache.brain.prepareAccess(page(7), true, clock.Now())
+	assert.Equal(t, openFile, actions[0].actionType, "expected stuck request to exceed the hard limit")
+	assert.Nil(t, b.cache.brain.checkInvariants())
+
+	b.endWait(wait)
+	assert.Empty(t, b.stuckRequests())
+	assert.Equal(t, 0, b.cache.brain.extraCapacity)
+	assert.Nil(t, b.cache.brain.checkInvariants(), "expected the page let in to be allowed until evicted")
+
+	b.cache.brain.uploadComplete(page(0), clock.Now())
+	_, err := b.cache.brain.evict(page(0))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, b.cache.brain.heldLimit)
+	actions = b.cache.brain.prepareAccess(page(8), true, clock.Now())
+	assert.Equal(t, []action{{actionType: waitAndRetry}}, actions)
+}
@@ -0,0 +1,65 @@
+package sia
+
+type (
+	// combinedWrite holds adjacent small writes to a page, so that they
+	// hit the cache file as a single write. It needs to be written out
+	// before the cache file is read, uploaded, synced or closed.
+	combinedWrite struct {
+		offset int64
+		data   []byte
+	}
+)
+
+// combineWrite buffers a write of buf at offset within page, writing out
+// previously buffered data first if the new write does not extend it.
+// The mutex needs to be held.
+func (b *Backend) combineWrite(page page, buf []byte, offset int64) error {
+	combined := &b.cache.pages.get(page).combined
+	if len(combined.data) > 0 &&
+		(offset != combined.offset+int64(len(combined.data)) ||
+			len(combined.data)+len(buf) > b.writeCombineBytes) {
+		err := b.writeCombined(page)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(combined.data) == 0 {
+		combined.offset = offset
+	}
+	combined.data = append(combined.data, buf...)
+	return nil
+}
+
+// writeCombined writes out the buffered writes of a page. The mutex needs
+// to be held.
+func (b *Backend) writeCombined(page page) error {
+	details, ok := b.cache.pages[page]
+	if !ok || len(details.combined.data) == 0 {
+		return nil
+	}
+
+	_, err := details.file.WriteAt(details.combined.data, details.combined.offset)
+	if err != nil {
+		return err
+	}
+
+	details.combined.data = details.combined.data[:0]
+	return nil
+}
+
+// writeAllCombined writes out the buffered writes of all pages. The mutex
+// needs to be held.
+func (b *Backend) writeAllCombined() error {
+	if b.writeCombineBytes == 0 {
+		return nil
+	}
+
+	for page := range b.cache.brain.dirtyPages {
+		err := b.writeCombined(page)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package sia
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCombineWrites(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "writecombine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	backend := newTestBackend(t, 1, dataDirectory)
+	backend.writeCombineBytes = 8
+	backend.cache.brain.setState(page(0), cachedChanged)
+	file, err := os.Create(backend.asCachePath(page(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	backend.cache.pages.get(page(0)).file = file
+
+	readBack := func() string {
+		buf := make([]byte, 16)
+		n, _ := file.ReadAt(buf, 0)
+		return string(buf[:n])
+	}
+
+	assert.Nil(t, backend.combineWrite(page(0), []byte("abc"), 2))
+	assert.Nil(t, backend.combineWrite(page(0), []byte("def"), 5))
+	assert.Equal(t, "", readBack(), "expected adjacent writes to be held back")
+
+	assert.Nil(t, backend.combineWrite(page(0), []byte("xyz"), 8))
+	assert.Equal(t, "\x00\x00abcdef", readBack(), "expected full buffer to be written out")
+
+	assert.Nil(t, backend.combineWrite(page(0), []byte("!"), 0))
+	assert.Equal(t, "\x00\x00abcdefxyz", readBack(), "expected non-adjacent write to write out buffer")
+
+	assert.Nil(t, backend.writeAllCombined())
+	assert.Equal(t, "!\x00abcdefxyz", readBack())
+}
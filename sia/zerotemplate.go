@@ -0,0 +1,134 @@
+package sia
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+type (
+	// zeroTemplate is a file holding a page of zeroes that the cache files
+	// of new pages are cloned from. On filesystems with copy-on-write, such
+	// as btrfs and XFS, the clone shares the extents of the template, so
+	// that a page is ready right away instead of after writing a whole page
+	// of zeroes. Elsewhere, the kernel copies the template without passing
+	// it through the server.
+	zeroTemplate struct {
+		path    string
+		file    *os.File
+		reflink bool
+	}
+)
+
+const (
+	zeroTemplateName = "zero.template"
+
+	// ficlone is the ioctl that makes a file share the extents of another.
+	ficlone = 0x40049409
+)
+
+func newZeroTemplate(dataDirectory string) *zeroTemplate {
+	return &zeroTemplate{
+		path:    filepath.Join(dataDirectory, zeroTemplateName),
+		reflink: true,
+	}
+}
+
+// open opens the template, writing it first if it does not hold a page yet.
+func (zt *zeroTemplate) open(mode os.FileMode) error {
+	if zt.file != nil {
+		return nil
+	}
+
+	file, err := os.OpenFile(zt.path, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if fileInfo.Size() != pageSize {
+		_, err = file.WriteAt(make([]byte, pageSize), 0)
+		if err == nil {
+			err = file.Truncate(pageSize)
+		}
+		if err == nil {
+			err = file.Sync()
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	zt.file = file
+	return nil
+}
+
+// clone makes dst a page of zeroes by cloning the template. Once cloning
+// fails, e.g. as the filesystem lacks copy-on-write, the template is copied
+// with copy_file_range instead.
+func (zt *zeroTemplate) clone(dst *os.File, mode os.FileMode) error {
+	err := zt.open(mode)
+	if err != nil {
+		return err
+	}
+
+	if zt.reflink {
+		err = reflink(dst, zt.file)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Unable to clone %s (%s); copying it instead\n", zt.path, err)
+		zt.reflink = false
+	}
+
+	_, err = zt.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, &io.LimitedReader{R: zt.file, N: pageSize})
+	return err
+}
+
+// reflink makes dst share the extents of src, which only works on
+// filesystems with copy-on-write.
+func reflink(dst *os.File, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (zt *zeroTemplate) close() error {
+	if zt == nil || zt.file == nil {
+		return nil
+	}
+	err := zt.file.Close()
+	zt.file = nil
+	return err
+}
+
+// zeroCacheFile fills the cache file of a page with zeroes, cloning the zero
+// template unless the cache is encrypted. The mutex needs to be held.
+func (b *Backend) zeroCacheFile(page page) error {
+	file := b.cache.pages.get(page).file
+	if osFile, ok := file.(*os.File); ok && b.zeroTemplate != nil {
+		err := b.zeroTemplate.clone(osFile, b.cacheFileMode())
+		if err == nil {
+			return nil
+		}
+		log.Printf("Unable to initialize page %d from %s: %s\n", page, b.zeroTemplate.path, err)
+	}
+
+	_, err := file.WriteAt(make([]byte, pageSize), 0)
+	return err
+}
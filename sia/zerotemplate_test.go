@@ -0,0 +1,42 @@
+package sia
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZeroTemplate(t *testing.T) {
+	dataDirectory, err := ioutil.TempDir("", "zerotemplate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	// a template cut short, e.g. by a crash, is written again
+	zt := newZeroTemplate(dataDirectory)
+	err = ioutil.WriteFile(zt.path, make([]byte, 100), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zt.close()
+
+	for i, name := range []string{"page1", "page2"} {
+		dst, err := os.OpenFile(filepath.Join(dataDirectory, name), os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			zt.reflink = false
+		}
+		assert.Nil(t, zt.clone(dst, 0600))
+		dst.Close()
+
+		data, err := ioutil.ReadFile(dst.Name())
+		assert.Nil(t, err)
+		assert.Equal(t, make([]byte, pageSize), data, name)
+	}
+}
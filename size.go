@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/javgh/sia-nbdserver/sia"
+)
+
+// sectorSize is the granularity NBD clients address a device in, so every
+// device size needs to be a multiple of it.
+const sectorSize = 512
+
+// sizeUnits are the suffixes accepted by parseBytes. Single letters are
+// binary units, like with qemu-img.
+var sizeUnits = map[string]uint64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kib": 1 << 10,
+	"kb":  1000,
+	"m":   1 << 20,
+	"mib": 1 << 20,
+	"mb":  1000 * 1000,
+	"g":   1 << 30,
+	"gib": 1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"t":   1 << 40,
+	"tib": 1 << 40,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"p":   1 << 50,
+	"pib": 1 << 50,
+	"pb":  1000 * 1000 * 1000 * 1000 * 1000,
+}
+
+// byteSize is a flag for a device size in bytes, which also accepts values
+// like 250GiB or 1.5TiB.
+type byteSize uint64
+
+func (s *byteSize) String() string {
+	return strconv.FormatUint(uint64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	bytes, err := parseBytes(value)
+	if err != nil {
+		return err
+	}
+	if bytes == 0 || bytes%sectorSize != 0 {
+		return fmt.Errorf("size %s needs to be a positive multiple of %d bytes", value, sectorSize)
+	}
+	if bytes > sia.MaxSize {
+		return fmt.Errorf("size %s exceeds the maximum of %d bytes", value, uint64(sia.MaxSize))
+	}
+	*s = byteSize(bytes)
+	return nil
+}
+
+func (s *byteSize) Type() string {
+	return "size"
+}
+
+// parseBytes turns a number with an optional unit into an exact number of
+// bytes. Fractions are allowed as long as they come out as whole bytes.
+func parseBytes(value string) (uint64, error) {
+	trimmed := strings.ToLower(strings.TrimSpace(value))
+	i := strings.IndexFunc(trimmed, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(trimmed)
+	}
+
+	unit, ok := sizeUnits[strings.TrimSpace(trimmed[i:])]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %s: unknown unit %q", value, trimmed[i:])
+	}
+	number, ok := new(big.Rat).SetString(trimmed[:i])
+	if !ok {
+		return 0, fmt.Errorf("invalid size %s", value)
+	}
+
+	bytes := number.Mul(number, new(big.Rat).SetInt(new(big.Int).SetUint64(unit)))
+	if !bytes.IsInt() {
+		return 0, fmt.Errorf("invalid size %s: not a whole number of bytes", value)
+	}
+	if !bytes.Num().IsUint64() {
+		return 0, fmt.Errorf("invalid size %s: too large", value)
+	}
+	return bytes.Num().Uint64(), nil
+}
@@ -0,0 +1,307 @@
+// Package tracing records spans for NBD requests as they pass through the
+// cache and the Sia calls and exports them to an OpenTelemetry collector
+// using OTLP over HTTP with the JSON encoding.
+//
+// Tracing is disabled until Init is called. While disabled, StartSpan
+// returns a nil *Span and all Span methods are no-ops, so callers never need
+// to check whether tracing is enabled.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	Span struct {
+		tracer       *tracer
+		name         string
+		traceID      [16]byte
+		spanID       [8]byte
+		parentSpanID [8]byte
+		start        time.Time
+		end          time.Time
+		attributes   []attribute
+		err          error
+	}
+
+	attribute struct {
+		key   string
+		value interface{}
+	}
+
+	tracer struct {
+		url         string
+		serviceName string
+		client      *http.Client
+		spans       chan *Span
+		done        chan struct{}
+	}
+
+	spanContextKey struct{}
+)
+
+const (
+	maxQueuedSpans = 4096
+	maxBatchSize   = 512
+	exportInterval = 5 * time.Second
+	exportTimeout  = 10 * time.Second
+	tracesPath     = "/v1/traces"
+
+	spanKindInternal = 1
+	statusCodeError  = 2
+)
+
+var (
+	mutex        sync.Mutex
+	activeTracer *tracer
+)
+
+// Init enables tracing and starts exporting spans to the OTLP/HTTP collector
+// at endpoint (e.g. "http://localhost:4318").
+func Init(endpoint string, serviceName string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if activeTracer != nil {
+		return fmt.Errorf("tracing is already initialized")
+	}
+
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return fmt.Errorf("OTLP endpoint %q needs to start with http:// or https://", endpoint)
+	}
+
+	t := &tracer{
+		url:         strings.TrimSuffix(endpoint, "/") + tracesPath,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: exportTimeout},
+		spans:       make(chan *Span, maxQueuedSpans),
+		done:        make(chan struct{}),
+	}
+	go t.run()
+
+	activeTracer = t
+	return nil
+}
+
+// Shutdown disables tracing and exports all spans that are still queued.
+func Shutdown() {
+	mutex.Lock()
+	t := activeTracer
+	activeTracer = nil
+	mutex.Unlock()
+
+	if t == nil {
+		return
+	}
+
+	close(t.spans)
+	<-t.done
+}
+
+// StartSpan starts a new span. If ctx carries a span, the new span becomes
+// its child; otherwise a new trace is started. The returned context carries
+// the new span and should be passed on to nested operations.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	mutex.Lock()
+	t := activeTracer
+	mutex.Unlock()
+
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: t,
+		name:   name,
+		start:  time.Now(),
+	}
+
+	parent, ok := ctx.Value(spanContextKey{}).(*Span)
+	if ok && parent != nil {
+		span.traceID = parent.traceID
+		span.parentSpanID = parent.spanID
+	} else {
+		_, _ = rand.Read(span.traceID[:])
+	}
+	_, _ = rand.Read(span.spanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// SetAttribute records a key/value pair on the span. Supported value types
+// are string, bool, int, int64, uint32, uint64 and float64.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.attributes = append(s.attributes, attribute{key: key, value: value})
+}
+
+// SetError marks the span as failed. A nil error is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.err = err
+}
+
+// End finishes the span and queues it for export. Spans are dropped if the
+// export queue is full, so that tracing never blocks I/O.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if activeTracer != s.tracer {
+		// tracing was shut down in the meantime
+		return
+	}
+
+	select {
+	case s.tracer.spans <- s:
+	default:
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	for {
+		select {
+		case span, ok := <-t.spans:
+			if !ok {
+				t.export(batch)
+				return
+			}
+
+			batch = append(batch, span)
+			if len(batch) >= maxBatchSize {
+				t.export(batch)
+				batch = []*Span{}
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = []*Span{}
+		}
+	}
+}
+
+func (t *tracer) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(t.encode(batch))
+	if err != nil {
+		log.Printf("Unable to encode %d spans: %s\n", len(batch), err)
+		return
+	}
+
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Unable to export %d spans: %s\n", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Unable to export %d spans: collector replied with %s\n", len(batch), resp.Status)
+	}
+}
+
+// encode builds an ExportTraceServiceRequest in the OTLP/JSON encoding.
+func (t *tracer) encode(batch []*Span) map[string]interface{} {
+	spans := []map[string]interface{}{}
+	for _, s := range batch {
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              spanKindInternal,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        encodeAttributes(s.attributes),
+		}
+		if s.parentSpanID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentSpanID[:])
+		}
+		if s.err != nil {
+			span["status"] = map[string]interface{}{
+				"code":    statusCodeError,
+				"message": s.err.Error(),
+			}
+		}
+		spans = append(spans, span)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": encodeAttributes([]attribute{
+						{key: "service.name", value: t.serviceName},
+					}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": t.serviceName},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func encodeAttributes(attributes []attribute) []map[string]interface{} {
+	encoded := []map[string]interface{}{}
+	for _, a := range attributes {
+		var value map[string]interface{}
+		switch v := a.value.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(int64(v), 10)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case uint32:
+			value = map[string]interface{}{"intValue": strconv.FormatUint(uint64(v), 10)}
+		case uint64:
+			value = map[string]interface{}{"intValue": strconv.FormatUint(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+
+		encoded = append(encoded, map[string]interface{}{
+			"key":   a.key,
+			"value": value,
+		})
+	}
+	return encoded
+}
@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type exportRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []struct {
+				TraceID      string `json:"traceId"`
+				SpanID       string `json:"spanId"`
+				ParentSpanID string `json:"parentSpanId"`
+				Name         string `json:"name"`
+				Status       struct {
+					Code    int    `json:"code"`
+					Message string `json:"message"`
+				} `json:"status"`
+			} `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func TestDisabled(t *testing.T) {
+	ctx, span := StartSpan(context.Background(), "noop")
+	assert.Nil(t, span, "expected no span while tracing is disabled")
+	assert.Equal(t, context.Background(), ctx)
+
+	// must not panic
+	span.SetAttribute("key", 1)
+	span.SetError(errors.New("failure"))
+	span.End()
+}
+
+func TestExport(t *testing.T) {
+	requests := make(chan exportRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, tracesPath, r.URL.Path)
+		var request exportRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		assert.Nil(t, err)
+		requests <- request
+	}))
+	defer server.Close()
+
+	err := Init(server.URL, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, parent := StartSpan(context.Background(), "parent")
+	_, child := StartSpan(ctx, "child")
+	child.SetAttribute("page", 3)
+	child.SetError(errors.New("download failed"))
+	child.End()
+	parent.End()
+	Shutdown()
+
+	request := <-requests
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, "parent", spans[1].Name)
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID, "expected child to share trace")
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID, "expected parent link")
+	assert.Equal(t, "", spans[1].ParentSpanID, "expected root span")
+	assert.Equal(t, statusCodeError, spans[0].Status.Code)
+	assert.Equal(t, "download failed", spans[0].Status.Message)
+}
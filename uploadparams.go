@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// uploadParameters is a flag for further query parameters of uploads, given
+// as comma-separated key=value pairs. It may be repeated.
+type uploadParameters url.Values
+
+func (p *uploadParameters) String() string {
+	pairs := []string{}
+	for key, values := range *p {
+		for _, value := range values {
+			pairs = append(pairs, key+"="+value)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (p *uploadParameters) Set(value string) error {
+	if *p == nil {
+		*p = make(uploadParameters)
+	}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid upload parameter %s (expected key=value)", pair)
+		}
+		(*p)[parts[0]] = append((*p)[parts[0]], parts[1])
+	}
+	return nil
+}
+
+func (p *uploadParameters) Type() string {
+	return "key=value"
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/javgh/sia-nbdserver/sia"
+)
+
+// version is set when building a release, with
+// -ldflags "-X main.version=v1.2.3".
+var version = ""
+
+// buildInfo tells which binary is running.
+type buildInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+func currentBuild() buildInfo {
+	build := buildInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	// fall back to the module version for binaries built with go install
+	if build.Version == "" {
+		info, ok := debug.ReadBuildInfo()
+		if ok {
+			build.Version = info.Main.Version
+		}
+	}
+	if build.Version == "" {
+		build.Version = "(devel)"
+	}
+	return build
+}
+
+// exportDescription lets clients listing the exports tell devices apart
+// and see their geometry.
+func exportDescription(device sia.DeviceInfo) string {
+	name := device.UUID
+	if device.Label != "" {
+		name = fmt.Sprintf("%s (%s)", device.Label, device.UUID)
+	}
+	return fmt.Sprintf("%s, %s in %s pages", name, formatBytes(device.Size),
+		formatBytes(sia.PageSize))
+}
+
+func printVersion() {
+	build := currentBuild()
+	fmt.Printf("sia-nbdserver %s\n", build.Version)
+	fmt.Printf("Built with %s for %s\n", build.GoVersion, build.Platform)
+	fmt.Printf("Page size: %s\n", formatBytes(sia.PageSize))
+}